@@ -12,13 +12,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/containerd/containerd/reference/docker"
 	"github.com/distribution/reference"
 	"github.com/dustin/go-humanize"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
@@ -31,6 +36,7 @@ import (
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/copier"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/packer"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/provider"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/server"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/viewer"
 )
@@ -121,6 +127,11 @@ func getTargetReference(c *cli.Context) (string, error) {
 		return "", fmt.Errorf("--target conflicts with --target-suffix")
 	}
 	if target == "" && targetSuffix == "" {
+		// The target image will be written into the OCI image layout
+		// directory specified by --target-path.
+		if c.String("target-path") != "" {
+			return "", nil
+		}
 		return "", fmt.Errorf("--target or --target-suffix is required")
 	}
 	var err error
@@ -171,13 +182,53 @@ func getPrefetchPatterns(c *cli.Context) (string, error) {
 		patterns = prefetchedDir
 	}
 
-	if len(patterns) == 0 {
+	// Prefetch all files by default unless a prefetch file or trace is specified.
+	if len(patterns) == 0 && c.String("prefetch-file") == "" && c.String("prefetch-trace") == "" {
 		patterns = "/"
 	}
 
 	return patterns, nil
 }
 
+// getPlatformPrefetchPatterns reads the prefetch patterns file of each
+// platform specified as `<platform>=<file>`, the blank lines and comment
+// lines starting with '#' are ignored.
+func getPlatformPrefetchPatterns(c *cli.Context) (map[string]string, error) {
+	platformPatterns := map[string]string{}
+	for _, value := range c.StringSlice("platform-prefetch-file") {
+		platform, path, ok := strings.Cut(value, "=")
+		if !ok || platform == "" || path == "" {
+			return nil, fmt.Errorf("invalid --platform-prefetch-file option %s, should be <platform>=<file>", value)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read prefetch file of platform %s", platform)
+		}
+		patterns := []string{}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				patterns = append(patterns, line)
+			}
+		}
+		platformPatterns[platform] = strings.Join(patterns, "\n")
+	}
+	return platformPatterns, nil
+}
+
+// getSourceDiffIDs parses the known diff IDs of source layers specified by
+// `--source-diff-id` in format <layer digest>=<diff id>.
+func getSourceDiffIDs(c *cli.Context) (map[digest.Digest]digest.Digest, error) {
+	diffIDs := map[digest.Digest]digest.Digest{}
+	for _, value := range c.StringSlice("source-diff-id") {
+		layer, diffID, ok := strings.Cut(value, "=")
+		if !ok || layer == "" || diffID == "" {
+			return nil, fmt.Errorf("invalid --source-diff-id option %s, should be <layer digest>=<diff id>", value)
+		}
+		diffIDs[digest.Digest(layer)] = digest.Digest(diffID)
+	}
+	return diffIDs, nil
+}
+
 func main() {
 	logrus.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp: true,
@@ -216,10 +267,34 @@ func main() {
 			Flags: []cli.Flag{
 				&cli.StringFlag{
 					Name:     "source",
-					Required: true,
-					Usage:    "Source OCI image reference",
+					Required: false,
+					Usage:    "Source OCI image reference, conflicts with --source-path",
 					EnvVars:  []string{"SOURCE"},
 				},
+				&cli.PathFlag{
+					Name:     "source-path",
+					Required: false,
+					Usage:    "Source OCI image layout directory, conflicts with --source",
+					EnvVars:  []string{"SOURCE_PATH"},
+				},
+				&cli.PathFlag{
+					Name:     "source-dir",
+					Required: false,
+					Usage:    "Build a single layer Nydus image from the rootfs directory, conflicts with --source and --source-path",
+					EnvVars:  []string{"SOURCE_DIR"},
+				},
+				&cli.PathFlag{
+					Name:     "source-archive",
+					Required: false,
+					Usage:    "Build the Nydus image from the tarball saved by `docker save`, conflicts with --source, --source-path and --source-dir",
+					EnvVars:  []string{"SOURCE_ARCHIVE"},
+				},
+				&cli.StringFlag{
+					Name:     "source-archive-tag",
+					Required: false,
+					Usage:    "Repo tag of the image in the tarball of --source-archive, required if the tarball contains several images",
+					EnvVars:  []string{"SOURCE_ARCHIVE_TAG"},
+				},
 				&cli.StringFlag{
 					Name:     "target",
 					Required: false,
@@ -232,6 +307,18 @@ func main() {
 					Usage:    "Generate the target image reference by adding a suffix to the source image reference, conflicts with --target",
 					EnvVars:  []string{"TARGET_SUFFIX"},
 				},
+				&cli.PathFlag{
+					Name:     "target-path",
+					Required: false,
+					Usage:    "Write the target (Nydus) image into an OCI image layout directory, conflicts with --target",
+					EnvVars:  []string{"TARGET_PATH"},
+				},
+				&cli.BoolFlag{
+					Name:    "offline",
+					Value:   false,
+					Usage:   "Fail instead of accessing registry, only supported between --source-path and --target-path",
+					EnvVars: []string{"OFFLINE"},
+				},
 				&cli.BoolFlag{
 					Name:     "source-insecure",
 					Required: false,
@@ -318,6 +405,19 @@ func main() {
 					Usage:    "Skip verifying server certs for HTTPS dict registry",
 					EnvVars:  []string{"CHUNK_DICT_INSECURE"},
 				},
+				&cli.StringFlag{
+					Name:     "base-bootstrap",
+					Required: false,
+					Usage:    "Nydus image of the base shared by source image, the base chunks are reused and base blobs are referenced without being stored again, it's an alias of '--chunk-dict bootstrap:registry:<base>' and can't be used with --chunk-dict",
+					EnvVars:  []string{"BASE_BOOTSTRAP"},
+				},
+				&cli.BoolFlag{
+					Name:     "base-bootstrap-insecure",
+					Required: false,
+					Value:    false,
+					Usage:    "Skip verifying server certs for HTTPS base image registry",
+					EnvVars:  []string{"BASE_BOOTSTRAP_INSECURE"},
+				},
 
 				&cli.BoolFlag{
 					Name:    "merge-platform",
@@ -336,6 +436,12 @@ func main() {
 					Value: "linux/" + runtime.GOARCH,
 					Usage: "Convert images for specific platforms, for example: 'linux/amd64,linux/arm64'",
 				},
+				&cli.BoolFlag{
+					Name:    "convert-all-platforms",
+					Value:   false,
+					Usage:   "Convert all platforms of source image one by one, the failed platforms are skipped and excluded from target image index",
+					EnvVars: []string{"CONVERT_ALL_PLATFORMS"},
+				},
 				&cli.BoolFlag{
 					Name:    "oci-ref",
 					Value:   false,
@@ -348,6 +454,123 @@ func main() {
 					Usage:   "Associate a reference to the source image, see https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-referrers",
 					EnvVars: []string{"WITH_REFERRER"},
 				},
+				&cli.BoolFlag{
+					Name:    "link-source",
+					Value:   false,
+					Usage:   "Push an artifact referring to the source image to make the nydus image discoverable by referrers API of source repository",
+					EnvVars: []string{"LINK_SOURCE"},
+				},
+				&cli.BoolFlag{
+					Name:    "hybrid-output",
+					Value:   false,
+					Usage:   "Push the source image to target, and the nydus image as a referrer of it in target repository, requires --oci",
+					EnvVars: []string{"HYBRID_OUTPUT"},
+				},
+				&cli.BoolFlag{
+					Name:    "preserve-config",
+					Value:   false,
+					Usage:   "Copy the image config of source image into target image verbatim, except the rootfs and history describing nydus layers",
+					EnvVars: []string{"PRESERVE_CONFIG"},
+				},
+				&cli.BoolFlag{
+					Name:    "reproducible",
+					Value:   false,
+					Usage:   "Reset the file timestamps and remove the created time of image config, so that the same files are converted to the same target manifest",
+					EnvVars: []string{"REPRODUCIBLE"},
+				},
+				&cli.StringFlag{
+					Name:    "owner-override",
+					Value:   "",
+					Usage:   "Force the ownership of all the files in target image in format <uid>:<gid>, for example 0:0 makes them owned by root",
+					EnvVars: []string{"OWNER_OVERRIDE"},
+				},
+				&cli.BoolFlag{
+					Name:    "flatten-whiteouts",
+					Value:   false,
+					Usage:   "Leave no whiteout file in the bootstrap of target image for the runtime not understanding OCI whiteouts",
+					EnvVars: []string{"FLATTEN_WHITEOUTS"},
+				},
+				&cli.BoolFlag{
+					Name:    "blob-annotations",
+					Value:   false,
+					Usage:   "Annotate each nydus blob layer with the source layer digest, chunk count and uncompressed size",
+					EnvVars: []string{"BLOB_ANNOTATIONS"},
+				},
+				&cli.BoolFlag{
+					Name:    "snapshotter-compat",
+					Value:   false,
+					Usage:   "Annotate the layers with the labels consumed by nydus snapshotter, like the blob IDs referenced by bootstrap",
+					EnvVars: []string{"SNAPSHOTTER_COMPAT"},
+				},
+				&cli.BoolFlag{
+					Name:    "verify-after-build",
+					Value:   false,
+					Usage:   "Verify the chunk digests of built nydus blobs against bootstrap before pushing",
+					EnvVars: []string{"VERIFY_AFTER_BUILD"},
+				},
+				&cli.Float64Flag{
+					Name:    "skip-incompressible-threshold",
+					Value:   0,
+					Usage:   "Store the blob of layer uncompressed if its compression ratio (compressed / decompressed size) is greater than the threshold in (0, 1], only for RAFS v6, disabled by default",
+					EnvVars: []string{"SKIP_INCOMPRESSIBLE_THRESHOLD"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "include",
+					Usage:   "Gitignore-style glob of the paths left in target image, can be specified multiple times, all the paths are left if not specified",
+					EnvVars: []string{"INCLUDE"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "exclude",
+					Usage:   "Gitignore-style glob of the paths dropped from target image, can be specified multiple times, which takes precedence over --include",
+					EnvVars: []string{"EXCLUDE"},
+				},
+				&cli.PathFlag{
+					Name:      "sign-key",
+					TakesFile: true,
+					Usage:     "Sign the target image with the ECDSA private key in cosign compatible format, the passphrase of encrypted key is read from env COSIGN_PASSWORD",
+					EnvVars:   []string{"SIGN_KEY"},
+				},
+				&cli.PathFlag{
+					Name:      "verify-source-key",
+					TakesFile: true,
+					Usage:     "Verify the cosign signature of source image with the ECDSA public key before conversion, the unsigned source image is refused",
+					EnvVars:   []string{"VERIFY_SOURCE_KEY"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "source-diff-id",
+					Usage:   "Known diff ID of source layer in format <layer digest>=<diff id>, which is checked against the image config of source image before conversion, can be specified multiple times",
+					EnvVars: []string{"SOURCE_DIFF_ID"},
+				},
+				&cli.PathFlag{
+					Name:      "sbom",
+					TakesFile: true,
+					Usage:     "Attach the SPDX document in JSON format to the target image as a referrer with artifact type application/spdx+json",
+					EnvVars:   []string{"SBOM"},
+				},
+				&cli.BoolFlag{
+					Name:    "provenance",
+					Value:   false,
+					Usage:   "Attach the SLSA provenance in in-toto format to the target image as a referrer with artifact type application/vnd.in-toto+json",
+					EnvVars: []string{"PROVENANCE"},
+				},
+				&cli.BoolFlag{
+					Name:    "dry-run",
+					Value:   false,
+					Usage:   "Build the nydus image locally without pushing anything, and print the conversion plan in JSON",
+					EnvVars: []string{"DRY_RUN"},
+				},
+				&cli.BoolFlag{
+					Name:    "print-result",
+					Value:   false,
+					Usage:   "Print the conversion result including target digest, blob digests, pushed bytes and source layer mapping in JSON",
+					EnvVars: []string{"PRINT_RESULT"},
+				},
+				&cli.BoolFlag{
+					Name:    "skip-converted",
+					Value:   false,
+					Usage:   "Skip rebuilding if the target image has been converted from the same source image, the blobs missing in target are copied from build cache or chunk dict",
+					EnvVars: []string{"SKIP_CONVERTED"},
+				},
 				&cli.BoolFlag{
 					Name:    "oci",
 					Value:   false,
@@ -359,6 +582,12 @@ func main() {
 					Value:  false,
 					Hidden: true,
 				},
+				&cli.StringFlag{
+					Name:    "media-type-scheme",
+					Value:   "containerd",
+					Usage:   "Media types of target manifest, config and bootstrap layer, possible values: 'containerd' (as written by nydus-snapshotter), 'oci' and 'docker'",
+					EnvVars: []string{"MEDIA_TYPE_SCHEME"},
+				},
 				&cli.StringFlag{
 					Name:        "fs-version",
 					Required:    false,
@@ -391,6 +620,48 @@ func main() {
 					Usage:   "Read prefetch list from STDIN, please input absolute paths line by line",
 					EnvVars: []string{"PREFETCH_PATTERNS"},
 				},
+				&cli.PathFlag{
+					Name:    "prefetch-file",
+					Value:   "",
+					Usage:   "Read prefetch list from file, please input absolute paths line by line, lines starting with '#' are ignored",
+					EnvVars: []string{"PREFETCH_FILE"},
+				},
+				&cli.PathFlag{
+					Name:    "prefetch-trace",
+					Value:   "",
+					Usage:   "Order the prefetch table by the file access trace, please input absolute paths line by line in access order",
+					EnvVars: []string{"PREFETCH_TRACE"},
+				},
+				&cli.StringFlag{
+					Name:    "prefetch-layer-policy",
+					Value:   "",
+					Usage:   "Limit the prefetched files by layer position, possible values: all, none, bottom-<n> (only the lowest n layers)",
+					EnvVars: []string{"PREFETCH_LAYER_POLICY"},
+				},
+				&cli.BoolFlag{
+					Name:    "prefetch-metadata-only",
+					Value:   false,
+					Usage:   "Prefetch no file data, only the metadata in bootstrap is loaded for fast directory listing, conflicts with the other prefetch options",
+					EnvVars: []string{"PREFETCH_METADATA_ONLY"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "platform-prefetch-file",
+					Usage:   "Read prefetch list of a platform from file with --convert-all-platforms, in format <platform>=<file> like linux/arm64=prefetch.txt, can be specified multiple times, the other platforms use the global prefetch list",
+					EnvVars: []string{"PLATFORM_PREFETCH_FILE"},
+				},
+				&cli.BoolFlag{
+					Name:    "encrypt",
+					Value:   false,
+					Usage:   "Encrypt the Nydus image data blob and bootstrap, requires --encrypt-key",
+					EnvVars: []string{"ENCRYPT"},
+				},
+				&cli.PathFlag{
+					Name:      "encrypt-key",
+					Value:     "",
+					TakesFile: true,
+					Usage:     "Path to the JWE public key in PEM format used to encrypt the Nydus image, either an EC key or an RSA key of at least 2048 bits",
+					EnvVars:   []string{"ENCRYPT_KEY"},
+				},
 				&cli.StringFlag{
 					Name:    "compressor",
 					Value:   "zstd",
@@ -400,7 +671,7 @@ func main() {
 				&cli.StringFlag{
 					Name:    "fs-chunk-size",
 					Value:   "0x100000",
-					Usage:   "size of nydus image data chunk, must be power of two and between 0x1000-0x100000, [default: 0x100000]",
+					Usage:   "size of nydus image data chunk in hex or human readable format (e.g. 256KiB), must be power of two and between 0x1000-0x100000, applied to all the files of image, [default: 0x100000]",
 					EnvVars: []string{"FS_CHUNK_SIZE"},
 					Aliases: []string{"chunk-size"},
 				},
@@ -410,24 +681,92 @@ func main() {
 					Usage:   "size of batch data chunks, must be power of two, between 0x1000-0x1000000 or zero, [default: 0]",
 					EnvVars: []string{"BATCH_SIZE"},
 				},
+				&cli.StringFlag{
+					Name:    "source-cache-dir",
+					Usage:   "Directory to cache the blobs pulled from source registry, which are reused by subsequent conversions",
+					EnvVars: []string{"SOURCE_CACHE_DIR"},
+				},
+				&cli.StringFlag{
+					Name:    "source-cache-size",
+					Value:   "0",
+					Usage:   "Maximum size of source blob cache like '10GiB', the least recently used blobs are evicted once exceeded, 0 means no limit",
+					EnvVars: []string{"SOURCE_CACHE_SIZE"},
+				},
+				&cli.StringFlag{
+					Name:    "build-cache-dir",
+					Usage:   "Directory to cache the nydus blobs built from source layers, which are reused without building by subsequent conversions with the same build options",
+					EnvVars: []string{"BUILD_CACHE_DIR"},
+				},
+				&cli.StringFlag{
+					Name:    "resume-state-file",
+					Usage:   "File to record the nydus blobs built from source layers, the conversion restarted after failure skips the layers recorded, removed once the conversion succeeds",
+					EnvVars: []string{"RESUME_STATE_FILE"},
+				},
+				&cli.StringFlag{
+					Name:    "shared-blob-dir",
+					Usage:   "Directory shared by conversions to store the built nydus blobs by digest, which can be used as the blob directory of localfs backend",
+					EnvVars: []string{"SHARED_BLOB_DIR"},
+				},
 				&cli.StringFlag{
 					Name:    "work-dir",
 					Value:   "./tmp",
 					Usage:   "Working directory for image conversion",
 					EnvVars: []string{"WORK_DIR"},
 				},
+				&cli.BoolFlag{
+					Name:    "keep-work-dir",
+					Value:   false,
+					Usage:   "Keep the temp directory of intermediate bootstraps and blobs in work directory after conversion for inspection",
+					EnvVars: []string{"KEEP_WORK_DIR"},
+				},
+				&cli.StringFlag{
+					Name:    "builder-temp-dir",
+					Value:   "",
+					Usage:   "Directory for the scratch files of nydus-image instead of work directory, for example a local disk when work directory is on a network filesystem",
+					EnvVars: []string{"BUILDER_TEMP_DIR"},
+				},
 				&cli.StringFlag{
 					Name:    "nydus-image",
 					Value:   "nydus-image",
 					Usage:   "Path to the nydus-image binary, default to search in PATH",
 					EnvVars: []string{"NYDUS_IMAGE"},
 				},
+				&cli.StringFlag{
+					Name:    "nydus-image-version",
+					Value:   "",
+					Usage:   "Version of the nydus-image binary like 'v2.2.0' to check the supported features, default to detect by running 'nydus-image --version'",
+					EnvVars: []string{"NYDUS_IMAGE_VERSION"},
+				},
 				&cli.StringFlag{
 					Name:    "output-json",
 					Value:   "",
 					Usage:   "File path to save the metrics collected during conversion in JSON format, for example: './output.json'",
 					EnvVars: []string{"OUTPUT_JSON"},
 				},
+				&cli.IntFlag{
+					Name:    "worker",
+					Value:   0,
+					Usage:   "Number of layers being converted concurrently, zero means the number of CPUs",
+					EnvVars: []string{"WORKER"},
+				},
+				&cli.IntFlag{
+					Name:    "upload-worker",
+					Value:   0,
+					Usage:   "Number of blobs being pushed to registry concurrently, zero means the value of --worker",
+					EnvVars: []string{"UPLOAD_WORKER"},
+				},
+				&cli.IntFlag{
+					Name:    "pull-worker",
+					Value:   0,
+					Usage:   "Number of source layers being pulled from registry concurrently, zero means the default limit 5",
+					EnvVars: []string{"PULL_WORKER"},
+				},
+				&cli.DurationFlag{
+					Name:    "timeout",
+					Value:   0,
+					Usage:   "Timeout of the whole conversion, the running nydus-image processes are killed once it's exceeded, for example: '30m', zero means no timeout",
+					EnvVars: []string{"TIMEOUT"},
+				},
 			},
 			Action: func(c *cli.Context) error {
 				setupLogLevel(c)
@@ -455,6 +794,11 @@ func main() {
 				}
 				cacheVersion := c.String("build-cache-version")
 
+				sourceCacheSize, err := humanize.ParseBytes(c.String("source-cache-size"))
+				if err != nil {
+					return errors.Wrap(err, "invalid --source-cache-size option")
+				}
+
 				fsVersion := c.String("fs-version")
 				possibleFsVersions := []string{"5", "6"}
 				if !isPossibleValue(possibleFsVersions, fsVersion) {
@@ -465,6 +809,14 @@ func main() {
 				if err != nil {
 					return err
 				}
+				platformPrefetchPatterns, err := getPlatformPrefetchPatterns(c)
+				if err != nil {
+					return err
+				}
+				sourceDiffIDs, err := getSourceDiffIDs(c)
+				if err != nil {
+					return err
+				}
 
 				chunkDictRef := ""
 				chunkDict := c.String("chunk-dict")
@@ -475,6 +827,14 @@ func main() {
 					}
 				}
 
+				var ownerOverride *converter.Owner
+				if owner := c.String("owner-override"); owner != "" {
+					ownerOverride, err = converter.ParseOwner(owner)
+					if err != nil {
+						return errors.Wrap(err, "invalid --owner-override option")
+					}
+				}
+
 				docker2OCI := false
 				if c.Bool("docker-v2-format") {
 					logrus.Warn("the option `--docker-v2-format` has been deprecated, use `--oci` instead")
@@ -492,9 +852,13 @@ func main() {
 				opt := converter.Opt{
 					WorkDir:        c.String("work-dir"),
 					NydusImagePath: c.String("nydus-image"),
+					BuilderVersion: c.String("nydus-image-version"),
 
 					Source:         c.String("source"),
+					SourcePath:     c.String("source-path"),
 					Target:         targetRef,
+					TargetPath:     c.String("target-path"),
+					Offline:        c.Bool("offline"),
 					SourceInsecure: c.Bool("source-insecure"),
 					TargetInsecure: c.Bool("target-insecure"),
 
@@ -507,27 +871,124 @@ func main() {
 					CacheMaxRecords: cacheMaxRecords,
 					CacheVersion:    cacheVersion,
 
+					CacheDir:        c.String("source-cache-dir"),
+					CacheSizeBytes:  int64(sourceCacheSize),
+					BuildCacheDir:   c.String("build-cache-dir"),
+					ResumeStateFile: c.String("resume-state-file"),
+					SharedBlobDir:   c.String("shared-blob-dir"),
+
 					ChunkDictRef:      chunkDictRef,
 					ChunkDictInsecure: c.Bool("chunk-dict-insecure"),
 
+					BaseBootstrapRef:      c.String("base-bootstrap"),
+					BaseBootstrapInsecure: c.Bool("base-bootstrap-insecure"),
+
 					PrefetchPatterns: prefetchPatterns,
 					MergePlatform:    c.Bool("merge-platform"),
 					Docker2OCI:       docker2OCI,
+					MediaTypeScheme:  c.String("media-type-scheme"),
 					FsVersion:        fsVersion,
 					FsAlignChunk:     c.Bool("backend-aligned-chunk") || c.Bool("fs-align-chunk"),
 					Compressor:       c.String("compressor"),
 					ChunkSize:        c.String("chunk-size"),
 					BatchSize:        c.String("batch-size"),
 
-					OCIRef:       c.Bool("oci-ref"),
-					WithReferrer: c.Bool("with-referrer"),
-					AllPlatforms: c.Bool("all-platforms"),
-					Platforms:    c.String("platform"),
+					OCIRef:              c.Bool("oci-ref"),
+					WithReferrer:        c.Bool("with-referrer"),
+					LinkSource:          c.Bool("link-source"),
+					HybridOutput:        c.Bool("hybrid-output"),
+					SignKeyPath:         c.String("sign-key"),
+					VerifySourceKeyPath: c.String("verify-source-key"),
+					SBOMPath:            c.String("sbom"),
+					Provenance:          c.Bool("provenance"),
+					SourceDiffIDs:       sourceDiffIDs,
+					DryRun:              c.Bool("dry-run"),
+					AllPlatforms:        c.Bool("all-platforms"),
+					Platforms:           c.String("platform"),
+
+					ConvertAllPlatforms: c.Bool("convert-all-platforms"),
+					PreserveConfig:      c.Bool("preserve-config"),
+					Reproducible:        c.Bool("reproducible"),
+					OwnerOverride:       ownerOverride,
+					FlattenWhiteouts:    c.Bool("flatten-whiteouts"),
+					BlobAnnotations:     c.Bool("blob-annotations"),
+					SnapshotterCompat:   c.Bool("snapshotter-compat"),
+					VerifyAfterBuild:    c.Bool("verify-after-build"),
+					IncludePatterns:     c.StringSlice("include"),
+					ExcludePatterns:     c.StringSlice("exclude"),
+
+					SkipIncompressibleThreshold: c.Float64("skip-incompressible-threshold"),
+
+					Encrypt:        c.Bool("encrypt"),
+					EncryptKeyPath: c.String("encrypt-key"),
+
+					PrefetchPatternsFile:     c.String("prefetch-file"),
+					PrefetchTracePath:        c.String("prefetch-trace"),
+					PrefetchLayerPolicy:      c.String("prefetch-layer-policy"),
+					PlatformPrefetchPatterns: platformPrefetchPatterns,
+
+					PrefetchIncludeMetadataOnly: c.Bool("prefetch-metadata-only"),
+
+					Worker:       c.Int("worker"),
+					UploadWorker: c.Int("upload-worker"),
+					PullWorker:   c.Int("pull-worker"),
+					Timeout:      c.Duration("timeout"),
+					OutputJSON:   c.String("output-json"),
+
+					KeepWorkDir:    c.Bool("keep-work-dir"),
+					BuilderTempDir: c.String("builder-temp-dir"),
+				}
+
+				sourceDir := c.String("source-dir")
+				if sourceDir != "" && (opt.DryRun || c.Bool("skip-converted")) {
+					return fmt.Errorf("--source-dir conflicts with --dry-run and --skip-converted")
+				}
+				sourceArchive := c.String("source-archive")
+				if sourceArchive != "" && (sourceDir != "" || opt.DryRun || c.Bool("skip-converted")) {
+					return fmt.Errorf("--source-archive conflicts with --source-dir, --dry-run and --skip-converted")
+				}
+				opt.SourceArchiveTag = c.String("source-archive-tag")
 
-					OutputJSON: c.String("output-json"),
+				if !opt.DryRun {
+					convert := converter.Convert
+					if c.Bool("skip-converted") {
+						convert = converter.Copy
+					}
+					if sourceDir != "" {
+						convert = func(ctx context.Context, opt converter.Opt) (*converter.Result, error) {
+							return converter.BuildFromDir(ctx, sourceDir, opt)
+						}
+					}
+					if sourceArchive != "" {
+						convert = func(ctx context.Context, opt converter.Opt) (*converter.Result, error) {
+							return converter.BuildFromDockerArchive(ctx, sourceArchive, opt)
+						}
+					}
+					result, err := convert(context.Background(), opt)
+					if err != nil {
+						return err
+					}
+					if c.Bool("print-result") {
+						data, err := json.MarshalIndent(result, "", "  ")
+						if err != nil {
+							return errors.Wrap(err, "marshal conversion result")
+						}
+						fmt.Println(string(data))
+					}
+					return nil
+				}
+
+				plan, err := converter.ConvertWithPlan(context.Background(), opt)
+				if err != nil {
+					return err
+				}
+				data, err := json.MarshalIndent(plan, "", "  ")
+				if err != nil {
+					return errors.Wrap(err, "marshal conversion plan")
 				}
+				fmt.Println(string(data))
 
-				return converter.Convert(context.Background(), opt)
+				return nil
 			},
 		},
 		{
@@ -643,6 +1104,206 @@ func main() {
 				return checker.Check(context.Background())
 			},
 		},
+		{
+			Name:  "inspect",
+			Usage: "Print the metadata of Nydus bootstrap in JSON format",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "target",
+					Required: true,
+					Usage:    "Target (Nydus) image reference, or path to a local bootstrap file or bootstrap layer",
+					EnvVars:  []string{"TARGET"},
+				},
+				&cli.BoolFlag{
+					Name:     "target-insecure",
+					Required: false,
+					Usage:    "Skip verifying server certs for HTTPS target registry",
+					EnvVars:  []string{"TARGET_INSECURE"},
+				},
+				&cli.StringFlag{
+					Name:    "work-dir",
+					Value:   "./tmp",
+					Usage:   "Working directory for image inspection",
+					EnvVars: []string{"WORK_DIR"},
+				},
+				&cli.StringFlag{
+					Name:    "nydus-image",
+					Value:   "nydus-image",
+					Usage:   "Path to the nydus-image binary, default to search in PATH",
+					EnvVars: []string{"NYDUS_IMAGE"},
+				},
+			},
+			Action: func(c *cli.Context) error {
+				setupLogLevel(c)
+
+				info, err := converter.Inspect(context.Background(), c.String("target"), converter.Opt{
+					WorkDir:        c.String("work-dir"),
+					NydusImagePath: c.String("nydus-image"),
+					SourceInsecure: c.Bool("target-insecure"),
+				})
+				if err != nil {
+					return err
+				}
+				data, err := json.MarshalIndent(info, "", "  ")
+				if err != nil {
+					return errors.Wrap(err, "marshal bootstrap info")
+				}
+				fmt.Println(string(data))
+
+				return nil
+			},
+		},
+		{
+			Name:  "diff",
+			Usage: "Print the files and blobs changed between two Nydus images in JSON format",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "source",
+					Required: true,
+					Usage:    "Old (Nydus) image reference, or path to a local bootstrap file or bootstrap layer",
+					EnvVars:  []string{"SOURCE"},
+				},
+				&cli.StringFlag{
+					Name:     "target",
+					Required: true,
+					Usage:    "New (Nydus) image reference, or path to a local bootstrap file or bootstrap layer",
+					EnvVars:  []string{"TARGET"},
+				},
+				&cli.BoolFlag{
+					Name:     "source-insecure",
+					Required: false,
+					Usage:    "Skip verifying server certs for HTTPS source registry",
+					EnvVars:  []string{"SOURCE_INSECURE"},
+				},
+				&cli.BoolFlag{
+					Name:     "target-insecure",
+					Required: false,
+					Usage:    "Skip verifying server certs for HTTPS target registry",
+					EnvVars:  []string{"TARGET_INSECURE"},
+				},
+				&cli.StringFlag{
+					Name:    "work-dir",
+					Value:   "./tmp",
+					Usage:   "Working directory for image diff",
+					EnvVars: []string{"WORK_DIR"},
+				},
+				&cli.StringFlag{
+					Name:    "nydus-image",
+					Value:   "nydus-image",
+					Usage:   "Path to the nydus-image binary, default to search in PATH",
+					EnvVars: []string{"NYDUS_IMAGE"},
+				},
+			},
+			Action: func(c *cli.Context) error {
+				setupLogLevel(c)
+
+				report, err := converter.Diff(context.Background(), c.String("source"), c.String("target"), converter.Opt{
+					WorkDir:        c.String("work-dir"),
+					NydusImagePath: c.String("nydus-image"),
+					SourceInsecure: c.Bool("source-insecure"),
+					TargetInsecure: c.Bool("target-insecure"),
+				})
+				if err != nil {
+					return err
+				}
+				data, err := json.MarshalIndent(report, "", "  ")
+				if err != nil {
+					return errors.Wrap(err, "marshal diff report")
+				}
+				fmt.Println(string(data))
+
+				return nil
+			},
+		},
+		{
+			Name:  "gc",
+			Usage: "Delete the blobs from storage backend which aren't referenced by any live Nydus image",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:     "live",
+					Required: true,
+					Usage:    "Live Nydus image reference, or path to a local bootstrap file or bootstrap layer, whose blobs are kept, can be specified multiple times",
+					EnvVars:  []string{"LIVE"},
+				},
+				&cli.BoolFlag{
+					Name:     "live-insecure",
+					Required: false,
+					Usage:    "Skip verifying server certs for HTTPS registry of live images",
+					EnvVars:  []string{"LIVE_INSECURE"},
+				},
+				&cli.StringFlag{
+					Name:     "backend-type",
+					Required: true,
+					Usage:    "Type of storage backend, possible values: 'oss', 's3'",
+					EnvVars:  []string{"BACKEND_TYPE"},
+				},
+				&cli.StringFlag{
+					Name:    "backend-config",
+					Value:   "",
+					Usage:   "Json string for storage backend configuration",
+					EnvVars: []string{"BACKEND_CONFIG"},
+				},
+				&cli.PathFlag{
+					Name:      "backend-config-file",
+					Value:     "",
+					TakesFile: true,
+					Usage:     "Json configuration file for storage backend",
+					EnvVars:   []string{"BACKEND_CONFIG_FILE"},
+				},
+				&cli.DurationFlag{
+					Name:    "grace-period",
+					Value:   24 * time.Hour,
+					Usage:   "Keep the unreferenced blobs modified within the period, which may be referenced by the images being converted",
+					EnvVars: []string{"GRACE_PERIOD"},
+				},
+				&cli.BoolFlag{
+					Name:    "dry-run",
+					Value:   false,
+					Usage:   "Only print the blobs to be deleted without deleting them",
+					EnvVars: []string{"DRY_RUN"},
+				},
+				&cli.StringFlag{
+					Name:    "work-dir",
+					Value:   "./tmp",
+					Usage:   "Working directory for garbage collection",
+					EnvVars: []string{"WORK_DIR"},
+				},
+				&cli.StringFlag{
+					Name:    "nydus-image",
+					Value:   "nydus-image",
+					Usage:   "Path to the nydus-image binary, default to search in PATH",
+					EnvVars: []string{"NYDUS_IMAGE"},
+				},
+			},
+			Action: func(c *cli.Context) error {
+				setupLogLevel(c)
+
+				backendType, backendConfig, err := getBackendConfig(c, "", true)
+				if err != nil {
+					return err
+				}
+				result, err := converter.GCBackend(context.Background(), converter.GCOpt{
+					WorkDir:        c.String("work-dir"),
+					NydusImagePath: c.String("nydus-image"),
+					BackendType:    backendType,
+					BackendConfig:  backendConfig,
+					LiveRefs:       c.StringSlice("live"),
+					Insecure:       c.Bool("live-insecure"),
+					GracePeriod:    c.Duration("grace-period"),
+					DryRun:         c.Bool("dry-run"),
+				})
+				if err != nil {
+					return err
+				}
+				data, err := json.MarshalIndent(result, "", "  ")
+				if err != nil {
+					return errors.Wrap(err, "marshal gc result")
+				}
+				fmt.Println(string(data))
+
+				return nil
+			},
+		},
 		{
 			Name:  "chunkdict",
 			Usage: "Deduplicate chunk for Nydus image (experimental)",
@@ -1157,6 +1818,169 @@ func main() {
 				return copier.Copy(context.Background(), opt)
 			},
 		},
+		{
+			Name:  "merge",
+			Usage: "Merge the bootstraps of layers built independently into a single Nydus image",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:     "bootstrap",
+					Required: true,
+					Usage:    "Bootstrap of layer to be merged, can be specified multiple times in order from lowest to uppermost layer",
+				},
+				&cli.StringFlag{
+					Name:     "blob-dir",
+					Required: true,
+					Usage:    "Directory containing the nydus blobs referenced by bootstraps",
+					EnvVars:  []string{"BLOB_DIR"},
+				},
+				&cli.StringFlag{
+					Name:    "chunk-dict-bootstrap",
+					Usage:   "Bootstrap of chunk dict to dedup the chunks of merged image",
+					EnvVars: []string{"CHUNK_DICT_BOOTSTRAP"},
+				},
+				&cli.StringFlag{
+					Name:     "target",
+					Required: true,
+					Usage:    "Target (Nydus) image reference",
+					EnvVars:  []string{"TARGET"},
+				},
+				&cli.BoolFlag{
+					Name:     "target-insecure",
+					Required: false,
+					Usage:    "Skip verifying server certs for HTTPS target registry",
+					EnvVars:  []string{"TARGET_INSECURE"},
+				},
+				&cli.StringFlag{
+					Name:    "prefetch-patterns",
+					Usage:   "File/directory paths to be prefetched, separated by new line",
+					EnvVars: []string{"PREFETCH_PATTERNS"},
+				},
+				&cli.StringFlag{
+					Name:        "fs-version",
+					Value:       "6",
+					DefaultText: "V6 nydus image format",
+					Usage:       "Nydus image format version of bootstraps, possible values: 5, 6",
+					EnvVars:     []string{"FS_VERSION"},
+				},
+				&cli.StringFlag{
+					Name:    "output-bootstrap",
+					Usage:   "Save the merged bootstrap to the file path",
+					EnvVars: []string{"OUTPUT_BOOTSTRAP"},
+				},
+
+				&cli.StringFlag{
+					Name:    "work-dir",
+					Value:   "./tmp",
+					Usage:   "Working directory for image merge",
+					EnvVars: []string{"WORK_DIR"},
+				},
+				&cli.StringFlag{
+					Name:    "nydus-image",
+					Value:   "nydus-image",
+					Usage:   "Path to the nydus-image binary, default to search in PATH",
+					EnvVars: []string{"NYDUS_IMAGE"},
+				},
+			},
+			Action: func(c *cli.Context) error {
+				setupLogLevel(c)
+
+				fsVersion := c.String("fs-version")
+				if fsVersion != "5" && fsVersion != "6" {
+					return fmt.Errorf("invalid fs version %s, possible values: 5, 6", fsVersion)
+				}
+
+				opt := converter.MergeOpt{
+					WorkDir:        c.String("work-dir"),
+					NydusImagePath: c.String("nydus-image"),
+
+					BootstrapPaths:   c.StringSlice("bootstrap"),
+					BlobDir:          c.String("blob-dir"),
+					ChunkDictPath:    c.String("chunk-dict-bootstrap"),
+					PrefetchPatterns: c.String("prefetch-patterns"),
+					FsVersion:        fsVersion,
+
+					Target:         c.String("target"),
+					TargetInsecure: c.Bool("target-insecure"),
+
+					MergedBootstrapPath: c.String("output-bootstrap"),
+				}
+
+				return converter.Merge(context.Background(), opt)
+			},
+		},
+		{
+			Name:  "export",
+			Usage: "Export the Nydus image back to an OCI layer tarball flattened from all layers",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "source",
+					Required: true,
+					Usage:    "Source (Nydus) image reference",
+					EnvVars:  []string{"SOURCE"},
+				},
+				&cli.BoolFlag{
+					Name:     "source-insecure",
+					Required: false,
+					Usage:    "Skip verifying server certs for HTTPS source registry",
+					EnvVars:  []string{"SOURCE_INSECURE"},
+				},
+				&cli.StringFlag{
+					Name:  "platform",
+					Value: "linux/" + runtime.GOARCH,
+					Usage: "Specify platform identifier to choose image manifest, possible values: 'linux/amd64' and 'linux/arm64'",
+				},
+				&cli.StringFlag{
+					Name:     "output",
+					Required: true,
+					Usage:    "File path to save the exported .tar.gz layer",
+					EnvVars:  []string{"OUTPUT"},
+				},
+
+				&cli.StringFlag{
+					Name:    "work-dir",
+					Value:   "./tmp",
+					Usage:   "Working directory for image export",
+					EnvVars: []string{"WORK_DIR"},
+				},
+				&cli.StringFlag{
+					Name:    "nydus-image",
+					Value:   "nydus-image",
+					Usage:   "Path to the nydus-image binary, default to search in PATH",
+					EnvVars: []string{"NYDUS_IMAGE"},
+				},
+			},
+			Action: func(c *cli.Context) error {
+				setupLogLevel(c)
+
+				_, arch, err := provider.ExtractOsArch(c.String("platform"))
+				if err != nil {
+					return err
+				}
+
+				output, err := os.Create(c.String("output"))
+				if err != nil {
+					return errors.Wrap(err, "create output file")
+				}
+				defer output.Close()
+
+				opt := converter.ExportOpt{
+					WorkDir:        c.String("work-dir"),
+					NydusImagePath: c.String("nydus-image"),
+
+					Source:         c.String("source"),
+					SourceInsecure: c.Bool("source-insecure"),
+					ExpectedArch:   arch,
+
+					Writer: output,
+				}
+
+				if err := converter.Export(context.Background(), opt); err != nil {
+					return err
+				}
+
+				return output.Close()
+			},
+		},
 		{
 			Name:  "commit",
 			Usage: "Create and push a new nydus image from a container's changes that use a nydus image",
@@ -1267,6 +2091,73 @@ func main() {
 				return cm.Commit(c.Context, opt)
 			},
 		},
+		{
+			Name:  "server",
+			Usage: "Run the image conversion as an HTTP service with POST /convert, GET /healthz and GET /readyz endpoints",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "address",
+					Value:   ":8080",
+					Usage:   "Address for the HTTP service to listen on",
+					EnvVars: []string{"ADDRESS"},
+				},
+				&cli.IntFlag{
+					Name:    "concurrency",
+					Value:   1,
+					Usage:   "Maximum number of conversions running at the same time, the excess requests are queued",
+					EnvVars: []string{"CONCURRENCY"},
+				},
+				&cli.IntFlag{
+					Name:    "queue-size",
+					Value:   0,
+					Usage:   "Maximum number of requests waiting in queue, the excess requests are rejected with 429, 0 means no limit",
+					EnvVars: []string{"QUEUE_SIZE"},
+				},
+				&cli.StringFlag{
+					Name:    "work-dir",
+					Value:   "./tmp",
+					Usage:   "Working directory for image conversion",
+					EnvVars: []string{"WORK_DIR"},
+				},
+				&cli.StringFlag{
+					Name:    "nydus-image",
+					Value:   "nydus-image",
+					Usage:   "Path to the nydus-image binary, default to search in PATH",
+					EnvVars: []string{"NYDUS_IMAGE"},
+				},
+			},
+			Action: func(c *cli.Context) error {
+				setupLogLevel(c)
+
+				handler := server.New(server.Opt{
+					Base: converter.Opt{
+						WorkDir:        c.String("work-dir"),
+						NydusImagePath: c.String("nydus-image"),
+					},
+					Concurrency: c.Int("concurrency"),
+					QueueSize:   c.Int("queue-size"),
+				})
+				httpServer := &http.Server{
+					Addr:              c.String("address"),
+					Handler:           handler,
+					ReadHeaderTimeout: 10 * time.Second,
+				}
+
+				// The running conversions are cancelled on shutdown.
+				ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+				defer stop()
+				go func() {
+					<-ctx.Done()
+					_ = httpServer.Close()
+				}()
+
+				logrus.Infof("serving image conversion on %s", httpServer.Addr)
+				if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					return errors.Wrap(err, "serve image conversion")
+				}
+				return nil
+			},
+		},
 	}
 
 	if !utils.IsSupportedArch(runtime.GOARCH) {
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter"
 )
@@ -27,7 +29,15 @@ func main() {
 		Docker2OCI:       true,
 	}
 
-	if err := converter.Convert(context.Background(), opt); err != nil {
+	result, err := converter.Convert(context.Background(), opt)
+	if err != nil {
 		panic(err)
 	}
+
+	// The structured result can be consumed by scripts without parsing logs
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(data))
 }
@@ -8,6 +8,8 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"strings"
+	"time"
 
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/remote"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
@@ -30,6 +32,35 @@ type Backend interface {
 	Size(blobID string) (int64, error)
 }
 
+// BlobInfo is a blob object stored in backend.
+type BlobInfo struct {
+	ID           string
+	Size         int64
+	LastModified time.Time
+}
+
+// Collector is implemented by the object storage backends supporting the
+// garbage collection of blobs.
+type Collector interface {
+	// List returns the blobs under the object prefix, the objects not
+	// named by blob ID are ignored.
+	List(ctx context.Context) ([]BlobInfo, error)
+	Delete(ctx context.Context, blobID string) error
+}
+
+// blobIDOfKey returns the blob ID of the object key under prefix, or false if
+// the object isn't a blob.
+func blobIDOfKey(prefix, key string) (string, bool) {
+	if !strings.HasPrefix(key, prefix) {
+		return "", false
+	}
+	blobID := strings.TrimPrefix(key, prefix)
+	if digest.NewDigestFromEncoded(digest.SHA256, blobID).Validate() != nil {
+		return "", false
+	}
+	return blobID, true
+}
+
 // TODO: Directly forward blob data to storage backend
 
 type Type = int
@@ -24,6 +24,25 @@ func TestBlobDesc(t *testing.T) {
 	}, desc.Annotations)
 }
 
+func TestBlobIDOfKey(t *testing.T) {
+	blobID := "205eed24cbec29ad9cb4593a73168ef1803402370a82f7d51ce25646fc2f943a"
+	id, ok := blobIDOfKey("nydus/", "nydus/"+blobID)
+	require.True(t, ok)
+	require.Equal(t, blobID, id)
+	id, ok = blobIDOfKey("", blobID)
+	require.True(t, ok)
+	require.Equal(t, blobID, id)
+
+	// The objects not named by blob ID aren't blobs.
+	for _, key := range []string{"meta/" + blobID, "nydus/bootstrap", "nydus/sub/" + blobID, "nydus/" + blobID + ".tmp"} {
+		_, ok = blobIDOfKey("nydus/", key)
+		require.False(t, ok, key)
+	}
+
+	var _ Collector = &OSSBackend{}
+	var _ Collector = &S3Backend{}
+}
+
 func TestNewBackend(t *testing.T) {
 	ossConfigJSON := `
 	{
@@ -27,8 +27,15 @@ const (
 	// For multipart uploads, OSS has a maximum number of 10000 chunks,
 	// so we can only upload blob size of about 10000 * multipartChunkSize.
 	multipartChunkSize = 200 * 1024 * 1024 /// 200MB
+	// uploadPartRetries is the max number of retries for a failed part, the
+	// completed parts aren't uploaded again.
+	uploadPartRetries = 3
 )
 
+// uploadPartRetryDelay is the initial delay of exponential backoff between
+// the retries of a failed part.
+var uploadPartRetryDelay = time.Second
+
 type multipartStatus struct {
 	imur          *oss.InitiateMultipartUploadResult
 	parts         []oss.UploadPart
@@ -42,41 +49,55 @@ type OSSBackend struct {
 	// to make it a path-like object.
 	objectPrefix string
 	bucket       *oss.Bucket
-	ms           []multipartStatus
-	msMutex      sync.Mutex
+	// partSize is the size of each part of multipart upload.
+	partSize int64
+	ms       []multipartStatus
+	msMutex  sync.Mutex
+}
+
+type OSSConfig struct {
+	Endpoint        string `json:"endpoint,omitempty"`
+	BucketName      string `json:"bucket_name,omitempty"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	AccessKeySecret string `json:"access_key_secret,omitempty"`
+	ObjectPrefix    string `json:"object_prefix,omitempty"`
+	// PartSize is the size of each part of multipart upload, defaults to
+	// 200MB. OSS allows at most 10000 parts for an object.
+	PartSize int64 `json:"part_size,omitempty"`
 }
 
 func newOSSBackend(rawConfig []byte) (*OSSBackend, error) {
-	var configMap map[string]string
-	if err := json.Unmarshal(rawConfig, &configMap); err != nil {
+	cfg := &OSSConfig{}
+	if err := json.Unmarshal(rawConfig, cfg); err != nil {
 		return nil, errors.Wrap(err, "Parse OSS storage backend configuration")
 	}
 
-	endpoint := configMap["endpoint"]
-	bucketName := configMap["bucket_name"]
-
-	// Below items are not mandatory
-	accessKeyID := configMap["access_key_id"]
-	accessKeySecret := configMap["access_key_secret"]
-	objectPrefix := configMap["object_prefix"]
-
-	if endpoint == "" || bucketName == "" {
+	// The access keys and object prefix are not mandatory.
+	if cfg.Endpoint == "" || cfg.BucketName == "" {
 		return nil, fmt.Errorf("invalid OSS configuration: missing 'endpoint' or 'bucket'")
 	}
+	if cfg.PartSize < 0 {
+		return nil, fmt.Errorf("invalid OSS configuration: negative 'part_size' %d", cfg.PartSize)
+	}
+	partSize := cfg.PartSize
+	if partSize == 0 {
+		partSize = multipartChunkSize
+	}
 
-	client, err := oss.New(endpoint, accessKeyID, accessKeySecret)
+	client, err := oss.New(cfg.Endpoint, cfg.AccessKeyID, cfg.AccessKeySecret)
 	if err != nil {
 		return nil, errors.Wrap(err, "Create client")
 	}
 
-	bucket, err := client.Bucket(bucketName)
+	bucket, err := client.Bucket(cfg.BucketName)
 	if err != nil {
 		return nil, errors.Wrap(err, "Create bucket")
 	}
 
 	return &OSSBackend{
-		objectPrefix: objectPrefix,
+		objectPrefix: cfg.ObjectPrefix,
 		bucket:       bucket,
+		partSize:     partSize,
 	}, nil
 }
 
@@ -109,7 +130,7 @@ func calcCrc64ECMA(path string) (uint64, error) {
 
 // Upload blob as image layer to oss backend and verify
 // integrity by calculate CRC64.
-func (b *OSSBackend) Upload(_ context.Context, blobID, blobPath string, size int64, forcePush bool) (*ocispec.Descriptor, error) {
+func (b *OSSBackend) Upload(ctx context.Context, blobID, blobPath string, size int64, forcePush bool) (*ocispec.Descriptor, error) {
 	blobObjectKey := b.objectPrefix + blobID
 
 	desc := blobDesc(size, blobID)
@@ -138,7 +159,7 @@ func (b *OSSBackend) Upload(_ context.Context, blobID, blobPath string, size int
 	}()
 
 	logrus.Debugf("upload %s using multipart method", blobObjectKey)
-	chunks, err := oss.SplitFileByPartSize(blobPath, multipartChunkSize)
+	chunks, err := oss.SplitFileByPartSize(blobPath, b.partSize)
 	if err != nil {
 		return nil, errors.Wrap(err, "split file by part size")
 	}
@@ -153,9 +174,9 @@ func (b *OSSBackend) Upload(_ context.Context, blobID, blobPath string, size int
 	for _, chunk := range chunks {
 		ck := chunk
 		eg.Go(func() error {
-			p, err := b.bucket.UploadPartFromFile(imur, blobPath, ck.Offset, ck.Size, ck.Number)
+			p, err := b.uploadPart(ctx, imur, blobPath, ck)
 			if err != nil {
-				return errors.Wrap(err, "upload part from file")
+				return err
 			}
 			partsChan <- p
 			return nil
@@ -192,6 +213,28 @@ func (b *OSSBackend) Upload(_ context.Context, blobID, blobPath string, size int
 	return &desc, nil
 }
 
+// uploadPart uploads the chunk of blob file as a part, the failed part is
+// retried alone so that a flaky link doesn't restart the whole blob.
+func (b *OSSBackend) uploadPart(ctx context.Context, imur oss.InitiateMultipartUploadResult, blobPath string, chunk oss.FileChunk) (oss.UploadPart, error) {
+	delay := uploadPartRetryDelay
+	for attempt := 0; ; attempt++ {
+		part, err := b.bucket.UploadPartFromFile(imur, blobPath, chunk.Offset, chunk.Size, chunk.Number)
+		if err == nil {
+			return part, nil
+		}
+		if attempt >= uploadPartRetries {
+			return part, errors.Wrapf(err, "upload part %d from file", chunk.Number)
+		}
+		logrus.WithError(err).Warnf("retry to upload part %d of %s after %s", chunk.Number, imur.Key, delay)
+		select {
+		case <-ctx.Done():
+			return part, errors.Wrapf(ctx.Err(), "upload part %d from file", chunk.Number)
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
 func (b *OSSBackend) Finalize(cancel bool) error {
 	b.msMutex.Lock()
 	defer b.msMutex.Unlock()
@@ -279,6 +322,30 @@ func (b *OSSBackend) Size(blobID string) (int64, error) {
 	return size, nil
 }
 
+func (b *OSSBackend) List(_ context.Context) ([]BlobInfo, error) {
+	blobs := []BlobInfo{}
+	marker := ""
+	for {
+		result, err := b.bucket.ListObjects(oss.Prefix(b.objectPrefix), oss.Marker(marker))
+		if err != nil {
+			return nil, errors.Wrap(err, "list objects")
+		}
+		for _, object := range result.Objects {
+			if blobID, ok := blobIDOfKey(b.objectPrefix, object.Key); ok {
+				blobs = append(blobs, BlobInfo{ID: blobID, Size: object.Size, LastModified: object.LastModified})
+			}
+		}
+		if !result.IsTruncated {
+			return blobs, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+func (b *OSSBackend) Delete(_ context.Context, blobID string) error {
+	return errors.Wrap(b.bucket.DeleteObject(b.objectPrefix+blobID), "delete object")
+}
+
 func (b *OSSBackend) remoteID(blobID string) string {
 	return fmt.Sprintf("oss://%s/%s%s", b.bucket.BucketName, b.objectPrefix, blobID)
 }
@@ -5,10 +5,21 @@
 package backend
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"hash/crc64"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -134,4 +145,90 @@ func TestNewOSSBackend(t *testing.T) {
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "Parse OSS storage backend configuration")
 	require.Nil(t, backend)
+
+	ossConfigJSON7 := `
+	{
+		"bucket_name": "test",
+		"endpoint": "region.oss.com",
+		"part_size": -1
+	}`
+	backend, err = newOSSBackend([]byte(ossConfigJSON7))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "negative 'part_size'")
+	require.Nil(t, backend)
+}
+
+func TestOSSUploadRetryPart(t *testing.T) {
+	defer func(delay time.Duration) {
+		uploadPartRetryDelay = delay
+	}(uploadPartRetryDelay)
+	uploadPartRetryDelay = time.Millisecond
+
+	blob := bytes.Repeat([]byte("0123456789"), 30)
+	blobPath := filepath.Join(t.TempDir(), "blob")
+	require.NoError(t, os.WriteFile(blobPath, blob, 0644))
+
+	var mutex sync.Mutex
+	// failures is the number of failures left of each part.
+	failures := map[int]int{}
+	attempts := map[int]int{}
+	parts := map[int][]byte{}
+	aborted := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodPost && query.Has("uploads"):
+			fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>test</Bucket><Key>%s</Key><UploadId>upload-id</UploadId></InitiateMultipartUploadResult>", strings.TrimPrefix(r.URL.Path, "/test/"))
+		case r.Method == http.MethodPut && query.Has("partNumber"):
+			number, err := strconv.Atoi(query.Get("partNumber"))
+			require.NoError(t, err)
+			data, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			attempts[number]++
+			if failures[number] > 0 {
+				failures[number]--
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			parts[number] = data
+			w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, number))
+		case r.Method == http.MethodDelete && query.Get("uploadId") == "upload-id":
+			aborted = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	backend, err := newOSSBackend([]byte(fmt.Sprintf(`{
+		"bucket_name": "test",
+		"endpoint": "%s",
+		"object_prefix": "blob",
+		"part_size": 100
+	}`, server.Listener.Addr().String())))
+	require.NoError(t, err)
+	require.Equal(t, int64(100), backend.partSize)
+
+	// Only the failed part is uploaded again.
+	failures[2] = 2
+	_, err = backend.Upload(context.Background(), "111", blobPath, int64(len(blob)), true)
+	require.NoError(t, err)
+	require.Equal(t, map[int]int{1: 1, 2: 3, 3: 1}, attempts)
+	require.Equal(t, blob, bytes.Join([][]byte{parts[1], parts[2], parts[3]}, nil))
+	require.Len(t, backend.ms, 1)
+	require.Len(t, backend.ms[0].parts, 3)
+	require.False(t, aborted)
+
+	// The upload is aborted once the retries of part are exhausted.
+	attempts = map[int]int{}
+	failures[3] = uploadPartRetries + 1
+	_, err = backend.Upload(context.Background(), "222", blobPath, int64(len(blob)), true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "upload part 3 from file")
+	require.Equal(t, uploadPartRetries+1, attempts[3])
+	require.Equal(t, 1, attempts[1])
+	require.True(t, aborted)
 }
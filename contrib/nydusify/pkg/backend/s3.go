@@ -35,7 +35,12 @@ type S3Backend struct {
 	objectPrefix       string
 	bucketName         string
 	endpointWithScheme string
-	client             *s3.Client
+	// pathStyle uses path-style addressing like `endpoint/bucket/key`,
+	// otherwise uses virtual-hosted-style addressing like `bucket.endpoint/key`.
+	pathStyle bool
+	// partSize is the size of each part of multipart upload.
+	partSize int64
+	client   *s3.Client
 }
 
 type S3Config struct {
@@ -46,6 +51,11 @@ type S3Config struct {
 	BucketName      string `json:"bucket_name,omitempty"`
 	Region          string `json:"region,omitempty"`
 	ObjectPrefix    string `json:"object_prefix,omitempty"`
+	// ForcePathStyle defaults to true for compatibility.
+	ForcePathStyle *bool `json:"force_path_style,omitempty"`
+	// PartSize is the size of each part of multipart upload, defaults to
+	// 200MB and must be at least 5MB. The failed part is retried alone.
+	PartSize int64 `json:"part_size,omitempty"`
 }
 
 func newS3Backend(rawConfig []byte) (*S3Backend, error) {
@@ -65,6 +75,19 @@ func newS3Backend(rawConfig []byte) (*S3Backend, error) {
 		return nil, fmt.Errorf("invalid S3 configuration: missing 'bucket_name' or 'region'")
 	}
 
+	partSize := cfg.PartSize
+	if partSize == 0 {
+		partSize = multipartChunkSize
+	}
+	if partSize < manager.MinUploadPartSize {
+		return nil, fmt.Errorf("invalid S3 configuration: 'part_size' %d is less than %d", partSize, manager.MinUploadPartSize)
+	}
+
+	pathStyle := true
+	if cfg.ForcePathStyle != nil {
+		pathStyle = *cfg.ForcePathStyle
+	}
+
 	s3AWSConfig, err := awscfg.LoadDefaultConfig(context.TODO())
 	if err != nil {
 		return nil, errors.Wrap(err, "load default AWS config")
@@ -73,17 +96,20 @@ func newS3Backend(rawConfig []byte) (*S3Backend, error) {
 	client := s3.NewFromConfig(s3AWSConfig, func(o *s3.Options) {
 		o.BaseEndpoint = &endpointWithScheme
 		o.Region = cfg.Region
-		o.UsePathStyle = true
+		o.UsePathStyle = pathStyle
+		// Leave the credentials to be loaded from environment (for example
+		// IAM role) if access keys are not specified.
 		if len(cfg.AccessKeySecret) > 0 && len(cfg.AccessKeyID) > 0 {
 			o.Credentials = credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.AccessKeySecret, "")
 		}
-		o.UsePathStyle = true
 	})
 
 	return &S3Backend{
 		objectPrefix:       cfg.ObjectPrefix,
 		bucketName:         cfg.BucketName,
 		endpointWithScheme: endpointWithScheme,
+		pathStyle:          pathStyle,
+		partSize:           partSize,
 		client:             client,
 	}, nil
 }
@@ -112,7 +138,7 @@ func (b *S3Backend) Upload(ctx context.Context, blobID, blobPath string, size in
 	defer blobFile.Close()
 
 	uploader := manager.NewUploader(b.client, func(u *manager.Uploader) {
-		u.PartSize = multipartChunkSize
+		u.PartSize = b.partSize
 	})
 	_, err = uploader.Upload(ctx, &s3.PutObjectInput{
 		Bucket:            aws.String(b.bucketName),
@@ -181,8 +207,48 @@ func (b *S3Backend) Size(blobID string) (int64, error) {
 	return *output.ObjectSize, nil
 }
 
+func (b *S3Backend) List(ctx context.Context) ([]BlobInfo, error) {
+	blobs := []BlobInfo{}
+	paginator := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: &b.bucketName,
+		Prefix: &b.objectPrefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "list objects")
+		}
+		for _, object := range page.Contents {
+			blobID, ok := blobIDOfKey(b.objectPrefix, aws.ToString(object.Key))
+			if !ok {
+				continue
+			}
+			blobs = append(blobs, BlobInfo{
+				ID:           blobID,
+				Size:         aws.ToInt64(object.Size),
+				LastModified: aws.ToTime(object.LastModified),
+			})
+		}
+	}
+	return blobs, nil
+}
+
+func (b *S3Backend) Delete(ctx context.Context, blobID string) error {
+	objectKey := b.blobObjectKey(blobID)
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &b.bucketName,
+		Key:    &objectKey,
+	})
+	return errors.Wrap(err, "delete object")
+}
+
 func (b *S3Backend) remoteID(blobObjectKey string) string {
 	remoteURL, _ := url.Parse(b.endpointWithScheme)
-	remoteURL.Path = path.Join(remoteURL.Path, b.bucketName, blobObjectKey)
+	if b.pathStyle {
+		remoteURL.Path = path.Join(remoteURL.Path, b.bucketName, blobObjectKey)
+	} else {
+		remoteURL.Host = b.bucketName + "." + remoteURL.Host
+		remoteURL.Path = path.Join(remoteURL.Path, blobObjectKey)
+	}
 	return remoteURL.String()
 }
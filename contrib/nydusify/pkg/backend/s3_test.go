@@ -7,9 +7,18 @@ package backend
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/stretchr/testify/require"
 )
 
@@ -34,6 +43,20 @@ func TestS3RemoteID(t *testing.T) {
 	require.Equal(t, "https://s3.amazonaws.com/test/111", id)
 }
 
+func TestS3RemoteIDWithVirtualHostedStyle(t *testing.T) {
+	s3ConfigJSON := `
+	{
+		"bucket_name": "test",
+		"endpoint": "s3.amazonaws.com",
+		"region": "region1",
+		"force_path_style": false
+	}`
+	s3Backend, err := newS3Backend([]byte(s3ConfigJSON))
+	require.NoError(t, err)
+	require.False(t, s3Backend.client.Options().UsePathStyle)
+	require.Equal(t, "https://test.s3.amazonaws.com/111", s3Backend.remoteID("111"))
+}
+
 func TestBlobObjectKey(t *testing.T) {
 	s3Backend := tempS3Backend()
 	blobObjectKey := s3Backend.blobObjectKey("111")
@@ -116,4 +139,97 @@ func TestNewS3Backend(t *testing.T) {
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "invalid S3 configuration: missing 'bucket_name' or 'region'")
 	require.Nil(t, backend)
+
+	backend, err = newS3Backend([]byte(`{"bucket_name": "test", "region": "region1"}`))
+	require.NoError(t, err)
+	require.Equal(t, int64(multipartChunkSize), backend.partSize)
+	backend, err = newS3Backend([]byte(`{"bucket_name": "test", "region": "region1", "part_size": 10485760}`))
+	require.NoError(t, err)
+	require.Equal(t, int64(10485760), backend.partSize)
+	backend, err = newS3Backend([]byte(`{"bucket_name": "test", "region": "region1", "part_size": 1024}`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "'part_size' 1024 is less than")
+	require.Nil(t, backend)
+}
+
+func TestS3BackendRequests(t *testing.T) {
+	blob := []byte("blob data")
+	blobPath := filepath.Join(t.TempDir(), "blob")
+	require.NoError(t, os.WriteFile(blobPath, blob, 0644))
+
+	for _, pathStyle := range []bool{true, false} {
+		t.Run(fmt.Sprintf("force_path_style=%v", pathStyle), func(t *testing.T) {
+			var mutex sync.Mutex
+			// requests records the method, host and path of requests.
+			requests := []string{}
+			objects := map[string][]byte{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				requests = append(requests, fmt.Sprintf("%s %s%s", r.Method, r.Host, r.URL.Path))
+				switch r.Method {
+				case http.MethodHead:
+					if _, ok := objects[r.Host+r.URL.Path]; !ok {
+						w.WriteHeader(http.StatusNotFound)
+					}
+				case http.MethodPut:
+					data, err := io.ReadAll(r.Body)
+					require.NoError(t, err)
+					objects[r.Host+r.URL.Path] = data
+				case http.MethodDelete:
+					delete(objects, r.Host+r.URL.Path)
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					w.WriteHeader(http.StatusMethodNotAllowed)
+				}
+			}))
+			defer server.Close()
+
+			backend, err := newS3Backend([]byte(fmt.Sprintf(`{
+				"bucket_name": "test",
+				"endpoint": "s3.example.com",
+				"scheme": "http",
+				"access_key_id": "testAK",
+				"access_key_secret": "testSK",
+				"object_prefix": "prefix/",
+				"region": "region1",
+				"force_path_style": %v
+			}`, pathStyle)))
+			require.NoError(t, err)
+			// Dial the fake endpoint for any host, which is prefixed by
+			// bucket name in virtual-hosted-style addressing.
+			backend.client = s3.New(backend.client.Options(), func(o *s3.Options) {
+				o.HTTPClient = &http.Client{Transport: &http.Transport{
+					DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+						return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+					},
+				}}
+			})
+
+			host, path := "test.s3.example.com", "/prefix/111"
+			if pathStyle {
+				host, path = "s3.example.com", "/test/prefix/111"
+			}
+			desc, err := backend.Upload(context.Background(), "111", blobPath, int64(len(blob)), false)
+			require.NoError(t, err)
+			require.Equal(t, []string{"http://" + host + path}, desc.URLs)
+			mutex.Lock()
+			require.Equal(t, blob, objects[host+path])
+			mutex.Unlock()
+			exists, err := backend.Check("111")
+			require.NoError(t, err)
+			require.True(t, exists)
+			require.NoError(t, backend.Delete(context.Background(), "111"))
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			require.Equal(t, []string{
+				"HEAD " + host + path,
+				"PUT " + host + path,
+				"HEAD " + host + path,
+				"DELETE " + host + path,
+			}, requests)
+			require.Empty(t, objects)
+		})
+	}
 }
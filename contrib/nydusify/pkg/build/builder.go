@@ -41,6 +41,14 @@ type CompactOption struct {
 	CompactConfigPath   string
 }
 
+type UnpackOption struct {
+	BootstrapPath string
+	// BlobDir is the directory containing the blobs named by blob id.
+	BlobDir string
+	// A regular file or fifo into which commands nydus-image to dump tarball.
+	OutputPath string
+}
+
 type GenerateOption struct {
 	BootstrapPaths         []string
 	DatabasePath           string
@@ -151,6 +159,24 @@ func (builder *Builder) Run(option BuilderOption) error {
 	return builder.run(args, option.PrefetchPatterns)
 }
 
+// Unpack calls `nydus-image unpack` to reconstruct the file tree of bootstrap
+// as a tarball
+func (builder *Builder) Unpack(option UnpackOption) error {
+	args := []string{
+		"unpack",
+		"--log-level",
+		"warn",
+		"--bootstrap",
+		option.BootstrapPath,
+		"--blob-dir",
+		option.BlobDir,
+		"--output",
+		option.OutputPath,
+	}
+
+	return builder.run(args, "")
+}
+
 // Generate calls `nydus-image chunkdict generate` to get chunkdict
 func (builder *Builder) Generate(option GenerateOption) error {
 	logrus.Infof("Invoking 'nydus-image chunkdict generate' command")
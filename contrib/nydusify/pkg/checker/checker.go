@@ -34,6 +34,10 @@ type Opt struct {
 	BackendType    string
 	BackendConfig  string
 	ExpectedArch   string
+	// SourceRemoteOpt and TargetRemoteOpt configure the requests to source
+	// and target registry independently, like the TLS certs.
+	SourceRemoteOpt provider.RemoteOpt
+	TargetRemoteOpt provider.RemoteOpt
 }
 
 // Checker validates Nydus image manifest, bootstrap and mounts filesystem
@@ -46,8 +50,7 @@ type Checker struct {
 
 // New creates Checker instance, target is the Nydus image reference.
 func New(opt Opt) (*Checker, error) {
-	// TODO: support source and target resolver
-	targetRemote, err := provider.DefaultRemote(opt.Target, opt.TargetInsecure)
+	targetRemote, err := provider.DefaultRemoteWithOpt(opt.Target, opt.TargetInsecure, opt.TargetRemoteOpt)
 	if err != nil {
 		return nil, errors.Wrap(err, "Init target image parser")
 	}
@@ -58,7 +61,7 @@ func New(opt Opt) (*Checker, error) {
 
 	var sourceParser *parser.Parser
 	if opt.Source != "" {
-		sourceRemote, err := provider.DefaultRemote(opt.Source, opt.SourceInsecure)
+		sourceRemote, err := provider.DefaultRemoteWithOpt(opt.Source, opt.SourceInsecure, opt.SourceRemoteOpt)
 		if err != nil {
 			return nil, errors.Wrap(err, "Init source image parser")
 		}
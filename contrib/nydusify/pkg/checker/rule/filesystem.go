@@ -13,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"syscall"
 
 	"github.com/distribution/reference"
@@ -43,6 +44,29 @@ type FilesystemRule struct {
 	Target          string
 	TargetInsecure  bool
 	PlainHTTP       bool
+
+	// Diffs records the mismatched files found in the last validation.
+	Diffs []FileDiff
+}
+
+// FileDiff describes a mismatched file between source and Nydus image,
+// Source or Target is nil if the file is not found in the image.
+type FileDiff struct {
+	Path   string
+	Reason string
+	Source *Node
+	Target *Node
+}
+
+func (diff *FileDiff) String() string {
+	switch {
+	case diff.Target == nil:
+		return fmt.Sprintf("File not found in Nydus image: %s", diff.Path)
+	case diff.Source == nil:
+		return fmt.Sprintf("File not found in source image: %s", diff.Path)
+	default:
+		return fmt.Sprintf("File %s in Nydus image: %s <=> %s", diff.Reason, diff.Source.String(), diff.Target.String())
+	}
 }
 
 // Node records file metadata and file data hash.
@@ -181,7 +205,7 @@ func (rule *FilesystemRule) pullSourceImage() (*tool.Image, error) {
 					return errors.Wrap(err, "pull source image layers from the remote registry")
 				}
 
-				if err = utils.UnpackTargz(context.Background(), filepath.Join(rule.SourcePath, fmt.Sprintf("layer-%d", idx)), reader, true); err != nil {
+				if err = utils.UnpackLayer(context.Background(), filepath.Join(rule.SourcePath, fmt.Sprintf("layer-%d", idx)), reader, layer.MediaType, true); err != nil {
 					return errors.Wrap(err, "unpack source image layers")
 				}
 
@@ -318,23 +342,58 @@ func (rule *FilesystemRule) verify() error {
 		return errors.Wrap(err, "walk rootfs of source image")
 	}
 
+	rule.Diffs = diffNodes(sourceNodes, nydusNodes)
+	for idx := range rule.Diffs {
+		logrus.Warn(rule.Diffs[idx].String())
+	}
+	if len(rule.Diffs) > 0 {
+		return fmt.Errorf("found %d mismatched files in Nydus image, first one: %s", len(rule.Diffs), rule.Diffs[0].String())
+	}
+
+	return nil
+}
+
+// diffNodes compares the file nodes of source and Nydus image, and returns
+// all mismatched files sorted by path.
+func diffNodes(sourceNodes, nydusNodes map[string]Node) []FileDiff {
+	diffs := []FileDiff{}
+
 	for path, sourceNode := range sourceNodes {
+		sourceNode := sourceNode
 		nydusNode, exist := nydusNodes[path]
 		if !exist {
-			return fmt.Errorf("File not found in Nydus image: %s", path)
+			diffs = append(diffs, FileDiff{Path: path, Reason: "not found", Source: &sourceNode})
+			continue
 		}
-		delete(nydusNodes, path)
 
-		if path != "/" && !reflect.DeepEqual(sourceNode, nydusNode) {
-			return fmt.Errorf("File not match in Nydus image: %s <=> %s", sourceNode.String(), nydusNode.String())
+		if path == "/" || reflect.DeepEqual(sourceNode, nydusNode) {
+			continue
 		}
+
+		reason := "not match"
+		switch {
+		case sourceNode.Size != nydusNode.Size:
+			reason = "size not match"
+		case sourceNode.Mode != nydusNode.Mode:
+			reason = "mode not match"
+		case !reflect.DeepEqual(sourceNode.Xattrs, nydusNode.Xattrs):
+			reason = "xattrs not match"
+		}
+		diffs = append(diffs, FileDiff{Path: path, Reason: reason, Source: &sourceNode, Target: &nydusNode})
 	}
 
-	for path := range nydusNodes {
-		return fmt.Errorf("File not found in source image: %s", path)
+	for path, nydusNode := range nydusNodes {
+		nydusNode := nydusNode
+		if _, exist := sourceNodes[path]; !exist {
+			diffs = append(diffs, FileDiff{Path: path, Reason: "not found", Target: &nydusNode})
+		}
 	}
 
-	return nil
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Path < diffs[j].Path
+	})
+
+	return diffs
 }
 
 func (rule *FilesystemRule) Validate() error {
@@ -0,0 +1,43 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package rule
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffNodes(t *testing.T) {
+	sourceNodes := map[string]Node{
+		"/":      {Path: "/", Mode: 0755},
+		"/file1": {Path: "/file1", Size: 10, Mode: 0644},
+		"/file2": {Path: "/file2", Size: 10, Mode: 0644, Xattrs: map[string][]byte{"user.key": []byte("v1")}},
+		"/file3": {Path: "/file3", Size: 10, Mode: 0644},
+		"/file4": {Path: "/file4", Size: 10, Mode: 0644},
+	}
+	nydusNodes := map[string]Node{
+		"/":      {Path: "/", Mode: 0700},
+		"/file1": {Path: "/file1", Size: 10, Mode: 0644},
+		"/file2": {Path: "/file2", Size: 10, Mode: 0644, Xattrs: map[string][]byte{"user.key": []byte("v2")}},
+		"/file3": {Path: "/file3", Size: 20, Mode: 0644},
+		"/file5": {Path: "/file5", Size: 10, Mode: 0644},
+	}
+	require.Empty(t, diffNodes(sourceNodes, sourceNodes))
+
+	diffs := diffNodes(sourceNodes, nydusNodes)
+	require.Len(t, diffs, 4)
+
+	require.Equal(t, "/file2", diffs[0].Path)
+	require.Equal(t, "xattrs not match", diffs[0].Reason)
+	require.Equal(t, "/file3", diffs[1].Path)
+	require.Equal(t, "size not match", diffs[1].Reason)
+	require.Equal(t, "/file4", diffs[2].Path)
+	require.Nil(t, diffs[2].Target)
+	require.Contains(t, diffs[2].String(), "not found in Nydus image")
+	require.Equal(t, "/file5", diffs[3].Path)
+	require.Nil(t, diffs[3].Source)
+	require.Contains(t, diffs[3].String(), "not found in source image")
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/backend"
+)
+
+var backendTypes = []string{"oss", "s3"}
+
+// Required configuration keys for OSS storage backend.
+var ossRequiredKeys = []string{"endpoint", "bucket_name", "access_key_id", "access_key_secret"}
+
+func isValidBackendType(typ string) bool {
+	for i := range backendTypes {
+		if backendTypes[i] == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBackend checks the storage backend configuration, the Nydus blobs
+// will be uploaded to the backend instead of target registry if specified,
+// so a misconfigured backend must not be ignored silently.
+func validateBackend(backendType, backendConfig string) error {
+	if backendType == "" {
+		if strings.TrimSpace(backendConfig) != "" {
+			return fmt.Errorf("backend type is empty but backend config is specified")
+		}
+		return nil
+	}
+
+	if !isValidBackendType(backendType) {
+		return fmt.Errorf("invalid backend type %s, should be one of %v", backendType, backendTypes)
+	}
+	if strings.TrimSpace(backendConfig) == "" {
+		return fmt.Errorf("backend config is empty for backend type %s", backendType)
+	}
+
+	switch backendType {
+	case "oss":
+		var cfg map[string]string
+		if err := json.Unmarshal([]byte(backendConfig), &cfg); err != nil {
+			return errors.Wrap(err, "parse OSS backend config")
+		}
+		for _, key := range ossRequiredKeys {
+			if strings.TrimSpace(cfg[key]) == "" {
+				return fmt.Errorf("invalid OSS backend config: missing '%s'", key)
+			}
+		}
+	case "s3":
+		var cfg backend.S3Config
+		if err := json.Unmarshal([]byte(backendConfig), &cfg); err != nil {
+			return errors.Wrap(err, "parse S3 backend config")
+		}
+		if cfg.BucketName == "" || cfg.Region == "" {
+			return fmt.Errorf("invalid S3 backend config: missing 'bucket_name' or 'region'")
+		}
+		// Both of access keys should be empty to use the credentials from
+		// environment, for example IAM role.
+		if (cfg.AccessKeyID == "") != (cfg.AccessKeySecret == "") {
+			return fmt.Errorf("invalid S3 backend config: 'access_key_id' and 'access_key_secret' should be specified together")
+		}
+	}
+
+	return nil
+}
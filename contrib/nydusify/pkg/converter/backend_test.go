@@ -0,0 +1,54 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateBackend(t *testing.T) {
+	ossConfigJSON := `
+	{
+		"bucket_name": "test",
+		"endpoint": "region.oss.com",
+		"access_key_id": "testAK",
+		"access_key_secret": "testSK",
+		"object_prefix": "blob"
+	}`
+	require.NoError(t, validateBackend("", ""))
+	require.NoError(t, validateBackend("oss", ossConfigJSON))
+
+	// Failure situation
+	require.Error(t, validateBackend("", ossConfigJSON))
+	require.Error(t, validateBackend("oss", ""))
+	require.Error(t, validateBackend("unknown", ossConfigJSON))
+	require.Error(t, validateBackend("oss", "invalid json"))
+
+	err := validateBackend("oss", `{"bucket_name": "test", "endpoint": "region.oss.com"}`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "missing 'access_key_id'")
+}
+
+func TestValidateS3Backend(t *testing.T) {
+	s3ConfigJSON := `
+	{
+		"bucket_name": "test",
+		"endpoint": "s3.amazonaws.com",
+		"access_key_id": "testAK",
+		"access_key_secret": "testSK",
+		"object_prefix": "blob",
+		"scheme": "https",
+		"region": "region1"
+	}`
+	require.NoError(t, validateBackend("s3", s3ConfigJSON))
+	// Use the credentials from environment.
+	require.NoError(t, validateBackend("s3", `{"bucket_name": "test", "region": "region1"}`))
+
+	// Failure situation
+	require.Error(t, validateBackend("s3", `{"bucket_name": "test"}`))
+	require.Error(t, validateBackend("s3", `{"bucket_name": "test", "region": "region1", "access_key_id": "testAK"}`))
+}
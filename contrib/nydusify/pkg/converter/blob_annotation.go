@@ -0,0 +1,204 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// The annotations of the nydus blob layers converted with
+// Opt.BlobAnnotations, the values are the same as reported by Inspect.
+const (
+	// AnnotationBlobSource is the digest of source layer the blob is built
+	// from, or the comma separated digests of identical source layers. It's
+	// absent for the blob of chunk dict.
+	AnnotationBlobSource = "io.nydus.blob.source.digest"
+	// AnnotationBlobChunkCount is the number of chunks in blob.
+	AnnotationBlobChunkCount = "io.nydus.blob.chunk.count"
+	// AnnotationBlobUncompressedSize is the size of decompressed blob data.
+	AnnotationBlobUncompressedSize = "io.nydus.blob.uncompressed.size"
+)
+
+// unpackManifestBootstrap unpacks the bootstrap layer of manifest into a
+// temporary directory under opt.WorkDir, it returns the bootstrap path and
+// the function removing the directory.
+func unpackManifestBootstrap(ctx context.Context, cs content.Store, opt Opt, manifest ocispec.Manifest) (string, func(), error) {
+	var bootstrapDesc *ocispec.Descriptor
+	for idx := range manifest.Layers {
+		if nydusify.IsNydusBootstrap(manifest.Layers[idx]) {
+			bootstrapDesc = &manifest.Layers[idx]
+		}
+	}
+	if bootstrapDesc == nil {
+		return "", nil, errors.New("bootstrap layer not found")
+	}
+
+	dir, err := os.MkdirTemp(opt.WorkDir, "nydusify-blobs-")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "create bootstrap directory")
+	}
+	cleanup := func() {
+		os.RemoveAll(dir)
+	}
+	ra, err := cs.ReaderAt(ctx, *bootstrapDesc)
+	if err != nil {
+		cleanup()
+		return "", nil, errors.Wrap(err, "open bootstrap layer")
+	}
+	defer ra.Close()
+	bootstrapPath := filepath.Join(dir, "bootstrap")
+	if err := utils.UnpackFile(content.NewReader(ra), utils.BootstrapFileNameInLayer, bootstrapPath); err != nil {
+		cleanup()
+		return "", nil, errors.Wrap(err, "unpack bootstrap layer")
+	}
+	return bootstrapPath, cleanup, nil
+}
+
+// bootstrapBlobs returns the blobs referenced by bootstrap in the order of
+// its blob table.
+func bootstrapBlobs(ctx context.Context, opt Opt, bootstrapPath string) ([]BootstrapBlob, error) {
+	builder := opt.NydusImagePath
+	if builder == "" {
+		builder = "nydus-image"
+	}
+	blobs := []BootstrapBlob{}
+	if err := requestBootstrap(ctx, builder, bootstrapPath, "blobs", &blobs); err != nil {
+		return nil, errors.Wrap(err, "get blobs of bootstrap")
+	}
+	return blobs, nil
+}
+
+// rewriteManifests writes the target image with each manifest rewritten by
+// rewrite, the source manifests merged into target index with MergePlatform
+// are kept as they are.
+func rewriteManifests(ctx context.Context, cs content.Store, sourceDesc, targetDesc ocispec.Descriptor, rewrite func(desc ocispec.Descriptor) (*ocispec.Descriptor, error)) (*ocispec.Descriptor, error) {
+	manifests := map[digest.Digest]bool{sourceDesc.Digest: true}
+	if images.IsIndexType(sourceDesc.MediaType) {
+		var index ocispec.Index
+		if err := readJSON(ctx, cs, sourceDesc, &index); err != nil {
+			return nil, errors.Wrap(err, "read source index")
+		}
+		for _, manifest := range index.Manifests {
+			manifests[manifest.Digest] = true
+		}
+	}
+
+	if !images.IsIndexType(targetDesc.MediaType) {
+		if manifests[targetDesc.Digest] {
+			return &targetDesc, nil
+		}
+		return rewrite(targetDesc)
+	}
+
+	var index ocispec.Index
+	if err := readJSON(ctx, cs, targetDesc, &index); err != nil {
+		return nil, errors.Wrap(err, "read target index")
+	}
+	for idx, manifest := range index.Manifests {
+		if manifests[manifest.Digest] {
+			continue
+		}
+		desc, err := rewrite(manifest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "rewrite manifest %s", manifest.Digest)
+		}
+		index.Manifests[idx] = *desc
+	}
+
+	desc, err := writeJSON(ctx, cs, targetDesc.MediaType, index)
+	if err != nil {
+		return nil, errors.Wrap(err, "write target index")
+	}
+	desc.Annotations = targetDesc.Annotations
+
+	return desc, nil
+}
+
+// annotateManifestBlobs writes the target manifest with the annotations of
+// nydus blob layers, sources maps each blob to the source layers it's built
+// from.
+func annotateManifestBlobs(ctx context.Context, cs content.Store, opt Opt, targetDesc ocispec.Descriptor, sources map[digest.Digest][]string) (*ocispec.Descriptor, error) {
+	var manifest ocispec.Manifest
+	if err := readJSON(ctx, cs, targetDesc, &manifest); err != nil {
+		return nil, errors.Wrap(err, "read target manifest")
+	}
+	bootstrapPath, cleanup, err := unpackManifestBootstrap(ctx, cs, opt, manifest)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	blobList, err := bootstrapBlobs(ctx, opt, bootstrapPath)
+	if err != nil {
+		return nil, err
+	}
+	blobs := map[string]BootstrapBlob{}
+	for _, blob := range blobList {
+		blobs[blob.ID] = blob
+	}
+
+	for idx, layer := range manifest.Layers {
+		if layer.Annotations[utils.LayerAnnotationNydusBlob] != "true" {
+			continue
+		}
+		blob, ok := blobs[layer.Digest.Hex()]
+		if !ok {
+			return nil, errors.Errorf("blob %s isn't referenced by bootstrap", layer.Digest)
+		}
+		annotations := map[string]string{}
+		for key, value := range layer.Annotations {
+			annotations[key] = value
+		}
+		annotations[AnnotationBlobChunkCount] = strconv.FormatUint(uint64(blob.ChunkCount), 10)
+		annotations[AnnotationBlobUncompressedSize] = strconv.FormatUint(blob.DecompressedSize, 10)
+		if layers := sources[layer.Digest]; len(layers) > 0 {
+			annotations[AnnotationBlobSource] = strings.Join(layers, ",")
+		}
+		manifest.Layers[idx].Annotations = annotations
+	}
+
+	manifestDesc, err := writeJSON(ctx, cs, targetDesc.MediaType, manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "write target manifest")
+	}
+	manifestDesc.Platform = targetDesc.Platform
+	manifestDesc.Annotations = targetDesc.Annotations
+
+	return manifestDesc, nil
+}
+
+// annotateBlobs annotates the nydus blob layers of all the manifests in
+// target image with the source layer digest, chunk count and uncompressed
+// size.
+func annotateBlobs(ctx context.Context, cs *store, opt Opt, sourceDesc, targetDesc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	layerMap, err := makeLayerMap(ctx, cs, sourceDesc)
+	if err != nil {
+		return nil, err
+	}
+	sources := map[digest.Digest][]string{}
+	for layer, blob := range layerMap {
+		sources[blob] = append(sources[blob], layer.String())
+	}
+	for _, layers := range sources {
+		sort.Strings(layers)
+	}
+
+	return rewriteManifests(ctx, cs, sourceDesc, targetDesc, func(desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		return annotateManifestBlobs(ctx, cs, opt, desc, sources)
+	})
+}
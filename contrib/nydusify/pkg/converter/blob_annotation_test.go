@@ -0,0 +1,158 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// fakeBlobsBuilder makes a builder script answering `nydus-image inspect
+// --request blobs` with the blobs json.
+func fakeBlobsBuilder(t *testing.T, blobs []BootstrapBlob) string {
+	data, err := json.Marshal(blobs)
+	require.NoError(t, err)
+	builderPath := filepath.Join(t.TempDir(), "nydus-image")
+	script := fmt.Sprintf(`#!/bin/sh
+if [ "$1" = "inspect" ] && [ "$4" = "blobs" ]; then
+	printf '%%s' '%s'
+	exit 0
+fi
+exit 1
+`, data)
+	require.NoError(t, os.WriteFile(builderPath, []byte(script), 0755))
+	return builderPath
+}
+
+func makeBootstrapLayer(t *testing.T) []byte {
+	sb := makeSuperBlock("6", 0x100000, 1)
+	buf := bytes.Buffer{}
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: utils.BootstrapFileNameInLayer, Mode: 0644, Size: int64(len(sb))}))
+	_, err := tw.Write(sb)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func TestAnnotateBlobs(t *testing.T) {
+	base, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	cs := newStore(base, 1, nil)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	marshal := func(v interface{}) []byte {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return data
+	}
+
+	// The blobs are built from lower and upper layers by layer converter.
+	lower := writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, []byte("lower"), true)
+	upper := writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, []byte("upper"), true)
+	convert := func(source digest.Digest, data string) digest.Digest {
+		writer, err := content.OpenWriter(ctx, cs, content.WithRef(layerConvertRefPrefix+source.String()))
+		require.NoError(t, err)
+		defer writer.Close()
+		_, err = writer.Write([]byte(data))
+		require.NoError(t, err)
+		require.NoError(t, writer.Commit(ctx, int64(len(data)), ""))
+		return writer.Digest()
+	}
+	lowerBlob := convert(lower.Digest, "lower blob")
+	upperBlob := convert(upper.Digest, "upper blob")
+	// The blob of chunk dict has no source layer.
+	dictBlob := digest.FromString("dict blob")
+
+	config := writeContent(t, cs, ocispec.MediaTypeImageConfig, []byte("{}"), true)
+	sourceDesc := writeContent(t, cs, ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{lower, upper},
+	}), true)
+
+	blobLayer := func(blob digest.Digest) ocispec.Descriptor {
+		return ocispec.Descriptor{
+			MediaType:   utils.MediaTypeNydusBlob,
+			Digest:      blob,
+			Size:        10,
+			Annotations: map[string]string{utils.LayerAnnotationNydusBlob: "true"},
+		}
+	}
+	bootstrapLayer := writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, makeBootstrapLayer(t), true)
+	bootstrapLayer.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+	targetDesc := writeContent(t, cs, ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{blobLayer(dictBlob), blobLayer(lowerBlob), blobLayer(upperBlob), bootstrapLayer},
+	}), true)
+	targetDesc.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+
+	opt := Opt{
+		WorkDir: t.TempDir(),
+		NydusImagePath: fakeBlobsBuilder(t, []BootstrapBlob{
+			{ID: dictBlob.Hex(), CompressedSize: 10, DecompressedSize: 30, ChunkCount: 3},
+			{ID: lowerBlob.Hex(), CompressedSize: 10, DecompressedSize: 20, ChunkCount: 2},
+			{ID: upperBlob.Hex(), CompressedSize: 10, DecompressedSize: 40, ChunkCount: 4},
+		}),
+	}
+	desc, err := annotateBlobs(ctx, cs, opt, sourceDesc, targetDesc)
+	require.NoError(t, err)
+	require.Equal(t, targetDesc.Platform, desc.Platform)
+
+	var manifest ocispec.Manifest
+	require.NoError(t, readJSON(ctx, cs, *desc, &manifest))
+	require.Equal(t, config, manifest.Config)
+	require.Len(t, manifest.Layers, 4)
+	require.Equal(t, map[string]string{
+		utils.LayerAnnotationNydusBlob: "true",
+		AnnotationBlobChunkCount:       "3",
+		AnnotationBlobUncompressedSize: "30",
+	}, manifest.Layers[0].Annotations)
+	require.Equal(t, map[string]string{
+		utils.LayerAnnotationNydusBlob: "true",
+		AnnotationBlobSource:           lower.Digest.String(),
+		AnnotationBlobChunkCount:       "2",
+		AnnotationBlobUncompressedSize: "20",
+	}, manifest.Layers[1].Annotations)
+	require.Equal(t, map[string]string{
+		utils.LayerAnnotationNydusBlob: "true",
+		AnnotationBlobSource:           upper.Digest.String(),
+		AnnotationBlobChunkCount:       "4",
+		AnnotationBlobUncompressedSize: "40",
+	}, manifest.Layers[2].Annotations)
+	require.Equal(t, bootstrapLayer, manifest.Layers[3])
+
+	// The annotations are stable.
+	again, err := annotateBlobs(ctx, cs, opt, sourceDesc, targetDesc)
+	require.NoError(t, err)
+	require.Equal(t, desc.Digest, again.Digest)
+
+	// Failure situation
+	opt.NydusImagePath = fakeBlobsBuilder(t, []BootstrapBlob{{ID: lowerBlob.Hex()}})
+	_, err = annotateBlobs(ctx, cs, opt, sourceDesc, targetDesc)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "isn't referenced by bootstrap")
+}
@@ -0,0 +1,40 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+// newBlobFilter calls the filter once for each blob built in conversion, the
+// blobs reused from chunk dict or build cache are skipped, and the blobs
+// pushed again with another image aren't filtered twice.
+func newBlobFilter(cs *store, pvd *provider.Provider, filter func(ctx context.Context, blobPath string) error) provider.BlobFilter {
+	var mutex sync.Mutex
+	filtered := map[digest.Digest]bool{}
+	return func(ctx context.Context, desc ocispec.Descriptor) error {
+		if !cs.isBuilt(desc.Digest) {
+			return nil
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if filtered[desc.Digest] {
+			return nil
+		}
+		if err := filter(ctx, pvd.BlobPath(desc.Digest)); err != nil {
+			return err
+		}
+		filtered[desc.Digest] = true
+
+		return nil
+	}
+}
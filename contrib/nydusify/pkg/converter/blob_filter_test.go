@@ -0,0 +1,75 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestBlobFilter(t *testing.T) {
+	pvd, err := provider.New(t.TempDir(), nil, 0, "", platforms.All, 0)
+	require.NoError(t, err)
+	cs := newStore(pvd.ContentStore(), 1, nil)
+	pvd.SetContentStore(cs)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	// Two blobs are built, and the other one is reused from chunk dict.
+	blob1 := writeContent(t, cs, utils.MediaTypeNydusBlob, []byte("blob-1"), false)
+	blob2 := writeContent(t, cs, utils.MediaTypeNydusBlob, []byte("blob-2"), false)
+	reused := writeContent(t, cs, utils.MediaTypeNydusBlob, []byte("reused"), true)
+	bootstrap := writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, []byte("bootstrap"), false)
+	config := writeContent(t, cs, ocispec.MediaTypeImageConfig, []byte("{}"), false)
+	manifestBytes, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{reused, blob1, blob2, bootstrap},
+	})
+	require.NoError(t, err)
+	manifest := writeContent(t, cs, ocispec.MediaTypeImageManifest, manifestBytes, false)
+
+	filtered := []string{}
+	pvd.SetBlobFilter(newBlobFilter(cs, pvd, func(_ context.Context, blobPath string) error {
+		data, err := os.ReadFile(blobPath)
+		require.NoError(t, err)
+		filtered = append(filtered, string(data))
+		return nil
+	}))
+
+	// The filter is invoked once per built blob before pushing.
+	target := "localhost/filter:nydus"
+	pvd.UseLayout(target, t.TempDir())
+	require.NoError(t, pvd.Push(ctx, manifest, target))
+	require.Equal(t, []string{"blob-1", "blob-2"}, filtered)
+	require.NoError(t, pvd.Push(ctx, manifest, target))
+	require.Len(t, filtered, 2)
+
+	// Failure situation
+	pvd.SetBlobFilter(newBlobFilter(cs, pvd, func(context.Context, string) error {
+		return fmt.Errorf("malware found")
+	}))
+	target = "localhost/filter:failed"
+	dir := t.TempDir()
+	pvd.UseLayout(target, dir)
+	err = pvd.Push(ctx, manifest, target)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "malware found")
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
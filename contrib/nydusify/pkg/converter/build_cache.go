@@ -0,0 +1,188 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/content"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+const buildCacheTempPrefix = ".tmp-"
+
+// buildParams are the options deciding the nydus blob layer built from a
+// source layer, the cached blob is only reused by the conversion with the
+// same parameters.
+type buildParams struct {
+	BuilderVersion   string   `json:"builder_version"`
+	FsVersion        string   `json:"fs_version"`
+	Compressor       string   `json:"compressor"`
+	ChunkSize        string   `json:"chunk_size"`
+	BatchSize        string   `json:"batch_size"`
+	FsAlignChunk     bool     `json:"fs_align_chunk"`
+	PrefetchPatterns string   `json:"prefetch_patterns"`
+	ChunkDictRef     string   `json:"chunk_dict_ref"`
+	OCIRef           bool     `json:"oci_ref"`
+	Reproducible     bool     `json:"reproducible"`
+	OwnerOverride    *Owner   `json:"owner_override"`
+	IncludePatterns  []string `json:"include_patterns"`
+	ExcludePatterns  []string `json:"exclude_patterns"`
+}
+
+// buildCacheRecord is the nydus blob layer built from a source layer.
+type buildCacheRecord struct {
+	Blob digest.Digest `json:"blob"`
+	Size int64         `json:"size"`
+}
+
+// buildCache caches the nydus blob layers, including the blob data and chunk
+// meta, built from source layers in local directory, so that the builder
+// isn't run again for the source layer converted before with the same build
+// parameters. The records are keyed by the digest of source layer and build
+// parameters, the blobs are stored by digest.
+type buildCache struct {
+	dir    string
+	params []byte
+	blobs  *provider.BlobCache
+}
+
+// marshalBuildParams returns the build parameters of opt in JSON.
+func marshalBuildParams(opt Opt, version *BuilderVersion) ([]byte, error) {
+	params := buildParams{
+		FsVersion:        opt.FsVersion,
+		Compressor:       opt.Compressor,
+		ChunkSize:        opt.ChunkSize,
+		BatchSize:        opt.BatchSize,
+		FsAlignChunk:     opt.FsAlignChunk,
+		PrefetchPatterns: opt.PrefetchPatterns,
+		ChunkDictRef:     opt.ChunkDictRef,
+		OCIRef:           opt.OCIRef,
+		Reproducible:     opt.Reproducible,
+		OwnerOverride:    opt.OwnerOverride,
+		IncludePatterns:  opt.IncludePatterns,
+		ExcludePatterns:  opt.ExcludePatterns,
+	}
+	if opt.ChunkSize != "" {
+		params.ChunkSize = formatChunkSize(opt.ChunkSize)
+	}
+	if version != nil {
+		params.BuilderVersion = version.String()
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal build parameters")
+	}
+	return data, nil
+}
+
+func newBuildCache(dir string, opt Opt, version *BuilderVersion) (*buildCache, error) {
+	data, err := marshalBuildParams(opt, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "records"), 0755); err != nil {
+		return nil, errors.Wrap(err, "create build cache directory")
+	}
+	blobs, err := provider.NewBlobCache(filepath.Join(dir, "blobs"), 0)
+	if err != nil {
+		return nil, err
+	}
+	return &buildCache{
+		dir:    dir,
+		params: data,
+		blobs:  blobs,
+	}, nil
+}
+
+// recordPath returns the path of record for source layer, any change of the
+// build parameters makes a different key.
+func (cache *buildCache) recordPath(source digest.Digest) string {
+	key := digest.FromBytes(append([]byte(source.String()+"\n"), cache.params...))
+	return filepath.Join(cache.dir, "records", key.Hex())
+}
+
+// load writes the cached nydus blob layer built from source layer into store,
+// it returns false if the layer isn't cached.
+func (cache *buildCache) load(ctx context.Context, store content.Store, source digest.Digest) (digest.Digest, bool) {
+	data, err := os.ReadFile(cache.recordPath(source))
+	if err != nil {
+		return "", false
+	}
+	var record buildCacheRecord
+	if err := json.Unmarshal(data, &record); err != nil || record.Blob.Validate() != nil {
+		return "", false
+	}
+	desc := ocispec.Descriptor{
+		MediaType: nydusify.MediaTypeNydusBlob,
+		Digest:    record.Blob,
+		Size:      record.Size,
+	}
+	if _, err := store.Info(ctx, desc.Digest); err != nil && !cache.blobs.Load(ctx, store, desc) {
+		return "", false
+	}
+	return record.Blob, true
+}
+
+// save copies the nydus blob layer built from source layer from store into
+// cache.
+func (cache *buildCache) save(ctx context.Context, store content.Store, source, blob digest.Digest) error {
+	info, err := store.Info(ctx, blob)
+	if err != nil {
+		return errors.Wrapf(err, "get blob info %s", blob)
+	}
+	desc := ocispec.Descriptor{
+		MediaType: nydusify.MediaTypeNydusBlob,
+		Digest:    blob,
+		Size:      info.Size,
+	}
+	if err := cache.blobs.Save(ctx, store, desc); err != nil {
+		return errors.Wrapf(err, "save blob %s", blob)
+	}
+
+	data, err := json.Marshal(buildCacheRecord{Blob: blob, Size: info.Size})
+	if err != nil {
+		return err
+	}
+	recordPath := cache.recordPath(source)
+	tmp, err := os.CreateTemp(filepath.Dir(recordPath), buildCacheTempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), recordPath)
+}
+
+// saveBuildCache saves the nydus blob layers built by the conversion into
+// cache, the layers reused from caches are skipped.
+func saveBuildCache(ctx context.Context, cs *store, layerMap map[digest.Digest]digest.Digest) error {
+	for source, blob := range layerMap {
+		if !cs.isBuilt(blob) {
+			continue
+		}
+		if err := cs.buildCache.save(ctx, cs.Store, source, blob); err != nil {
+			return errors.Wrapf(err, "save layer %s", source)
+		}
+		logrus.Debugf("saved blob %s built from layer %s into build cache", blob, source)
+	}
+	return nil
+}
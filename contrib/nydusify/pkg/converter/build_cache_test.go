@@ -0,0 +1,101 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/namespaces"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildCache(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	dir := t.TempDir()
+	opt := Opt{FsVersion: "6", Compressor: "zstd", ChunkSize: "0x100000"}
+	version, err := ParseBuilderVersion("v2.2.0")
+	require.NoError(t, err)
+	cache, err := newBuildCache(dir, opt, version)
+	require.NoError(t, err)
+
+	base, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	source := writeContent(t, base, ocispec.MediaTypeImageLayerGzip, []byte("layer"), true)
+	blob := writeContent(t, base, nydusify.MediaTypeNydusBlob, []byte("blob"), false)
+
+	_, ok := cache.load(ctx, base, source.Digest)
+	require.False(t, ok)
+	require.NoError(t, cache.save(ctx, base, source.Digest, blob.Digest))
+
+	// The cached blob is written into the store of another conversion.
+	other, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	cached, ok := cache.load(ctx, other, source.Digest)
+	require.True(t, ok)
+	require.Equal(t, blob.Digest, cached)
+	data, err := content.ReadBlob(ctx, other, blob)
+	require.NoError(t, err)
+	require.Equal(t, []byte("blob"), data)
+
+	// The chunk size in human readable format is the same parameter.
+	cache, err = newBuildCache(dir, Opt{FsVersion: "6", Compressor: "zstd", ChunkSize: "1MiB"}, version)
+	require.NoError(t, err)
+	_, ok = cache.load(ctx, other, source.Digest)
+	require.True(t, ok)
+
+	// Any change of the build parameters misses the cache.
+	for _, changed := range []Opt{
+		{FsVersion: "6", Compressor: "lz4_block", ChunkSize: "0x100000"},
+		{FsVersion: "6", Compressor: "zstd", ChunkSize: "0x10000"},
+		{FsVersion: "5", Compressor: "zstd", ChunkSize: "0x100000"},
+	} {
+		cache, err := newBuildCache(dir, changed, version)
+		require.NoError(t, err)
+		_, ok := cache.load(ctx, other, source.Digest)
+		require.False(t, ok)
+	}
+	newer, err := ParseBuilderVersion("v2.3.0")
+	require.NoError(t, err)
+	cache, err = newBuildCache(dir, opt, newer)
+	require.NoError(t, err)
+	_, ok = cache.load(ctx, other, source.Digest)
+	require.False(t, ok)
+}
+
+func TestStoreInfoBuildCache(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	cache, err := newBuildCache(t.TempDir(), Opt{}, nil)
+	require.NoError(t, err)
+
+	base, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	source := writeContent(t, base, ocispec.MediaTypeImageLayerGzip, []byte("layer"), true)
+	blob := writeContent(t, base, nydusify.MediaTypeNydusBlob, []byte("blob"), false)
+	require.NoError(t, cache.save(ctx, base, source.Digest, blob.Digest))
+
+	other, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	writeContent(t, other, ocispec.MediaTypeImageLayerGzip, []byte("layer"), true)
+	cs := newStore(other, 1, nil)
+	cs.buildCache = cache
+
+	// The layer converter skips building the layer with target digest label.
+	info, err := cs.Info(ctx, source.Digest)
+	require.NoError(t, err)
+	require.Equal(t, blob.Digest.String(), info.Labels[nydusify.LayerAnnotationNydusTargetDigest])
+	require.Equal(t, map[digest.Digest]digest.Digest{source.Digest: blob.Digest}, cs.converted)
+	require.False(t, cs.isBuilt(blob.Digest))
+	_, err = other.Info(ctx, blob.Digest)
+	require.NoError(t, err)
+
+	// The blob reused from cache isn't saved again.
+	require.NoError(t, saveBuildCache(ctx, cs, cs.converted))
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/containerd/containerd/archive"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// writeLayoutBlob writes the content of reader into the blobs of OCI image
+// layout directory, and returns its descriptor.
+func writeLayoutBlob(dir, mediaType string, reader io.Reader) (*ocispec.Descriptor, error) {
+	blobDir := filepath.Join(dir, ocispec.ImageBlobsDir, digest.Canonical.String())
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create blob directory")
+	}
+	file, err := os.CreateTemp(blobDir, ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(file, digester.Hash()), reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digester.Digest(),
+		Size:      size,
+	}
+	if err := os.Rename(file.Name(), filepath.Join(blobDir, desc.Digest.Hex())); err != nil {
+		return nil, err
+	}
+	return &desc, nil
+}
+
+func writeLayoutJSON(dir, mediaType string, v interface{}) (*ocispec.Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return writeLayoutBlob(dir, mediaType, bytes.NewReader(data))
+}
+
+// packRootfs packs the rootfs directory as the single uncompressed tar layer
+// of the image in OCI image layout directory.
+func packRootfs(ctx context.Context, rootfs, dir string) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(archive.WriteDiff(ctx, writer, "", rootfs))
+	}()
+	defer reader.Close()
+	layerDesc, err := writeLayoutBlob(dir, ocispec.MediaTypeImageLayer, reader)
+	if err != nil {
+		return errors.Wrapf(err, "pack rootfs %s", rootfs)
+	}
+
+	configDesc, err := writeLayoutJSON(dir, ocispec.MediaTypeImageConfig, ocispec.Image{
+		Platform: ocispec.Platform{
+			OS:           "linux",
+			Architecture: runtime.GOARCH,
+		},
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{layerDesc.Digest},
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "write image config")
+	}
+	manifestDesc, err := writeLayoutJSON(dir, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *configDesc,
+		Layers:    []ocispec.Descriptor{*layerDesc},
+	})
+	if err != nil {
+		return errors.Wrap(err, "write image manifest")
+	}
+
+	indexBytes, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{*manifestDesc},
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ocispec.ImageIndexFile), indexBytes, 0644); err != nil {
+		return errors.Wrap(err, "write oci index file")
+	}
+	layoutBytes, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(os.WriteFile(filepath.Join(dir, ocispec.ImageLayoutFile), layoutBytes, 0644), "write oci layout file")
+}
+
+// BuildFromDir builds a single layer Nydus image from the rootfs directory,
+// like the unpacked rootfs of a running container, and pushes it to
+// opt.Target or writes it into opt.TargetPath. The rootfs is packed as the
+// image in an OCI image layout under opt.WorkDir, which is converted with
+// all the other options of opt like PrefetchPatterns and ExcludePatterns,
+// so opt.Source and opt.SourcePath must be empty.
+func BuildFromDir(ctx context.Context, rootfs string, opt Opt) (*Result, error) {
+	if opt.Source != "" || opt.SourcePath != "" {
+		return nil, fmt.Errorf("source reference and source path can't be specified with rootfs directory")
+	}
+	info, err := os.Stat(rootfs)
+	if err != nil {
+		return nil, errors.Wrap(err, "stat rootfs directory")
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("rootfs %s isn't a directory", rootfs)
+	}
+
+	workDir := opt.WorkDir
+	if workDir == "" {
+		workDir = os.TempDir()
+	}
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "prepare work directory")
+	}
+	layoutDir, err := os.MkdirTemp(workDir, "nydusify-rootfs-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create rootfs layout directory")
+	}
+	defer os.RemoveAll(layoutDir)
+
+	if err := packRootfs(ctx, rootfs, layoutDir); err != nil {
+		return nil, err
+	}
+	opt.SourcePath = layoutDir
+	return Convert(ctx, opt)
+}
@@ -0,0 +1,105 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func readLayoutBlob(t *testing.T, dir string, dgst digest.Digest, v interface{}) {
+	data, err := os.ReadFile(filepath.Join(dir, ocispec.ImageBlobsDir, dgst.Algorithm().String(), dgst.Hex()))
+	require.NoError(t, err)
+	require.Equal(t, dgst, digest.FromBytes(data))
+	require.NoError(t, json.Unmarshal(data, v))
+}
+
+func TestPackRootfs(t *testing.T) {
+	rootfs := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "usr/bin"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "usr/bin/sh"), []byte("shell"), 0755))
+	require.NoError(t, os.Symlink("usr/bin", filepath.Join(rootfs, "bin")))
+
+	dir := t.TempDir()
+	require.NoError(t, packRootfs(context.Background(), rootfs, dir))
+
+	layoutBytes, err := os.ReadFile(filepath.Join(dir, ocispec.ImageLayoutFile))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"imageLayoutVersion":"1.0.0"}`, string(layoutBytes))
+
+	index := ocispec.Index{}
+	indexBytes, err := os.ReadFile(filepath.Join(dir, ocispec.ImageIndexFile))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(indexBytes, &index))
+	require.Len(t, index.Manifests, 1)
+	require.Equal(t, ocispec.MediaTypeImageManifest, index.Manifests[0].MediaType)
+
+	manifest := ocispec.Manifest{}
+	readLayoutBlob(t, dir, index.Manifests[0].Digest, &manifest)
+	require.Len(t, manifest.Layers, 1)
+	layer := manifest.Layers[0]
+	require.Equal(t, ocispec.MediaTypeImageLayer, layer.MediaType)
+
+	config := ocispec.Image{}
+	readLayoutBlob(t, dir, manifest.Config.Digest, &config)
+	require.Equal(t, "linux", config.OS)
+	require.Equal(t, []digest.Digest{layer.Digest}, config.RootFS.DiffIDs)
+
+	file, err := os.Open(filepath.Join(dir, ocispec.ImageBlobsDir, "sha256", layer.Digest.Hex()))
+	require.NoError(t, err)
+	defer file.Close()
+	info, err := file.Stat()
+	require.NoError(t, err)
+	require.Equal(t, layer.Size, info.Size())
+	names := []string{}
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		if hdr.Name == "bin" {
+			require.Equal(t, "usr/bin", hdr.Linkname)
+		}
+	}
+	sort.Strings(names)
+	require.Equal(t, []string{"bin", "usr/", "usr/bin/", "usr/bin/sh"}, names)
+
+	// No temporary blob is left.
+	entries, err := os.ReadDir(filepath.Join(dir, ocispec.ImageBlobsDir, "sha256"))
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+}
+
+func TestBuildFromDirInvalid(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	_, err := BuildFromDir(ctx, dir, Opt{SourcePath: dir, TargetPath: filepath.Join(dir, "target")})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "can't be specified with rootfs directory")
+
+	_, err = BuildFromDir(ctx, filepath.Join(dir, "missing"), Opt{TargetPath: filepath.Join(dir, "target")})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "stat rootfs directory")
+
+	filePath := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(filePath, []byte("file"), 0644))
+	_, err = BuildFromDir(ctx, filePath, Opt{TargetPath: filepath.Join(dir, "target")})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "isn't a directory")
+}
@@ -0,0 +1,200 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/fifo"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// BuildResult is the Nydus blob and bootstrap built by BuildFromTar.
+type BuildResult struct {
+	// Dir is the directory created under Opt.WorkDir holding the blob and
+	// bootstrap, which is owned by the caller.
+	Dir           string
+	BootstrapPath string
+	// BlobPath is empty if the tar stream has no file data.
+	BlobPath   string
+	BlobDigest digest.Digest
+	BlobSize   int64
+}
+
+// buildTarArgs returns the arguments of builder creating the Nydus blob and
+// bootstrap from the tar stream of sourcePath.
+func buildTarArgs(opt Opt, sourcePath, blobPath, bootstrapPath string) []string {
+	fsVersion := opt.FsVersion
+	if fsVersion == "" {
+		fsVersion = "6"
+	}
+	args := []string{
+		"create",
+		"--log-level", "warn",
+		"--type", "tar-rafs",
+		"--whiteout-spec", "oci",
+		"--fs-version", fsVersion,
+		"--blob", blobPath,
+		"--bootstrap", bootstrapPath,
+	}
+	if opt.PrefetchPatterns != "" {
+		args = append(args, "--prefetch-policy", "fs")
+	}
+	if opt.Compressor != "" {
+		args = append(args, "--compressor", opt.Compressor)
+	}
+	if opt.FsAlignChunk {
+		args = append(args, "--aligned-chunk")
+	}
+	if opt.ChunkSize != "" {
+		args = append(args, "--chunk-size", formatChunkSize(opt.ChunkSize))
+	}
+	if opt.BatchSize != "" {
+		args = append(args, "--batch-size", opt.BatchSize)
+	}
+	return append(args, sourcePath)
+}
+
+// BuildFromTar builds a Nydus blob and bootstrap from the uncompressed tar
+// stream of r, which is fed to the builder through a fifo rather than
+// written to disk. Only the builder options of opt are used, like
+// NydusImagePath, WorkDir, FsVersion, Compressor, ChunkSize, BatchSize,
+// FsAlignChunk, PrefetchPatterns and Timeout.
+//
+// The builder reads the fifo at its own pace, a slow builder just blocks the
+// reads of r. The builder is killed if reading r fails, so that nothing is
+// built from a truncated stream, and the fifo is closed once the builder
+// exits, so that a failed builder never blocks the writes.
+func BuildFromTar(ctx context.Context, r io.Reader, opt Opt) (*BuildResult, error) {
+	if err := validateOpt(opt); err != nil {
+		return nil, err
+	}
+	if opt.WorkDir == "" {
+		opt.WorkDir = os.TempDir()
+	}
+	if err := os.MkdirAll(opt.WorkDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "prepare work directory")
+	}
+	dir, err := os.MkdirTemp(opt.WorkDir, "nydusify-build-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create build directory")
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	result := &BuildResult{
+		Dir:           dir,
+		BootstrapPath: filepath.Join(dir, "bootstrap"),
+		BlobPath:      filepath.Join(dir, "blob"),
+	}
+	if err = buildTar(ctx, r, opt, filepath.Join(dir, "layer.tar"), result.BlobPath, result.BootstrapPath); err != nil {
+		return nil, err
+	}
+
+	var blob *os.File
+	blob, err = os.Open(result.BlobPath)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		result.BlobPath = ""
+		return result, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "open blob")
+	}
+	defer blob.Close()
+	digester := digest.Canonical.Digester()
+	if result.BlobSize, err = io.Copy(digester.Hash(), blob); err != nil {
+		return nil, errors.Wrap(err, "calculate blob digest")
+	}
+	result.BlobDigest = digester.Digest()
+
+	return result, nil
+}
+
+// buildTar runs the builder reading the tar stream of r from the fifo of
+// sourcePath.
+func buildTar(ctx context.Context, r io.Reader, opt Opt, sourcePath, blobPath, bootstrapPath string) error {
+	if opt.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opt.Timeout)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	builderPath := opt.NydusImagePath
+	if builderPath == "" {
+		builderPath = "nydus-image"
+	}
+	args := buildTarArgs(opt, sourcePath, blobPath, bootstrapPath)
+	logrus.Debugf("\tCommand: %s %s", builderPath, strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, builderPath, args...)
+	output := &strings.Builder{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Stdin = strings.NewReader(opt.PrefetchPatterns)
+
+	// The fifo is opened without blocking, the writes wait for the builder
+	// opening it until ctx is done.
+	tarFifo, err := fifo.OpenFifo(ctx, sourcePath, syscall.O_CREAT|syscall.O_WRONLY|syscall.O_NONBLOCK, 0640)
+	if err != nil {
+		return errors.Wrap(err, "create fifo file")
+	}
+	defer tarFifo.Close()
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "start builder")
+	}
+
+	copyErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(tarFifo, r)
+		if err != nil {
+			// The builder must not build from the truncated stream.
+			cancel()
+		}
+		// The builder reads the end of stream once the fifo is closed.
+		tarFifo.Close()
+		copyErr <- err
+	}()
+
+	waitErr := cmd.Wait()
+	// Unblock the writes if the builder exits before opening fifo.
+	cancel()
+	err = <-copyErr
+	if waitErr != nil {
+		// The writes fail with EPIPE or ErrWriteClosed once the builder
+		// exits, otherwise reading r failed.
+		if err != nil && !errors.Is(err, syscall.EPIPE) && !errors.Is(err, fifo.ErrWriteClosed) {
+			return errors.Wrap(err, "read tar stream")
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return errors.Wrapf(waitErr, "builder timeout after %s", opt.Timeout)
+		}
+		return errors.Wrapf(waitErr, "run builder: %s", strings.TrimSpace(output.String()))
+	}
+	// The builder may exit without reading the padding after the end of
+	// archive.
+	if err != nil && !errors.Is(err, syscall.EPIPE) {
+		return errors.Wrap(err, "read tar stream")
+	}
+
+	if _, err := os.Stat(bootstrapPath); err != nil {
+		return fmt.Errorf("bootstrap isn't built: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+// envFakeTarBuilder makes the test binary act as a builder of tar-rafs type,
+// which copies the slowly read tar stream as blob in mode `copy`, or fails
+// without reading the source in mode `fail`.
+const envFakeTarBuilder = "NYDUSIFY_TEST_FAKE_TAR_BUILDER"
+
+func fakeTarBuilder(mode string, args []string) int {
+	if mode == "fail" {
+		fmt.Fprintln(os.Stderr, "invalid arguments")
+		return 1
+	}
+
+	var blobPath, bootstrapPath string
+	for idx := 0; idx+1 < len(args); idx++ {
+		switch args[idx] {
+		case "--blob":
+			blobPath = args[idx+1]
+		case "--bootstrap":
+			bootstrapPath = args[idx+1]
+		}
+	}
+	source, err := os.Open(args[len(args)-1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer source.Close()
+
+	blob := bytes.Buffer{}
+	names := []string{}
+	tr := tar.NewReader(io.TeeReader(source, &blob))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		names = append(names, hdr.Name)
+		// Read slower than the writes to fifo.
+		for {
+			_, err := io.CopyN(io.Discard, tr, 64*1024)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if err := os.WriteFile(blobPath, blob.Bytes(), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := os.WriteFile(bootstrapPath, []byte(strings.Join(names, "\n")), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// makeLowerTar makes the tar stream of the entries like the lower layer of
+// smoke tests, with a file larger than the fifo buffer.
+func makeLowerTar(t *testing.T) []byte {
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	writeFile := func(name string, data []byte) {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}))
+		_, err := tw.Write(data)
+		require.NoError(t, err)
+	}
+	writeFile("file-1", []byte("file-1"))
+	writeFile("file-2", []byte("file-2"))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "dir-1/", Typeflag: tar.TypeDir, Mode: 0755}))
+	writeFile("dir-1/file-1", []byte("dir-1/file-1"))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "dir-1/file-1-hardlink-1", Typeflag: tar.TypeLink, Linkname: "dir-1/file-1"}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "dir-1/file-1-symlink-1", Typeflag: tar.TypeSymlink, Linkname: "dir-1/file-1", Mode: 0777}))
+	writeFile("唐诗三百首", []byte("This is poetry"))
+	writeFile("large-file", bytes.Repeat([]byte("nydus"), 1024*1024))
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestBuildFromTar(t *testing.T) {
+	executable, err := os.Executable()
+	require.NoError(t, err)
+	opt := Opt{NydusImagePath: executable, WorkDir: t.TempDir(), Timeout: time.Minute}
+	layer := makeLowerTar(t)
+
+	t.Setenv(envFakeTarBuilder, "copy")
+	result, err := BuildFromTar(context.Background(), bytes.NewReader(layer), opt)
+	require.NoError(t, err)
+	require.Equal(t, opt.WorkDir, filepath.Dir(result.Dir))
+	blob, err := os.ReadFile(result.BlobPath)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(layer, blob))
+	require.Equal(t, digest.FromBytes(layer), result.BlobDigest)
+	require.Equal(t, int64(len(layer)), result.BlobSize)
+	bootstrap, err := os.ReadFile(result.BootstrapPath)
+	require.NoError(t, err)
+	require.Equal(t, "file-1\nfile-2\ndir-1/\ndir-1/file-1\ndir-1/file-1-hardlink-1\ndir-1/file-1-symlink-1\n唐诗三百首\nlarge-file", string(bootstrap))
+	// The source is streamed by fifo rather than written to disk.
+	info, err := os.Stat(filepath.Join(result.Dir, "layer.tar"))
+	require.NoError(t, err)
+	require.Equal(t, os.ModeNamedPipe, info.Mode().Type())
+
+	// Failure situation
+	t.Setenv(envFakeTarBuilder, "fail")
+	_, err = BuildFromTar(context.Background(), bytes.NewReader(layer), opt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid arguments")
+
+	t.Setenv(envFakeTarBuilder, "copy")
+	_, err = BuildFromTar(context.Background(), io.MultiReader(bytes.NewReader(layer[:len(layer)/2]), errReader{}), opt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "read tar stream: connection reset")
+
+	// The build directories of failed builds are removed.
+	entries, err := os.ReadDir(opt.WorkDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestBuildTarArgs(t *testing.T) {
+	args := buildTarArgs(Opt{Compressor: "zstd", ChunkSize: "0x100000", PrefetchPatterns: "/"}, "layer.tar", "blob", "bootstrap")
+	require.Equal(t, []string{
+		"create",
+		"--log-level", "warn",
+		"--type", "tar-rafs",
+		"--whiteout-spec", "oci",
+		"--fs-version", "6",
+		"--blob", "blob",
+		"--bootstrap", "bootstrap",
+		"--prefetch-policy", "fs",
+		"--compressor", "zstd",
+		"--chunk-size", "0x100000",
+		"layer.tar",
+	}, args)
+}
+
+func TestBuildFromTarWithBuilder(t *testing.T) {
+	builderPath, err := exec.LookPath("nydus-image")
+	if err != nil {
+		t.Skip("nydus-image isn't found")
+	}
+
+	result, err := BuildFromTar(context.Background(), bytes.NewReader(makeLowerTar(t)), Opt{NydusImagePath: builderPath, WorkDir: t.TempDir()})
+	require.NoError(t, err)
+	require.FileExists(t, result.BootstrapPath)
+	require.NotEmpty(t, result.BlobDigest)
+	require.NotZero(t, result.BlobSize)
+}
@@ -0,0 +1,294 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/klauspost/compress/zstd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"lukechampine.com/blake3"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// The superblock flags of RAFS deciding the chunk compressor and digester,
+// see RafsSuperFlags in rafs/src/metadata.
+const (
+	rafsFlagCompressionNone = 0x0000_0001
+	rafsFlagCompressionLZ4  = 0x0000_0002
+	rafsFlagHashBlake3      = 0x0000_0004
+	rafsFlagHashSHA256      = 0x0000_0008
+	rafsFlagCompressionGzip = 0x0000_0040
+	rafsFlagCompressionZstd = 0x0000_0080
+	rafsFlagEncryptionXTS   = 0x0200_0000
+)
+
+// bootstrapChunk is a chunk of file reported by `nydus-image check --verbose`.
+type bootstrapChunk struct {
+	ID               string
+	Index            uint32
+	BlobIndex        uint32
+	CompressedOffset uint64
+	CompressedSize   uint32
+	UncompressedSize uint32
+}
+
+// parseChunkLine parses the chunk line printed by `nydus-image check
+// --verbose` like `chunk: id <digest>, index 0, blob_index 0, ...`.
+func parseChunkLine(line string) (*bootstrapChunk, error) {
+	var chunk bootstrapChunk
+	var fileOffset, uncompressedOffset uint64
+	if _, err := fmt.Sscanf(
+		strings.Replace(strings.TrimPrefix(line, "chunk: "), ",", " ", 1),
+		"id %s index %d, blob_index %d, file_offset %d, compressed %d/%d, uncompressed %d/%d",
+		&chunk.ID, &chunk.Index, &chunk.BlobIndex, &fileOffset,
+		&chunk.CompressedOffset, &chunk.CompressedSize, &uncompressedOffset, &chunk.UncompressedSize,
+	); err != nil {
+		return nil, errors.Wrapf(err, "invalid chunk %q", line)
+	}
+	return &chunk, nil
+}
+
+// parseBootstrapChunks parses the chunks printed by `nydus-image check
+// --verbose`, the chunks shared by several files are only returned once.
+func parseBootstrapChunks(output []byte) ([]bootstrapChunk, error) {
+	type chunkKey struct {
+		blobIndex uint32
+		offset    uint64
+	}
+	seen := map[chunkKey]bool{}
+	chunks := []bootstrapChunk{}
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "chunk: ") {
+			continue
+		}
+		chunk, err := parseChunkLine(line)
+		if err != nil {
+			return nil, err
+		}
+		key := chunkKey{chunk.BlobIndex, chunk.CompressedOffset}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		chunks = append(chunks, *chunk)
+	}
+	return chunks, nil
+}
+
+// checkBootstrapVerbose returns the inodes and their chunks of bootstrap
+// printed by `nydus-image check --verbose`.
+func checkBootstrapVerbose(ctx context.Context, opt Opt, bootstrapPath string) ([]byte, error) {
+	builder := opt.NydusImagePath
+	if builder == "" {
+		builder = "nydus-image"
+	}
+	args := []string{"check", "--bootstrap", bootstrapPath, "--verbose"}
+	logrus.Debugf("\tCommand: %s %s", builder, args)
+	stderr := &strings.Builder{}
+	cmd := exec.CommandContext(ctx, builder, args...)
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "run check command: %s", strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// bootstrapChunks returns the chunks of all the files in bootstrap.
+func bootstrapChunks(ctx context.Context, opt Opt, bootstrapPath string) ([]bootstrapChunk, error) {
+	output, err := checkBootstrapVerbose(ctx, opt, bootstrapPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseBootstrapChunks(output)
+}
+
+// readSuperFlags reads the flags of RAFS superblock.
+func readSuperFlags(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if _, err := readSuperBlock(file); err != nil {
+		return 0, err
+	}
+	sb := make([]byte, rafsSuperBlockSize)
+	if _, err := file.ReadAt(sb, 0); err != nil && err != io.EOF {
+		return 0, errors.Wrap(err, "read superblock")
+	}
+	le := binary.LittleEndian
+	if le.Uint32(sb[0:]) == rafsV5SuperMagic {
+		return le.Uint64(sb[16:]), nil
+	}
+	return le.Uint64(sb[rafsV6SuperExtOffset:]), nil
+}
+
+// chunkVerifier recomputes the digest of chunk data with the compressor and
+// digester of bootstrap.
+type chunkVerifier struct {
+	flags   uint64
+	decoder *zstd.Decoder
+}
+
+func newChunkVerifier(flags uint64) (*chunkVerifier, error) {
+	if flags&rafsFlagEncryptionXTS != 0 {
+		return nil, fmt.Errorf("encrypted blobs can't be verified")
+	}
+	if flags&rafsFlagCompressionLZ4 != 0 {
+		return nil, fmt.Errorf("blobs compressed by lz4_block can't be verified")
+	}
+	if flags&(rafsFlagCompressionNone|rafsFlagCompressionGzip|rafsFlagCompressionZstd) == 0 {
+		return nil, fmt.Errorf("unknown compressor of bootstrap flags 0x%x", flags)
+	}
+	if flags&(rafsFlagHashBlake3|rafsFlagHashSHA256) == 0 {
+		return nil, fmt.Errorf("unknown digester of bootstrap flags 0x%x", flags)
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkVerifier{flags: flags, decoder: decoder}, nil
+}
+
+func (v *chunkVerifier) close() {
+	v.decoder.Close()
+}
+
+// decompress returns the uncompressed data of chunk, the chunk isn't
+// compressed by builder if it doesn't get smaller.
+func (v *chunkVerifier) decompress(data []byte, size uint32) ([]byte, error) {
+	if v.flags&rafsFlagCompressionNone != 0 || len(data) == int(size) {
+		return data, nil
+	}
+	if v.flags&rafsFlagCompressionZstd != 0 {
+		return v.decoder.DecodeAll(data, make([]byte, 0, size))
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func (v *chunkVerifier) digest(data []byte) string {
+	var hasher hash.Hash
+	if v.flags&rafsFlagHashBlake3 != 0 {
+		hasher = blake3.New(32, nil)
+	} else {
+		hasher = sha256.New()
+	}
+	hasher.Write(data)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// verifyBlobChunks checks the chunks of blob read from ra against their
+// digests in bootstrap.
+func (v *chunkVerifier) verifyBlobChunks(ra io.ReaderAt, blobID string, chunks []bootstrapChunk) error {
+	for _, chunk := range chunks {
+		data := make([]byte, chunk.CompressedSize)
+		if _, err := ra.ReadAt(data, int64(chunk.CompressedOffset)); err != nil {
+			return errors.Wrapf(err, "read chunk %d of blob %s", chunk.Index, blobID)
+		}
+		data, err := v.decompress(data, chunk.UncompressedSize)
+		if err != nil {
+			return errors.Wrapf(err, "decompress chunk %d of blob %s", chunk.Index, blobID)
+		}
+		if len(data) != int(chunk.UncompressedSize) {
+			return fmt.Errorf("chunk %d of blob %s mismatched with bootstrap: size %d, expected %d", chunk.Index, blobID, len(data), chunk.UncompressedSize)
+		}
+		if dgst := v.digest(data); dgst != chunk.ID {
+			return fmt.Errorf("chunk %d of blob %s mismatched with bootstrap: digest %s, expected %s", chunk.Index, blobID, dgst, chunk.ID)
+		}
+	}
+	return nil
+}
+
+// verifyManifestChunks verifies the chunks of the nydus blob layers of
+// manifest built locally, the blobs absent in content store, like the blobs
+// of chunk dict, are skipped.
+func verifyManifestChunks(ctx context.Context, cs content.Store, opt Opt, manifest ocispec.Manifest) error {
+	bootstrapPath, cleanup, err := unpackManifestBootstrap(ctx, cs, opt, manifest)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	blobs, err := bootstrapBlobs(ctx, opt, bootstrapPath)
+	if err != nil {
+		return err
+	}
+	chunks, err := bootstrapChunks(ctx, opt, bootstrapPath)
+	if err != nil {
+		return errors.Wrap(err, "get chunks of bootstrap")
+	}
+	flags, err := readSuperFlags(bootstrapPath)
+	if err != nil {
+		return err
+	}
+	verifier, err := newChunkVerifier(flags)
+	if err != nil {
+		return err
+	}
+	defer verifier.close()
+
+	blobChunks := map[string][]bootstrapChunk{}
+	for _, chunk := range chunks {
+		if int(chunk.BlobIndex) >= len(blobs) {
+			return fmt.Errorf("chunk %d refers to unknown blob index %d", chunk.Index, chunk.BlobIndex)
+		}
+		blobID := blobs[chunk.BlobIndex].ID
+		blobChunks[blobID] = append(blobChunks[blobID], chunk)
+	}
+	for _, layer := range manifest.Layers {
+		if layer.Annotations[utils.LayerAnnotationNydusBlob] != "true" {
+			continue
+		}
+		ra, err := cs.ReaderAt(ctx, layer)
+		if err != nil {
+			logrus.Debugf("skip verifying blob %s absent in content store", layer.Digest)
+			continue
+		}
+		err = verifier.verifyBlobChunks(ra, layer.Digest.Hex(), blobChunks[layer.Digest.Hex()])
+		ra.Close()
+		if err != nil {
+			return err
+		}
+		logrus.Infof("verified %d chunks of blob %s", len(blobChunks[layer.Digest.Hex()]), layer.Digest)
+	}
+	return nil
+}
+
+// verifyChunks verifies the chunks of all the manifests in target image
+// before pushing, the source manifests merged with MergePlatform without
+// bootstrap layer are skipped.
+func verifyChunks(ctx context.Context, cs content.Store, opt Opt, targetDesc ocispec.Descriptor) error {
+	return walkManifests(ctx, cs, targetDesc, func(manifest ocispec.Manifest) error {
+		for _, layer := range manifest.Layers {
+			if nydusify.IsNydusBootstrap(layer) {
+				return verifyManifestChunks(ctx, cs, opt, manifest)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"lukechampine.com/blake3"
+)
+
+func TestParseBootstrapChunks(t *testing.T) {
+	output := []byte(`inode: /foo
+	 chunk: id 0a0b, index 0, blob_index 1, file_offset 0, compressed 0/10, uncompressed 0/20
+	 chunk: id 0c0d, index 1, blob_index 1, file_offset 20, compressed 10/5, uncompressed 20/5
+inode: /bar
+	 chunk: id 0a0b, index 0, blob_index 1, file_offset 0, compressed 0/10, uncompressed 0/20
+`)
+	chunks, err := parseBootstrapChunks(output)
+	require.NoError(t, err)
+	require.Equal(t, []bootstrapChunk{
+		{ID: "0a0b", Index: 0, BlobIndex: 1, CompressedOffset: 0, CompressedSize: 10, UncompressedSize: 20},
+		{ID: "0c0d", Index: 1, BlobIndex: 1, CompressedOffset: 10, CompressedSize: 5, UncompressedSize: 5},
+	}, chunks)
+
+	// Failure situation
+	_, err = parseBootstrapChunks([]byte("\t chunk: id 0a0b, index x"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid chunk")
+}
+
+func TestVerifyBlobChunks(t *testing.T) {
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	defer encoder.Close()
+
+	// The blob has a zstd chunk and a chunk stored uncompressed.
+	blob := []byte{}
+	chunks := []bootstrapChunk{}
+	for idx, data := range [][]byte{bytes.Repeat([]byte("foo"), 100), []byte("x")} {
+		compressed := encoder.EncodeAll(data, nil)
+		if len(compressed) >= len(data) {
+			compressed = data
+		}
+		sum := blake3.Sum256(data)
+		chunks = append(chunks, bootstrapChunk{
+			ID:               fmt.Sprintf("%x", sum),
+			Index:            uint32(idx),
+			CompressedOffset: uint64(len(blob)),
+			CompressedSize:   uint32(len(compressed)),
+			UncompressedSize: uint32(len(data)),
+		})
+		blob = append(blob, compressed...)
+	}
+	require.Less(t, chunks[0].CompressedSize, chunks[0].UncompressedSize)
+	require.Equal(t, chunks[1].CompressedSize, chunks[1].UncompressedSize)
+
+	verifier, err := newChunkVerifier(rafsFlagCompressionZstd | rafsFlagHashBlake3)
+	require.NoError(t, err)
+	defer verifier.close()
+	require.NoError(t, verifier.verifyBlobChunks(bytes.NewReader(blob), "blob", chunks))
+
+	// Failure situation
+	corrupted := append([]byte{}, blob...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	err = verifier.verifyBlobChunks(bytes.NewReader(corrupted), "blob", chunks)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "chunk 1 of blob blob mismatched with bootstrap")
+
+	_, err = newChunkVerifier(rafsFlagCompressionLZ4 | rafsFlagHashBlake3)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "lz4_block")
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// BuilderVersion is the release version of nydus-image builder.
+type BuilderVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func (v BuilderVersion) String() string {
+	return fmt.Sprintf("v%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Less returns true if v is older than other.
+func (v BuilderVersion) Less(other BuilderVersion) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	}
+	return v.Patch < other.Patch
+}
+
+// The version is printed by `nydus-image --version` like `Version: v2.2.0`,
+// it may have the suffix of git describe like `v2.2.0-12-g1234abc`.
+var builderVersionRegexp = regexp.MustCompile(`v?(\d+)\.(\d+)\.(\d+)`)
+
+var errInvalidBuilderVersion = errors.New("invalid builder version")
+
+// ParseBuilderVersion parses the version from the output of
+// `nydus-image --version` or a version string like `v2.2.0`.
+func ParseBuilderVersion(output string) (*BuilderVersion, error) {
+	text := output
+	if idx := strings.Index(output, "Version:"); idx >= 0 {
+		text = output[idx+len("Version:"):]
+	}
+	matches := builderVersionRegexp.FindStringSubmatch(text)
+	if matches == nil {
+		return nil, fmt.Errorf("%w %q", errInvalidBuilderVersion, strings.TrimSpace(output))
+	}
+	// The numbers are matched by `\d+`, so only overflow is possible.
+	numbers := make([]int, 3)
+	for idx, match := range matches[1:] {
+		number, err := strconv.Atoi(match)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %s", errInvalidBuilderVersion, strings.TrimSpace(output), err)
+		}
+		numbers[idx] = number
+	}
+
+	return &BuilderVersion{Major: numbers[0], Minor: numbers[1], Patch: numbers[2]}, nil
+}
+
+// DetectBuilderVersion runs `nydus-image --version` to get the version of
+// builder.
+func DetectBuilderVersion(ctx context.Context, builder string) (*BuilderVersion, error) {
+	if builder == "" {
+		builder = "nydus-image"
+	}
+	output, err := exec.CommandContext(ctx, builder, "--version").CombinedOutput()
+	if err != nil {
+		return nil, errors.Wrapf(err, "run version command: %s", strings.TrimSpace(string(output)))
+	}
+	return ParseBuilderVersion(string(output))
+}
+
+// builderFeature is the capability requested by Opt, which is only supported
+// since the version of builder.
+type builderFeature struct {
+	name      string
+	since     BuilderVersion
+	requested func(opt Opt) bool
+}
+
+var builderFeatures = []builderFeature{
+	{
+		name:      "rafs v6",
+		since:     BuilderVersion{Major: 2},
+		requested: func(opt Opt) bool { return opt.FsVersion == "6" },
+	},
+	{
+		name:      "zstd compressor",
+		since:     BuilderVersion{Major: 2, Minor: 1},
+		requested: func(opt Opt) bool { return opt.Compressor == "zstd" },
+	},
+	{
+		name:      "encryption",
+		since:     BuilderVersion{Major: 2, Minor: 2},
+		requested: func(opt Opt) bool { return opt.Encrypt },
+	},
+}
+
+// checkBuilderFeatures ensures the features requested by opt are supported
+// by the builder of version.
+func checkBuilderFeatures(version BuilderVersion, opt Opt) error {
+	for _, feature := range builderFeatures {
+		if feature.requested(opt) && version.Less(feature.since) {
+			return fmt.Errorf("%s requires builder %s or later, but the builder is %s", feature.name, feature.since, version)
+		}
+	}
+	return nil
+}
+
+// builderVersion returns the version of builder, which is parsed from
+// Opt.BuilderVersion if specified, otherwise detected by running builder.
+// The features requested by opt are checked against the version. It returns
+// nil if the detected version is unknown like the builder built without git
+// tags, then the features aren't checked.
+func builderVersion(ctx context.Context, opt Opt) (*BuilderVersion, error) {
+	var version *BuilderVersion
+	var err error
+	if opt.BuilderVersion != "" {
+		version, err = ParseBuilderVersion(opt.BuilderVersion)
+	} else {
+		version, err = DetectBuilderVersion(ctx, opt.NydusImagePath)
+		if errors.Is(err, errInvalidBuilderVersion) {
+			logrus.Warnf("skip checking builder features: %s", err)
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "get builder version")
+	}
+	logrus.Infof("nydus-image builder version %s", version)
+
+	if err := checkBuilderFeatures(*version, opt); err != nil {
+		return nil, err
+	}
+
+	return version, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeVersionBuilder makes a builder script printing the version like
+// `nydus-image --version`.
+func fakeVersionBuilder(t *testing.T, version string) string {
+	builderPath := filepath.Join(t.TempDir(), "nydus-image")
+	script := fmt.Sprintf("#!/bin/sh\nprintf 'nydus-image \\rVersion: \\t%s\\nGit Commit: \\t1234abc\\n'\n", version)
+	require.NoError(t, os.WriteFile(builderPath, []byte(script), 0755))
+	return builderPath
+}
+
+func TestParseBuilderVersion(t *testing.T) {
+	version, err := ParseBuilderVersion("nydus-image \rVersion: \tv2.2.4-12-g1234abc\nGit Commit: \t1234abc\n")
+	require.NoError(t, err)
+	require.Equal(t, BuilderVersion{Major: 2, Minor: 2, Patch: 4}, *version)
+	require.Equal(t, "v2.2.4", version.String())
+
+	version, err = ParseBuilderVersion("2.10.0")
+	require.NoError(t, err)
+	require.Equal(t, BuilderVersion{Major: 2, Minor: 10}, *version)
+	require.True(t, BuilderVersion{Major: 2, Minor: 2, Patch: 4}.Less(*version))
+	require.False(t, version.Less(*version))
+
+	_, err = ParseBuilderVersion("Version: unknown")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid builder version")
+}
+
+func TestBuilderVersion(t *testing.T) {
+	ctx := context.Background()
+
+	version, err := builderVersion(ctx, Opt{NydusImagePath: fakeVersionBuilder(t, "v2.2.0"), Encrypt: true, Compressor: "zstd"})
+	require.NoError(t, err)
+	require.Equal(t, "v2.2.0", version.String())
+
+	// The explicit version is used without running builder.
+	version, err = builderVersion(ctx, Opt{NydusImagePath: filepath.Join(t.TempDir(), "non-existent"), BuilderVersion: "v2.1.0", FsVersion: "6"})
+	require.NoError(t, err)
+	require.Equal(t, "v2.1.0", version.String())
+
+	// The features aren't checked with the builder of unknown version.
+	version, err = builderVersion(ctx, Opt{NydusImagePath: fakeVersionBuilder(t, "unknown"), Encrypt: true})
+	require.NoError(t, err)
+	require.Nil(t, version)
+
+	// Failure situation
+	_, err = builderVersion(ctx, Opt{NydusImagePath: fakeVersionBuilder(t, "v2.0.1"), Compressor: "zstd"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "zstd compressor requires builder v2.1.0 or later, but the builder is v2.0.1")
+	_, err = builderVersion(ctx, Opt{BuilderVersion: "v1.1.2", FsVersion: "6"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "rafs v6 requires builder v2.0.0 or later")
+	_, err = builderVersion(ctx, Opt{BuilderVersion: "unknown"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid builder version "unknown"`)
+	_, err = builderVersion(ctx, Opt{NydusImagePath: filepath.Join(t.TempDir(), "non-existent")})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "get builder version")
+}
+
+func TestConvertWithOldBuilder(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	keyPath := writeEncryptKey(t, &key.PublicKey)
+
+	// The conversion fails before pulling the source image.
+	_, err = Convert(context.Background(), Opt{
+		WorkDir:        t.TempDir(),
+		NydusImagePath: fakeVersionBuilder(t, "v2.1.2"),
+		Source:         "localhost:1/non-existent:latest",
+		Target:         "localhost:1/non-existent:nydus",
+		Encrypt:        true,
+		EncryptKeyPath: keyPath,
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "encryption requires builder v2.2.0 or later, but the builder is v2.1.2")
+}
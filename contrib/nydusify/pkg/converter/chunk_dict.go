@@ -5,10 +5,26 @@
 package converter
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	parserPkg "github.com/dragonflyoss/nydus/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/provider"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
 )
 
+// defaultCompressor is used by builder if no compressor specified.
+const defaultCompressor = "zstd"
+
 var (
 	chunkDictFormats = []string{"bootstrap"}
 	chunkDictSources = []string{"registry", "local"}
@@ -59,3 +75,138 @@ type ChunkDictOpt struct {
 	Args     string
 	Insecure bool
 }
+
+// checkOutput is the output json of `nydus-image check`.
+type checkOutput struct {
+	FsVersion  string `json:"fs_version"`
+	Compressor string `json:"compressor"`
+}
+
+// pullBootstrap pulls the bootstrap of Nydus image to the specified path.
+func pullBootstrap(ctx context.Context, ref string, insecure bool, target string) error {
+	parser, parsed, err := parseNydusImage(ctx, ref, insecure, runtime.GOARCH)
+	if err != nil {
+		return err
+	}
+
+	reader, err := parser.PullNydusBootstrap(ctx, parsed.NydusImage)
+	if err != nil {
+		return errors.Wrap(err, "pull bootstrap layer")
+	}
+	defer reader.Close()
+
+	return errors.Wrap(utils.UnpackFile(reader, utils.BootstrapFileNameInLayer, target), "unpack bootstrap layer")
+}
+
+// parseNydusImage parses the Nydus image of the arch from registry, and
+// retries with plain HTTP if needed.
+func parseNydusImage(ctx context.Context, ref string, insecure bool, arch string) (*parserPkg.Parser, *parserPkg.Parsed, error) {
+	remoter, err := provider.DefaultRemote(ref, insecure)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create remote")
+	}
+	parser, err := parserPkg.New(remoter, arch)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create parser")
+	}
+
+	parsed, err := parser.Parse(ctx)
+	if err != nil {
+		if !utils.RetryWithHTTP(err) {
+			return nil, nil, errors.Wrap(err, "parse nydus image")
+		}
+		remoter.MaybeWithHTTP(err)
+		if parsed, err = parser.Parse(ctx); err != nil {
+			return nil, nil, errors.Wrap(err, "parse nydus image")
+		}
+	}
+	if parsed.NydusImage == nil {
+		return nil, nil, fmt.Errorf("not a nydus image: %s", ref)
+	}
+
+	return parser, parsed, nil
+}
+
+// inspectBootstrap gets the fs version and compressor of bootstrap by builder.
+func inspectBootstrap(ctx context.Context, builder, bootstrapPath string) (*checkOutput, error) {
+	outputJSONPath := bootstrapPath + ".json"
+	defer os.Remove(outputJSONPath)
+
+	args := []string{
+		"check",
+		"--log-level",
+		"warn",
+		"--bootstrap",
+		bootstrapPath,
+		"--output-json",
+		outputJSONPath,
+	}
+	logrus.Debugf("\tCommand: %s %s", builder, args)
+	if output, err := exec.CommandContext(ctx, builder, args...).CombinedOutput(); err != nil {
+		return nil, errors.Wrapf(err, "run check command: %s", strings.TrimSpace(string(output)))
+	}
+
+	outputBytes, err := os.ReadFile(outputJSONPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read file %s", outputJSONPath)
+	}
+	var info checkOutput
+	if err := json.Unmarshal(outputBytes, &info); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal output json file %s", outputJSONPath)
+	}
+
+	return &info, nil
+}
+
+// builderCompressors maps the compressor names reported by `nydus-image
+// check`, which are the debug names of compression algorithms, to the names
+// accepted by `--compressor`.
+var builderCompressors = map[string]string{
+	"None":     "none",
+	"Lz4Block": "lz4_block",
+	"GZip":     "gzip",
+	"Zstd":     "zstd",
+}
+
+// checkChunkDictCompatible ensures the chunk dict image is built with the same
+// fs version and compressor, otherwise builder can't reference its chunks.
+func checkChunkDictCompatible(info *checkOutput, opt Opt) error {
+	compressor := opt.Compressor
+	if compressor == "" {
+		compressor = defaultCompressor
+	}
+	dictCompressor, ok := builderCompressors[info.Compressor]
+	if !ok {
+		dictCompressor = strings.ToLower(info.Compressor)
+	}
+	if dictCompressor != compressor {
+		return fmt.Errorf(
+			"chunk dict image %s is compressed by %s, but %s is used for conversion, please specify the same compressor",
+			opt.ChunkDictRef, dictCompressor, compressor,
+		)
+	}
+	if opt.FsVersion != "" && info.FsVersion != "" && info.FsVersion != opt.FsVersion {
+		return fmt.Errorf(
+			"chunk dict image %s is built with fs version %s, but %s is used for conversion",
+			opt.ChunkDictRef, info.FsVersion, opt.FsVersion,
+		)
+	}
+	return nil
+}
+
+// checkChunkDict pulls the bootstrap of chunk dict image and checks if it
+// can be used for the conversion.
+func checkChunkDict(ctx context.Context, opt Opt, workDir string) error {
+	bootstrapPath := filepath.Join(workDir, "chunk-dict-bootstrap")
+	defer os.Remove(bootstrapPath)
+
+	if err := pullBootstrap(ctx, opt.ChunkDictRef, opt.ChunkDictInsecure, bootstrapPath); err != nil {
+		return errors.Wrapf(err, "pull chunk dict image %s", opt.ChunkDictRef)
+	}
+	info, err := inspectBootstrap(ctx, opt.NydusImagePath, bootstrapPath)
+	if err != nil {
+		return errors.Wrap(err, "inspect chunk dict bootstrap")
+	}
+
+	return checkChunkDictCompatible(info, opt)
+}
@@ -0,0 +1,30 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckChunkDictCompatible(t *testing.T) {
+	info := &checkOutput{FsVersion: "6", Compressor: "Zstd"}
+	require.NoError(t, checkChunkDictCompatible(info, Opt{}))
+	require.NoError(t, checkChunkDictCompatible(info, Opt{Compressor: "zstd", FsVersion: "6"}))
+	require.NoError(t, checkChunkDictCompatible(&checkOutput{Compressor: "Lz4Block"}, Opt{Compressor: "lz4_block"}))
+	require.NoError(t, checkChunkDictCompatible(&checkOutput{Compressor: "None"}, Opt{Compressor: "none"}))
+
+	// Failure situation
+	err := checkChunkDictCompatible(info, Opt{ChunkDictRef: "localhost:5000/dict:latest", Compressor: "lz4_block"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is compressed by zstd, but lz4_block is used")
+	err = checkChunkDictCompatible(&checkOutput{Compressor: "Lz4Block"}, Opt{ChunkDictRef: "localhost:5000/dict:latest", Compressor: "zstd"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is compressed by lz4_block, but zstd is used")
+	err = checkChunkDictCompatible(info, Opt{ChunkDictRef: "localhost:5000/dict:latest", FsVersion: "5"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "fs version 6")
+}
@@ -5,9 +5,343 @@
 package converter
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+)
+
+const (
+	minChunkSize = 0x1000
+	maxChunkSize = 0x100000
+	// minRSAKeyBits is the minimum length of RSA encryption key.
+	minRSAKeyBits = 2048
 )
 
+var compressors = []string{"none", "lz4_block", "zstd"}
+
+// fsVersions are the RAFS versions supported by builder, the version 6 is
+// compatible with EROFS.
+var fsVersions = []string{"5", "6"}
+
+func isValidCompressor(compressor string) bool {
+	for i := range compressors {
+		if compressors[i] == compressor {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidFsVersion(fsVersion string) bool {
+	for i := range fsVersions {
+		if fsVersions[i] == fsVersion {
+			return true
+		}
+	}
+	return false
+}
+
+// parseChunkSize parses chunk size in hex format like "0x100000"
+// or in human readable format like "256KiB", "1MiB".
+func parseChunkSize(size string) (uint64, error) {
+	if strings.HasPrefix(size, "0x") || strings.HasPrefix(size, "0X") {
+		return strconv.ParseUint(size[2:], 16, 64)
+	}
+	return humanize.ParseBytes(size)
+}
+
+func validateChunkSize(size string) error {
+	parsed, err := parseChunkSize(size)
+	if err != nil {
+		return errors.Wrapf(err, "invalid chunk size %s", size)
+	}
+	if parsed&(parsed-1) != 0 {
+		return fmt.Errorf("invalid chunk size %s, should be power of two", size)
+	}
+	if parsed < minChunkSize || parsed > maxChunkSize {
+		return fmt.Errorf("invalid chunk size %s, should be between 0x%x-0x%x", size, minChunkSize, maxChunkSize)
+	}
+	return nil
+}
+
+// formatChunkSize converts chunk size to the hex format accepted by builder.
+func formatChunkSize(size string) string {
+	parsed, err := parseChunkSize(size)
+	if err != nil {
+		return size
+	}
+	return fmt.Sprintf("0x%x", parsed)
+}
+
+// validateOpt checks the options which will be passed to the nydus-image
+// builder, so that an invalid option fails fast before pulling the image.
+func validateOpt(opt Opt) error {
+	// Leave it empty to use the default compressor of builder.
+	if opt.Compressor != "" && !isValidCompressor(opt.Compressor) {
+		return fmt.Errorf("invalid compressor %s, should be one of %v", opt.Compressor, compressors)
+	}
+	// Leave it empty to use the default fs version of builder.
+	if opt.FsVersion != "" && !isValidFsVersion(opt.FsVersion) {
+		return fmt.Errorf("invalid fs version %s, should be one of %v", opt.FsVersion, fsVersions)
+	}
+
+	if err := validateMediaTypeScheme(opt); err != nil {
+		return err
+	}
+
+	if err := validateBackend(opt.BackendType, opt.BackendConfig); err != nil {
+		return err
+	}
+	// The blobs are uploaded to storage backend by builder directly.
+	if opt.DryRun && opt.BackendType != "" {
+		return fmt.Errorf("dry run isn't supported with storage backend")
+	}
+
+	if opt.SharedBlobDir != "" && opt.BackendType != "" {
+		return fmt.Errorf("shared blob dir isn't supported with storage backend")
+	}
+
+	// The OCI ref builder references the original gzip layer, which can't
+	// be rewritten.
+	if opt.Reproducible && opt.OCIRef {
+		return fmt.Errorf("reproducible conversion isn't supported with OCI ref")
+	}
+	if opt.OwnerOverride != nil && opt.OCIRef {
+		return fmt.Errorf("owner override isn't supported with OCI ref")
+	}
+	if opt.FlattenWhiteouts && opt.OCIRef {
+		return fmt.Errorf("flattening whiteouts isn't supported with OCI ref")
+	}
+	if opt.BlobAnnotations && opt.OCIRef {
+		return fmt.Errorf("blob annotations aren't supported with OCI ref")
+	}
+	// The chunks are read back from the nydus blobs in content store.
+	if opt.VerifyAfterBuild {
+		if opt.OCIRef {
+			return fmt.Errorf("verifying after build isn't supported with OCI ref")
+		}
+		if opt.BackendType != "" {
+			return fmt.Errorf("verifying after build isn't supported with storage backend")
+		}
+		if opt.Encrypt {
+			return fmt.Errorf("verifying after build isn't supported with encryption")
+		}
+		// The chunks of a batch are compressed together.
+		if opt.BatchSize != "" {
+			return fmt.Errorf("verifying after build isn't supported with batch size")
+		}
+		if opt.Compressor == "lz4_block" {
+			return fmt.Errorf("verifying after build isn't supported with compressor lz4_block")
+		}
+	}
+	// The layers are built twice, see probeIncompressible.
+	if opt.SkipIncompressibleThreshold != 0 {
+		if opt.SkipIncompressibleThreshold < 0 || opt.SkipIncompressibleThreshold > 1 {
+			return fmt.Errorf("invalid incompressible threshold %v, should be in (0, 1]", opt.SkipIncompressibleThreshold)
+		}
+		// Only the blob table of RAFS v6 records the compressor per blob.
+		if opt.FsVersion == "5" {
+			return fmt.Errorf("skipping incompressible blobs isn't supported with fs version 5")
+		}
+		if opt.Compressor == "none" {
+			return fmt.Errorf("skipping incompressible blobs isn't supported with compressor none")
+		}
+		if opt.OCIRef {
+			return fmt.Errorf("skipping incompressible blobs isn't supported with OCI ref")
+		}
+		if opt.BackendType != "" {
+			return fmt.Errorf("skipping incompressible blobs isn't supported with storage backend")
+		}
+		if opt.Encrypt {
+			return fmt.Errorf("skipping incompressible blobs isn't supported with encryption")
+		}
+		// The chunks are verified by the compressor of superblock.
+		if opt.VerifyAfterBuild {
+			return fmt.Errorf("skipping incompressible blobs isn't supported with verifying after build")
+		}
+		if opt.ConvertAllPlatforms {
+			return fmt.Errorf("skipping incompressible blobs isn't supported with converting all platforms")
+		}
+		if opt.CacheRef != "" || opt.BuildCacheDir != "" || opt.ResumeStateFile != "" {
+			return fmt.Errorf("skipping incompressible blobs isn't supported with build cache or resume state")
+		}
+	}
+	for layer, diffID := range opt.SourceDiffIDs {
+		if err := layer.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid source layer digest %s", layer)
+		}
+		if err := diffID.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid diff id %s of source layer %s", diffID, layer)
+		}
+	}
+	if len(opt.IncludePatterns) > 0 || len(opt.ExcludePatterns) > 0 {
+		if opt.OCIRef {
+			return fmt.Errorf("path patterns aren't supported with OCI ref")
+		}
+		if _, err := newPathFilter(opt.IncludePatterns, opt.ExcludePatterns); err != nil {
+			return err
+		}
+	}
+
+	// The nydus blob layer cached by BuildCacheDir must be only decided by
+	// the source layer and build parameters.
+	if opt.BuildCacheDir != "" {
+		// The blobs are uploaded to storage backend by builder, which is
+		// skipped for the cached blobs.
+		if opt.BackendType != "" {
+			return fmt.Errorf("build cache dir isn't supported with storage backend")
+		}
+		// The blob data is encrypted with a random key.
+		if opt.Encrypt {
+			return fmt.Errorf("build cache dir isn't supported with encryption")
+		}
+		// The whiteouts are dropped only if the layer is the lowest layer
+		// of source image.
+		if opt.FlattenWhiteouts {
+			return fmt.Errorf("build cache dir isn't supported with flattening whiteouts")
+		}
+	}
+
+	if _, err := parsePrefetchLayerPolicy(opt.PrefetchLayerPolicy); err != nil {
+		return err
+	}
+
+	if opt.PrefetchIncludeMetadataOnly && (strings.TrimSpace(opt.PrefetchPatterns) != "" || opt.PrefetchPatternsFile != "" ||
+		opt.PrefetchTracePath != "" || opt.PrefetchLayerPolicy != "" || len(opt.PlatformPrefetchPatterns) > 0) {
+		return fmt.Errorf("prefetching metadata only can't be used with prefetch patterns, trace or layer policy")
+	}
+
+	if len(opt.PlatformPrefetchPatterns) > 0 {
+		if !opt.ConvertAllPlatforms {
+			return fmt.Errorf("platform prefetch patterns are only supported with converting all platforms")
+		}
+		// The layer files are found in the whole source image.
+		if opt.PrefetchLayerPolicy != "" {
+			return fmt.Errorf("platform prefetch patterns can't be used with prefetch layer policy")
+		}
+		for specifier := range opt.PlatformPrefetchPatterns {
+			if _, err := platforms.Parse(specifier); err != nil {
+				return errors.Wrapf(err, "invalid platform %q of prefetch patterns", specifier)
+			}
+		}
+	}
+
+	if opt.BaseBootstrapRef != "" && opt.ChunkDictRef != "" {
+		return fmt.Errorf("base bootstrap and chunk dict can't be specified together")
+	}
+
+	if _, err := parsePlatforms(opt.AllPlatforms || opt.ConvertAllPlatforms, opt.Platforms); err != nil {
+		return err
+	}
+
+	if opt.ChunkSize != "" {
+		if err := validateChunkSize(opt.ChunkSize); err != nil {
+			return err
+		}
+	}
+
+	if opt.Encrypt {
+		if opt.FsVersion == "5" {
+			return fmt.Errorf("encryption is only supported by fs version 6")
+		}
+		if opt.EncryptKeyPath == "" {
+			return fmt.Errorf("encryption key path is empty")
+		}
+		if err := validateEncryptKey(opt.EncryptKeyPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateEncryptKey ensures the encryption key is a PEM encoded RSA public
+// key of at least minRSAKeyBits or an EC public key, which is used as the
+// JWE recipient to wrap the random AES-256-GCM key of blob data, so that a
+// malformed key fails before building.
+func validateEncryptKey(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "read encryption key")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("invalid encryption key %s, should be PEM encoded", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return errors.Wrapf(err, "invalid encryption key %s, should be a public key", path)
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < minRSAKeyBits {
+			return fmt.Errorf("invalid encryption key %s, RSA key of %d bits is shorter than %d bits", path, key.N.BitLen(), minRSAKeyBits)
+		}
+	case *ecdsa.PublicKey:
+	default:
+		return fmt.Errorf("invalid encryption key %s, unsupported key type %T", path, key)
+	}
+	return nil
+}
+
+// loadPrefetchPatterns merges the inline prefetch patterns with the patterns
+// read line by line from prefetch patterns file, the blank lines and comment
+// lines starting with `#` in file are ignored.
+func loadPrefetchPatterns(opt Opt) (string, error) {
+	if opt.PrefetchPatternsFile == "" {
+		return opt.PrefetchPatterns, nil
+	}
+
+	file, err := os.Open(opt.PrefetchPatternsFile)
+	if err != nil {
+		return "", errors.Wrap(err, "open prefetch patterns file")
+	}
+	defer file.Close()
+
+	patterns := []string{}
+	seen := map[string]bool{}
+	appendPattern := func(pattern string) {
+		if !seen[pattern] {
+			seen[pattern] = true
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	for _, pattern := range strings.Split(opt.PrefetchPatterns, "\n") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			appendPattern(pattern)
+		}
+	}
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		if !filepath.IsAbs(pattern) {
+			return "", fmt.Errorf("invalid prefetch pattern %s at line %d, should be an absolute path", pattern, line)
+		}
+		appendPattern(pattern)
+	}
+	if err := scanner.Err(); err != nil {
+		return "", errors.Wrap(err, "read prefetch patterns file")
+	}
+
+	return strings.Join(patterns, "\n"), nil
+}
+
 func getConfig(opt Opt) map[string]string {
 	cfg := map[string]string{}
 
@@ -23,12 +357,20 @@ func getConfig(opt Opt) map[string]string {
 	cfg["merge_manifest"] = strconv.FormatBool(opt.MergePlatform)
 	cfg["oci_ref"] = strconv.FormatBool(opt.OCIRef)
 	cfg["with_referrer"] = strconv.FormatBool(opt.WithReferrer)
+	if opt.Encrypt {
+		// The bootstrap layer is encrypted with the JWE public key, and
+		// the blob data will be encrypted by builder with a random key
+		// which is recorded in the encrypted bootstrap.
+		cfg["encrypt_recipients"] = "jwe:" + opt.EncryptKeyPath
+	}
 
 	cfg["prefetch_patterns"] = opt.PrefetchPatterns
 	cfg["compressor"] = opt.Compressor
 	cfg["fs_version"] = opt.FsVersion
 	cfg["fs_align_chunk"] = strconv.FormatBool(opt.FsAlignChunk)
-	cfg["fs_chunk_size"] = opt.ChunkSize
+	if opt.ChunkSize != "" {
+		cfg["fs_chunk_size"] = formatChunkSize(opt.ChunkSize)
+	}
 	cfg["batch_size"] = opt.BatchSize
 
 	cfg["cache_ref"] = opt.CacheRef
@@ -0,0 +1,233 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateOpt(t *testing.T) {
+	for _, compressor := range []string{"", "none", "lz4_block", "zstd"} {
+		require.NoError(t, validateOpt(Opt{Compressor: compressor}))
+	}
+
+	for _, fsVersion := range []string{"", "5", "6"} {
+		require.NoError(t, validateOpt(Opt{FsVersion: fsVersion}))
+		require.Equal(t, fsVersion, getConfig(Opt{FsVersion: fsVersion})["fs_version"])
+	}
+
+	// Failure situation
+	err := validateOpt(Opt{Compressor: "gzip"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid compressor gzip")
+
+	err = validateOpt(Opt{FsVersion: "7"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid fs version 7")
+
+	require.NoError(t, validateOpt(Opt{Reproducible: true}))
+	err = validateOpt(Opt{Reproducible: true, OCIRef: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "reproducible conversion isn't supported with OCI ref")
+	require.NoError(t, validateOpt(Opt{OwnerOverride: &Owner{}}))
+	err = validateOpt(Opt{OwnerOverride: &Owner{}, OCIRef: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "owner override isn't supported with OCI ref")
+	require.NoError(t, validateOpt(Opt{FlattenWhiteouts: true}))
+	err = validateOpt(Opt{FlattenWhiteouts: true, OCIRef: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "flattening whiteouts isn't supported with OCI ref")
+	require.NoError(t, validateOpt(Opt{BlobAnnotations: true}))
+	err = validateOpt(Opt{BlobAnnotations: true, OCIRef: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "blob annotations aren't supported with OCI ref")
+	require.NoError(t, validateOpt(Opt{VerifyAfterBuild: true, Compressor: "zstd"}))
+	err = validateOpt(Opt{VerifyAfterBuild: true, Compressor: "lz4_block"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "verifying after build isn't supported with compressor lz4_block")
+	err = validateOpt(Opt{VerifyAfterBuild: true, BatchSize: "0x100000"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "verifying after build isn't supported with batch size")
+	require.NoError(t, validateOpt(Opt{IncludePatterns: []string{"usr/**"}, ExcludePatterns: []string{"*.log"}}))
+	err = validateOpt(Opt{ExcludePatterns: []string{"var/log/"}, OCIRef: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "path patterns aren't supported with OCI ref")
+	err = validateOpt(Opt{ExcludePatterns: []string{"var/[log"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid path pattern")
+
+	require.NoError(t, validateOpt(Opt{BuildCacheDir: "cache", OCIRef: true}))
+	ossConfig := `{"bucket_name": "test", "endpoint": "region.oss.com", "access_key_id": "testAK", "access_key_secret": "testSK"}`
+	err = validateOpt(Opt{BuildCacheDir: "cache", BackendType: "oss", BackendConfig: ossConfig})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "build cache dir isn't supported with storage backend")
+	require.NoError(t, validateOpt(Opt{SharedBlobDir: "blobs"}))
+	err = validateOpt(Opt{SharedBlobDir: "blobs", BackendType: "oss", BackendConfig: ossConfig})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "shared blob dir isn't supported with storage backend")
+	err = validateOpt(Opt{BuildCacheDir: "cache", FlattenWhiteouts: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "build cache dir isn't supported with flattening whiteouts")
+	require.NoError(t, validateOpt(Opt{PrefetchIncludeMetadataOnly: true}))
+	for _, opt := range []Opt{
+		{PrefetchIncludeMetadataOnly: true, PrefetchPatterns: "/usr"},
+		{PrefetchIncludeMetadataOnly: true, PrefetchTracePath: "trace"},
+		{PrefetchIncludeMetadataOnly: true, PrefetchLayerPolicy: PrefetchLayerPolicyNone},
+	} {
+		err = validateOpt(opt)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "prefetching metadata only can't be used with prefetch patterns, trace or layer policy")
+	}
+	layer := digest.FromString("layer")
+	require.NoError(t, validateOpt(Opt{SourceDiffIDs: map[digest.Digest]digest.Digest{layer: digest.FromString("diff")}}))
+	err = validateOpt(Opt{SourceDiffIDs: map[digest.Digest]digest.Digest{"sha256:invalid": digest.FromString("diff")}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid source layer digest sha256:invalid")
+	err = validateOpt(Opt{SourceDiffIDs: map[digest.Digest]digest.Digest{layer: "invalid"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid diff id invalid of source layer "+layer.String())
+	require.NoError(t, validateOpt(Opt{SkipIncompressibleThreshold: 0.9, Compressor: "zstd"}))
+	for _, threshold := range []float64{-0.1, 1.5} {
+		err = validateOpt(Opt{SkipIncompressibleThreshold: threshold})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "invalid incompressible threshold")
+	}
+	for _, c := range []struct {
+		opt Opt
+		err string
+	}{
+		{Opt{FsVersion: "5"}, "with fs version 5"},
+		{Opt{Compressor: "none"}, "with compressor none"},
+		{Opt{OCIRef: true}, "with OCI ref"},
+		{Opt{VerifyAfterBuild: true}, "with verifying after build"},
+		{Opt{ConvertAllPlatforms: true}, "with converting all platforms"},
+		{Opt{BuildCacheDir: "cache"}, "with build cache or resume state"},
+		{Opt{ResumeStateFile: "state.json"}, "with build cache or resume state"},
+	} {
+		c.opt.SkipIncompressibleThreshold = 0.9
+		err = validateOpt(c.opt)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "skipping incompressible blobs isn't supported "+c.err)
+	}
+}
+
+// writeEncryptKey writes the public key in PEM format as encryption key.
+func writeEncryptKey(t *testing.T, key interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "public.pem")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+	return keyPath
+}
+
+func TestValidateEncryptOpt(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	keyPath := writeEncryptKey(t, &ecKey.PublicKey)
+
+	require.NoError(t, validateOpt(Opt{Encrypt: true, EncryptKeyPath: keyPath}))
+	cfg := getConfig(Opt{Encrypt: true, EncryptKeyPath: keyPath})
+	require.Equal(t, "jwe:"+keyPath, cfg["encrypt_recipients"])
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	require.NoError(t, validateOpt(Opt{Encrypt: true, EncryptKeyPath: writeEncryptKey(t, &rsaKey.PublicKey)}))
+
+	// Failure situation
+	require.Error(t, validateOpt(Opt{Encrypt: true}))
+	require.Error(t, validateOpt(Opt{Encrypt: true, EncryptKeyPath: keyPath, FsVersion: "5"}))
+	err = validateOpt(Opt{Encrypt: true, EncryptKeyPath: "non-existent.pem"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "read encryption key")
+
+	plainPath := filepath.Join(t.TempDir(), "plain.pem")
+	require.NoError(t, os.WriteFile(plainPath, []byte("public key"), 0644))
+	err = validateOpt(Opt{Encrypt: true, EncryptKeyPath: plainPath})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "should be PEM encoded")
+
+	der, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	privatePath := filepath.Join(t.TempDir(), "private.pem")
+	require.NoError(t, os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+	err = validateOpt(Opt{Encrypt: true, EncryptKeyPath: privatePath})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "should be a public key")
+
+	shortKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	err = validateOpt(Opt{Encrypt: true, EncryptKeyPath: writeEncryptKey(t, &shortKey.PublicKey)})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "RSA key of 1024 bits is shorter than 2048 bits")
+}
+
+func TestValidateDryRunOpt(t *testing.T) {
+	require.NoError(t, validateOpt(Opt{DryRun: true}))
+
+	// Failure situation
+	backendConfig := `{"bucket_name": "test", "endpoint": "region.oss.com", "access_key_id": "testAK", "access_key_secret": "testSK"}`
+	require.NoError(t, validateOpt(Opt{BackendType: "oss", BackendConfig: backendConfig}))
+	err := validateOpt(Opt{DryRun: true, BackendType: "oss", BackendConfig: backendConfig})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "dry run")
+}
+
+func TestValidateChunkSize(t *testing.T) {
+	for size, expected := range map[string]string{
+		"0x100000": "0x100000",
+		"0x1000":   "0x1000",
+		"256KiB":   "0x40000",
+		"1MiB":     "0x100000",
+	} {
+		require.NoError(t, validateOpt(Opt{ChunkSize: size}))
+		require.Equal(t, expected, getConfig(Opt{ChunkSize: size})["fs_chunk_size"])
+	}
+
+	// Failure situation
+	for _, size := range []string{"0x100001", "300KiB", "2KiB", "2MiB", "invalid"} {
+		require.Error(t, validateOpt(Opt{ChunkSize: size}), size)
+	}
+}
+
+func TestLoadPrefetchPatterns(t *testing.T) {
+	patternsFile := filepath.Join(t.TempDir(), "prefetch.txt")
+	require.NoError(t, os.WriteFile(patternsFile, []byte("# generated by profiling\n/usr/bin\n\n  /etc/passwd  \n/usr/lib\n# /usr/share\n"), 0644))
+
+	patterns, err := loadPrefetchPatterns(Opt{PrefetchPatterns: "/usr/lib\n/bin", PrefetchPatternsFile: patternsFile})
+	require.NoError(t, err)
+	require.Equal(t, "/usr/lib\n/bin\n/usr/bin\n/etc/passwd", patterns)
+
+	patterns, err = loadPrefetchPatterns(Opt{PrefetchPatterns: "/"})
+	require.NoError(t, err)
+	require.Equal(t, "/", patterns)
+
+	// Failure situation
+	_, err = loadPrefetchPatterns(Opt{PrefetchPatternsFile: filepath.Join(t.TempDir(), "non-existent.txt")})
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(patternsFile, []byte("/usr/bin\nusr/lib\n"), 0644))
+	_, err = loadPrefetchPatterns(Opt{PrefetchPatternsFile: patternsFile})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "line 2")
+}
+
+func TestValidateBaseBootstrapOpt(t *testing.T) {
+	require.NoError(t, validateOpt(Opt{BaseBootstrapRef: "localhost/base:nydus"}))
+
+	// Failure situation
+	err := validateOpt(Opt{BaseBootstrapRef: "localhost/base:nydus", ChunkDictRef: "localhost/dict:nydus"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "can't be specified together")
+}
@@ -6,13 +6,26 @@ package converter
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"runtime"
+	"time"
 
 	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/reference/docker"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+	originprovider "github.com/dragonflyoss/nydus/contrib/nydusify/pkg/provider"
 	"github.com/goharbor/acceleration-service/pkg/converter"
-	"github.com/goharbor/acceleration-service/pkg/platformutil"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The placeholder references of source image imported from and target
+// image exported to OCI image layout directory.
+const (
+	layoutSourceRef = "localhost/nydusify/oci-layout:latest"
+	layoutTargetRef = "localhost/nydusify/oci-layout:nydus"
 )
 
 type Opt struct {
@@ -20,10 +33,44 @@ type Opt struct {
 	ContainerdAddress string
 	NydusImagePath    string
 
+	// BuilderVersion is the version of builder like `v2.2.0`, it's detected
+	// by running `nydus-image --version` if not specified. The conversion
+	// fails early if the requested features like encryption, zstd compressor
+	// or rafs v6 aren't supported by the builder version.
+	BuilderVersion string
+
+	// Source may be pinned by digest like `name@sha256:...`, the conversion
+	// fails if the pulled manifest doesn't match the pinned digest.
 	Source       string
 	Target       string
 	ChunkDictRef string
 
+	// SourcePath is the path of OCI image layout directory to be converted,
+	// it can't be specified together with Source.
+	SourcePath string
+	// SourceArchiveTag selects the image by repo tag from the docker archive
+	// converted by BuildFromDockerArchive, it's required if the archive
+	// contains several images.
+	SourceArchiveTag string
+	// TargetPath is the path of OCI image layout directory to write the
+	// converted image, it can't be specified together with Target.
+	TargetPath string
+	// Offline guarantees the conversion between SourcePath and TargetPath
+	// never accesses registry, for example in an air-gapped environment,
+	// the conversion fails instead once a registry access is needed, like
+	// the blob missing from SourcePath.
+	Offline bool
+
+	// BaseBootstrapRef is the Nydus image of the base shared by the source
+	// image, the chunks of base are reused and the base blobs are referenced
+	// by digest rather than stored in new blobs. It's an alias of
+	// ChunkDictRef with no semantics of its own: the driver builds each layer
+	// against a chunk dict rather than a parent bootstrap, so the base image
+	// is used as chunk dict, and can't be specified together with
+	// ChunkDictRef.
+	BaseBootstrapRef      string
+	BaseBootstrapInsecure bool
+
 	SourceInsecure    bool
 	TargetInsecure    bool
 	ChunkDictInsecure bool
@@ -48,53 +95,686 @@ type Opt struct {
 	OCIRef           bool
 	WithReferrer     bool
 
+	// LinkSource pushes an artifact referring to the source image after
+	// conversion, so that the Nydus image is discoverable from the source
+	// image by referrers API.
+	LinkSource bool
+	// HybridOutput pushes the original source image to target reference,
+	// and the Nydus image by digest into the target repository as a
+	// referrer of the source image with artifact type NydusArtifactType, so
+	// that the target still works as an OCI image for the clients without
+	// Nydus support. The result describes the Nydus image. It requires OCI
+	// media types, see Docker2OCI.
+	HybridOutput bool
+	// SignKeyPath is the path of ECDSA private key to sign the target image
+	// in cosign compatible format, the passphrase of encrypted key is read
+	// from env `COSIGN_PASSWORD`.
+	SignKeyPath string
+	// VerifySourceKeyPath is the path of ECDSA public key in PEM format to
+	// verify the cosign signature of source image before pulling it, the
+	// conversion is aborted if the source image has no signature verified
+	// with the key.
+	VerifySourceKeyPath string
+	// SourceDiffIDs maps the digest of source layer to its known diff ID,
+	// like the one recorded by the build system of source image. The known
+	// diff IDs are checked against the image config of source image before
+	// conversion, which fails on mismatch. The uncompressed source layers are
+	// never hashed by Nydusify, the builder trusts the diff IDs of config.
+	SourceDiffIDs map[digest.Digest]digest.Digest
+	// SBOMPath is the path of SPDX document in JSON format, which is pushed
+	// as a referrer of target image with artifact type SBOMArtifactType.
+	SBOMPath string
+	// Provenance pushes the in-toto statement of SLSA provenance as a
+	// referrer of target image with artifact type ProvenanceArtifactType,
+	// which records the digests of source and target images, the builder
+	// version and the options of conversion except the secrets.
+	Provenance bool
+	// PreserveConfig copies the image config of source image into target
+	// image verbatim, including labels, env, entrypoint and the fields unknown
+	// to OCI image spec, only the rootfs and history of target config are
+	// kept since they describe the Nydus layers.
+	PreserveConfig bool
+	// AnnotateSource records the digest of source image and build parameters
+	// in the annotations AnnotationSourceDigest and AnnotationBuildParams of
+	// target manifest or index, so that Copy can skip rebuilding the image
+	// converted from the same source with the same parameters. It's always
+	// set by Copy.
+	AnnotateSource bool
+	// BlobAnnotations records the digest of source layer, the chunk count
+	// and the uncompressed size of each nydus blob layer in the annotations
+	// of layer descriptor, like AnnotationBlobSource, which are the same as
+	// reported by Inspect.
+	BlobAnnotations bool
+	// SnapshotterCompat annotates the layers of target manifest with the
+	// labels consumed by nydus snapshotter, like the IDs of all the blobs
+	// referenced by bootstrap in LayerAnnotationNydusReferenceBlobIDs and
+	// the fs version on bootstrap layer. It's independent of
+	// MediaTypeScheme.
+	SnapshotterCompat bool
+	// VerifyAfterBuild reads back the chunks of each nydus blob built and
+	// checks their digests against the chunk table of bootstrap before
+	// pushing, the conversion aborts with the index of first mismatched
+	// chunk. It requires the blobs compressed by zstd, gzip or none.
+	VerifyAfterBuild bool
+	// SkipIncompressibleThreshold stores the nydus blob uncompressed, with
+	// compressor `none`, if its compression ratio, the compressed size
+	// divided by the uncompressed size, is greater than the threshold, for
+	// the source layers of already compressed media. It should be in (0, 1],
+	// zero means never, and requires RAFS v6 since the layers are built with
+	// different compressors.
+	SkipIncompressibleThreshold float64
+	// ResumeStateFile records the nydus blob layers built from source layers
+	// as the conversion goes, the blobs are stored in the directory
+	// `<ResumeStateFile>.blobs`. The conversion restarted after failure with
+	// the same file skips building the layers recorded, if the source image
+	// and build parameters are unchanged. Both are removed once the
+	// conversion succeeds.
+	ResumeStateFile string
+	// Reproducible resets the modification time of all the files in source
+	// layers and removes the created time from target config and history,
+	// so that the target manifest digest is stable across the conversions
+	// of the same files. The builder already sorts the entries and leaves
+	// the build time out of bootstrap.
+	Reproducible bool
+	// OwnerOverride forces the uid and gid of all the files in source layers
+	// if not nil, for example to make them owned by root.
+	OwnerOverride *Owner
+	// FlattenWhiteouts makes no whiteout left in the bootstrap of target
+	// image for the runtime not understanding OCI whiteouts. The whiteouts of
+	// upper layers are always applied by builder when merging bootstrap, the
+	// option drops the whiteouts left in the lowest layer, which have no file
+	// to delete.
+	FlattenWhiteouts bool
+	// IncludePatterns and ExcludePatterns are the gitignore-style globs of
+	// the paths in source layers, the files not matching any include or
+	// matching an exclude are dropped from the target image. The excludes
+	// take precedence over the includes, no include means all the files.
+	IncludePatterns []string
+	ExcludePatterns []string
+	// MediaTypeScheme decides the media types of target manifest, index,
+	// config and bootstrap layer for the downstreams expecting different
+	// ones, should be one of MediaTypeSchemeContainerd (default),
+	// MediaTypeSchemeOCI and MediaTypeSchemeDocker.
+	MediaTypeScheme string
+
+	// DryRun builds the target image locally but skips all pushes to target
+	// registry, OCI image layout and build cache, the conversion plan can be
+	// got by ConvertWithPlan.
+	DryRun bool
+
+	// PrefetchPatternsFile is the file containing prefetch patterns line by
+	// line, which will be merged with PrefetchPatterns.
+	PrefetchPatternsFile string
+	// PrefetchTracePath is the file access trace collected at runtime, with
+	// an absolute path per line in access order. The traced paths are put
+	// before the prefetch patterns so that the prefetch table follows the
+	// access order, the paths not found in source image are warned.
+	PrefetchTracePath string
+	// PrefetchLayerPolicy limits the prefetched files by the position of
+	// layer, should be one of PrefetchLayerPolicyAll (default),
+	// PrefetchLayerPolicyNone and `bottom-<n>` only prefetching the files
+	// of the lowest n layers. It's applied to the files matched by prefetch
+	// patterns, and the source image is pulled before building to find the
+	// files of the layers.
+	PrefetchLayerPolicy string
+	// PrefetchIncludeMetadataOnly prefetches no file data once the image is
+	// mounted. The bootstrap holding the metadata like inodes and directory
+	// entries is always loaded by nydusd before mounting, so the directories
+	// are listed fast without pulling the file bodies. It can't be used with
+	// any prefetch patterns, trace or layer policy.
+	PrefetchIncludeMetadataOnly bool
+
+	Encrypt        bool
+	EncryptKeyPath string
+
 	AllPlatforms bool
 	Platforms    string
+	// ConvertAllPlatforms converts every platform of source image index one
+	// by one, the failed platforms are skipped rather than aborting the whole
+	// conversion, and the target index only references the converted ones.
+	ConvertAllPlatforms bool
+	// PlatformPrefetchPatterns maps the platform like `linux/arm64` to the
+	// prefetch patterns of its manifest converted with ConvertAllPlatforms,
+	// the platforms without entry use PrefetchPatterns.
+	PlatformPrefetchPatterns map[string]string
+
+	// RetryCount and RetryDelay configure the retry policy with exponential
+	// backoff for the requests to registry, zero RetryCount means no retry.
+	RetryCount int
+	RetryDelay time.Duration
+	// RequestTimeout limits each request to registry, a timed out request
+	// is retried per the retry policy, zero means no limit.
+	RequestTimeout time.Duration
+	// MaxUploadBytesPerSec limits the total throughput of blob uploads to
+	// target registry shared across the concurrent layer pushes, zero means
+	// no limit.
+	MaxUploadBytesPerSec int64
+	// UserAgent replaces the generic User-Agent of the requests to registry,
+	// and RequestHeaders are the static headers like `X-Tenant` set on every
+	// request, except the authorization headers which are never overridden.
+	UserAgent      string
+	RequestHeaders map[string]string
+
+	// CacheDir caches the blobs pulled from source registry by digest to
+	// be reused by subsequent conversions, the least recently used blobs are
+	// evicted once the total size exceeds CacheSizeBytes, zero means no limit.
+	CacheDir       string
+	CacheSizeBytes int64
+	// BuildCacheDir caches the nydus blob layers built from source layers
+	// to be reused by subsequent conversions without running builder, the
+	// layers are keyed by the digest of source layer and build parameters
+	// like chunk size, compressor and builder version, so that any change of
+	// the parameters rebuilds the layer.
+	BuildCacheDir string
+	// SharedBlobDir is the directory shared by conversions to store the
+	// built nydus blobs by digest like `<SharedBlobDir>/<hex>`, which is the
+	// blob directory of localfs backend, so that the same blob is stored on
+	// disk only once. It's safe to be shared by concurrent conversions.
+	SharedBlobDir string
+
+	// Timeout limits the duration of the whole conversion, the running
+	// nydus-image builder processes are killed once it's exceeded.
+	Timeout time.Duration
+
+	// Worker limits the number of layers being converted concurrently,
+	// defaults to the number of CPUs.
+	Worker int
+	// UploadWorker limits the number of blobs being pushed to registry
+	// concurrently apart from Worker, for example to push many blobs to a
+	// slow registry with a few builders, defaults to Worker.
+	UploadWorker int
+	// PullWorker limits the number of source layers being pulled from
+	// registry concurrently, each layer is streamed into the content store
+	// on disk, to bound the memory and bandwidth used on a small builder.
+	// Defaults to provider.LayerConcurrentLimit.
+	PullWorker int
+
+	// KeepWorkDir keeps the temp directory created under WorkDir for each
+	// conversion, which holds the intermediate bootstraps and blobs, for
+	// inspection after the conversion returns. By default it's removed on
+	// either success or failure, together with the WorkDir if it's created
+	// by the conversion.
+	KeepWorkDir bool
+	// BuilderTempDir holds the scratch files of builder like the unpacked
+	// layers and intermediate bootstraps instead of WorkDir, for example a
+	// local disk when WorkDir is on a slow network filesystem, while the
+	// built blobs still land in the content store under WorkDir. It's
+	// created if not exists, and the temp directory created in it for each
+	// conversion is cleaned up like the one under WorkDir.
+	BuilderTempDir string
+
+	// BlobFilter is called with the path of each built nydus blob before it's
+	// pushed, for example to scan the blob by a custom tool, a non-nil error
+	// aborts the conversion. The blob is referenced by digest in bootstrap,
+	// so it must not be modified by the filter. It isn't called with DryRun
+	// since nothing is pushed.
+	BlobFilter func(ctx context.Context, blobPath string) error
+
+	// ProgressCh receives the progress events during conversion if specified,
+	// it will be closed by Convert when the conversion is done. The events
+	// are dropped rather than blocking the conversion if the channel is full,
+	// so it should be buffered and kept drained by the receiver.
+	ProgressCh chan<- Progress
+
+	// Metrics is updated once the conversion finishes if specified, it can
+	// be shared by the conversions to be scraped by prometheus.
+	Metrics *Metrics
 
 	OutputJSON string
 }
 
-func Convert(ctx context.Context, opt Opt) error {
+// Convert converts the source image to Nydus image, and returns the result
+// summarizing the target image.
+func Convert(ctx context.Context, opt Opt) (*Result, error) {
+	if opt.ProgressCh != nil {
+		defer close(opt.ProgressCh)
+	}
+	return convert(ctx, opt)
+}
+
+// ConvertWithPlan converts the image same as Convert, and returns the plan
+// describing the layers of target image, it's useful with Opt.DryRun.
+func ConvertWithPlan(ctx context.Context, opt Opt) (*Plan, error) {
+	if opt.ProgressCh != nil {
+		defer close(opt.ProgressCh)
+	}
+	result, err := convert(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	return result.plan, nil
+}
+
+// remoteOpt returns the option of the requests to registry, like the retry
+// policy and request headers.
+func remoteOpt(opt Opt) originprovider.RemoteOpt {
+	return originprovider.RemoteOpt{
+		RetryCount:     opt.RetryCount,
+		RetryDelay:     opt.RetryDelay,
+		RequestTimeout: opt.RequestTimeout,
+		UserAgent:      opt.UserAgent,
+		Headers:        opt.RequestHeaders,
+
+		MaxUploadBytesPerSec: opt.MaxUploadBytesPerSec,
+	}
+}
+
+func convert(ctx context.Context, opt Opt) (result *Result, err error) {
+	start := time.Now()
+	defer func() {
+		opt.Metrics.observe(result, err)
+	}()
+
+	if opt.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opt.Timeout)
+		defer cancel()
+		defer func() {
+			if err != nil && ctx.Err() == context.DeadlineExceeded {
+				err = errors.Wrapf(err, "conversion timeout after %s", opt.Timeout)
+			}
+		}()
+	}
+
+	if err := validateOpt(opt); err != nil {
+		return nil, errors.Wrap(err, "validate options")
+	}
+	// BaseBootstrapRef is an alias of ChunkDictRef, the base image is
+	// verified as a Nydus image by checking the chunk dict.
+	if opt.BaseBootstrapRef != "" {
+		opt.ChunkDictRef = opt.BaseBootstrapRef
+		opt.ChunkDictInsecure = opt.BaseBootstrapInsecure
+	}
+
+	source := opt.Source
+	switch {
+	case opt.Source != "" && opt.SourcePath != "":
+		return nil, fmt.Errorf("source reference and source path can't be specified together")
+	case opt.Source == "" && opt.SourcePath == "":
+		return nil, fmt.Errorf("either source reference or source path should be specified")
+	case opt.SourcePath != "":
+		source = layoutSourceRef
+	}
+
+	target := opt.Target
+	switch {
+	case opt.Target != "" && opt.TargetPath != "":
+		return nil, fmt.Errorf("target reference and target path can't be specified together")
+	case opt.Target == "" && opt.TargetPath == "":
+		return nil, fmt.Errorf("either target reference or target path should be specified")
+	case opt.TargetPath != "":
+		target = layoutTargetRef
+	}
+
+	if opt.LinkSource && (opt.SourcePath != "" || opt.TargetPath != "") {
+		return nil, fmt.Errorf("link source is only supported between source and target references")
+	}
+	if opt.HybridOutput {
+		if opt.TargetPath != "" {
+			return nil, fmt.Errorf("hybrid output is only supported for target reference")
+		}
+		// The merged index already carries the source manifests.
+		if opt.MergePlatform {
+			return nil, fmt.Errorf("hybrid output can't be used with merge platform")
+		}
+	}
+	if opt.SignKeyPath != "" && opt.TargetPath != "" {
+		return nil, fmt.Errorf("sign is only supported for target reference")
+	}
+	if opt.VerifySourceKeyPath != "" && opt.SourcePath != "" {
+		return nil, fmt.Errorf("source verification is only supported for source reference")
+	}
+	if opt.SBOMPath != "" && opt.TargetPath != "" {
+		return nil, fmt.Errorf("sbom is only supported for target reference")
+	}
+	if opt.Provenance && opt.TargetPath != "" {
+		return nil, fmt.Errorf("provenance is only supported for target reference")
+	}
+	// The blob may be recorded before it's uploaded by builder.
+	if opt.ResumeStateFile != "" && opt.BackendType != "" {
+		return nil, fmt.Errorf("resume isn't supported with storage backend")
+	}
+	if opt.Offline {
+		if opt.SourcePath == "" || opt.TargetPath == "" {
+			return nil, fmt.Errorf("offline mode is only supported between source and target paths")
+		}
+		if opt.ChunkDictRef != "" || opt.CacheRef != "" {
+			return nil, fmt.Errorf("offline mode isn't supported with chunk dict or build cache in registry")
+		}
+		if opt.BackendType != "" {
+			return nil, fmt.Errorf("offline mode isn't supported with storage backend")
+		}
+	}
+	var doc *sbom
+	if opt.SBOMPath != "" {
+		if doc, err = loadSBOM(opt.SBOMPath); err != nil {
+			return nil, err
+		}
+	}
+
+	prefetchPatterns, tracePaths, err := resolvePrefetchPatterns(opt)
+	if err != nil {
+		return nil, err
+	}
+	opt.PrefetchPatterns = prefetchPatterns
+
 	ctx = namespaces.WithNamespace(ctx, "nydusify")
-	platformMC, err := platformutil.ParsePlatforms(opt.AllPlatforms, opt.Platforms)
+	platformMC, err := parsePlatforms(opt.AllPlatforms || opt.ConvertAllPlatforms, opt.Platforms)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if _, err := os.Stat(opt.WorkDir); err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			if err := os.MkdirAll(opt.WorkDir, 0755); err != nil {
-				return errors.Wrap(err, "prepare work directory")
+				return nil, errors.Wrap(err, "prepare work directory")
 			}
 			// We should only clean up when the work directory not exists
 			// before, otherwise it may delete user data by mistake.
-			defer os.RemoveAll(opt.WorkDir)
+			if !opt.KeepWorkDir {
+				defer os.RemoveAll(opt.WorkDir)
+			}
 		} else {
-			return errors.Wrap(err, "stat work directory")
+			return nil, errors.Wrap(err, "stat work directory")
 		}
 	}
 	tmpDir, err := os.MkdirTemp(opt.WorkDir, "nydusify-")
 	if err != nil {
-		return errors.Wrap(err, "create temp directory")
+		return nil, errors.Wrap(err, "create temp directory")
 	}
+	defer func() {
+		if opt.KeepWorkDir {
+			logrus.Infof("keep temp directory %s", tmpDir)
+			return
+		}
+		if err := os.RemoveAll(tmpDir); err != nil {
+			logrus.Warnf("failed to remove temp directory %s: %s", tmpDir, err)
+		}
+	}()
 	pvd, err := provider.New(tmpDir, hosts(opt), opt.CacheMaxRecords, opt.CacheVersion, platformMC, 0)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// Build in the temp directory, so that the partial files left by the
+	// builder interrupted by timeout are cleaned up together.
+	opt.WorkDir = tmpDir
+	if opt.BuilderTempDir != "" {
+		builderDir, cleanup, err := prepareBuilderTempDir(opt.BuilderTempDir, !opt.KeepWorkDir)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		opt.WorkDir = builderDir
+	}
+	if opt.Timeout > 0 {
+		// Only the builder subprocesses started with the link of this
+		// conversion are killed on timeout.
+		builderPath, err := linkBuilder(opt.NydusImagePath, tmpDir)
+		if err != nil {
+			return nil, err
+		}
+		opt.NydusImagePath = builderPath
+		defer killBuildersOnTimeout(ctx, builderPath)()
 	}
-	defer os.RemoveAll(tmpDir)
 
-	cvt, err := converter.New(
-		converter.WithProvider(pvd),
-		converter.WithDriver("nydus", getConfig(opt)),
-		converter.WithPlatform(platformMC),
-	)
+	version, err := builderVersion(ctx, opt)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if opt.ChunkDictRef != "" {
+		if err := checkChunkDict(ctx, opt, tmpDir); err != nil {
+			return nil, errors.Wrap(err, "check chunk dict")
+		}
 	}
 
-	metric, err := cvt.Convert(ctx, opt.Source, opt.Target, opt.CacheRef)
-	if opt.OutputJSON != "" {
-		dumpMetric(metric, opt.OutputJSON)
+	worker := opt.Worker
+	if worker <= 0 {
+		worker = runtime.NumCPU()
 	}
-	return err
+	uploadWorker := opt.UploadWorker
+	if uploadWorker <= 0 {
+		uploadWorker = worker
+	}
+	pvd.SetUploadWorker(uploadWorker)
+	pvd.SetPullWorker(opt.PullWorker)
+	reporter := &reporter{ch: opt.ProgressCh, target: target}
+	if err := pvd.SetRemoteOpt(remoteOpt(opt)); err != nil {
+		return nil, errors.Wrap(err, "set remote option")
+	}
+	if opt.CacheDir != "" {
+		blobCache, err := provider.NewBlobCache(opt.CacheDir, opt.CacheSizeBytes)
+		if err != nil {
+			return nil, err
+		}
+		pvd.SetBlobCache(blobCache)
+	}
+	var buildCache *buildCache
+	if opt.BuildCacheDir != "" {
+		if buildCache, err = newBuildCache(opt.BuildCacheDir, opt, version); err != nil {
+			return nil, err
+		}
+	}
+	pvd.SetProgressFunc(reporter.progressFunc)
+	pvd.SetUploadFunc(reporter.uploadFunc)
+	cs := newStore(pvd.ContentStore(), worker, reporter)
+	if !opt.OCIRef {
+		// The OCI ref builder reads the original gzip layer directly.
+		cs.estargz = true
+	}
+	cs.reproducible = opt.Reproducible
+	cs.owner = opt.OwnerOverride
+	cs.tempDir = tmpDir
+	if cs.filter, err = newPathFilter(opt.IncludePatterns, opt.ExcludePatterns); err != nil {
+		return nil, err
+	}
+	cs.buildCache = buildCache
+	if opt.ResumeStateFile != "" {
+		if cs.resumer, err = newResumer(opt.ResumeStateFile, opt, version, sourceImageDigest(pvd, source)); err != nil {
+			return nil, errors.Wrap(err, "prepare resume state")
+		}
+	}
+	if opt.FlattenWhiteouts {
+		cs.bottomLayers = sourceBottomLayers(pvd, cs.Store, source)
+	}
+	// The source layers pushed with MergePlatform are read from the content
+	// store directly, rather than the one limiting and rewriting the layers
+	// for builder.
+	pvd.SetConvertStore(cs)
+	pvd.SetDryRun(opt.DryRun)
+	if opt.BlobFilter != nil {
+		pvd.SetBlobFilter(newBlobFilter(cs, pvd, opt.BlobFilter))
+	}
+	hook, err := newTargetHook(pvd, cs, opt, source, target)
+	if err != nil {
+		return nil, err
+	}
+	if opt.VerifySourceKeyPath != "" {
+		verified, err := verifySource(ctx, pvd, opt.VerifySourceKeyPath, source)
+		if err != nil {
+			return nil, errors.Wrap(err, "verify source image")
+		}
+		if hook, err = verifiedSourceHook(pvd, hook, source, target, verified); err != nil {
+			return nil, err
+		}
+	}
+	var hybrid *hybridTarget
+	if opt.HybridOutput {
+		if hybrid, err = newHybridTarget(pvd, source, target, opt.DryRun); err != nil {
+			return nil, err
+		}
+		hook = hybrid.hook(hook)
+	}
+	pvd.SetImageHook(hook)
+	if opt.SourcePath != "" {
+		pvd.UseLayout(source, opt.SourcePath)
+	}
+	if opt.TargetPath != "" {
+		pvd.UseLayout(target, opt.TargetPath)
+	}
+	if len(opt.SourceDiffIDs) > 0 {
+		if err := verifySourceDiffIDs(ctx, pvd, cs.Store, source, opt.SourceDiffIDs); err != nil {
+			return nil, errors.Wrap(err, "verify source diff ids")
+		}
+	}
+	if opt.PrefetchLayerPolicy != "" {
+		if opt.PrefetchPatterns, err = sourcePrefetchPatterns(ctx, pvd, cs.Store, source, opt); err != nil {
+			return nil, errors.Wrap(err, "apply prefetch layer policy")
+		}
+	}
+
+	var failedPlatforms []string
+	if opt.ConvertAllPlatforms {
+		failedPlatforms, err = convertAllPlatforms(ctx, opt, pvd, source, target)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		buildOpt := opt
+		if opt.SkipIncompressibleThreshold > 0 {
+			if buildOpt.Compressor, err = probeIncompressible(ctx, opt, pvd, cs, platformMC, source); err != nil {
+				return nil, errors.Wrap(err, "probe incompressible layers")
+			}
+		}
+		cvt, err := converter.New(
+			converter.WithProvider(pvd),
+			converter.WithDriver("nydus", getConfig(buildOpt)),
+			converter.WithPlatform(platformMC),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		metric, err := cvt.Convert(ctx, source, target, opt.CacheRef)
+		opt.Metrics.observeBuild(metric)
+		if opt.OutputJSON != "" {
+			dumpMetric(metric, opt.OutputJSON)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(tracePaths) > 0 {
+		warnMissingTracePaths(ctx, pvd, cs.Store, source, tracePaths)
+	}
+
+	targetNamed, err := docker.ParseDockerRef(target)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse target reference")
+	}
+	targetDesc, err := pvd.Image(ctx, targetNamed.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "get target image")
+	}
+	if hybrid != nil && hybrid.nydus != nil {
+		targetDesc = hybrid.nydus
+	}
+	plan, err := makePlan(ctx, cs, displayRef(opt.Source, opt.SourcePath), displayRef(opt.Target, opt.TargetPath), *targetDesc)
+	if err != nil {
+		return nil, errors.Wrap(err, "make conversion plan")
+	}
+	plan.FailedPlatforms = failedPlatforms
+	sourceNamed, err := docker.ParseDockerRef(source)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse source reference")
+	}
+	sourceDesc, err := pvd.Image(ctx, sourceNamed.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "get source image")
+	}
+	if plan.LayerMap, err = makeLayerMap(ctx, cs, *sourceDesc); err != nil {
+		return nil, errors.Wrap(err, "make layer map")
+	}
+	if version != nil {
+		plan.BuilderVersion = version.String()
+	}
+	if opt.DryRun {
+		return newResult(plan, reporter.pushedBytes.Load(), time.Since(start)), nil
+	}
+
+	if buildCache != nil {
+		if err := saveBuildCache(ctx, cs, plan.LayerMap); err != nil {
+			return nil, errors.Wrap(err, "save build cache")
+		}
+	}
+	if opt.SharedBlobDir != "" {
+		if err := saveSharedBlobs(ctx, cs.Store, opt.SharedBlobDir, plan.Layers); err != nil {
+			return nil, errors.Wrap(err, "save shared blobs")
+		}
+	}
+
+	if opt.SignKeyPath != "" {
+		if err := signImage(ctx, pvd, opt.SignKeyPath, target); err != nil {
+			return nil, errors.Wrap(err, "sign target image")
+		}
+	}
+
+	if doc != nil {
+		if err := attachSBOM(ctx, pvd, doc, target); err != nil {
+			return nil, errors.Wrap(err, "attach sbom")
+		}
+	}
+
+	if opt.Provenance {
+		if err := attachProvenance(ctx, pvd, opt, displayRef(opt.Source, opt.SourcePath), *sourceDesc, target, plan.BuilderVersion); err != nil {
+			return nil, errors.Wrap(err, "attach provenance")
+		}
+	}
+
+	if opt.LinkSource {
+		if err := linkSource(ctx, pvd, source, target); err != nil {
+			return nil, errors.Wrap(err, "link source image")
+		}
+	}
+
+	if cs.resumer != nil {
+		if err := cs.resumer.remove(); err != nil {
+			logrus.Warnf("failed to remove resume state %s: %s", opt.ResumeStateFile, err)
+		}
+	}
+
+	return newResult(plan, reporter.pushedBytes.Load(), time.Since(start)), nil
+}
+
+// displayRef returns the image reference, or the OCI image layout path if
+// the reference isn't specified.
+func displayRef(ref, path string) string {
+	if ref != "" {
+		return ref
+	}
+	return path
+}
+
+// prepareBuilderTempDir creates the temp directory of builder in dir, which
+// also verifies that dir is writable. The returned function removes the temp
+// directory with cleanup, and dir too if it's created here.
+func prepareBuilderTempDir(dir string, cleanup bool) (string, func(), error) {
+	_, err := os.Stat(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", nil, errors.Wrap(err, "stat builder temp directory")
+	}
+	created := err != nil
+	if created {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", nil, errors.Wrap(err, "prepare builder temp directory")
+		}
+	}
+	tmpDir, err := os.MkdirTemp(dir, "nydusify-")
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "builder temp directory %s isn't writable", dir)
+	}
+
+	return tmpDir, func() {
+		if !cleanup {
+			logrus.Infof("keep builder temp directory %s", tmpDir)
+			return
+		}
+		if created {
+			tmpDir = dir
+		}
+		if err := os.RemoveAll(tmpDir); err != nil {
+			logrus.Warnf("failed to remove builder temp directory %s: %s", tmpDir, err)
+		}
+	}, nil
 }
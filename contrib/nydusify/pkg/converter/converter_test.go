@@ -0,0 +1,179 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertRemovesTempDir(t *testing.T) {
+	// The conversion fails after the temp directory is created since the
+	// source OCI image layout doesn't exist.
+	workDir := t.TempDir()
+	opt := Opt{
+		WorkDir:    workDir,
+		SourcePath: filepath.Join(t.TempDir(), "non-existent"),
+		Target:     "localhost/foo:nydus",
+	}
+	_, err := Convert(context.Background(), opt)
+	require.Error(t, err)
+
+	// The temp directory is removed but the user's work directory is kept.
+	entries, err := os.ReadDir(workDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// The work directory created by conversion is removed entirely.
+	opt.WorkDir = filepath.Join(workDir, "created")
+	_, err = Convert(context.Background(), opt)
+	require.Error(t, err)
+	require.NoDirExists(t, opt.WorkDir)
+
+	// The temp directory is kept on request.
+	opt.WorkDir = workDir
+	opt.KeepWorkDir = true
+	_, err = Convert(context.Background(), opt)
+	require.Error(t, err)
+	entries, err = os.ReadDir(workDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.True(t, entries[0].IsDir())
+}
+
+func TestConvertOffline(t *testing.T) {
+	ctx := context.Background()
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	registry := strings.TrimPrefix(server.URL, "http://")
+
+	// The layer blob is missing from source layout.
+	rootfs := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "file"), []byte("file"), 0644))
+	layoutDir := t.TempDir()
+	require.NoError(t, packRootfs(ctx, rootfs, layoutDir))
+	index := ocispec.Index{}
+	indexBytes, err := os.ReadFile(filepath.Join(layoutDir, ocispec.ImageIndexFile))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(indexBytes, &index))
+	manifest := ocispec.Manifest{}
+	readLayoutBlob(t, layoutDir, index.Manifests[0].Digest, &manifest)
+	require.NoError(t, os.Remove(filepath.Join(layoutDir, ocispec.ImageBlobsDir, "sha256", manifest.Layers[0].Digest.Hex())))
+
+	opt := Opt{
+		WorkDir:        t.TempDir(),
+		BuilderVersion: "v2.2.0",
+		SourcePath:     layoutDir,
+		TargetPath:     filepath.Join(t.TempDir(), "target"),
+		Offline:        true,
+	}
+	_, err = Convert(ctx, opt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "open blob")
+
+	ossConfig := `{"bucket_name": "test", "endpoint": "region.oss.com", "access_key_id": "testAK", "access_key_secret": "testSK"}`
+	invalidOpts := map[string]Opt{
+		"offline mode is only supported between source and target paths": {
+			SourcePath: layoutDir, Target: registry + "/foo:nydus",
+		},
+		"offline mode isn't supported with chunk dict or build cache in registry": {
+			SourcePath: layoutDir, TargetPath: opt.TargetPath, ChunkDictRef: registry + "/foo:dict",
+		},
+		"offline mode isn't supported with storage backend": {
+			SourcePath: layoutDir, TargetPath: opt.TargetPath, BackendType: "oss", BackendConfig: ossConfig,
+		},
+	}
+	for message, invalidOpt := range invalidOpts {
+		invalidOpt.WorkDir = opt.WorkDir
+		invalidOpt.Offline = true
+		_, err = Convert(ctx, invalidOpt)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), message)
+	}
+	require.Zero(t, atomic.LoadInt32(&hits))
+
+	_, _, err = hosts(opt)(registry + "/foo:latest")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "offline mode: can't access registry")
+}
+
+func TestConvertBuilderTempDir(t *testing.T) {
+	executable, err := os.Executable()
+	require.NoError(t, err)
+	argsPath := filepath.Join(t.TempDir(), "args")
+	t.Setenv(envFakeBuilder, "1")
+	t.Setenv(envFakeBuilderArgs, argsPath)
+
+	workDir := t.TempDir()
+	builderTempDir := filepath.Join(t.TempDir(), "builder")
+	_, err = Convert(context.Background(), Opt{
+		WorkDir:        workDir,
+		BuilderTempDir: builderTempDir,
+		NydusImagePath: executable,
+		SourcePath:     makeLayout(t, "foo"),
+		TargetPath:     t.TempDir(),
+		Timeout:        time.Second,
+		KeepWorkDir:    true,
+	})
+	require.Error(t, err)
+
+	// The builder writes the intermediate files into the builder temp
+	// directory.
+	data, err := os.ReadFile(argsPath)
+	require.NoError(t, err)
+	args := strings.Split(string(data), "\n")
+	blobPath := ""
+	for idx := 0; idx+1 < len(args); idx++ {
+		if args[idx] == "--blob" {
+			blobPath = args[idx+1]
+		}
+	}
+	require.True(t, strings.HasPrefix(blobPath, builderTempDir+"/"), blobPath)
+	// The built blobs land in the content store under work directory.
+	blobs, err := filepath.Glob(filepath.Join(workDir, "nydusify-*", "content", "blobs", "sha256", "*"))
+	require.NoError(t, err)
+	require.NotEmpty(t, blobs)
+
+	// The builder temp directory created by conversion is removed.
+	builderTempDir = filepath.Join(t.TempDir(), "created")
+	_, err = Convert(context.Background(), Opt{
+		WorkDir:        workDir,
+		BuilderTempDir: builderTempDir,
+		NydusImagePath: executable,
+		SourcePath:     makeLayout(t, "foo"),
+		TargetPath:     t.TempDir(),
+		Timeout:        time.Second,
+	})
+	require.Error(t, err)
+	require.NoDirExists(t, builderTempDir)
+
+	// Failure situation
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, []byte("file"), 0644))
+	_, err = Convert(context.Background(), Opt{
+		WorkDir:        workDir,
+		BuilderTempDir: file,
+		NydusImagePath: executable,
+		SourcePath:     makeLayout(t, "foo"),
+		TargetPath:     t.TempDir(),
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "isn't writable")
+}
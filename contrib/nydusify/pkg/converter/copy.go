@@ -0,0 +1,430 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+	originprovider "github.com/dragonflyoss/nydus/contrib/nydusify/pkg/provider"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// AnnotationSourceDigest is the annotation of target manifest or index
+// recording the digest of source image it's converted from.
+const AnnotationSourceDigest = "io.nydus.source.digest"
+
+// AnnotationBuildParams is the annotation of target manifest or index
+// recording the digest of build parameters it's converted with.
+const AnnotationBuildParams = "io.nydus.build.params"
+
+// buildParamsDigest returns the digest of build parameters deciding the nydus
+// blob layers, like compressor, fs version, chunk size and prefetch patterns,
+// same as the key of build cache. The builder version isn't included since
+// Copy decides to skip rebuilding without running the builder.
+func buildParamsDigest(opt Opt) (digest.Digest, error) {
+	// BaseBootstrapRef is an alias of ChunkDictRef.
+	if opt.BaseBootstrapRef != "" {
+		opt.ChunkDictRef = opt.BaseBootstrapRef
+	}
+	data, err := marshalBuildParams(opt, nil)
+	if err != nil {
+		return "", err
+	}
+	return digest.FromBytes(data), nil
+}
+
+// annotateSource adds the source digest and build parameters annotations
+// into the target manifest or index, the other fields are kept verbatim.
+func annotateSource(ctx context.Context, cs content.Store, sourceDesc, targetDesc ocispec.Descriptor, params digest.Digest) (*ocispec.Descriptor, error) {
+	var target map[string]json.RawMessage
+	if err := readJSON(ctx, cs, targetDesc, &target); err != nil {
+		return nil, errors.Wrap(err, "read target image")
+	}
+	annotations := map[string]string{}
+	if data, ok := target["annotations"]; ok {
+		if err := json.Unmarshal(data, &annotations); err != nil {
+			return nil, errors.Wrap(err, "unmarshal annotations")
+		}
+	}
+	if annotations[AnnotationSourceDigest] == sourceDesc.Digest.String() && annotations[AnnotationBuildParams] == params.String() {
+		return &targetDesc, nil
+	}
+	annotations[AnnotationSourceDigest] = sourceDesc.Digest.String()
+	annotations[AnnotationBuildParams] = params.String()
+	data, err := json.Marshal(annotations)
+	if err != nil {
+		return nil, err
+	}
+	target["annotations"] = data
+
+	desc, err := writeJSON(ctx, cs, targetDesc.MediaType, target)
+	if err != nil {
+		return nil, errors.Wrap(err, "write target image")
+	}
+	desc.Platform = targetDesc.Platform
+	desc.Annotations = targetDesc.Annotations
+
+	return desc, nil
+}
+
+// newTargetHook returns the image hook rewriting the image pushed to target,
+// the other images like build cache are pushed as they are. The source
+// config is preserved if Opt.PreserveConfig is set, the created time is
+// removed if Opt.Reproducible is set, the media types are rewritten by
+// Opt.MediaTypeScheme, the nydus blob layers are annotated if
+// Opt.BlobAnnotations is set, the snapshotter labels are annotated if
+// Opt.SnapshotterCompat is set, and the source digest is annotated if
+// Opt.AnnotateSource is set. It returns nil if none is set.
+func newTargetHook(pvd *provider.Provider, cs *store, opt Opt, source, target string) (provider.ImageHook, error) {
+	rewriteTypes := schemeMediaTypes(opt.MediaTypeScheme) != nil
+	if !opt.PreserveConfig && !opt.Reproducible && !rewriteTypes && !opt.BlobAnnotations && !opt.SnapshotterCompat && !opt.AnnotateSource && !opt.VerifyAfterBuild {
+		return nil, nil
+	}
+	sourceNamed, err := docker.ParseDockerRef(source)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse source reference")
+	}
+	targetNamed, err := docker.ParseDockerRef(target)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse target reference")
+	}
+	params, err := buildParamsDigest(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context, desc ocispec.Descriptor, ref string) (*ocispec.Descriptor, error) {
+		if ref != targetNamed.String() {
+			return &desc, nil
+		}
+		if opt.VerifyAfterBuild {
+			if err := verifyChunks(ctx, pvd.ContentStore(), opt, desc); err != nil {
+				return nil, errors.Wrap(err, "verify chunks")
+			}
+		}
+		sourceDesc, err := pvd.Image(ctx, sourceNamed.String())
+		if err != nil {
+			return nil, errors.Wrap(err, "get source image")
+		}
+		if opt.PreserveConfig {
+			newDesc, err := preserveConfig(ctx, pvd.ContentStore(), *sourceDesc, desc)
+			if err != nil {
+				return nil, errors.Wrap(err, "preserve source config")
+			}
+			desc = *newDesc
+		}
+		if opt.Reproducible {
+			newDesc, err := clearCreated(ctx, pvd.ContentStore(), *sourceDesc, desc)
+			if err != nil {
+				return nil, errors.Wrap(err, "clear created time")
+			}
+			desc = *newDesc
+		}
+		if rewriteTypes {
+			newDesc, err := rewriteMediaTypes(ctx, pvd.ContentStore(), *sourceDesc, desc, opt.MediaTypeScheme)
+			if err != nil {
+				return nil, errors.Wrap(err, "rewrite media types")
+			}
+			desc = *newDesc
+		}
+		if opt.BlobAnnotations {
+			newDesc, err := annotateBlobs(ctx, cs, opt, *sourceDesc, desc)
+			if err != nil {
+				return nil, errors.Wrap(err, "annotate blobs")
+			}
+			desc = *newDesc
+		}
+		if opt.SnapshotterCompat {
+			newDesc, err := snapshotterCompat(ctx, pvd.ContentStore(), opt, *sourceDesc, desc)
+			if err != nil {
+				return nil, errors.Wrap(err, "annotate snapshotter labels")
+			}
+			desc = *newDesc
+		}
+		if opt.AnnotateSource {
+			return annotateSource(ctx, pvd.ContentStore(), *sourceDesc, desc, params)
+		}
+		return &desc, nil
+	}, nil
+}
+
+// resolve resolves the image of remote, and retries with plain HTTP if
+// the registry doesn't support HTTPS.
+func resolve(ctx context.Context, remoter *remote.Remote) (*ocispec.Descriptor, error) {
+	desc, err := remoter.Resolve(ctx)
+	if err != nil && utils.RetryWithHTTP(err) {
+		remoter.MaybeWithHTTP(err)
+		desc, err = remoter.Resolve(ctx)
+	}
+	return desc, err
+}
+
+func pullBytes(ctx context.Context, remoter *remote.Remote, desc ocispec.Descriptor) ([]byte, error) {
+	reader, err := remoter.Pull(ctx, desc, true)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+func pullJSON(ctx context.Context, remoter *remote.Remote, desc ocispec.Descriptor, v interface{}) error {
+	data, err := pullBytes(ctx, remoter, desc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// convertedImage is the target image converted from the source image.
+type convertedImage struct {
+	desc ocispec.Descriptor
+	// data is the manifest or index of image, which is re-pushed after the
+	// missing blobs are recovered.
+	data    []byte
+	blobs   []digest.Digest
+	missing []ocispec.Descriptor
+}
+
+// convertedTarget returns the target image if it's converted from the source
+// image, with the blobs missing in target repository, otherwise nil.
+func convertedTarget(ctx context.Context, opt Opt, targetRemote *remote.Remote) (*convertedImage, error) {
+	sourceRemote, err := originprovider.DefaultRemoteWithOpt(opt.Source, opt.SourceInsecure, remoteOpt(opt))
+	if err != nil {
+		return nil, errors.Wrap(err, "create source remote")
+	}
+	defer sourceRemote.Close()
+	sourceDesc, err := resolve(ctx, sourceRemote)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve source image")
+	}
+	targetDesc, err := resolve(ctx, targetRemote)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			logrus.Infof("target image %s isn't found", opt.Target)
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "resolve target image")
+	}
+
+	data, err := pullBytes(ctx, targetRemote, *targetDesc)
+	if err != nil {
+		return nil, errors.Wrap(err, "pull target image")
+	}
+	var target struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(data, &target); err != nil {
+		return nil, errors.Wrap(err, "unmarshal target image")
+	}
+	if target.Annotations[AnnotationSourceDigest] != sourceDesc.Digest.String() {
+		logrus.Infof("target image %s isn't converted from source image %s@%s", opt.Target, opt.Source, sourceDesc.Digest)
+		return nil, nil
+	}
+	params, err := buildParamsDigest(opt)
+	if err != nil {
+		return nil, err
+	}
+	if target.Annotations[AnnotationBuildParams] != params.String() {
+		logrus.Infof("target image %s isn't converted with the same build parameters", opt.Target)
+		return nil, nil
+	}
+
+	manifests := []ocispec.Descriptor{*targetDesc}
+	if images.IsIndexType(targetDesc.MediaType) {
+		var index ocispec.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, errors.Wrap(err, "unmarshal target index")
+		}
+		manifests = index.Manifests
+	}
+	image := &convertedImage{
+		desc:  *targetDesc,
+		data:  data,
+		blobs: []digest.Digest{},
+	}
+	for _, manifestDesc := range manifests {
+		var manifest ocispec.Manifest
+		if err := pullJSON(ctx, targetRemote, manifestDesc, &manifest); err != nil {
+			return nil, errors.Wrapf(err, "pull target manifest %s", manifestDesc.Digest)
+		}
+		for _, desc := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+			exists, err := targetRemote.Exists(ctx, desc)
+			if err != nil {
+				return nil, errors.Wrapf(err, "check target blob %s", desc.Digest)
+			}
+			if !exists {
+				logrus.Infof("blob %s of target image %s isn't found", desc.Digest, opt.Target)
+				image.missing = append(image.missing, desc)
+			}
+			if desc.MediaType == utils.MediaTypeNydusBlob {
+				image.blobs = append(image.blobs, desc.Digest)
+			}
+		}
+	}
+
+	return image, nil
+}
+
+// blobSources returns the remotes of build cache and chunk dict, the blobs of
+// target image are also pushed to or referenced from their repositories.
+func blobSources(ctx context.Context, opt Opt) []*remote.Remote {
+	sources := []*remote.Remote{}
+	for _, source := range []struct {
+		ref      string
+		insecure bool
+	}{
+		{opt.CacheRef, opt.CacheInsecure},
+		{opt.ChunkDictRef, opt.ChunkDictInsecure},
+	} {
+		if source.ref == "" {
+			continue
+		}
+		remoter, err := originprovider.DefaultRemoteWithOpt(source.ref, source.insecure, remoteOpt(opt))
+		if err != nil {
+			logrus.Warnf("skip blob source %s: %s", source.ref, err)
+			continue
+		}
+		// Resolve to detect the plain HTTP registry.
+		if _, err := resolve(ctx, remoter); err != nil {
+			logrus.Warnf("skip blob source %s: %s", source.ref, err)
+			remoter.Close()
+			continue
+		}
+		sources = append(sources, remoter)
+	}
+	return sources
+}
+
+type countReader struct {
+	io.Reader
+	size int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// recoverBlob copies the blob missing in target repository from the first
+// source having it, the blob is mounted across repositories if the source is
+// in the same registry as target. It returns false if no source has it, and
+// the bytes uploaded to target, which are zero if the blob is mounted.
+func recoverBlob(ctx context.Context, targetRemote *remote.Remote, sources []*remote.Remote, desc ocispec.Descriptor) (bool, int64, error) {
+	for _, source := range sources {
+		reader, err := source.Pull(ctx, desc, true)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				continue
+			}
+			return false, 0, errors.Wrapf(err, "pull blob %s from %s", desc.Digest, source.Ref)
+		}
+		targetRemote.TryBlobMount = true
+		targetRemote.MountSource = source.Ref
+		counter := &countReader{Reader: reader}
+		err = targetRemote.Push(ctx, desc, true, counter)
+		reader.Close()
+		if err != nil {
+			return false, 0, errors.Wrapf(err, "push blob %s", desc.Digest)
+		}
+		logrus.Infof("recovered blob %s from %s", desc.Digest, source.Ref)
+		return true, counter.size, nil
+	}
+	return false, 0, nil
+}
+
+// Copy converts the source image same as Convert, but skips rebuilding if the
+// target image has been converted from the same source image with the same
+// build parameters. The blobs missing in target repository are copied from
+// the repositories of build cache or chunk dict, then the target image is
+// re-pushed, the result is marked as unchanged if nothing is missing. The
+// image is only converted again if the source or build parameters are
+// changed or a missing blob can't be found. The source digest and build
+// parameters are always annotated into target image by Copy.
+func Copy(ctx context.Context, opt Opt) (*Result, error) {
+	if opt.ProgressCh != nil {
+		defer close(opt.ProgressCh)
+	}
+	if opt.Source == "" || opt.Target == "" {
+		return nil, fmt.Errorf("source and target references should be specified")
+	}
+	opt.AnnotateSource = true
+
+	// The build parameters are compared with the prefetch patterns passed
+	// to builder.
+	copyOpt := opt
+	prefetchPatterns, _, err := resolvePrefetchPatterns(opt)
+	if err != nil {
+		return nil, err
+	}
+	copyOpt.PrefetchPatterns = prefetchPatterns
+
+	start := time.Now()
+	targetRemote, err := originprovider.DefaultRemoteWithOpt(opt.Target, opt.TargetInsecure, remoteOpt(opt))
+	if err != nil {
+		return nil, errors.Wrap(err, "create target remote")
+	}
+	defer targetRemote.Close()
+	target, err := convertedTarget(ctx, copyOpt, targetRemote)
+	if err != nil {
+		return nil, err
+	}
+	if target == nil {
+		return convert(ctx, opt)
+	}
+
+	result := &Result{
+		TargetDigest: target.desc.Digest,
+		BlobDigests:  target.blobs,
+		DedupRatio:   1,
+		Unchanged:    len(target.missing) == 0,
+	}
+	if len(target.missing) > 0 {
+		sources := blobSources(ctx, opt)
+		defer func() {
+			for _, source := range sources {
+				source.Close()
+			}
+		}()
+		for _, desc := range target.missing {
+			recovered, uploaded, err := recoverBlob(ctx, targetRemote, sources, desc)
+			if err != nil {
+				return nil, errors.Wrap(err, "recover target blob")
+			}
+			if !recovered {
+				logrus.Warnf("blob %s of target image %s can't be recovered, convert again", desc.Digest, opt.Target)
+				return convert(ctx, opt)
+			}
+			result.PushedBytes += uploaded
+		}
+		if err := targetRemote.Push(ctx, target.desc, false, bytes.NewReader(target.data)); err != nil {
+			return nil, errors.Wrap(err, "push target image")
+		}
+		logrus.Infof("recovered %d blobs of target image %s, skip conversion", len(target.missing), opt.Target)
+	} else {
+		logrus.Infof("target image %s has been converted from source image %s, skip conversion", opt.Target, opt.Source)
+	}
+	result.Elapsed = time.Since(start)
+
+	return result, nil
+}
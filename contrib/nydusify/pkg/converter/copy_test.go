@@ -0,0 +1,343 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestAnnotateSource(t *testing.T) {
+	cs, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	data, err := json.Marshal(ocispec.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Config:      ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromString("config")},
+		Annotations: map[string]string{"foo": "bar"},
+	})
+	require.NoError(t, err)
+	platform := platforms.MustParse("linux/amd64")
+	target := writeContent(t, cs, ocispec.MediaTypeImageManifest, data, true)
+	target.Platform = &platform
+	source := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("source")}
+	params, err := buildParamsDigest(Opt{Compressor: "zstd"})
+	require.NoError(t, err)
+
+	desc, err := annotateSource(ctx, cs, source, target, params)
+	require.NoError(t, err)
+	require.NotEqual(t, target.Digest, desc.Digest)
+	require.Equal(t, &platform, desc.Platform)
+
+	var manifest ocispec.Manifest
+	require.NoError(t, readJSON(ctx, cs, *desc, &manifest))
+	require.Equal(t, map[string]string{
+		"foo":                  "bar",
+		AnnotationSourceDigest: source.Digest.String(),
+		AnnotationBuildParams:  params.String(),
+	}, manifest.Annotations)
+	require.Equal(t, digest.FromString("config"), manifest.Config.Digest)
+
+	// The annotated image is kept as it is.
+	again, err := annotateSource(ctx, cs, source, *desc, params)
+	require.NoError(t, err)
+	require.Equal(t, desc.Digest, again.Digest)
+
+	// The image is annotated again with different build parameters.
+	changed, err := buildParamsDigest(Opt{Compressor: "lz4_block"})
+	require.NoError(t, err)
+	require.NotEqual(t, params, changed)
+	again, err = annotateSource(ctx, cs, source, *desc, changed)
+	require.NoError(t, err)
+	require.NotEqual(t, desc.Digest, again.Digest)
+	require.NoError(t, readJSON(ctx, cs, *again, &manifest))
+	require.Equal(t, changed.String(), manifest.Annotations[AnnotationBuildParams])
+}
+
+type registryManifest struct {
+	mediaType string
+	data      []byte
+}
+
+// fakeRegistry is a minimal registry keeping the blobs and manifests per
+// repository, it supports monolithic upload and cross-repository mount.
+type fakeRegistry struct {
+	mutex     sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string]registryManifest
+	uploads   int
+	blobGets  int
+	// header is checked on every request if set.
+	header    string
+	noHeaders int
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		blobs:     map[string][]byte{},
+		manifests: map[string]registryManifest{},
+	}
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.header != "" && req.Header.Get(r.header) == "" {
+		r.noHeaders++
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case req.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case strings.Contains(path, "/blobs/uploads/"):
+		repo, id, _ := strings.Cut(path, "/blobs/uploads/")
+		switch req.Method {
+		case http.MethodPost:
+			if from := req.URL.Query().Get("from"); from != "" {
+				mount := req.URL.Query().Get("mount")
+				if data, ok := r.blobs[from+"@"+mount]; ok {
+					r.blobs[repo+"@"+mount] = data
+					w.WriteHeader(http.StatusCreated)
+					return
+				}
+			}
+			w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", repo, len(r.blobs)))
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPut:
+			data, _ := io.ReadAll(req.Body)
+			if id == "" || digest.FromBytes(data).String() != req.URL.Query().Get("digest") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			r.uploads++
+			r.blobs[repo+"@"+req.URL.Query().Get("digest")] = data
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case strings.Contains(path, "/blobs/"):
+		repo, dgst, _ := strings.Cut(path, "/blobs/")
+		data, ok := r.blobs[repo+"@"+dgst]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Header().Set("Docker-Content-Digest", dgst)
+		if req.Method == http.MethodGet {
+			r.blobGets++
+			_, _ = w.Write(data)
+		}
+	case strings.Contains(path, "/manifests/"):
+		repo, ref, _ := strings.Cut(path, "/manifests/")
+		if req.Method == http.MethodPut {
+			data, _ := io.ReadAll(req.Body)
+			manifest := registryManifest{mediaType: req.Header.Get("Content-Type"), data: data}
+			r.manifests[repo+":"+ref] = manifest
+			r.manifests[repo+":"+digest.FromBytes(data).String()] = manifest
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		manifest, ok := r.manifests[repo+":"+ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", manifest.mediaType)
+		w.Header().Set("Content-Length", fmt.Sprint(len(manifest.data)))
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest.data).String())
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(manifest.data)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *fakeRegistry) addBlob(repo string, data []byte) ocispec.Descriptor {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	desc := ocispec.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data))}
+	r.blobs[repo+"@"+desc.Digest.String()] = data
+	return desc
+}
+
+func (r *fakeRegistry) addManifest(t *testing.T, repo, tag string, manifest ocispec.Manifest) ocispec.Descriptor {
+	data, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	desc := ocispec.Descriptor{MediaType: manifest.MediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	r.manifests[repo+":"+tag] = registryManifest{mediaType: manifest.MediaType, data: data}
+	r.manifests[repo+":"+desc.Digest.String()] = registryManifest{mediaType: manifest.MediaType, data: data}
+	return desc
+}
+
+func TestCopy(t *testing.T) {
+	registry := newFakeRegistry()
+	server := httptest.NewTLSServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	layer := registry.addBlob("source", []byte("source layer"))
+	layer.MediaType = ocispec.MediaTypeImageLayerGzip
+	config := registry.addBlob("source", []byte("source config"))
+	config.MediaType = ocispec.MediaTypeImageConfig
+	sourceDesc := registry.addManifest(t, "source", "latest", ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+
+	// The builder records its runs, the blobs are never built by Copy.
+	logPath := filepath.Join(t.TempDir(), "builder.log")
+	builderPath := filepath.Join(t.TempDir(), "nydus-image")
+	require.NoError(t, os.WriteFile(builderPath, []byte(fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\nexit 1\n", logPath)), 0755))
+	opt := Opt{
+		WorkDir:        t.TempDir(),
+		NydusImagePath: builderPath,
+		Source:         host + "/source:latest",
+		Target:         host + "/target:nydus",
+		SourceInsecure: true,
+		TargetInsecure: true,
+		CacheRef:       host + "/cache:latest",
+		CacheInsecure:  true,
+		RequestHeaders: map[string]string{"X-Tenant": "foo"},
+	}
+	registry.header = "X-Tenant"
+	params, err := buildParamsDigest(opt)
+	require.NoError(t, err)
+
+	// The target image converted by Convert with AnnotateSource, the blobs
+	// are pushed to build cache too.
+	blob := registry.addBlob("target", []byte("nydus blob"))
+	blob.MediaType = utils.MediaTypeNydusBlob
+	registry.addBlob("cache", []byte("nydus blob"))
+	bootstrap := registry.addBlob("target", []byte("nydus bootstrap"))
+	bootstrap.MediaType = ocispec.MediaTypeImageLayerGzip
+	targetConfig := registry.addBlob("target", []byte("target config"))
+	targetConfig.MediaType = ocispec.MediaTypeImageConfig
+	targetDesc := registry.addManifest(t, "target", "nydus", ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    targetConfig,
+		Layers:    []ocispec.Descriptor{blob, bootstrap},
+		Annotations: map[string]string{
+			AnnotationSourceDigest: sourceDesc.Digest.String(),
+			AnnotationBuildParams:  params.String(),
+		},
+	})
+
+	progressCh := make(chan Progress, 100)
+	skipOpt := opt
+	skipOpt.ProgressCh = progressCh
+	result, err := Copy(context.Background(), skipOpt)
+	require.NoError(t, err)
+	require.True(t, result.Unchanged)
+	require.Equal(t, targetDesc.Digest, result.TargetDigest)
+	require.Equal(t, []digest.Digest{blob.Digest}, result.BlobDigests)
+	require.Zero(t, result.PushedBytes)
+	require.NoFileExists(t, logPath)
+	requireProgressClosed(t, progressCh)
+	registry.mutex.Lock()
+	require.Zero(t, registry.uploads)
+	// The target blobs are checked by HEAD without pulling, and the
+	// requests carry the headers of option.
+	require.Zero(t, registry.blobGets)
+	require.Zero(t, registry.noHeaders)
+	registry.mutex.Unlock()
+
+	// The blob missing in target is recovered from build cache.
+	registry.addManifest(t, "cache", "latest", ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    targetConfig,
+		Layers:    []ocispec.Descriptor{blob},
+	})
+	registry.mutex.Lock()
+	delete(registry.blobs, "target@"+blob.Digest.String())
+	registry.mutex.Unlock()
+	result, err = Copy(context.Background(), opt)
+	require.NoError(t, err)
+	require.False(t, result.Unchanged)
+	require.Equal(t, targetDesc.Digest, result.TargetDigest)
+	// The blob is mounted from build cache without uploading.
+	require.Zero(t, result.PushedBytes)
+	require.NoFileExists(t, logPath)
+	registry.mutex.Lock()
+	require.Equal(t, []byte("nydus blob"), registry.blobs["target@"+blob.Digest.String()])
+	require.Zero(t, registry.uploads)
+	registry.mutex.Unlock()
+
+	// The image is converted again once the build parameters are changed,
+	// the progress channel is closed even if the conversion fails.
+	changedOpt := opt
+	changedOpt.Compressor = "lz4_block"
+	progressCh = make(chan Progress, 100)
+	changedOpt.ProgressCh = progressCh
+	_, err = Copy(context.Background(), changedOpt)
+	require.Error(t, err)
+	require.FileExists(t, logPath)
+	requireProgressClosed(t, progressCh)
+	require.NoError(t, os.Remove(logPath))
+
+	// The image is converted again once the source is changed.
+	registry.addManifest(t, "source", "latest", ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer, layer},
+	})
+	_, err = Copy(context.Background(), opt)
+	require.Error(t, err)
+	require.FileExists(t, logPath)
+}
+
+// requireProgressClosed drains the progress channel and checks it has been
+// closed.
+func requireProgressClosed(t *testing.T, ch chan Progress) {
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		default:
+			require.Fail(t, "progress channel isn't closed")
+			return
+		}
+	}
+}
+
+func TestCopyInvalid(t *testing.T) {
+	// The progress channel is closed on the early errors too.
+	progressCh := make(chan Progress, 1)
+	_, err := Copy(context.Background(), Opt{ProgressCh: progressCh})
+	require.Error(t, err)
+	requireProgressClosed(t, progressCh)
+}
@@ -0,0 +1,292 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// DiffReport is the difference from a Nydus image to another one reported
+// by Diff.
+type DiffReport struct {
+	// Added, Removed and Modified are the sorted absolute paths of the files
+	// only in the new image, only in the old image, and changed in type,
+	// size, content or symlink target.
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
+	// AddedBlobs and RemovedBlobs are the blobs only referenced by the new
+	// image and only by the old image.
+	AddedBlobs   []BootstrapBlob `json:"added_blobs"`
+	RemovedBlobs []BootstrapBlob `json:"removed_blobs"`
+	// CompressedSizeDelta and DecompressedSizeDelta are the total size of
+	// the blobs referenced by the new image minus the old image.
+	CompressedSizeDelta   int64 `json:"compressed_size_delta"`
+	DecompressedSizeDelta int64 `json:"decompressed_size_delta"`
+}
+
+// bootstrapFile is a file reported by `nydus-image check --verbose`.
+type bootstrapFile struct {
+	Type    string
+	Size    uint64
+	Symlink string
+	// Chunks are the chunk digests of file in order.
+	Chunks []string
+}
+
+// unquoteDebug unquotes the leading string of s formatted by the Debug trait
+// of Rust, it returns the string and the rest of s.
+func unquoteDebug(s string) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", "", fmt.Errorf("missing quote")
+	}
+	var builder strings.Builder
+	for idx := 1; idx < len(s); {
+		switch c := s[idx]; c {
+		case '"':
+			return builder.String(), s[idx+1:], nil
+		case '\\':
+			if idx+1 >= len(s) {
+				return "", "", fmt.Errorf("unterminated escape")
+			}
+			switch e := s[idx+1]; e {
+			case 'n':
+				builder.WriteByte('\n')
+			case 'r':
+				builder.WriteByte('\r')
+			case 't':
+				builder.WriteByte('\t')
+			case '0':
+				builder.WriteByte(0)
+			case '\\', '"', '\'':
+				builder.WriteByte(e)
+			case 'x':
+				if idx+4 > len(s) {
+					return "", "", fmt.Errorf("invalid escape \\x")
+				}
+				value, err := strconv.ParseUint(s[idx+2:idx+4], 16, 8)
+				if err != nil {
+					return "", "", errors.Wrap(err, "invalid escape \\x")
+				}
+				builder.WriteByte(byte(value))
+				idx += 4
+				continue
+			case 'u':
+				end := strings.IndexByte(s[idx:], '}')
+				if !strings.HasPrefix(s[idx+2:], "{") || end < 0 {
+					return "", "", fmt.Errorf("invalid escape \\u")
+				}
+				value, err := strconv.ParseUint(s[idx+3:idx+end], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(value)) {
+					return "", "", fmt.Errorf("invalid escape \\u")
+				}
+				builder.WriteRune(rune(value))
+				idx += end + 1
+				continue
+			default:
+				return "", "", fmt.Errorf("unknown escape \\%c", e)
+			}
+			idx += 2
+		default:
+			builder.WriteByte(c)
+			idx++
+		}
+	}
+	return "", "", fmt.Errorf("missing quote")
+}
+
+// parseInodeLine parses the inode line printed by `nydus-image check
+// --verbose` like `inode: file "/foo": index 2 ... i_size 3 ... link None
+// i_mtime ...`, it returns the path and the file.
+func parseInodeLine(line string) (string, *bootstrapFile, error) {
+	rest := strings.TrimPrefix(line, "inode: ")
+	idx := strings.IndexByte(rest, '"')
+	if idx < 0 {
+		return "", nil, fmt.Errorf("invalid inode %q", line)
+	}
+	file := &bootstrapFile{Type: strings.TrimSpace(rest[:idx])}
+	// The first hardlink of inode is reported as file.
+	if file.Type == "hardlink" {
+		file.Type = "file"
+	}
+	path, rest, err := unquoteDebug(rest[idx:])
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "invalid path of inode %q", line)
+	}
+
+	idx = strings.Index(rest, " i_size ")
+	if idx < 0 {
+		return "", nil, fmt.Errorf("invalid inode %q", line)
+	}
+	if _, err := fmt.Sscanf(rest[idx:], " i_size %d", &file.Size); err != nil {
+		return "", nil, errors.Wrapf(err, "invalid size of inode %q", line)
+	}
+	idx = strings.Index(rest, " link Some(")
+	if idx >= 0 {
+		if file.Symlink, _, err = unquoteDebug(rest[idx+len(" link Some("):]); err != nil {
+			return "", nil, errors.Wrapf(err, "invalid symlink of inode %q", line)
+		}
+	}
+	return path, file, nil
+}
+
+// parseBootstrapFiles parses the files and their chunks printed by
+// `nydus-image check --verbose` by absolute path.
+func parseBootstrapFiles(output []byte) (map[string]*bootstrapFile, error) {
+	files := map[string]*bootstrapFile{}
+	var file *bootstrapFile
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "inode: "):
+			path, parsed, err := parseInodeLine(line)
+			if err != nil {
+				return nil, err
+			}
+			file = parsed
+			files[path] = file
+		case strings.HasPrefix(line, "chunk: "):
+			if file == nil {
+				return nil, fmt.Errorf("chunk %q isn't in any inode", line)
+			}
+			chunk, err := parseChunkLine(line)
+			if err != nil {
+				return nil, err
+			}
+			file.Chunks = append(file.Chunks, chunk.ID)
+		}
+	}
+	return files, nil
+}
+
+// modified reports whether the file is changed in type, size, content or
+// symlink target, the chunks are only compared if both files report them.
+func (file *bootstrapFile) modified(other *bootstrapFile) bool {
+	if file.Type != other.Type || file.Size != other.Size || file.Symlink != other.Symlink {
+		return true
+	}
+	if len(file.Chunks) == 0 || len(other.Chunks) == 0 {
+		return false
+	}
+	return strings.Join(file.Chunks, ",") != strings.Join(other.Chunks, ",")
+}
+
+// diffFiles compares the files of old and new bootstraps, the directories
+// are only reported if added, removed or changed in type.
+func diffFiles(oldFiles, newFiles map[string]*bootstrapFile, report *DiffReport) {
+	for path, newFile := range newFiles {
+		if path == "/" {
+			continue
+		}
+		oldFile, ok := oldFiles[path]
+		if !ok {
+			report.Added = append(report.Added, path)
+		} else if newFile.Type == "dir" && oldFile.Type == "dir" {
+			continue
+		} else if oldFile.modified(newFile) {
+			report.Modified = append(report.Modified, path)
+		}
+	}
+	for path := range oldFiles {
+		if _, ok := newFiles[path]; !ok && path != "/" {
+			report.Removed = append(report.Removed, path)
+		}
+	}
+	sort.Strings(report.Added)
+	sort.Strings(report.Removed)
+	sort.Strings(report.Modified)
+}
+
+// diffBlobs compares the blobs referenced by old and new bootstraps.
+func diffBlobs(oldBlobs, newBlobs []BootstrapBlob, report *DiffReport) {
+	oldIDs := map[string]bool{}
+	for _, blob := range oldBlobs {
+		oldIDs[blob.ID] = true
+		report.CompressedSizeDelta -= int64(blob.CompressedSize)
+		report.DecompressedSizeDelta -= int64(blob.DecompressedSize)
+	}
+	newIDs := map[string]bool{}
+	for _, blob := range newBlobs {
+		newIDs[blob.ID] = true
+		report.CompressedSizeDelta += int64(blob.CompressedSize)
+		report.DecompressedSizeDelta += int64(blob.DecompressedSize)
+		if !oldIDs[blob.ID] {
+			report.AddedBlobs = append(report.AddedBlobs, blob)
+		}
+	}
+	for _, blob := range oldBlobs {
+		if !newIDs[blob.ID] {
+			report.RemovedBlobs = append(report.RemovedBlobs, blob)
+		}
+	}
+}
+
+// Diff reports the files and blobs changed from the Nydus image of oldRef
+// to newRef, which are compared by their bootstraps without pulling the
+// blobs. Both refs are a Nydus image in registry, or a local bootstrap file
+// or bootstrap layer like Inspect. Only the NydusImagePath, WorkDir,
+// SourceInsecure and TargetInsecure options of opt are used, for oldRef
+// and newRef respectively.
+func Diff(ctx context.Context, oldRef, newRef string, opt Opt) (*DiffReport, error) {
+	if opt.WorkDir == "" {
+		opt.WorkDir = os.TempDir()
+	}
+	if err := os.MkdirAll(opt.WorkDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "prepare work directory")
+	}
+	workDir, err := os.MkdirTemp(opt.WorkDir, "nydusify-diff-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create diff directory")
+	}
+	defer os.RemoveAll(workDir)
+
+	load := func(ref string, insecure bool, name string) (map[string]*bootstrapFile, []BootstrapBlob, error) {
+		bootstrapPath, err := prepareBootstrap(ctx, ref, insecure, filepath.Join(workDir, name))
+		if err != nil {
+			return nil, nil, err
+		}
+		output, err := checkBootstrapVerbose(ctx, opt, bootstrapPath)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "check bootstrap of %s", ref)
+		}
+		files, err := parseBootstrapFiles(output)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "parse files of %s", ref)
+		}
+		blobs, err := bootstrapBlobs(ctx, opt, bootstrapPath)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "get blobs of %s", ref)
+		}
+		return files, blobs, nil
+	}
+	oldFiles, oldBlobs, err := load(oldRef, opt.SourceInsecure, "old")
+	if err != nil {
+		return nil, err
+	}
+	newFiles, newBlobs, err := load(newRef, opt.TargetInsecure, "new")
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DiffReport{
+		Added:        []string{},
+		Removed:      []string{},
+		Modified:     []string{},
+		AddedBlobs:   []BootstrapBlob{},
+		RemovedBlobs: []BootstrapBlob{},
+	}
+	diffFiles(oldFiles, newFiles, report)
+	diffBlobs(oldBlobs, newBlobs, report)
+	return report, nil
+}
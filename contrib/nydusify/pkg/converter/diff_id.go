@@ -0,0 +1,81 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/reference/docker"
+	accelerrdefs "github.com/goharbor/acceleration-service/pkg/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+// checkDiffIDs compares the known diff IDs of source layers with the diff
+// IDs in the image config of each manifest of image pulled into content
+// store, the layers of diffIDs not referenced by any manifest are ignored
+// with warning.
+func checkDiffIDs(ctx context.Context, cs content.Store, desc ocispec.Descriptor, diffIDs map[digest.Digest]digest.Digest) error {
+	found := map[digest.Digest]bool{}
+	if err := walkManifests(ctx, cs, desc, func(manifest ocispec.Manifest) error {
+		var config ocispec.Image
+		if err := readJSON(ctx, cs, manifest.Config, &config); err != nil {
+			return errors.Wrap(err, "read image config")
+		}
+		if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+			return fmt.Errorf("image config %s has %d diff ids for %d layers", manifest.Config.Digest, len(config.RootFS.DiffIDs), len(manifest.Layers))
+		}
+		for idx, layer := range manifest.Layers {
+			diffID, ok := diffIDs[layer.Digest]
+			if !ok {
+				continue
+			}
+			if diffID != config.RootFS.DiffIDs[idx] {
+				return fmt.Errorf("diff id %s of layer %s doesn't match %s in image config", diffID, layer.Digest, config.RootFS.DiffIDs[idx])
+			}
+			found[layer.Digest] = true
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for layer := range diffIDs {
+		if !found[layer] {
+			logrus.Warnf("layer %s of source diff ids isn't found in source image", layer)
+		}
+	}
+	return nil
+}
+
+// verifySourceDiffIDs pulls the source image and checks the known diff IDs
+// of source layers with its image config before conversion.
+func verifySourceDiffIDs(ctx context.Context, pvd *provider.Provider, cs content.Store, source string, diffIDs map[digest.Digest]digest.Digest) error {
+	sourceNamed, err := docker.ParseDockerRef(source)
+	if err != nil {
+		return errors.Wrap(err, "parse source reference")
+	}
+	if err := pvd.Pull(ctx, sourceNamed.String()); err != nil {
+		if !accelerrdefs.NeedsRetryWithHTTP(err) {
+			return errors.Wrap(err, "pull image")
+		}
+		pvd.UsePlainHTTP()
+		if err := pvd.Pull(ctx, sourceNamed.String()); err != nil {
+			return errors.Wrap(err, "try to pull image")
+		}
+	}
+	sourceDesc, err := pvd.Image(ctx, sourceNamed.String())
+	if err != nil {
+		return errors.Wrap(err, "get source image")
+	}
+
+	return checkDiffIDs(ctx, cs, *sourceDesc, diffIDs)
+}
@@ -0,0 +1,70 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckDiffIDs(t *testing.T) {
+	base, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	marshal := func(v interface{}) []byte {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return data
+	}
+
+	lower := writeContent(t, base, ocispec.MediaTypeImageLayerGzip, []byte("lower"), true)
+	upper := writeContent(t, base, ocispec.MediaTypeImageLayerGzip, []byte("upper"), true)
+	lowerDiffID := digest.FromString("lower diff")
+	upperDiffID := digest.FromString("upper diff")
+	config := writeContent(t, base, ocispec.MediaTypeImageConfig, marshal(ocispec.Image{
+		RootFS: ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{lowerDiffID, upperDiffID}},
+	}), true)
+	manifest := writeContent(t, base, ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{lower, upper},
+	}), true)
+
+	require.NoError(t, checkDiffIDs(ctx, base, manifest, map[digest.Digest]digest.Digest{
+		lower.Digest: lowerDiffID,
+		upper.Digest: upperDiffID,
+	}))
+	// The layer not in image is ignored.
+	require.NoError(t, checkDiffIDs(ctx, base, manifest, map[digest.Digest]digest.Digest{
+		upper.Digest:               upperDiffID,
+		digest.FromString("other"): digest.FromString("other diff"),
+	}))
+
+	// Failure situation
+	err = checkDiffIDs(ctx, base, manifest, map[digest.Digest]digest.Digest{
+		lower.Digest: upperDiffID,
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "diff id "+upperDiffID.String()+" of layer "+lower.Digest.String()+" doesn't match "+lowerDiffID.String())
+
+	broken := writeContent(t, base, ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{lower},
+	}), true)
+	err = checkDiffIDs(ctx, base, broken, map[digest.Digest]digest.Digest{lower.Digest: lowerDiffID})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "has 2 diff ids for 1 layers")
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnquoteDebug(t *testing.T) {
+	value, rest, err := unquoteDebug(`"/dir/a \"b\"\\c\n\u{1f433}\xff": index 1`)
+	require.NoError(t, err)
+	require.Equal(t, "/dir/a \"b\"\\c\n🐳\xff", value)
+	require.Equal(t, ": index 1", rest)
+
+	// Failure situation
+	for _, s := range []string{`/foo`, `"/foo`, `"\u{zz}"`, `"\q"`} {
+		_, _, err = unquoteDebug(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	oldFiles, err := parseBootstrapFiles([]byte(`inode: dir "/": index 1 ino 1 real_ino 1 child_index 2 child_count 3 i_nlink 2 i_size 4096 i_blocks 0 i_name_size 0 i_symlink_size 0 has_xattr false link None i_mtime 0 i_mtime_nsec 0
+inode: dir "/dir": index 2 ino 2 real_ino 2 child_index 5 child_count 1 i_nlink 2 i_size 4096 i_blocks 0 i_name_size 3 i_symlink_size 0 has_xattr false link None i_mtime 1 i_mtime_nsec 0
+inode: file "/dir/file": index 5 ino 5 real_ino 5 child_index 0 child_count 0 i_nlink 1 i_size 3 i_blocks 1 i_name_size 4 i_symlink_size 0 has_xattr false link None i_mtime 0 i_mtime_nsec 0
+	 chunk: id 0a0b, index 0, blob_index 0, file_offset 0, compressed 0/3, uncompressed 0/3
+inode: hardlink "/same": index 3 ino 3 real_ino 3 child_index 0 child_count 0 i_nlink 1 i_size 3 i_blocks 1 i_name_size 4 i_symlink_size 0 has_xattr false link None i_mtime 0 i_mtime_nsec 0
+	 chunk: id 0c0d, index 1, blob_index 0, file_offset 0, compressed 3/3, uncompressed 3/3
+inode: symlink "/link": index 4 ino 4 real_ino 4 child_index 0 child_count 0 i_nlink 1 i_size 4 i_blocks 0 i_name_size 4 i_symlink_size 4 has_xattr false link Some("same") i_mtime 0 i_mtime_nsec 0
+`))
+	require.NoError(t, err)
+	require.Equal(t, &bootstrapFile{Type: "symlink", Size: 4, Symlink: "same"}, oldFiles["/link"])
+	require.Equal(t, &bootstrapFile{Type: "file", Size: 3, Chunks: []string{"0c0d"}}, oldFiles["/same"])
+
+	newFiles, err := parseBootstrapFiles([]byte(`inode: dir "/": index 1 ino 1 real_ino 1 child_index 2 child_count 3 i_nlink 2 i_size 4096 i_blocks 0 i_name_size 0 i_symlink_size 0 has_xattr false link None i_mtime 2 i_mtime_nsec 0
+inode: dir "/dir": index 2 ino 2 real_ino 2 child_index 5 child_count 1 i_nlink 2 i_size 4096 i_blocks 0 i_name_size 3 i_symlink_size 0 has_xattr false link None i_mtime 2 i_mtime_nsec 0
+inode: file "/dir/file": index 5 ino 5 real_ino 5 child_index 0 child_count 0 i_nlink 1 i_size 3 i_blocks 1 i_name_size 4 i_symlink_size 0 has_xattr false link None i_mtime 0 i_mtime_nsec 0
+	 chunk: id 0e0f, index 0, blob_index 1, file_offset 0, compressed 0/3, uncompressed 0/3
+inode: file "/same": index 3 ino 3 real_ino 3 child_index 0 child_count 0 i_nlink 1 i_size 3 i_blocks 1 i_name_size 4 i_symlink_size 0 has_xattr false link None i_mtime 0 i_mtime_nsec 0
+	 chunk: id 0c0d, index 1, blob_index 0, file_offset 0, compressed 3/3, uncompressed 3/3
+inode: file "/new": index 4 ino 4 real_ino 4 child_index 0 child_count 0 i_nlink 1 i_size 0 i_blocks 0 i_name_size 3 i_symlink_size 0 has_xattr false link None i_mtime 0 i_mtime_nsec 0
+`))
+	require.NoError(t, err)
+
+	report := &DiffReport{}
+	diffFiles(oldFiles, newFiles, report)
+	diffBlobs([]BootstrapBlob{
+		{ID: "blob-1", CompressedSize: 10, DecompressedSize: 20},
+		{ID: "blob-2", CompressedSize: 5, DecompressedSize: 5},
+	}, []BootstrapBlob{
+		{ID: "blob-1", CompressedSize: 10, DecompressedSize: 20},
+		{ID: "blob-3", CompressedSize: 8, DecompressedSize: 10},
+	}, report)
+	require.Equal(t, &DiffReport{
+		Added:                 []string{"/new"},
+		Removed:               []string{"/link"},
+		Modified:              []string{"/dir/file"},
+		AddedBlobs:            []BootstrapBlob{{ID: "blob-3", CompressedSize: 8, DecompressedSize: 10}},
+		RemovedBlobs:          []BootstrapBlob{{ID: "blob-2", CompressedSize: 5, DecompressedSize: 5}},
+		CompressedSizeDelta:   3,
+		DecompressedSizeDelta: 5,
+	}, report)
+
+	// Failure situation
+	_, err = parseBootstrapFiles([]byte("\t chunk: id 0a0b, index 0, blob_index 0, file_offset 0, compressed 0/3, uncompressed 0/3"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "isn't in any inode")
+	_, err = parseBootstrapFiles([]byte(`inode: file "/foo`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid path of inode")
+}
@@ -0,0 +1,242 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// dockerArchiveManifestFile is the manifest of images in the tarball
+// written by `docker save`.
+const dockerArchiveManifestFile = "manifest.json"
+
+// dockerArchiveImage is an image entry of the manifest in docker archive.
+type dockerArchiveImage struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// walkTar calls fn with each entry of the tarball at tarPath.
+func walkTar(tarPath string, fn func(hdr *tar.Header, reader io.Reader) error) error {
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return errors.Wrap(err, "open docker archive")
+	}
+	defer file.Close()
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "read docker archive")
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// selectArchiveImage selects the image of repo tag from the images of docker
+// archive, the tag can be omitted if there is only one image.
+func selectArchiveImage(entries []dockerArchiveImage, repoTag string) (*dockerArchiveImage, error) {
+	if repoTag == "" {
+		switch len(entries) {
+		case 0:
+			return nil, fmt.Errorf("no image found in docker archive")
+		case 1:
+			return &entries[0], nil
+		default:
+			return nil, fmt.Errorf("docker archive contains %d images, repo tag is required", len(entries))
+		}
+	}
+	// The repo tags like `busybox:latest` are saved by docker as is, so
+	// they are compared after normalizing.
+	expected := repoTag
+	if named, err := docker.ParseDockerRef(repoTag); err == nil {
+		expected = named.String()
+	}
+	for idx := range entries {
+		for _, tag := range entries[idx].RepoTags {
+			if named, err := docker.ParseDockerRef(tag); err == nil {
+				tag = named.String()
+			}
+			if tag == expected {
+				return &entries[idx], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("image %s not found in docker archive", repoTag)
+}
+
+// archiveLayerMediaType detects the media type of layer by the magic of
+// its compression, `docker save` writes uncompressed layers, while the
+// layers of OCI image loaded by docker may be kept compressed.
+func archiveLayerMediaType(reader *bufio.Reader) string {
+	magic, _ := reader.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return ocispec.MediaTypeImageLayerGzip
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return ocispec.MediaTypeImageLayerZstd
+	default:
+		return ocispec.MediaTypeImageLayer
+	}
+}
+
+// unpackDockerArchive writes the image of repo tag in the docker archive
+// at tarPath into the OCI image layout directory, the config and layers are
+// kept as is so that the diff IDs of config still match.
+func unpackDockerArchive(tarPath, repoTag, dir string) error {
+	var entries []dockerArchiveImage
+	// The layers saved once are symlinked by the other images sharing them.
+	links := map[string]string{}
+	if err := walkTar(tarPath, func(hdr *tar.Header, reader io.Reader) error {
+		name := path.Clean(hdr.Name)
+		switch {
+		case name == dockerArchiveManifestFile && hdr.Typeflag == tar.TypeReg:
+			if err := json.NewDecoder(reader).Decode(&entries); err != nil {
+				return errors.Wrap(err, "decode manifest of docker archive")
+			}
+		case hdr.Typeflag == tar.TypeSymlink:
+			links[name] = path.Join(path.Dir(name), hdr.Linkname)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if entries == nil {
+		return fmt.Errorf("%s not found in docker archive", dockerArchiveManifestFile)
+	}
+	image, err := selectArchiveImage(entries, repoTag)
+	if err != nil {
+		return err
+	}
+
+	resolve := func(name string) string {
+		name = path.Clean(name)
+		for i := 0; i < 255; i++ {
+			target, ok := links[name]
+			if !ok {
+				break
+			}
+			name = target
+		}
+		return name
+	}
+	// descs are the blobs written from the regular files of archive, which
+	// are referred by the config and layers of image.
+	configName := resolve(image.Config)
+	descs := map[string]*ocispec.Descriptor{configName: nil}
+	for _, layer := range image.Layers {
+		descs[resolve(layer)] = nil
+	}
+	if err := walkTar(tarPath, func(hdr *tar.Header, reader io.Reader) error {
+		name := path.Clean(hdr.Name)
+		if desc, ok := descs[name]; !ok || desc != nil || hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		mediaType := ocispec.MediaTypeImageConfig
+		if name != configName {
+			buffered := bufio.NewReader(reader)
+			mediaType = archiveLayerMediaType(buffered)
+			reader = buffered
+		}
+		desc, err := writeLayoutBlob(dir, mediaType, reader)
+		if err != nil {
+			return errors.Wrapf(err, "write %s of docker archive", name)
+		}
+		descs[name] = desc
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	configDesc := descs[configName]
+	if configDesc == nil {
+		return fmt.Errorf("config %s not found in docker archive", image.Config)
+	}
+	layers := []ocispec.Descriptor{}
+	for _, layer := range image.Layers {
+		desc := descs[resolve(layer)]
+		if desc == nil {
+			return fmt.Errorf("layer %s not found in docker archive", layer)
+		}
+		layers = append(layers, *desc)
+	}
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *configDesc,
+		Layers:    layers,
+	}
+	manifestDesc, err := writeLayoutJSON(dir, ocispec.MediaTypeImageManifest, manifest)
+	if err != nil {
+		return errors.Wrap(err, "write image manifest")
+	}
+
+	indexBytes, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{*manifestDesc},
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ocispec.ImageIndexFile), indexBytes, 0644); err != nil {
+		return errors.Wrap(err, "write oci index file")
+	}
+	layoutBytes, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(os.WriteFile(filepath.Join(dir, ocispec.ImageLayoutFile), layoutBytes, 0644), "write oci layout file")
+}
+
+// BuildFromDockerArchive builds the Nydus image from the tarball written by
+// `docker save`, and pushes it to opt.Target or writes it into
+// opt.TargetPath. The image selected by opt.SourceArchiveTag is unpacked as
+// an OCI image layout under opt.WorkDir, which is converted with all the
+// other options of opt, so opt.Source and opt.SourcePath must be empty.
+func BuildFromDockerArchive(ctx context.Context, tarPath string, opt Opt) (*Result, error) {
+	if opt.Source != "" || opt.SourcePath != "" {
+		return nil, fmt.Errorf("source reference and source path can't be specified with docker archive")
+	}
+
+	workDir := opt.WorkDir
+	if workDir == "" {
+		workDir = os.TempDir()
+	}
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "prepare work directory")
+	}
+	layoutDir, err := os.MkdirTemp(workDir, "nydusify-archive-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create archive layout directory")
+	}
+	defer os.RemoveAll(layoutDir)
+
+	if err := unpackDockerArchive(tarPath, opt.SourceArchiveTag, layoutDir); err != nil {
+		return nil, err
+	}
+	opt.SourcePath = layoutDir
+	return Convert(ctx, opt)
+}
@@ -0,0 +1,123 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// writeDockerArchive writes the tarball like `docker save`, the files are
+// written in order, and the value of files starting with `->` is written as
+// a symlink.
+func writeDockerArchive(t *testing.T, path string, files [][2]string) {
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	for _, file := range files {
+		name, data := file[0], file[1]
+		if len(data) > 2 && data[:2] == "->" {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: data[2:], Mode: 0777}))
+			continue
+		}
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Size: int64(len(data)), Mode: 0644}))
+		_, err := tw.Write([]byte(data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+}
+
+func TestUnpackDockerArchive(t *testing.T) {
+	gzipped := bytes.Buffer{}
+	gw := gzip.NewWriter(&gzipped)
+	_, err := gw.Write([]byte("compressed layer"))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	manifest, err := json.Marshal([]dockerArchiveImage{{
+		Config:   "foo.json",
+		RepoTags: []string{"foo:latest"},
+		Layers:   []string{"base/layer.tar", "foo/layer.tar"},
+	}, {
+		Config:   "bar.json",
+		RepoTags: []string{"localhost:5000/bar:v1"},
+		Layers:   []string{"bar/layer.tar"},
+	}})
+	require.NoError(t, err)
+	archive := filepath.Join(t.TempDir(), "images.tar")
+	writeDockerArchive(t, archive, [][2]string{
+		{"base/layer.tar", "base layer"},
+		{"foo/layer.tar", gzipped.String()},
+		{"bar/layer.tar", "->../base/layer.tar"},
+		{"foo.json", `{"os":"linux"}`},
+		{"bar.json", `{"os":"linux","architecture":"arm64"}`},
+		{"manifest.json", string(manifest)},
+	})
+
+	// The repo tag is compared after normalizing.
+	dir := t.TempDir()
+	require.NoError(t, unpackDockerArchive(archive, "docker.io/library/foo", dir))
+	index := ocispec.Index{}
+	indexBytes, err := os.ReadFile(filepath.Join(dir, ocispec.ImageIndexFile))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(indexBytes, &index))
+	require.Len(t, index.Manifests, 1)
+	image := ocispec.Manifest{}
+	readLayoutBlob(t, dir, index.Manifests[0].Digest, &image)
+	require.Equal(t, ocispec.MediaTypeImageConfig, image.Config.MediaType)
+	require.Equal(t, digest.FromString(`{"os":"linux"}`), image.Config.Digest)
+	require.Len(t, image.Layers, 2)
+	require.Equal(t, ocispec.MediaTypeImageLayer, image.Layers[0].MediaType)
+	require.Equal(t, digest.FromString("base layer"), image.Layers[0].Digest)
+	require.Equal(t, ocispec.MediaTypeImageLayerGzip, image.Layers[1].MediaType)
+	require.Equal(t, digest.FromBytes(gzipped.Bytes()), image.Layers[1].Digest)
+
+	// The symlinked layer is resolved.
+	dir = t.TempDir()
+	require.NoError(t, unpackDockerArchive(archive, "localhost:5000/bar:v1", dir))
+	indexBytes, err = os.ReadFile(filepath.Join(dir, ocispec.ImageIndexFile))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(indexBytes, &index))
+	readLayoutBlob(t, dir, index.Manifests[0].Digest, &image)
+	require.Len(t, image.Layers, 1)
+	require.Equal(t, digest.FromString("base layer"), image.Layers[0].Digest)
+
+	// Failure situation
+	err = unpackDockerArchive(archive, "", t.TempDir())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "docker archive contains 2 images, repo tag is required")
+
+	err = unpackDockerArchive(archive, "foo:v2", t.TempDir())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "image foo:v2 not found in docker archive")
+
+	broken := filepath.Join(t.TempDir(), "broken.tar")
+	writeDockerArchive(t, broken, [][2]string{
+		{"foo.json", "{}"},
+		{"manifest.json", `[{"Config":"foo.json","Layers":["foo/layer.tar"]}]`},
+	})
+	err = unpackDockerArchive(broken, "", t.TempDir())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "layer foo/layer.tar not found in docker archive")
+
+	writeDockerArchive(t, broken, [][2]string{{"foo.json", "{}"}})
+	err = unpackDockerArchive(broken, "", t.TempDir())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "manifest.json not found in docker archive")
+
+	_, err = BuildFromDockerArchive(context.Background(), archive, Opt{SourcePath: dir})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "can't be specified with docker archive")
+}
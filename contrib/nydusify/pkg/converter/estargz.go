@@ -0,0 +1,140 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// writeEstargzTar writes the tar stream of eStargz layer, the TOC, footer
+// and prefetch landmarks are dropped, so they don't appear in the file tree
+// of Nydus image.
+func writeEstargzTar(ra content.ReaderAt, tocOffset int64, w io.Writer) error {
+	// The TOC follows the gzip members of all the tar entries.
+	reader, err := gzip.NewReader(io.NewSectionReader(ra, 0, tocOffset))
+	if err != nil {
+		return errors.Wrap(err, "decompress estargz layer")
+	}
+	defer reader.Close()
+
+	tr := tar.NewReader(reader)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read estargz layer")
+		}
+		if name := strings.TrimPrefix(hdr.Name, "./"); name == estargz.PrefetchLandmark || name == estargz.NoPrefetchLandmark {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrap(err, "write tar header")
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return errors.Wrapf(err, "write tar entry %s", hdr.Name)
+		}
+	}
+	return errors.Wrap(tw.Close(), "close tar writer")
+}
+
+// tarReaderAt reads the tar of source layer rewritten by write, the tar is
+// spooled into a temp file by writing once, so that its size is known to the
+// builder before reading.
+type tarReaderAt struct {
+	ra   content.ReaderAt
+	file *os.File
+	size int64
+}
+
+// newTarReaderAt returns the reader of the tar stream written by write, the
+// stream is spooled into a temp file in dir, which is removed along with
+// closing ra on Close. The system temp directory is used if dir is empty.
+func newTarReaderAt(ra content.ReaderAt, write func(w io.Writer) error, dir string) (content.ReaderAt, error) {
+	file, err := os.CreateTemp(dir, "layer-*.tar")
+	if err != nil {
+		return nil, errors.Wrap(err, "create temp file")
+	}
+	size, err := spoolTar(file, write)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return &tarReaderAt{
+		ra:   ra,
+		file: file,
+		size: size,
+	}, nil
+}
+
+func spoolTar(file *os.File, write func(w io.Writer) error) (int64, error) {
+	writer := bufio.NewWriter(file)
+	if err := write(writer); err != nil {
+		return 0, err
+	}
+	if err := writer.Flush(); err != nil {
+		return 0, errors.Wrap(err, "write temp file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "stat temp file")
+	}
+	return info.Size(), nil
+}
+
+func (ra *tarReaderAt) Size() int64 {
+	return ra.size
+}
+
+func (ra *tarReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return ra.file.ReadAt(p, off)
+}
+
+func (ra *tarReaderAt) Close() error {
+	ra.file.Close()
+	if err := os.Remove(ra.file.Name()); err != nil {
+		logrus.Warnf("failed to remove temp file %s: %s", ra.file.Name(), err)
+	}
+	return ra.ra.Close()
+}
+
+// estargzTar returns the function writing the tar stream of eStargz layer.
+// It returns nil if the layer has no eStargz footer, then the layer is read
+// as a normal tarball.
+func estargzTar(ra content.ReaderAt) func(w io.Writer) error {
+	// The footer records the offset of TOC.
+	tocOffset, _, err := estargz.OpenFooter(io.NewSectionReader(ra, 0, ra.Size()))
+	if err != nil {
+		return nil
+	}
+	return func(w io.Writer) error {
+		return writeEstargzTar(ra, tocOffset, w)
+	}
+}
+
+// unpackEstargz returns the reader of the tar stream of eStargz layer spooled
+// in dir, which closes ra on Close. It returns nil if the layer has no
+// eStargz footer.
+func unpackEstargz(ra content.ReaderAt, dir string) (content.ReaderAt, error) {
+	write := estargzTar(ra)
+	if write == nil {
+		return nil, nil
+	}
+	return newTarReaderAt(ra, write, dir)
+}
@@ -0,0 +1,194 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+type bytesReaderAt struct {
+	*bytes.Reader
+}
+
+func (ra *bytesReaderAt) Close() error {
+	return nil
+}
+
+func newBytesReaderAt(data []byte) content.ReaderAt {
+	return &bytesReaderAt{Reader: bytes.NewReader(data)}
+}
+
+// makeEstargz makes an eStargz blob by hand, since the footer written by
+// estargz package depends on the gzip implementation of Go.
+func makeEstargz(t *testing.T, files map[string]string, names ...string) []byte {
+	// The tar stream is split into gzip members, only the last one has the
+	// end of archive.
+	gzipMember := func(last bool, write func(tw *tar.Writer)) []byte {
+		buf := bytes.Buffer{}
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		write(tw)
+		if last {
+			require.NoError(t, tw.Close())
+		} else {
+			require.NoError(t, tw.Flush())
+		}
+		require.NoError(t, gw.Close())
+		return buf.Bytes()
+	}
+	writeFile := func(tw *tar.Writer, name, data string) {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}))
+		_, err := tw.Write([]byte(data))
+		require.NoError(t, err)
+	}
+
+	blob := gzipMember(false, func(tw *tar.Writer) {
+		for _, name := range names {
+			writeFile(tw, name, files[name])
+		}
+	})
+	tocOffset := len(blob)
+	blob = append(blob, gzipMember(true, func(tw *tar.Writer) {
+		writeFile(tw, estargz.TOCTarName, `{"version":1,"entries":[]}`)
+	})...)
+
+	// The footer is an empty gzip member, whose extra field records the
+	// offset of TOC.
+	footer := []byte{0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0, 0xff, 26, 0, 'S', 'G', 22, 0}
+	footer = append(footer, []byte(fmt.Sprintf("%016xSTARGZ", tocOffset))...)
+	footer = append(footer, 0x01, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+	require.Len(t, footer, estargz.FooterSize)
+
+	return append(blob, footer...)
+}
+
+func TestUnpackEstargz(t *testing.T) {
+	files := map[string]string{"etc/passwd": "root", "usr/bin/bash": "bash", estargz.PrefetchLandmark: "\x0c"}
+	blob := makeEstargz(t, files, "usr/bin/bash", estargz.PrefetchLandmark, "etc/passwd")
+
+	ra, err := unpackEstargz(newBytesReaderAt(blob), t.TempDir())
+	require.NoError(t, err)
+	require.NotNil(t, ra)
+	defer ra.Close()
+
+	// The TOC and landmarks are dropped from the tarball.
+	unpacked := map[string]string{}
+	tr := tar.NewReader(content.NewReader(ra))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		unpacked[hdr.Name] = string(data)
+	}
+	require.Equal(t, map[string]string{"etc/passwd": "root", "usr/bin/bash": "bash"}, unpacked)
+
+	// The normal gzip layer is read as it is.
+	ra, err = unpackEstargz(newBytesReaderAt(makeLayer(t, "etc/passwd")), t.TempDir())
+	require.NoError(t, err)
+	require.Nil(t, ra)
+}
+
+func TestTarReaderAt(t *testing.T) {
+	layer := makeLayer(t, "etc/passwd", "usr/bin/bash")
+	source := newBytesReaderAt(layer)
+	var expected bytes.Buffer
+	require.NoError(t, decompressTar(source)(&expected))
+
+	// The stream is written only once.
+	writes := 0
+	write := func(w io.Writer) error {
+		writes++
+		return decompressTar(source)(w)
+	}
+	dir := t.TempDir()
+	ra, err := newTarReaderAt(source, write, dir)
+	require.NoError(t, err)
+	require.Equal(t, 1, writes)
+	require.Equal(t, int64(expected.Len()), ra.Size())
+
+	// The stream is read at any offset, including backward.
+	data := make([]byte, 512)
+	n, err := ra.ReadAt(data, 512)
+	require.NoError(t, err)
+	require.Equal(t, expected.Bytes()[512:512+n], data[:n])
+	n, err = ra.ReadAt(data, 0)
+	require.NoError(t, err)
+	require.Equal(t, expected.Bytes()[:n], data[:n])
+	_, err = ra.ReadAt(data, ra.Size())
+	require.Equal(t, io.EOF, err)
+	data, err = io.ReadAll(content.NewReader(ra))
+	require.NoError(t, err)
+	require.Equal(t, expected.Bytes(), data)
+	require.Equal(t, 1, writes)
+
+	// The temp file is removed on close.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.NoError(t, ra.Close())
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// Nothing is left if the stream fails to be written.
+	_, err = newTarReaderAt(source, func(w io.Writer) error {
+		return fmt.Errorf("broken layer")
+	}, dir)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "broken layer")
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestStoreUnpacksEstargzForBuilder(t *testing.T) {
+	cs, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	files := map[string]string{"etc/passwd": "root"}
+	blob := makeEstargz(t, files, "etc/passwd")
+	desc := writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, blob, true)
+	s := newStore(cs, 1, &reporter{})
+	s.estargz = true
+
+	// The builder reads the tar stream without TOC.
+	ra, err := s.ReaderAt(ctx, desc)
+	require.NoError(t, err)
+	data, err := io.ReadAll(content.NewReader(ra))
+	require.NoError(t, err)
+	require.NoError(t, ra.Close())
+	tr := tar.NewReader(bytes.NewReader(data))
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, "etc/passwd", hdr.Name)
+	_, err = tr.Next()
+	require.Equal(t, io.EOF, err)
+
+	// The original layer is kept in the base store for pushing.
+	ra, err = cs.ReaderAt(ctx, desc)
+	require.NoError(t, err)
+	defer ra.Close()
+	data, err = io.ReadAll(content.NewReader(ra))
+	require.NoError(t, err)
+	require.Equal(t, blob, data)
+}
@@ -0,0 +1,186 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/containerd/fifo"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/build"
+	parserPkg "github.com/dragonflyoss/nydus/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// ExportOpt is the option of exporting Nydus image back to an OCI layer
+// tarball.
+type ExportOpt struct {
+	WorkDir        string
+	NydusImagePath string
+
+	Source         string
+	SourceInsecure bool
+	// ExpectedArch chooses the Nydus image from image index, defaults to
+	// the arch of host.
+	ExpectedArch string
+
+	// Writer receives the gzip compressed tar stream, which reconstructs
+	// the file tree of all layers in Nydus image.
+	Writer io.Writer
+}
+
+// pullBlob pulls the blob layer into blob directory with digest verified.
+func pullBlob(ctx context.Context, parser *parserPkg.Parser, desc ocispec.Descriptor, blobDir string) error {
+	reader, err := parser.Remote.Pull(ctx, desc, true)
+	if err != nil {
+		return errors.Wrap(err, "pull blob")
+	}
+	defer reader.Close()
+
+	file, err := os.Create(filepath.Join(blobDir, desc.Digest.Hex()))
+	if err != nil {
+		return errors.Wrap(err, "create blob file")
+	}
+	defer file.Close()
+
+	verifier := desc.Digest.Verifier()
+	if _, err := io.Copy(io.MultiWriter(file, verifier), reader); err != nil {
+		return errors.Wrap(err, "write blob file")
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("blob digest mismatched, expected %s", desc.Digest)
+	}
+
+	return nil
+}
+
+// Export pulls the bootstrap and blobs of Nydus image, and flattens all the
+// layers into an OCI layer tarball, the whiteouts have been applied in the
+// merged bootstrap and the hardlinks are kept in tarball. The tarball is
+// streamed to Writer through fifo without buffering the whole layer.
+func Export(ctx context.Context, opt ExportOpt) error {
+	if opt.Source == "" {
+		return fmt.Errorf("source reference should be specified")
+	}
+	if opt.Writer == nil {
+		return fmt.Errorf("writer should be specified")
+	}
+	if opt.ExpectedArch == "" {
+		opt.ExpectedArch = runtime.GOARCH
+	}
+
+	if err := os.MkdirAll(opt.WorkDir, 0755); err != nil {
+		return errors.Wrap(err, "prepare work directory")
+	}
+	tmpDir, err := os.MkdirTemp(opt.WorkDir, "nydusify-export-")
+	if err != nil {
+		return errors.Wrap(err, "create temp directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	parser, parsed, err := parseNydusImage(ctx, opt.Source, opt.SourceInsecure, opt.ExpectedArch)
+	if err != nil {
+		return err
+	}
+
+	bootstrapPath := filepath.Join(tmpDir, "bootstrap")
+	reader, err := parser.PullNydusBootstrap(ctx, parsed.NydusImage)
+	if err != nil {
+		return errors.Wrap(err, "pull bootstrap layer")
+	}
+	defer reader.Close()
+	if err := utils.UnpackFile(reader, utils.BootstrapFileNameInLayer, bootstrapPath); err != nil {
+		return errors.Wrap(err, "unpack bootstrap layer")
+	}
+
+	blobDir := filepath.Join(tmpDir, "blobs")
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return errors.Wrap(err, "create blob directory")
+	}
+	for _, layer := range parsed.NydusImage.Manifest.Layers {
+		if layer.MediaType != utils.MediaTypeNydusBlob {
+			continue
+		}
+		logrus.Infof("pulling blob %s", layer.Digest)
+		if err := pullBlob(ctx, parser, layer, blobDir); err != nil {
+			return errors.Wrapf(err, "pull blob %s", layer.Digest)
+		}
+	}
+
+	tarPath := filepath.Join(tmpDir, "layer.tar")
+	return exportTar(ctx, tarPath, opt.Writer, func() error {
+		return build.NewBuilder(opt.NydusImagePath).Unpack(build.UnpackOption{
+			BootstrapPath: bootstrapPath,
+			BlobDir:       blobDir,
+			OutputPath:    tarPath,
+		})
+	})
+}
+
+// exportWriter records the error of writer.
+type exportWriter struct {
+	io.Writer
+	err error
+}
+
+func (w *exportWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// exportTar compresses the tarball written by unpack into the fifo of
+// tarPath to writer.
+func exportTar(ctx context.Context, tarPath string, writer io.Writer, unpack func() error) error {
+	tarFifo, err := fifo.OpenFifo(ctx, tarPath, syscall.O_CREAT|syscall.O_RDONLY|syscall.O_NONBLOCK, 0640)
+	if err != nil {
+		return errors.Wrap(err, "create fifo file")
+	}
+	defer tarFifo.Close()
+
+	unpackErr := make(chan error, 1)
+	go func() {
+		err := unpack()
+		if err != nil {
+			// Unblock the reader if the builder fails before opening fifo.
+			tarFifo.Close()
+		}
+		unpackErr <- err
+	}()
+
+	output := &exportWriter{Writer: writer}
+	gzWriter := gzip.NewWriter(output)
+	_, copyErr := io.Copy(gzWriter, tarFifo)
+	if copyErr != nil {
+		// Nothing reads the fifo anymore, close it so that the builder
+		// fails writing into it rather than blocking forever.
+		tarFifo.Close()
+	}
+	err = <-unpackErr
+	// The builder fails writing into the closed fifo if the writer failed.
+	if output.err != nil {
+		return errors.Wrap(output.err, "compress tarball")
+	}
+	if err != nil {
+		return errors.Wrap(err, "unpack nydus image")
+	}
+	if copyErr != nil {
+		return errors.Wrap(copyErr, "compress tarball")
+	}
+
+	return errors.Wrap(gzWriter.Close(), "close gzip writer")
+}
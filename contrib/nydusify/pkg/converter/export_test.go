@@ -0,0 +1,87 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportInvalidOpt(t *testing.T) {
+	err := Export(context.Background(), ExportOpt{Writer: &bytes.Buffer{}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "source reference should be specified")
+
+	err = Export(context.Background(), ExportOpt{Source: "localhost:5000/foo:nydus"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "writer should be specified")
+}
+
+type failedWriter struct{}
+
+func (w *failedWriter) Write(_ []byte) (int, error) {
+	return 0, fmt.Errorf("disk is full")
+}
+
+// fakeUnpack writes the data into the fifo like builder, which blocks until
+// the data is read.
+func fakeUnpack(tarPath string, data []byte, count int) func() error {
+	return func() error {
+		file, err := os.OpenFile(tarPath, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		for i := 0; i < count; i++ {
+			if _, err := file.Write(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func TestExportTar(t *testing.T) {
+	tarPath := filepath.Join(t.TempDir(), "layer.tar")
+	data := bytes.Repeat([]byte("nydus"), 1024)
+	buf := &bytes.Buffer{}
+	require.NoError(t, exportTar(context.Background(), tarPath, buf, fakeUnpack(tarPath, data, 10)))
+	reader, err := gzip.NewReader(buf)
+	require.NoError(t, err)
+	exported, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat(data, 10), exported)
+
+	// The builder failure is returned.
+	tarPath = filepath.Join(t.TempDir(), "layer.tar")
+	err = exportTar(context.Background(), tarPath, &bytes.Buffer{}, func() error {
+		return fmt.Errorf("invalid bootstrap")
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unpack nydus image: invalid bootstrap")
+
+	// The builder writing into fifo isn't blocked if the copy fails.
+	tarPath = filepath.Join(t.TempDir(), "layer.tar")
+	done := make(chan error, 1)
+	go func() {
+		done <- exportTar(context.Background(), tarPath, &failedWriter{}, fakeUnpack(tarPath, bytes.Repeat(data, 64), 1024))
+	}()
+	select {
+	case err := <-done:
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "compress tarball: disk is full")
+	case <-time.After(10 * time.Second):
+		t.Fatal("export isn't returned after copy failure")
+	}
+}
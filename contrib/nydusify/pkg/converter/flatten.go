@@ -0,0 +1,91 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+// dropWhiteouts returns the function writing the tar stream written by write
+// without the whiteout and opaque whiteout entries.
+func dropWhiteouts(write func(w io.Writer) error) func(w io.Writer) error {
+	return rewriteTar(write, func(hdr *tar.Header) bool {
+		return !strings.HasPrefix(path.Base(hdr.Name), whiteoutPrefix)
+	})
+}
+
+// bottomLayers returns the layers which are the lowest layer of all the
+// manifests of image pulled into content store referencing them. A layer
+// also stacked on other layers by any manifest isn't returned, since its
+// whiteouts delete the files of lower layers there.
+func bottomLayers(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (map[digest.Digest]bool, error) {
+	bottom := map[digest.Digest]bool{}
+	upper := map[digest.Digest]bool{}
+	childrenHandler := images.ChildrenHandler(cs)
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if !images.IsManifestType(desc.MediaType) {
+			children, err := childrenHandler.Handle(ctx, desc)
+			if errdefs.IsNotFound(err) {
+				return nil, nil
+			}
+			return children, err
+		}
+
+		var manifest ocispec.Manifest
+		if err := readJSON(ctx, cs, desc, &manifest); err != nil {
+			// The manifest of unmatched platform isn't pulled.
+			if errdefs.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, errors.Wrap(err, "read manifest")
+		}
+		for idx, layer := range manifest.Layers {
+			if idx == 0 {
+				bottom[layer.Digest] = true
+			} else {
+				upper[layer.Digest] = true
+			}
+		}
+		return nil, nil
+	})
+	if err := images.Walk(ctx, handler, desc); err != nil {
+		return nil, err
+	}
+
+	for dgst := range upper {
+		delete(bottom, dgst)
+	}
+	return bottom, nil
+}
+
+// sourceBottomLayers returns the function getting the bottom layers of
+// source image, which is called once the source image is pulled.
+func sourceBottomLayers(pvd *provider.Provider, cs content.Store, source string) func(ctx context.Context) (map[digest.Digest]bool, error) {
+	return func(ctx context.Context) (map[digest.Digest]bool, error) {
+		sourceNamed, err := docker.ParseDockerRef(source)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse source reference")
+		}
+		sourceDesc, err := pvd.Image(ctx, sourceNamed.String())
+		if err != nil {
+			return nil, errors.Wrap(err, "get source image")
+		}
+		return bottomLayers(ctx, cs, *sourceDesc)
+	}
+}
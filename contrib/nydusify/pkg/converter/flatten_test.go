@@ -0,0 +1,108 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDropWhiteouts(t *testing.T) {
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"dir-1/", "dir-1/.wh.file-2", "dir-1/file-1", "dir-2/", "dir-2/.wh..wh..opq", ".wh.file-3", "file.wh.txt"} {
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+		if name[len(name)-1] == '/' {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		}
+		if name == "dir-1/file-1" {
+			hdr.Size = 6
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Size > 0 {
+			_, err := tw.Write([]byte("file-1"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	layer := buf.Bytes()
+
+	ra, err := newTarReaderAt(newBytesReaderAt(layer), dropWhiteouts(decompressTar(newBytesReaderAt(layer))), t.TempDir())
+	require.NoError(t, err)
+	defer ra.Close()
+
+	names := []string{}
+	tr := tar.NewReader(io.NewSectionReader(ra, 0, ra.Size()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		if hdr.Name == "dir-1/file-1" {
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			require.Equal(t, "file-1", string(data))
+		}
+	}
+	require.Equal(t, []string{"dir-1/", "dir-1/file-1", "dir-2/", "file.wh.txt"}, names)
+}
+
+func TestBottomLayers(t *testing.T) {
+	cs, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	marshal := func(v interface{}) []byte {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return data
+	}
+	layer := func(data string) ocispec.Descriptor {
+		return writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, []byte(data), true)
+	}
+	writeManifest := func(layers ...ocispec.Descriptor) ocispec.Descriptor {
+		return writeContent(t, cs, ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    writeContent(t, cs, ocispec.MediaTypeImageConfig, []byte("{}"), true),
+			Layers:    layers,
+		}), true)
+	}
+
+	base, app, shared := layer("base"), layer("app"), layer("shared")
+	bottom, err := bottomLayers(ctx, cs, writeManifest(base, app))
+	require.NoError(t, err)
+	require.Equal(t, map[digest.Digest]bool{base.Digest: true}, bottom)
+
+	// The layer stacked on other layers in another platform isn't bottom.
+	index := writeContent(t, cs, ocispec.MediaTypeImageIndex, marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{
+			writeManifest(base, app),
+			writeManifest(shared, app),
+			writeManifest(base, shared),
+			// The manifest of unmatched platform isn't pulled.
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("missing"), Size: 7},
+		},
+	}), true)
+	bottom, err = bottomLayers(ctx, cs, index)
+	require.NoError(t, err)
+	require.Equal(t, map[digest.Digest]bool{base.Digest: true}, bottom)
+}
@@ -0,0 +1,145 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/backend"
+)
+
+// defaultGCGracePeriod keeps the blobs uploaded by the conversions whose
+// images aren't pushed yet.
+const defaultGCGracePeriod = 24 * time.Hour
+
+// GCOpt is the option of GCBackend.
+type GCOpt struct {
+	WorkDir        string
+	NydusImagePath string
+
+	BackendType   string
+	BackendConfig string
+	// Backend is used instead of the one of BackendType and BackendConfig
+	// if specified, for example a custom object storage.
+	Backend backend.Collector
+
+	// LiveRefs are the Nydus images in registry, or local bootstrap files
+	// or bootstrap layers, whose blobs are referenced and never deleted.
+	LiveRefs []string
+	Insecure bool
+
+	// GracePeriod keeps the unreferenced blobs modified within it, which
+	// may be referenced by the images being converted, defaults to 24
+	// hours.
+	GracePeriod time.Duration
+	// DryRun only reports the blobs to be deleted without deleting them.
+	DryRun bool
+}
+
+// GCResult is the blobs collected by GCBackend.
+type GCResult struct {
+	// Referenced is the number of blobs referenced by the live images.
+	Referenced int `json:"referenced"`
+	// Deleted are the IDs of the unreferenced blobs deleted from backend,
+	// or to be deleted with GCOpt.DryRun.
+	Deleted []string `json:"deleted"`
+	// Recent are the IDs of the unreferenced blobs kept in grace period.
+	Recent []string `json:"recent"`
+}
+
+// referencedBlobs returns the blob IDs referenced by the bootstraps of refs,
+// any failure aborts the collection, so that no referenced blob is deleted
+// by mistake.
+func referencedBlobs(ctx context.Context, opt GCOpt) (map[string]bool, error) {
+	referenced := map[string]bool{}
+	for _, ref := range opt.LiveRefs {
+		info, err := Inspect(ctx, ref, Opt{
+			WorkDir:        opt.WorkDir,
+			NydusImagePath: opt.NydusImagePath,
+			SourceInsecure: opt.Insecure,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "inspect live image %s", ref)
+		}
+		for _, blob := range info.Blobs {
+			referenced[blob.ID] = true
+		}
+	}
+	return referenced, nil
+}
+
+// GCBackend deletes the blobs from storage backend which are referenced by
+// none of opt.LiveRefs, like the blobs of deleted images. It's conservative,
+// the blobs modified within opt.GracePeriod are kept, and nothing is deleted
+// if the blobs of any live image can't be got.
+func GCBackend(ctx context.Context, opt GCOpt) (*GCResult, error) {
+	if len(opt.LiveRefs) == 0 {
+		return nil, fmt.Errorf("no live image specified, refuse to delete all blobs")
+	}
+	gracePeriod := opt.GracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = defaultGCGracePeriod
+	}
+
+	collector := opt.Backend
+	if collector == nil {
+		if err := validateBackend(opt.BackendType, opt.BackendConfig); err != nil {
+			return nil, err
+		}
+		if opt.BackendType == "" {
+			return nil, fmt.Errorf("backend type is empty")
+		}
+		bkd, err := backend.NewBackend(opt.BackendType, []byte(opt.BackendConfig), nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "create backend")
+		}
+		var ok bool
+		if collector, ok = bkd.(backend.Collector); !ok {
+			return nil, fmt.Errorf("backend type %s doesn't support garbage collection", opt.BackendType)
+		}
+	}
+
+	referenced, err := referencedBlobs(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	// The blobs are listed after the live images are inspected, so that
+	// a blob uploaded in between is kept by the grace period.
+	blobs, err := collector.List(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list blobs of backend")
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].ID < blobs[j].ID
+	})
+
+	result := &GCResult{Referenced: len(referenced), Deleted: []string{}, Recent: []string{}}
+	deadline := time.Now().Add(-gracePeriod)
+	for _, blob := range blobs {
+		if referenced[blob.ID] {
+			continue
+		}
+		// The blob of unknown modification time is treated as recent.
+		if blob.LastModified.IsZero() || blob.LastModified.After(deadline) {
+			result.Recent = append(result.Recent, blob.ID)
+			continue
+		}
+		if !opt.DryRun {
+			if err := collector.Delete(ctx, blob.ID); err != nil {
+				return nil, errors.Wrapf(err, "delete blob %s", blob.ID)
+			}
+			logrus.Infof("deleted unreferenced blob %s", blob.ID)
+		}
+		result.Deleted = append(result.Deleted, blob.ID)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/backend"
+)
+
+type mockCollector struct {
+	blobs   []backend.BlobInfo
+	deleted []string
+}
+
+func (c *mockCollector) List(_ context.Context) ([]backend.BlobInfo, error) {
+	return c.blobs, nil
+}
+
+func (c *mockCollector) Delete(_ context.Context, blobID string) error {
+	c.deleted = append(c.deleted, blobID)
+	return nil
+}
+
+// fakeGCBuilder makes a builder script answering `nydus-image inspect
+// --request blobs` with the blob IDs of the file `<bootstrap>.blobs`.
+func fakeGCBuilder(t *testing.T) string {
+	builderPath := filepath.Join(t.TempDir(), "nydus-image")
+	script := `#!/bin/sh
+case "$1" in
+check)
+	while [ $# -gt 0 ]; do
+		if [ "$1" = "--output-json" ]; then
+			printf '{"fs_version":"6","compressor":"Zstd"}' > "$2"
+		fi
+		shift
+	done
+	;;
+inspect)
+	case "$4" in
+	blobs) cat "$(readlink -f "$2").blobs" ;;
+	prefetch) printf '[]' ;;
+	esac
+	;;
+esac
+`
+	require.NoError(t, os.WriteFile(builderPath, []byte(script), 0755))
+	return builderPath
+}
+
+func writeLiveBootstrap(t *testing.T, dir, name string, blobIDs ...string) string {
+	bootstrapPath := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(bootstrapPath, makeSuperBlock("6", 0x100000, 1), 0644))
+	blobs := []string{}
+	for _, blobID := range blobIDs {
+		blobs = append(blobs, fmt.Sprintf(`{"blob_id":%q,"compressed_size":1,"decompressed_size":1}`, blobID))
+	}
+	require.NoError(t, os.WriteFile(bootstrapPath+".blobs", []byte("["+strings.Join(blobs, ",")+"]"), 0644))
+	return bootstrapPath
+}
+
+func TestGCBackend(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	blobID := func(c string) string {
+		return strings.Repeat(c, 64)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	collector := &mockCollector{blobs: []backend.BlobInfo{
+		{ID: blobID("a"), Size: 1, LastModified: old},
+		{ID: blobID("c"), Size: 1, LastModified: old},
+		{ID: blobID("b"), Size: 1, LastModified: old},
+	}}
+	opt := GCOpt{
+		WorkDir:        filepath.Join(dir, "work"),
+		NydusImagePath: fakeGCBuilder(t),
+		Backend:        collector,
+		LiveRefs: []string{
+			writeLiveBootstrap(t, dir, "bootstrap-1", blobID("a")),
+			writeLiveBootstrap(t, dir, "bootstrap-2", blobID("b"), blobID("a")),
+		},
+	}
+
+	// Nothing is deleted with dry run.
+	opt.DryRun = true
+	result, err := GCBackend(ctx, opt)
+	require.NoError(t, err)
+	require.Equal(t, &GCResult{Referenced: 2, Deleted: []string{blobID("c")}, Recent: []string{}}, result)
+	require.Empty(t, collector.deleted)
+
+	// Only the orphan is deleted.
+	opt.DryRun = false
+	result, err = GCBackend(ctx, opt)
+	require.NoError(t, err)
+	require.Equal(t, []string{blobID("c")}, result.Deleted)
+	require.Equal(t, []string{blobID("c")}, collector.deleted)
+
+	// The orphan in grace period or of unknown age is kept.
+	collector.deleted = nil
+	collector.blobs = []backend.BlobInfo{
+		{ID: blobID("c"), Size: 1, LastModified: time.Now().Add(-time.Hour)},
+		{ID: blobID("d"), Size: 1},
+	}
+	result, err = GCBackend(ctx, opt)
+	require.NoError(t, err)
+	require.Equal(t, &GCResult{Referenced: 2, Deleted: []string{}, Recent: []string{blobID("c"), blobID("d")}}, result)
+	require.Empty(t, collector.deleted)
+	opt.GracePeriod = 30 * time.Minute
+	result, err = GCBackend(ctx, opt)
+	require.NoError(t, err)
+	require.Equal(t, []string{blobID("c")}, result.Deleted)
+	require.Equal(t, []string{blobID("c")}, collector.deleted)
+
+	// Failure situation
+	collector.deleted = nil
+	invalidPath := filepath.Join(dir, "invalid")
+	require.NoError(t, os.WriteFile(invalidPath, []byte("not a bootstrap"), 0644))
+	opt.LiveRefs = append(opt.LiveRefs, invalidPath)
+	_, err = GCBackend(ctx, opt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "inspect live image "+invalidPath)
+	require.Empty(t, collector.deleted)
+
+	opt.LiveRefs = nil
+	_, err = GCBackend(ctx, opt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no live image specified")
+}
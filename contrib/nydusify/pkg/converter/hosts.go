@@ -5,6 +5,9 @@
 package converter
 
 import (
+	"fmt"
+
+	originprovider "github.com/dragonflyoss/nydus/contrib/nydusify/pkg/provider"
 	"github.com/goharbor/acceleration-service/pkg/remote"
 )
 
@@ -16,6 +19,11 @@ func hosts(opt Opt) remote.HostFunc {
 		opt.CacheRef:     opt.CacheInsecure,
 	}
 	return func(ref string) (remote.CredentialFunc, bool, error) {
-		return remote.NewDockerConfigCredFunc(), maps[ref], nil
+		// All the registry accesses go through hosts, including the
+		// blobs fetched lazily by content store.
+		if opt.Offline {
+			return nil, false, fmt.Errorf("offline mode: can't access registry for %s", ref)
+		}
+		return originprovider.NewDockerConfigCredFunc(), maps[ref], nil
 	}
 }
@@ -0,0 +1,121 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/reference/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+// withSubject returns the Nydus image referring to the source image as its
+// subject with artifact type NydusArtifactType, so that it's listed by the
+// referrers API of source image. Only OCI manifest and index support subject.
+func withSubject(ctx context.Context, cs content.Store, sourceDesc, targetDesc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	if targetDesc.MediaType != ocispec.MediaTypeImageManifest && targetDesc.MediaType != ocispec.MediaTypeImageIndex {
+		return nil, fmt.Errorf("hybrid output requires OCI media types, but target image is %s", targetDesc.MediaType)
+	}
+	var target map[string]json.RawMessage
+	if err := readJSON(ctx, cs, targetDesc, &target); err != nil {
+		return nil, errors.Wrap(err, "read target image")
+	}
+	subject, err := json.Marshal(ocispec.Descriptor{
+		MediaType: sourceDesc.MediaType,
+		Digest:    sourceDesc.Digest,
+		Size:      sourceDesc.Size,
+	})
+	if err != nil {
+		return nil, err
+	}
+	target["subject"] = subject
+	target["artifactType"] = json.RawMessage(`"` + NydusArtifactType + `"`)
+
+	desc, err := writeJSON(ctx, cs, targetDesc.MediaType, target)
+	if err != nil {
+		return nil, errors.Wrap(err, "write target image")
+	}
+	desc.ArtifactType = NydusArtifactType
+	return desc, nil
+}
+
+// hybridTarget pushes the original source image to the target reference,
+// and the Nydus image by digest into the target repository as a referrer of
+// the source image, so that the clients not supporting Nydus still pull the
+// OCI image from target, while the Nydus image is discoverable from it.
+type hybridTarget struct {
+	pvd         *provider.Provider
+	sourceNamed docker.Named
+	targetNamed docker.Named
+	dryRun      bool
+	// nydus is the Nydus image pushed by digest, which is set once the
+	// target image is pushed.
+	nydus *ocispec.Descriptor
+}
+
+func newHybridTarget(pvd *provider.Provider, source, target string, dryRun bool) (*hybridTarget, error) {
+	sourceNamed, err := docker.ParseDockerRef(source)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse source reference")
+	}
+	targetNamed, err := docker.ParseDockerRef(target)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse target reference")
+	}
+	return &hybridTarget{
+		pvd:         pvd,
+		sourceNamed: sourceNamed,
+		targetNamed: targetNamed,
+		dryRun:      dryRun,
+	}, nil
+}
+
+// hook wraps hook to push the Nydus image rewritten by hook as a referrer,
+// and replaces the target image with the source image.
+func (h *hybridTarget) hook(hook provider.ImageHook) provider.ImageHook {
+	return func(ctx context.Context, desc ocispec.Descriptor, ref string) (*ocispec.Descriptor, error) {
+		if hook != nil {
+			newDesc, err := hook(ctx, desc, ref)
+			if err != nil {
+				return nil, err
+			}
+			desc = *newDesc
+		}
+		if ref != h.targetNamed.String() {
+			return &desc, nil
+		}
+
+		sourceDesc, err := h.pvd.Image(ctx, h.sourceNamed.String())
+		if err != nil {
+			return nil, errors.Wrap(err, "get source image")
+		}
+		nydusDesc, err := withSubject(ctx, h.pvd.ContentStore(), *sourceDesc, desc)
+		if err != nil {
+			return nil, err
+		}
+		nydusRef := fmt.Sprintf("%s@%s", docker.TrimNamed(h.targetNamed), nydusDesc.Digest)
+		logrus.Infof("pushing nydus image %s", nydusRef)
+		if err := h.pvd.Push(ctx, *nydusDesc, nydusRef); err != nil {
+			return nil, errors.Wrap(err, "push nydus image")
+		}
+		// The plain HTTP is already used if needed once the push succeeds.
+		if !h.dryRun {
+			if err := h.pvd.LinkReferrer(ctx, nydusRef, *sourceDesc, *nydusDesc); err != nil {
+				return nil, errors.Wrap(err, "link nydus image")
+			}
+		}
+		logrus.Infof("pushed nydus image %s", nydusRef)
+		h.nydus = nydusDesc
+
+		return sourceDesc, nil
+	}
+}
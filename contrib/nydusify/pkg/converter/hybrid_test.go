@@ -0,0 +1,91 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestHybridTarget(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	source := "localhost/foo:latest"
+	target := "localhost/foo:hybrid"
+	pvd, err := provider.New(t.TempDir(), hosts(Opt{}), 0, "", platforms.All, 0)
+	require.NoError(t, err)
+	pvd.SetDryRun(true)
+	cs := pvd.ContentStore()
+	marshal := func(v interface{}) []byte {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return data
+	}
+
+	config := writeContent(t, cs, ocispec.MediaTypeImageConfig, []byte("{}"), true)
+	sourceDesc := writeContent(t, cs, ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, []byte("layer"), true)},
+	}), true)
+	require.NoError(t, pvd.Push(ctx, sourceDesc, source))
+	bootstrapLayer := writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, []byte("bootstrap"), true)
+	bootstrapLayer.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+	nydusDesc := writeContent(t, cs, ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Config:      config,
+		Layers:      []ocispec.Descriptor{bootstrapLayer},
+		Annotations: map[string]string{"name": "nydus"},
+	}), true)
+
+	hybrid, err := newHybridTarget(pvd, source, target, true)
+	require.NoError(t, err)
+	hook := hybrid.hook(nil)
+
+	// The target reference gets the source image.
+	desc, err := hook(ctx, nydusDesc, target)
+	require.NoError(t, err)
+	require.Equal(t, sourceDesc, *desc)
+
+	// The Nydus image refers to the source image.
+	require.NotNil(t, hybrid.nydus)
+	require.Equal(t, NydusArtifactType, hybrid.nydus.ArtifactType)
+	var manifest ocispec.Manifest
+	require.NoError(t, readJSON(ctx, cs, *hybrid.nydus, &manifest))
+	require.Equal(t, NydusArtifactType, manifest.ArtifactType)
+	require.Equal(t, sourceDesc.Digest, manifest.Subject.Digest)
+	require.Equal(t, []ocispec.Descriptor{bootstrapLayer}, manifest.Layers)
+	require.Equal(t, map[string]string{"name": "nydus"}, manifest.Annotations)
+	pushed, err := pvd.Image(ctx, "localhost/foo@"+hybrid.nydus.Digest.String())
+	require.NoError(t, err)
+	require.Equal(t, hybrid.nydus, pushed)
+
+	// The other references are kept.
+	desc, err = hook(ctx, nydusDesc, "localhost/foo:other")
+	require.NoError(t, err)
+	require.Equal(t, nydusDesc, *desc)
+
+	// Failure situation
+	dockerDesc := writeContent(t, cs, images.MediaTypeDockerSchema2Manifest, marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: images.MediaTypeDockerSchema2Manifest,
+		Config:    config,
+	}), true)
+	_, err = hook(ctx, dockerDesc, target)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "hybrid output requires OCI media types")
+}
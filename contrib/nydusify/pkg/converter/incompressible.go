@@ -0,0 +1,109 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/platforms"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/goharbor/acceleration-service/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+// probeTargetRef is the placeholder reference of the image built by the
+// probing conversion of SkipIncompressibleThreshold, which is staged.
+const probeTargetRef = "localhost/nydusify/probe:latest"
+
+// splitIncompressible returns the nydus blob layers built from source layers
+// whose compression ratio in the bootstraps of image isn't greater than
+// opt.SkipIncompressibleThreshold, and the source layers of the other ones.
+// The manifests without bootstrap, like the source manifests merged with
+// MergePlatform, are skipped.
+func splitIncompressible(ctx context.Context, cs *store, opt Opt, desc ocispec.Descriptor) (map[digest.Digest]digest.Digest, []digest.Digest, error) {
+	incompressible := map[string]bool{}
+	if err := walkManifests(ctx, cs, desc, func(manifest ocispec.Manifest) error {
+		hasBootstrap := false
+		for _, layer := range manifest.Layers {
+			hasBootstrap = hasBootstrap || nydusify.IsNydusBootstrap(layer)
+		}
+		if !hasBootstrap {
+			return nil
+		}
+		bootstrapPath, cleanup, err := unpackManifestBootstrap(ctx, cs, opt, manifest)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		blobs, err := bootstrapBlobs(ctx, opt, bootstrapPath)
+		if err != nil {
+			return errors.Wrap(err, "get blobs of bootstrap")
+		}
+		for _, blob := range blobs {
+			if blob.DecompressedSize > 0 && float64(blob.CompressedSize)/float64(blob.DecompressedSize) > opt.SkipIncompressibleThreshold {
+				incompressible[blob.ID] = true
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	reused := map[digest.Digest]digest.Digest{}
+	skipped := []digest.Digest{}
+	for source, blob := range cs.converted {
+		if incompressible[blob.Hex()] {
+			skipped = append(skipped, source)
+			continue
+		}
+		reused[source] = blob
+	}
+	return reused, skipped, nil
+}
+
+// probeIncompressible converts the source image as the staged probe image
+// without pushing, and makes the store reuse the nydus blob layers which are
+// compressed well. So that the conversion afterwards only rebuilds the layers
+// with bad compression ratio by the returned compressor `none`, and merges
+// the bootstrap again. The compressor of opt is returned if all the layers
+// are compressed well.
+func probeIncompressible(ctx context.Context, opt Opt, pvd *provider.Provider, cs *store, platformMC platforms.MatchComparer, source string) (string, error) {
+	cvt, err := converter.New(
+		converter.WithProvider(pvd),
+		converter.WithDriver("nydus", getConfig(opt)),
+		converter.WithPlatform(platformMC),
+	)
+	if err != nil {
+		return "", err
+	}
+	pvd.Stage(probeTargetRef)
+	if _, err := cvt.Convert(ctx, source, probeTargetRef, ""); err != nil {
+		return "", errors.Wrap(err, "convert probe image")
+	}
+	probeDesc, err := pvd.Image(ctx, probeTargetRef)
+	if err != nil {
+		return "", errors.Wrap(err, "get probe image")
+	}
+
+	reused, skipped, err := splitIncompressible(ctx, cs, opt, *probeDesc)
+	if err != nil {
+		return "", errors.Wrap(err, "find incompressible blobs")
+	}
+	cs.reused = reused
+	if len(skipped) == 0 {
+		return opt.Compressor, nil
+	}
+	for _, source := range skipped {
+		logrus.Infof("storing blob of layer %s uncompressed, compression ratio is greater than %v", source, opt.SkipIncompressibleThreshold)
+	}
+	return "none", nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/namespaces"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestSplitIncompressible(t *testing.T) {
+	base, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	cs := newStore(base, 1, nil)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	marshal := func(v interface{}) []byte {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return data
+	}
+
+	// The blobs are built from the text and media layers by layer converter.
+	text := writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, []byte("text"), true)
+	media := writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, []byte("media"), true)
+	convert := func(source digest.Digest, data string) digest.Digest {
+		writer, err := content.OpenWriter(ctx, cs, content.WithRef(layerConvertRefPrefix+source.String()))
+		require.NoError(t, err)
+		defer writer.Close()
+		_, err = writer.Write([]byte(data))
+		require.NoError(t, err)
+		require.NoError(t, writer.Commit(ctx, int64(len(data)), ""))
+		return writer.Digest()
+	}
+	textBlob := convert(text.Digest, "text blob")
+	mediaBlob := convert(media.Digest, "media blob")
+
+	blobLayer := func(blob digest.Digest) ocispec.Descriptor {
+		return ocispec.Descriptor{
+			MediaType:   utils.MediaTypeNydusBlob,
+			Digest:      blob,
+			Size:        10,
+			Annotations: map[string]string{utils.LayerAnnotationNydusBlob: "true"},
+		}
+	}
+	bootstrapLayer := writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, makeBootstrapLayer(t), true)
+	bootstrapLayer.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+	probeDesc := writeContent(t, cs, ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    writeContent(t, cs, ocispec.MediaTypeImageConfig, []byte("{}"), true),
+		Layers:    []ocispec.Descriptor{blobLayer(textBlob), blobLayer(mediaBlob), bootstrapLayer},
+	}), true)
+
+	opt := Opt{
+		WorkDir:                     t.TempDir(),
+		SkipIncompressibleThreshold: 0.9,
+		NydusImagePath: fakeBlobsBuilder(t, []BootstrapBlob{
+			{ID: textBlob.Hex(), CompressedSize: 30, DecompressedSize: 100},
+			{ID: mediaBlob.Hex(), CompressedSize: 98, DecompressedSize: 100},
+		}),
+	}
+	reused, skipped, err := splitIncompressible(ctx, cs, opt, probeDesc)
+	require.NoError(t, err)
+	require.Equal(t, map[digest.Digest]digest.Digest{text.Digest: textBlob}, reused)
+	require.Equal(t, []digest.Digest{media.Digest}, skipped)
+
+	// The layer converter skips the reused layer, and rebuilds the other.
+	cs.reused = reused
+	info, err := cs.Info(ctx, text.Digest)
+	require.NoError(t, err)
+	require.Equal(t, textBlob.String(), info.Labels[nydusify.LayerAnnotationNydusTargetDigest])
+	info, err = cs.Info(ctx, media.Digest)
+	require.NoError(t, err)
+	require.Empty(t, info.Labels[nydusify.LayerAnnotationNydusTargetDigest])
+
+	// All the layers are reused with a looser threshold.
+	opt.SkipIncompressibleThreshold = 1
+	reused, skipped, err = splitIncompressible(ctx, cs, opt, probeDesc)
+	require.NoError(t, err)
+	require.Len(t, reused, 2)
+	require.Empty(t, skipped)
+}
@@ -0,0 +1,202 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// The on-disk layout of RAFS superblocks, see rafs/src/metadata/layout.
+const (
+	rafsV5SuperMagic   = 0x52414653
+	rafsV5SuperVersion = 0x500
+	rafsV6SuperMagic   = 0xE0F5E1E2
+	// rafsV6SuperOffset is the offset of EROFS superblock, which is
+	// followed by the RAFS v6 extended superblock.
+	rafsV6SuperOffset    = 1024
+	rafsV6SuperExtOffset = rafsV6SuperOffset + 128
+	rafsSuperBlockSize   = rafsV6SuperExtOffset + 256
+)
+
+// BootstrapBlob is a blob referenced by the bootstrap.
+type BootstrapBlob struct {
+	ID               string `json:"blob_id"`
+	CompressedSize   uint64 `json:"compressed_size"`
+	DecompressedSize uint64 `json:"decompressed_size"`
+	// ChunkCount is zero if it isn't reported by the older builder.
+	ChunkCount uint32 `json:"chunk_count"`
+}
+
+// PrefetchEntry is a file prefetched by nydusd once the image is mounted.
+type PrefetchEntry struct {
+	Inode uint64 `json:"inode"`
+	Path  string `json:"path"`
+}
+
+// BootstrapInfo is the metadata of a Nydus bootstrap reported by Inspect.
+type BootstrapInfo struct {
+	FsVersion string `json:"fs_version"`
+	// Compressor is named as `--compressor` of builder, like `zstd`.
+	Compressor string `json:"compressor"`
+	ChunkSize  uint32 `json:"chunk_size"`
+	// InodeCount counts each hard link once for RAFS v5, but separately for
+	// RAFS v6.
+	InodeCount uint64          `json:"inode_count"`
+	Blobs      []BootstrapBlob `json:"blobs"`
+	Prefetch   []PrefetchEntry `json:"prefetch"`
+}
+
+// readSuperBlock gets the fs version, chunk size and inode count from the
+// superblock of bootstrap.
+func readSuperBlock(r io.ReaderAt) (*BootstrapInfo, error) {
+	sb := make([]byte, rafsSuperBlockSize)
+	if _, err := r.ReadAt(sb, 0); err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "read superblock")
+	}
+	le := binary.LittleEndian
+	if le.Uint32(sb[0:]) == rafsV5SuperMagic && le.Uint32(sb[4:]) == rafsV5SuperVersion {
+		return &BootstrapInfo{
+			FsVersion:  "5",
+			ChunkSize:  le.Uint32(sb[12:]),
+			InodeCount: le.Uint64(sb[24:]),
+		}, nil
+	}
+	if le.Uint32(sb[rafsV6SuperOffset:]) == rafsV6SuperMagic {
+		return &BootstrapInfo{
+			FsVersion:  "6",
+			ChunkSize:  le.Uint32(sb[rafsV6SuperExtOffset+20:]),
+			InodeCount: le.Uint64(sb[rafsV6SuperOffset+16:]),
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid bootstrap: unknown superblock magic")
+}
+
+func readBootstrapSuperBlock(path string) (*BootstrapInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readSuperBlock(file)
+}
+
+// requestBootstrap runs `nydus-image inspect` in request mode, and decodes
+// the output json into v.
+func requestBootstrap(ctx context.Context, builder, bootstrapPath, request string, v interface{}) error {
+	args := []string{
+		"inspect",
+		bootstrapPath,
+		"--request",
+		request,
+	}
+	logrus.Debugf("\tCommand: %s %s", builder, args)
+	stderr := &strings.Builder{}
+	cmd := exec.CommandContext(ctx, builder, args...)
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return errors.Wrapf(err, "run inspect command: %s", strings.TrimSpace(stderr.String()))
+	}
+	return errors.Wrapf(json.Unmarshal(output, v), "unmarshal %s of bootstrap", request)
+}
+
+// prepareBootstrap makes the bootstrap of ref at target, ref is a local
+// bootstrap file, or bootstrap layer, or a Nydus image in registry.
+func prepareBootstrap(ctx context.Context, ref string, insecure bool, target string) (string, error) {
+	info, err := os.Stat(ref)
+	if err != nil || !info.Mode().IsRegular() {
+		if err := pullBootstrap(ctx, ref, insecure, target); err != nil {
+			return "", errors.Wrapf(err, "pull bootstrap of %s", ref)
+		}
+		return target, nil
+	}
+
+	if _, err := readBootstrapSuperBlock(ref); err == nil {
+		return ref, nil
+	}
+	file, err := os.Open(ref)
+	if err != nil {
+		return "", errors.Wrap(err, "open bootstrap")
+	}
+	defer file.Close()
+	if err := utils.UnpackFile(file, utils.BootstrapFileNameInLayer, target); err != nil {
+		return "", errors.Wrapf(err, "unpack bootstrap layer %s", ref)
+	}
+	return target, nil
+}
+
+// Inspect reports the metadata of the bootstrap of ref, which is a Nydus
+// image in registry, or a local bootstrap file or bootstrap layer. Only the
+// NydusImagePath, WorkDir and SourceInsecure options of opt are used.
+func Inspect(ctx context.Context, ref string, opt Opt) (*BootstrapInfo, error) {
+	builder := opt.NydusImagePath
+	if builder == "" {
+		builder = "nydus-image"
+	}
+	if opt.WorkDir == "" {
+		opt.WorkDir = os.TempDir()
+	}
+	if err := os.MkdirAll(opt.WorkDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "prepare work directory")
+	}
+	workDir, err := os.MkdirTemp(opt.WorkDir, "nydusify-inspect-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create inspect directory")
+	}
+	defer os.RemoveAll(workDir)
+
+	bootstrapPath, err := prepareBootstrap(ctx, ref, opt.SourceInsecure, filepath.Join(workDir, "bootstrap"))
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := readBootstrapSuperBlock(bootstrapPath)
+	if err != nil {
+		return nil, err
+	}
+	// The builder writes the output json beside the bootstrap, which is
+	// linked into work directory to not touch the directory of ref.
+	if bootstrapPath == ref {
+		if ref, err = filepath.Abs(ref); err != nil {
+			return nil, err
+		}
+		bootstrapPath = filepath.Join(workDir, "bootstrap")
+		if err := os.Symlink(ref, bootstrapPath); err != nil {
+			return nil, errors.Wrap(err, "link bootstrap")
+		}
+	}
+	check, err := inspectBootstrap(ctx, builder, bootstrapPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "check bootstrap")
+	}
+	info.Compressor = check.Compressor
+	if compressor, ok := builderCompressors[check.Compressor]; ok {
+		info.Compressor = compressor
+	}
+
+	info.Blobs = []BootstrapBlob{}
+	if err := requestBootstrap(ctx, builder, bootstrapPath, "blobs", &info.Blobs); err != nil {
+		return nil, errors.Wrap(err, "get blobs of bootstrap")
+	}
+	info.Prefetch = []PrefetchEntry{}
+	if err := requestBootstrap(ctx, builder, bootstrapPath, "prefetch", &info.Prefetch); err != nil {
+		return nil, errors.Wrap(err, "get prefetch entries of bootstrap")
+	}
+
+	return info, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func makeSuperBlock(fsVersion string, chunkSize uint32, inodes uint64) []byte {
+	sb := make([]byte, 8192)
+	le := binary.LittleEndian
+	if fsVersion == "5" {
+		le.PutUint32(sb[0:], rafsV5SuperMagic)
+		le.PutUint32(sb[4:], rafsV5SuperVersion)
+		le.PutUint32(sb[12:], chunkSize)
+		le.PutUint64(sb[24:], inodes)
+	} else {
+		le.PutUint32(sb[rafsV6SuperOffset:], rafsV6SuperMagic)
+		le.PutUint64(sb[rafsV6SuperOffset+16:], inodes)
+		le.PutUint32(sb[rafsV6SuperExtOffset+20:], chunkSize)
+	}
+	return sb
+}
+
+// fakeInspectBuilder makes a builder script answering `nydus-image check`
+// and `nydus-image inspect --request`.
+func fakeInspectBuilder(t *testing.T) string {
+	builderPath := filepath.Join(t.TempDir(), "nydus-image")
+	script := `#!/bin/sh
+case "$1" in
+check)
+	while [ $# -gt 0 ]; do
+		if [ "$1" = "--output-json" ]; then
+			printf '{"fs_version":"6","compressor":"Lz4Block"}' > "$2"
+		fi
+		shift
+	done
+	;;
+inspect)
+	case "$4" in
+	blobs) printf '[{"blob_id":"abc","compressed_size":10,"decompressed_size":20,"readahead_offset":0,"readahead_size":0,"chunk_count":2}]' ;;
+	prefetch) printf '[{"inode":2,"path":"/usr/bin"}]' ;;
+	*) echo "unknown request $4" >&2; exit 1 ;;
+	esac
+	;;
+esac
+`
+	require.NoError(t, os.WriteFile(builderPath, []byte(script), 0755))
+	return builderPath
+}
+
+func TestReadSuperBlock(t *testing.T) {
+	info, err := readSuperBlock(bytes.NewReader(makeSuperBlock("5", 0x100000, 12)))
+	require.NoError(t, err)
+	require.Equal(t, BootstrapInfo{FsVersion: "5", ChunkSize: 0x100000, InodeCount: 12}, *info)
+
+	info, err = readSuperBlock(bytes.NewReader(makeSuperBlock("6", 0x200000, 34)))
+	require.NoError(t, err)
+	require.Equal(t, BootstrapInfo{FsVersion: "6", ChunkSize: 0x200000, InodeCount: 34}, *info)
+
+	_, err = readSuperBlock(bytes.NewReader([]byte("not a bootstrap")))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid bootstrap")
+}
+
+func TestInspect(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	opt := Opt{NydusImagePath: fakeInspectBuilder(t), WorkDir: filepath.Join(dir, "work")}
+	expected := &BootstrapInfo{
+		FsVersion:  "6",
+		Compressor: "lz4_block",
+		ChunkSize:  0x100000,
+		InodeCount: 42,
+		Blobs:      []BootstrapBlob{{ID: "abc", CompressedSize: 10, DecompressedSize: 20, ChunkCount: 2}},
+		Prefetch:   []PrefetchEntry{{Inode: 2, Path: "/usr/bin"}},
+	}
+
+	// The local bootstrap file is inspected without being touched.
+	sb := makeSuperBlock("6", 0x100000, 42)
+	bootstrapPath := filepath.Join(dir, "bootstrap")
+	require.NoError(t, os.WriteFile(bootstrapPath, sb, 0644))
+	info, err := Inspect(ctx, bootstrapPath, opt)
+	require.NoError(t, err)
+	require.Equal(t, expected, info)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	// The bootstrap layer is unpacked.
+	buf := bytes.Buffer{}
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: utils.BootstrapFileNameInLayer, Mode: 0644, Size: int64(len(sb))}))
+	_, err = tw.Write(sb)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	layerPath := filepath.Join(dir, "bootstrap.tar.gz")
+	require.NoError(t, os.WriteFile(layerPath, buf.Bytes(), 0644))
+	info, err = Inspect(ctx, layerPath, opt)
+	require.NoError(t, err)
+	require.Equal(t, expected, info)
+
+	invalidPath := filepath.Join(dir, "invalid")
+	require.NoError(t, os.WriteFile(invalidPath, []byte("not a bootstrap"), 0644))
+	_, err = Inspect(ctx, invalidPath, opt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unpack bootstrap layer")
+}
@@ -0,0 +1,113 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// layerConvertRefPrefix is the ref prefix of the content writer opened by
+// the layer converter of nydus-snapshotter for the blob of source layer.
+const layerConvertRefPrefix = "convert-nydus-from-"
+
+// convertedLayer returns the source layer of the content written with ref,
+// or empty if the content isn't converted from a source layer.
+func convertedLayer(ref string) digest.Digest {
+	if !strings.HasPrefix(ref, layerConvertRefPrefix) {
+		return ""
+	}
+	dgst, err := digest.Parse(strings.TrimPrefix(ref, layerConvertRefPrefix))
+	if err != nil {
+		return ""
+	}
+	return dgst
+}
+
+// loadBuilt writes the nydus blob layer built from source layer before into
+// store, from local build cache or the state of failed conversion, or the
+// blob layer reused from probing conversion.
+func (s *store) loadBuilt(ctx context.Context, source digest.Digest) (digest.Digest, bool) {
+	if blob, ok := s.reused[source]; ok {
+		return blob, true
+	}
+	if s.buildCache != nil {
+		if cached, ok := s.buildCache.load(ctx, s.Store, source); ok {
+			return cached, true
+		}
+	}
+	if s.resumer != nil {
+		return s.resumer.load(ctx, s.Store, source)
+	}
+	return "", false
+}
+
+// Info records the nydus blob layer reused from build cache for the source
+// layer, the layer converter skips building the layer whose info has the
+// label of target digest. The label is set for the layer found in local
+// build cache or resume state if the remote build cache misses.
+func (s *store) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	info, err := s.Store.Info(ctx, dgst)
+	if err != nil {
+		return info, err
+	}
+	blob := digest.Digest(info.Labels[nydusify.LayerAnnotationNydusTargetDigest])
+	if blob.Validate() != nil {
+		if cached, ok := s.loadBuilt(ctx, dgst); ok {
+			labels := map[string]string{}
+			for key, value := range info.Labels {
+				labels[key] = value
+			}
+			labels[nydusify.LayerAnnotationNydusTargetDigest] = cached.String()
+			info.Labels = labels
+			blob = cached
+		}
+	}
+	if blob.Validate() == nil {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.converted[dgst] = blob
+	}
+	return info, nil
+}
+
+// makeLayerMap returns the mapping from each source layer converted to the
+// nydus blob layer built from it. The blob of each source layer is recorded
+// even if its chunks are deduplicated into the blobs of other layers or
+// chunk dict, then it may not be referenced by target manifest.
+func makeLayerMap(ctx context.Context, cs *store, desc ocispec.Descriptor) (map[digest.Digest]digest.Digest, error) {
+	layerMap := map[digest.Digest]digest.Digest{}
+	childrenHandler := images.ChildrenHandler(cs)
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if images.IsLayerType(desc.MediaType) {
+			cs.mutex.Lock()
+			defer cs.mutex.Unlock()
+			if blob, ok := cs.converted[desc.Digest]; ok {
+				layerMap[desc.Digest] = blob
+			}
+			return nil, nil
+		}
+
+		children, err := childrenHandler.Handle(ctx, desc)
+		// The manifest of unmatched platform isn't pulled.
+		if errdefs.IsNotFound(err) {
+			return nil, nil
+		}
+		return children, err
+	})
+	if err := images.Walk(ctx, handler, desc); err != nil {
+		return nil, errors.Wrap(err, "walk source image")
+	}
+
+	return layerMap, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/namespaces"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertedLayer(t *testing.T) {
+	dgst := digest.FromString("layer")
+	require.Equal(t, dgst, convertedLayer(layerConvertRefPrefix+dgst.String()))
+	require.Empty(t, convertedLayer("ref-"+dgst.String()))
+	require.Empty(t, convertedLayer(layerConvertRefPrefix+"invalid"))
+}
+
+// labeledStore returns the content info with the labels set by build cache.
+type labeledStore struct {
+	content.Store
+	labels map[digest.Digest]map[string]string
+}
+
+func (s *labeledStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	info, err := s.Store.Info(ctx, dgst)
+	if err != nil {
+		return info, err
+	}
+	info.Labels = s.labels[dgst]
+	return info, nil
+}
+
+func TestMakeLayerMap(t *testing.T) {
+	base, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	labeled := &labeledStore{Store: base, labels: map[digest.Digest]map[string]string{}}
+	cs := newStore(labeled, 1, nil)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	marshal := func(v interface{}) []byte {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return data
+	}
+	lower := writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, []byte("lower"), true)
+	upper := writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, []byte("upper"), true)
+	cached := writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, []byte("cached"), true)
+
+	// The blobs are built from lower and upper layers by layer converter.
+	convert := func(source digest.Digest, data string) digest.Digest {
+		writer, err := content.OpenWriter(ctx, cs, content.WithRef(layerConvertRefPrefix+source.String()))
+		require.NoError(t, err)
+		defer writer.Close()
+		_, err = writer.Write([]byte(data))
+		require.NoError(t, err)
+		require.NoError(t, writer.Commit(ctx, int64(len(data)), ""))
+		return writer.Digest()
+	}
+	lowerBlob := convert(lower.Digest, "lower blob")
+	upperBlob := convert(upper.Digest, "upper blob")
+
+	// The blob of cached layer is reused from build cache.
+	cachedBlob := digest.FromString("cached blob")
+	labeled.labels[cached.Digest] = map[string]string{nydusify.LayerAnnotationNydusTargetDigest: cachedBlob.String()}
+	_, err = cs.Info(ctx, cached.Digest)
+	require.NoError(t, err)
+
+	// The layer not converted isn't recorded.
+	unconverted := writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, []byte("unconverted"), true)
+
+	writeManifest := func(layers ...ocispec.Descriptor) ocispec.Descriptor {
+		return writeContent(t, cs, ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    writeContent(t, cs, ocispec.MediaTypeImageConfig, []byte("{}"), true),
+			Layers:    layers,
+		}), true)
+	}
+	layerMap, err := makeLayerMap(ctx, cs, writeManifest(lower, upper))
+	require.NoError(t, err)
+	require.Equal(t, map[digest.Digest]digest.Digest{
+		lower.Digest: lowerBlob,
+		upper.Digest: upperBlob,
+	}, layerMap)
+
+	index := writeContent(t, cs, ocispec.MediaTypeImageIndex, marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{
+			writeManifest(lower, upper),
+			writeManifest(lower, cached, unconverted),
+			// The manifest of unmatched platform isn't pulled.
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("missing"), Size: 7},
+		},
+	}), true)
+	layerMap, err = makeLayerMap(ctx, cs, index)
+	require.NoError(t, err)
+	require.Equal(t, map[digest.Digest]digest.Digest{
+		lower.Digest:  lowerBlob,
+		upper.Digest:  upperBlob,
+		cached.Digest: cachedBlob,
+	}, layerMap)
+}
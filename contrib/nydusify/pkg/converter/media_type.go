@@ -0,0 +1,155 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// The media type schemes of target image.
+const (
+	// MediaTypeSchemeContainerd keeps the media types written by the
+	// converter of nydus-snapshotter, the manifest follows the media type of
+	// source image unless Opt.Docker2OCI is set.
+	MediaTypeSchemeContainerd = "containerd"
+	// MediaTypeSchemeOCI writes the OCI media types for the manifest, index,
+	// config and bootstrap layer.
+	MediaTypeSchemeOCI = "oci"
+	// MediaTypeSchemeDocker writes the Docker media types for the manifest,
+	// manifest list, config and bootstrap layer.
+	MediaTypeSchemeDocker = "docker"
+)
+
+var mediaTypeSchemes = []string{MediaTypeSchemeContainerd, MediaTypeSchemeOCI, MediaTypeSchemeDocker}
+
+// mediaTypes are the media types written by a scheme, the nydus blob layer
+// always has the vendor type MediaTypeNydusBlob which has no Docker
+// counterpart.
+type mediaTypes struct {
+	index     string
+	manifest  string
+	config    string
+	bootstrap string
+}
+
+func schemeMediaTypes(scheme string) *mediaTypes {
+	switch scheme {
+	case MediaTypeSchemeOCI:
+		return &mediaTypes{
+			index:     ocispec.MediaTypeImageIndex,
+			manifest:  ocispec.MediaTypeImageManifest,
+			config:    ocispec.MediaTypeImageConfig,
+			bootstrap: ocispec.MediaTypeImageLayerGzip,
+		}
+	case MediaTypeSchemeDocker:
+		return &mediaTypes{
+			index:     images.MediaTypeDockerSchema2ManifestList,
+			manifest:  images.MediaTypeDockerSchema2Manifest,
+			config:    images.MediaTypeDockerSchema2Config,
+			bootstrap: images.MediaTypeDockerSchema2LayerGzip,
+		}
+	}
+	return nil
+}
+
+func validateMediaTypeScheme(opt Opt) error {
+	switch opt.MediaTypeScheme {
+	case "", MediaTypeSchemeContainerd, MediaTypeSchemeOCI:
+	case MediaTypeSchemeDocker:
+		if opt.Docker2OCI {
+			return fmt.Errorf("media type scheme %s conflicts with docker2oci", opt.MediaTypeScheme)
+		}
+	default:
+		return fmt.Errorf("invalid media type scheme %s, should be one of %v", opt.MediaTypeScheme, mediaTypeSchemes)
+	}
+	return nil
+}
+
+// rewriteManifestMediaTypes writes the target manifest with the media types,
+// the digests of config and layers are kept.
+func rewriteManifestMediaTypes(ctx context.Context, cs content.Store, targetDesc ocispec.Descriptor, types *mediaTypes) (*ocispec.Descriptor, error) {
+	var manifest ocispec.Manifest
+	if err := readJSON(ctx, cs, targetDesc, &manifest); err != nil {
+		return nil, errors.Wrap(err, "read target manifest")
+	}
+
+	manifest.MediaType = types.manifest
+	manifest.Config.MediaType = types.config
+	for idx, layer := range manifest.Layers {
+		if nydusify.IsNydusBootstrap(layer) {
+			manifest.Layers[idx].MediaType = types.bootstrap
+		}
+	}
+
+	manifestDesc, err := writeJSON(ctx, cs, types.manifest, manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "write target manifest")
+	}
+	manifestDesc.Platform = targetDesc.Platform
+	manifestDesc.Annotations = targetDesc.Annotations
+
+	return manifestDesc, nil
+}
+
+// rewriteMediaTypes writes the target image with the media types of scheme,
+// the source manifests merged into target index with MergePlatform are kept
+// as they are. It returns the target image as it is for the scheme keeping
+// the media types.
+func rewriteMediaTypes(ctx context.Context, cs content.Store, sourceDesc, targetDesc ocispec.Descriptor, scheme string) (*ocispec.Descriptor, error) {
+	types := schemeMediaTypes(scheme)
+	if types == nil {
+		return &targetDesc, nil
+	}
+
+	sources := map[digest.Digest]bool{sourceDesc.Digest: true}
+	if images.IsIndexType(sourceDesc.MediaType) {
+		var index ocispec.Index
+		if err := readJSON(ctx, cs, sourceDesc, &index); err != nil {
+			return nil, errors.Wrap(err, "read source index")
+		}
+		for _, manifest := range index.Manifests {
+			sources[manifest.Digest] = true
+		}
+	}
+
+	if !images.IsIndexType(targetDesc.MediaType) {
+		if sources[targetDesc.Digest] {
+			return &targetDesc, nil
+		}
+		return rewriteManifestMediaTypes(ctx, cs, targetDesc, types)
+	}
+
+	var index ocispec.Index
+	if err := readJSON(ctx, cs, targetDesc, &index); err != nil {
+		return nil, errors.Wrap(err, "read target index")
+	}
+	index.MediaType = types.index
+	for idx, manifest := range index.Manifests {
+		if sources[manifest.Digest] {
+			continue
+		}
+		desc, err := rewriteManifestMediaTypes(ctx, cs, manifest, types)
+		if err != nil {
+			return nil, errors.Wrapf(err, "rewrite media types of manifest %s", manifest.Digest)
+		}
+		index.Manifests[idx] = *desc
+	}
+
+	desc, err := writeJSON(ctx, cs, types.index, index)
+	if err != nil {
+		return nil, errors.Wrap(err, "write target index")
+	}
+	desc.Annotations = targetDesc.Annotations
+
+	return desc, nil
+}
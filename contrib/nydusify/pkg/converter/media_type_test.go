@@ -0,0 +1,106 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestValidateMediaTypeScheme(t *testing.T) {
+	for _, scheme := range []string{"", "containerd", "oci", "docker"} {
+		require.NoError(t, validateOpt(Opt{MediaTypeScheme: scheme}))
+	}
+	require.NoError(t, validateOpt(Opt{MediaTypeScheme: "oci", Docker2OCI: true}))
+
+	// Failure situation
+	err := validateOpt(Opt{MediaTypeScheme: "dragonfly"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid media type scheme dragonfly")
+	err = validateOpt(Opt{MediaTypeScheme: "docker", Docker2OCI: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "media type scheme docker conflicts with docker2oci")
+}
+
+func TestRewriteMediaTypes(t *testing.T) {
+	cs, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	marshal := func(v interface{}) []byte {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return data
+	}
+	config := writeContent(t, cs, images.MediaTypeDockerSchema2Config, []byte(`{"os":"linux"}`), true)
+	blob := writeContent(t, cs, utils.MediaTypeNydusBlob, []byte("blob"), true)
+	blob.Annotations = map[string]string{nydusify.LayerAnnotationNydusBlob: "true"}
+	bootstrap := writeContent(t, cs, images.MediaTypeDockerSchema2LayerGzip, []byte("bootstrap"), true)
+	bootstrap.Annotations = map[string]string{nydusify.LayerAnnotationNydusBootstrap: "true"}
+	source := writeContent(t, cs, images.MediaTypeDockerSchema2Manifest, marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: images.MediaTypeDockerSchema2Manifest,
+		Config:    config,
+	}), true)
+	target := writeContent(t, cs, images.MediaTypeDockerSchema2Manifest, marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: images.MediaTypeDockerSchema2Manifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{blob, bootstrap},
+	}), true)
+
+	for _, c := range []struct {
+		scheme    string
+		manifest  string
+		config    string
+		bootstrap string
+	}{
+		{"containerd", images.MediaTypeDockerSchema2Manifest, images.MediaTypeDockerSchema2Config, images.MediaTypeDockerSchema2LayerGzip},
+		{"oci", ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageConfig, ocispec.MediaTypeImageLayerGzip},
+		{"docker", images.MediaTypeDockerSchema2Manifest, images.MediaTypeDockerSchema2Config, images.MediaTypeDockerSchema2LayerGzip},
+	} {
+		desc, err := rewriteMediaTypes(ctx, cs, source, target, c.scheme)
+		require.NoError(t, err)
+		require.Equal(t, c.manifest, desc.MediaType)
+		var manifest ocispec.Manifest
+		require.NoError(t, readJSON(ctx, cs, *desc, &manifest))
+		require.Equal(t, c.manifest, manifest.MediaType)
+		require.Equal(t, c.config, manifest.Config.MediaType)
+		require.Equal(t, config.Digest, manifest.Config.Digest)
+		require.Len(t, manifest.Layers, 2)
+		// The nydus blob keeps its vendor type.
+		require.Equal(t, utils.MediaTypeNydusBlob, manifest.Layers[0].MediaType)
+		require.Equal(t, blob.Digest, manifest.Layers[0].Digest)
+		require.Equal(t, c.bootstrap, manifest.Layers[1].MediaType)
+		require.Equal(t, bootstrap.Digest, manifest.Layers[1].Digest)
+	}
+
+	// The source manifest merged into target index is kept as it is.
+	targetIndex := writeContent(t, cs, images.MediaTypeDockerSchema2ManifestList, marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: images.MediaTypeDockerSchema2ManifestList,
+		Manifests: []ocispec.Descriptor{source, target},
+	}), true)
+	desc, err := rewriteMediaTypes(ctx, cs, source, targetIndex, "oci")
+	require.NoError(t, err)
+	require.Equal(t, ocispec.MediaTypeImageIndex, desc.MediaType)
+	var index ocispec.Index
+	require.NoError(t, readJSON(ctx, cs, *desc, &index))
+	require.Equal(t, ocispec.MediaTypeImageIndex, index.MediaType)
+	require.Equal(t, source, index.Manifests[0])
+	require.Equal(t, ocispec.MediaTypeImageManifest, index.Manifests[1].MediaType)
+	require.NotEqual(t, target.Digest, index.Manifests[1].Digest)
+}
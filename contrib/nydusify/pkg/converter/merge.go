@@ -0,0 +1,245 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/containerd/nydus-snapshotter/pkg/converter/tool"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/provider"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// MergeOpt is the option of merging the bootstraps of layers into a single
+// Nydus image.
+type MergeOpt struct {
+	WorkDir        string
+	NydusImagePath string
+
+	// BootstrapPaths are the bootstraps of layers built independently,
+	// ordered from the lowest layer to the uppermost layer.
+	BootstrapPaths []string
+	// BlobDir is the directory containing all nydus blobs referenced by
+	// the bootstraps, the blob files are named by digest hex.
+	BlobDir string
+	// ChunkDictPath is the bootstrap of chunk dict to dedup shared chunks.
+	ChunkDictPath    string
+	PrefetchPatterns string
+	FsVersion        string
+
+	Target         string
+	TargetInsecure bool
+
+	// MergedBootstrapPath saves the merged bootstrap if specified.
+	MergedBootstrapPath string
+}
+
+func pushWithHTTPFallback(ctx context.Context, remoter *remote.Remote, desc ocispec.Descriptor, byDigest bool, open func() (io.ReadCloser, error)) error {
+	push := func() error {
+		reader, err := open()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		return remoter.Push(ctx, desc, byDigest, reader)
+	}
+
+	if err := push(); err != nil {
+		if !utils.RetryWithHTTP(err) {
+			return err
+		}
+		remoter.MaybeWithHTTP(err)
+		return push()
+	}
+
+	return nil
+}
+
+// packBootstrap packs bootstrap into a .tar.gz bootstrap layer, returns the
+// layer descriptor and the diff id of layer.
+func packBootstrap(bootstrapPath, target string) (*ocispec.Descriptor, digest.Digest, error) {
+	reader, err := utils.PackTargz(bootstrapPath, utils.BootstrapFileNameInLayer, false)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "pack bootstrap")
+	}
+	defer reader.Close()
+
+	layer, err := os.Create(target)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "create bootstrap layer")
+	}
+	defer layer.Close()
+
+	diffIDDigester := digest.SHA256.Digester()
+	layerDigester := digest.SHA256.Digester()
+	counter := &writeCounter{}
+	gzWriter := gzip.NewWriter(io.MultiWriter(layer, layerDigester.Hash(), counter))
+	if _, err := io.Copy(io.MultiWriter(gzWriter, diffIDDigester.Hash()), reader); err != nil {
+		return nil, "", errors.Wrap(err, "compress bootstrap layer")
+	}
+	if err := gzWriter.Close(); err != nil {
+		return nil, "", errors.Wrap(err, "close gzip writer")
+	}
+
+	return &ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    layerDigester.Digest(),
+		Size:      counter.size,
+	}, diffIDDigester.Digest(), nil
+}
+
+type writeCounter struct {
+	size int64
+}
+
+func (counter *writeCounter) Write(p []byte) (int, error) {
+	counter.size += int64(len(p))
+	return len(p), nil
+}
+
+// Merge merges the bootstraps of layers built independently into a single
+// multi-layer Nydus image and pushes it to target, the layer order is kept
+// as the order of bootstraps, and the chunks exist in chunk dict won't be
+// stored again.
+func Merge(ctx context.Context, opt MergeOpt) error {
+	if len(opt.BootstrapPaths) == 0 {
+		return fmt.Errorf("no bootstrap specified to merge")
+	}
+	if opt.Target == "" {
+		return fmt.Errorf("target reference should be specified")
+	}
+	if opt.FsVersion == "" {
+		opt.FsVersion = "6"
+	}
+
+	if err := os.MkdirAll(opt.WorkDir, 0755); err != nil {
+		return errors.Wrap(err, "prepare work directory")
+	}
+	tmpDir, err := os.MkdirTemp(opt.WorkDir, "nydusify-merge-")
+	if err != nil {
+		return errors.Wrap(err, "create temp directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	mergedBootstrapPath := opt.MergedBootstrapPath
+	if mergedBootstrapPath == "" {
+		mergedBootstrapPath = filepath.Join(tmpDir, "bootstrap")
+	}
+	blobDigests, err := tool.Merge(tool.MergeOption{
+		BuilderPath:          opt.NydusImagePath,
+		SourceBootstrapPaths: opt.BootstrapPaths,
+		TargetBootstrapPath:  mergedBootstrapPath,
+		ChunkDictPath:        opt.ChunkDictPath,
+		PrefetchPatterns:     opt.PrefetchPatterns,
+		OutputJSONPath:       filepath.Join(tmpDir, "merge-output.json"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "merge bootstraps")
+	}
+
+	remoter, err := provider.DefaultRemote(opt.Target, opt.TargetInsecure)
+	if err != nil {
+		return errors.Wrap(err, "create remote")
+	}
+
+	// Push blob layers in the order of blob table in merged bootstrap
+	layers := []ocispec.Descriptor{}
+	diffIDs := []digest.Digest{}
+	for _, blobDigest := range blobDigests {
+		blobPath := filepath.Join(opt.BlobDir, blobDigest.Hex())
+		info, err := os.Stat(blobPath)
+		if err != nil {
+			return errors.Wrapf(err, "stat blob %s", blobDigest)
+		}
+		desc := ocispec.Descriptor{
+			MediaType: utils.MediaTypeNydusBlob,
+			Digest:    blobDigest,
+			Size:      info.Size(),
+			Annotations: map[string]string{
+				utils.LayerAnnotationNydusBlob: "true",
+			},
+		}
+		if err := pushWithHTTPFallback(ctx, remoter, desc, true, func() (io.ReadCloser, error) {
+			return os.Open(blobPath)
+		}); err != nil {
+			return errors.Wrapf(err, "push blob %s", blobDigest)
+		}
+		layers = append(layers, desc)
+		diffIDs = append(diffIDs, blobDigest)
+	}
+
+	// Push bootstrap layer
+	bootstrapLayerPath := filepath.Join(tmpDir, "bootstrap.tar.gz")
+	bootstrapDesc, bootstrapDiffID, err := packBootstrap(mergedBootstrapPath, bootstrapLayerPath)
+	if err != nil {
+		return err
+	}
+	bootstrapDesc.Annotations = map[string]string{
+		utils.LayerAnnotationNydusFsVersion: opt.FsVersion,
+		utils.LayerAnnotationNydusBootstrap: "true",
+	}
+	if err := pushWithHTTPFallback(ctx, remoter, *bootstrapDesc, true, func() (io.ReadCloser, error) {
+		return os.Open(bootstrapLayerPath)
+	}); err != nil {
+		return errors.Wrap(err, "push bootstrap layer")
+	}
+	layers = append(layers, *bootstrapDesc)
+	diffIDs = append(diffIDs, bootstrapDiffID)
+
+	// Push image config
+	config := ocispec.Image{
+		Platform: ocispec.Platform{
+			OS:           "linux",
+			Architecture: runtime.GOARCH,
+		},
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	}
+	configDesc, configBytes, err := utils.MarshalToDesc(config, ocispec.MediaTypeImageConfig)
+	if err != nil {
+		return errors.Wrap(err, "marshal image config")
+	}
+	if err := pushWithHTTPFallback(ctx, remoter, *configDesc, true, func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(configBytes)), nil
+	}); err != nil {
+		return errors.Wrap(err, "push image config")
+	}
+
+	// Push image manifest
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *configDesc,
+		Layers:    layers,
+	}
+	manifestDesc, manifestBytes, err := utils.MarshalToDesc(manifest, ocispec.MediaTypeImageManifest)
+	if err != nil {
+		return errors.Wrap(err, "marshal image manifest")
+	}
+	if err := pushWithHTTPFallback(ctx, remoter, *manifestDesc, false, func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(manifestBytes)), nil
+	}); err != nil {
+		return errors.Wrap(err, "push image manifest")
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestPackBootstrap(t *testing.T) {
+	workDir := t.TempDir()
+	bootstrapPath := filepath.Join(workDir, "bootstrap")
+	require.NoError(t, os.WriteFile(bootstrapPath, []byte("bootstrap"), 0644))
+
+	layerPath := filepath.Join(workDir, "bootstrap.tar.gz")
+	desc, diffID, err := packBootstrap(bootstrapPath, layerPath)
+	require.NoError(t, err)
+
+	layer, err := os.ReadFile(layerPath)
+	require.NoError(t, err)
+	require.Equal(t, digest.FromBytes(layer), desc.Digest)
+	require.Equal(t, int64(len(layer)), desc.Size)
+
+	file, err := os.Open(layerPath)
+	require.NoError(t, err)
+	defer file.Close()
+	gzReader, err := gzip.NewReader(file)
+	require.NoError(t, err)
+	tarBytes, err := io.ReadAll(gzReader)
+	require.NoError(t, err)
+	require.Equal(t, digest.FromBytes(tarBytes), diffID)
+
+	// The bootstrap is stored at the path expected by snapshotter
+	_, err = file.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	gzReader, err = gzip.NewReader(file)
+	require.NoError(t, err)
+	tarReader := tar.NewReader(gzReader)
+	found := false
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if hdr.Name == utils.BootstrapFileNameInLayer {
+			data, err := io.ReadAll(tarReader)
+			require.NoError(t, err)
+			require.Equal(t, "bootstrap", string(data))
+			found = true
+		}
+	}
+	require.True(t, found)
+}
+
+func TestMergeInvalidOpt(t *testing.T) {
+	err := Merge(context.Background(), MergeOpt{Target: "localhost:5000/foo:nydus"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no bootstrap specified")
+
+	err = Merge(context.Background(), MergeOpt{BootstrapPaths: []string{"bootstrap"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target reference should be specified")
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/goharbor/acceleration-service/pkg/converter"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func dumpMetric(metric *converter.Metric, path string) error {
@@ -25,3 +26,90 @@ func dumpMetric(metric *converter.Metric, path string) error {
 	}
 	return nil
 }
+
+// Metrics is a prometheus collector of the conversions sharing it through
+// Opt.Metrics, which is useful when nydusify runs as a long-lived conversion
+// service. It should be registered by the caller, for example:
+//
+//	metrics := converter.NewMetrics()
+//	prometheus.MustRegister(metrics)
+//
+// All the methods are safe to be called with nil Metrics.
+type Metrics struct {
+	conversions   prometheus.Counter
+	failures      prometheus.Counter
+	pushedBytes   prometheus.Counter
+	buildDuration prometheus.Histogram
+}
+
+// NewMetrics creates the unregistered metrics of conversions.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		conversions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "nydusify",
+			Subsystem: "converter",
+			Name:      "conversions_total",
+			Help:      "The total number of conversions, including the failed ones.",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "nydusify",
+			Subsystem: "converter",
+			Name:      "conversion_failures_total",
+			Help:      "The total number of failed conversions.",
+		}),
+		pushedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "nydusify",
+			Subsystem: "converter",
+			Name:      "pushed_bytes_total",
+			Help:      "The total size of layers pushed to target registry.",
+		}),
+		buildDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "nydusify",
+			Subsystem: "converter",
+			Name:      "build_duration_seconds",
+			Help:      "The duration of building the layers of an image into nydus layers.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.conversions, m.failures, m.pushedBytes, m.buildDuration}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range m.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range m.collectors() {
+		collector.Collect(ch)
+	}
+}
+
+// observe records a finished conversion with its result.
+func (m *Metrics) observe(result *Result, err error) {
+	if m == nil {
+		return
+	}
+	m.conversions.Inc()
+	if err != nil {
+		m.failures.Inc()
+		return
+	}
+	m.pushedBytes.Add(float64(result.PushedBytes))
+}
+
+// observeBuild records the build duration reported by the converter of
+// acceleration-service, which is missing if the conversion fails before
+// the build finishes.
+func (m *Metrics) observeBuild(metric *converter.Metric) {
+	if m == nil || metric == nil || metric.ConversionElapsed == 0 {
+		return
+	}
+	m.buildDuration.Observe(metric.ConversionElapsed.Seconds())
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/goharbor/acceleration-service/pkg/converter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(metrics))
+
+	// The conversion fails since the source OCI image layout doesn't exist.
+	_, err := Convert(context.Background(), Opt{
+		WorkDir:    t.TempDir(),
+		SourcePath: filepath.Join(t.TempDir(), "non-existent"),
+		Target:     "localhost/foo:nydus",
+		Metrics:    metrics,
+	})
+	require.Error(t, err)
+	require.Equal(t, float64(1), testutil.ToFloat64(metrics.conversions))
+	require.Equal(t, float64(1), testutil.ToFloat64(metrics.failures))
+	require.Equal(t, float64(0), testutil.ToFloat64(metrics.pushedBytes))
+
+	metrics.observeBuild(&converter.Metric{ConversionElapsed: 3 * time.Second})
+	metrics.observe(&Result{PushedBytes: 5}, nil)
+	require.Equal(t, float64(2), testutil.ToFloat64(metrics.conversions))
+	require.Equal(t, float64(1), testutil.ToFloat64(metrics.failures))
+	require.Equal(t, float64(5), testutil.ToFloat64(metrics.pushedBytes))
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	names := []string{}
+	for _, family := range families {
+		names = append(names, family.GetName())
+		if family.GetName() == "nydusify_converter_build_duration_seconds" {
+			require.Equal(t, uint64(1), family.GetMetric()[0].GetHistogram().GetSampleCount())
+			require.Equal(t, float64(3), family.GetMetric()[0].GetHistogram().GetSampleSum())
+		}
+	}
+	require.ElementsMatch(t, []string{
+		"nydusify_converter_conversions_total",
+		"nydusify_converter_conversion_failures_total",
+		"nydusify_converter_pushed_bytes_total",
+		"nydusify_converter_build_duration_seconds",
+	}, names)
+
+	// The nil metrics are ignored.
+	var nilMetrics *Metrics
+	nilMetrics.observe(nil, err)
+	nilMetrics.observeBuild(&converter.Metric{ConversionElapsed: time.Second})
+}
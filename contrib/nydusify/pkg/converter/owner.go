@@ -0,0 +1,53 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Owner is the uid and gid forced on all the files of target image.
+type Owner struct {
+	UID uint32
+	GID uint32
+}
+
+// ParseOwner parses the owner in format `<uid>:<gid>`.
+func ParseOwner(value string) (*Owner, error) {
+	uid, gid, ok := strings.Cut(value, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid owner %s, should be in format <uid>:<gid>", value)
+	}
+	parsedUID, err := strconv.ParseUint(uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid of owner %s", value)
+	}
+	parsedGID, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid of owner %s", value)
+	}
+	return &Owner{UID: uint32(parsedUID), GID: uint32(parsedGID)}, nil
+}
+
+// overrideOwner returns the function writing the tar stream written by write
+// with the ownership of every entry, including directories, symlinks and
+// special files, replaced by owner. The user and group names are dropped
+// since they may not match the forced ids.
+func overrideOwner(write func(w io.Writer) error, owner Owner) func(w io.Writer) error {
+	return rewriteTar(write, func(hdr *tar.Header) bool {
+		hdr.Uid = int(owner.UID)
+		hdr.Gid = int(owner.GID)
+		hdr.Uname = ""
+		hdr.Gname = ""
+		for _, key := range []string{"uid", "gid", "uname", "gname"} {
+			delete(hdr.PAXRecords, key)
+		}
+		return true
+	})
+}
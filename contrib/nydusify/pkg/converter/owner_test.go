@@ -0,0 +1,74 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOwner(t *testing.T) {
+	owner, err := ParseOwner("0:0")
+	require.NoError(t, err)
+	require.Equal(t, Owner{UID: 0, GID: 0}, *owner)
+	owner, err = ParseOwner("1000:4294967295")
+	require.NoError(t, err)
+	require.Equal(t, Owner{UID: 1000, GID: 4294967295}, *owner)
+
+	// Failure situation
+	for _, value := range []string{"", "1000", "root:root", "1000:", "-1:0", "0:4294967296"} {
+		_, err := ParseOwner(value)
+		require.Error(t, err, value)
+	}
+}
+
+func TestOverrideOwner(t *testing.T) {
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	headers := []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 1234, Gid: 5678, Uname: "builder", Gname: "builder"},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 4, Uid: 1234, Gid: 5678},
+		{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "passwd", Uid: 1234, Gid: 5678},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3, Uid: 1 << 22, Gid: 1 << 22, Format: tar.FormatPAX},
+		// The whiteout is kept as it is except for the ownership.
+		{Name: "etc/.wh.hosts", Typeflag: tar.TypeReg, Uid: 1234, Gid: 5678},
+	}
+	for _, hdr := range headers {
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Size > 0 {
+			_, err := tw.Write([]byte("root"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	layer := buf.Bytes()
+
+	ra, err := newTarReaderAt(newBytesReaderAt(layer), overrideOwner(decompressTar(newBytesReaderAt(layer)), Owner{UID: 0, GID: 10}), t.TempDir())
+	require.NoError(t, err)
+	defer ra.Close()
+
+	tr := tar.NewReader(io.NewSectionReader(ra, 0, ra.Size()))
+	for _, expected := range headers {
+		hdr, err := tr.Next()
+		require.NoError(t, err)
+		require.Equal(t, expected.Name, hdr.Name)
+		require.Equal(t, expected.Typeflag, hdr.Typeflag)
+		require.Equal(t, expected.Linkname, hdr.Linkname)
+		require.Equal(t, expected.Devmajor, hdr.Devmajor)
+		require.Equal(t, 0, hdr.Uid)
+		require.Equal(t, 10, hdr.Gid)
+		require.Empty(t, hdr.Uname)
+		require.Empty(t, hdr.Gname)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		require.Equal(t, expected.Size, int64(len(data)))
+	}
+	_, err = tr.Next()
+	require.Equal(t, io.EOF, err)
+}
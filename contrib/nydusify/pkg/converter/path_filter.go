@@ -0,0 +1,181 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// opaqueWhiteout is the entry name marking its parent directory opaque.
+const opaqueWhiteout = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+// pathPattern is a gitignore-style glob matching the paths of layer entries.
+type pathPattern struct {
+	// segments are the path.Match patterns of path components, `**` matches
+	// zero or more components.
+	segments []string
+	// dirOnly makes the pattern ending with `/` only match directories.
+	dirOnly bool
+}
+
+// parsePathPattern parses the gitignore-style glob, the pattern without `/`
+// except a trailing one matches at any depth, otherwise it's relative to the
+// root of layer. A matched directory also matches all the entries inside it,
+// and `dir/**` matches the directory itself too, so that no empty directory
+// is left.
+func parsePathPattern(pattern string) (*pathPattern, error) {
+	value := strings.TrimSpace(pattern)
+	if value == "" || strings.HasPrefix(value, "!") {
+		return nil, fmt.Errorf("invalid path pattern %q", pattern)
+	}
+	pp := &pathPattern{}
+	if strings.HasSuffix(value, "/") {
+		pp.dirOnly = true
+		value = strings.TrimRight(value, "/")
+	}
+	if strings.Trim(value, "/") == "" {
+		return nil, fmt.Errorf("invalid path pattern %q", pattern)
+	}
+	if !strings.Contains(value, "/") {
+		value = "**/" + value
+	}
+	for _, seg := range strings.Split(strings.TrimLeft(value, "/"), "/") {
+		if seg == "" {
+			continue
+		}
+		if _, err := path.Match(seg, ""); err != nil {
+			return nil, fmt.Errorf("invalid path pattern %q: %s", pattern, err)
+		}
+		pp.segments = append(pp.segments, seg)
+	}
+	return pp, nil
+}
+
+// matchSegments returns true if the path components match the pattern
+// segments. The path matches once the pattern is consumed, since the entries
+// inside a matched directory are matched too. If partial is true, the path
+// also matches if it's consumed first, it's a directory some matched entries
+// may be inside.
+func matchSegments(segments, names []string, isDir, dirOnly, partial bool) bool {
+	if len(segments) == 0 {
+		// A trailing `/` requires the entry matched by the last segment
+		// to be a directory, the parents of entries are directories.
+		return len(names) > 0 || isDir || !dirOnly
+	}
+	if segments[0] == "**" {
+		return matchSegments(segments[1:], names, isDir, dirOnly, partial) ||
+			(len(names) > 0 && matchSegments(segments, names[1:], isDir, dirOnly, partial))
+	}
+	if len(names) == 0 {
+		return partial
+	}
+	if ok, _ := path.Match(segments[0], names[0]); !ok {
+		return false
+	}
+	return matchSegments(segments[1:], names[1:], isDir, dirOnly, partial)
+}
+
+func (pp *pathPattern) match(names []string, isDir, partial bool) bool {
+	return matchSegments(pp.segments, names, isDir, pp.dirOnly, partial)
+}
+
+// pathFilter drops the entries of source layers by Opt.IncludePatterns and
+// Opt.ExcludePatterns, the excludes take precedence over the includes.
+type pathFilter struct {
+	includes []*pathPattern
+	excludes []*pathPattern
+}
+
+func parsePathPatterns(patterns []string) ([]*pathPattern, error) {
+	var parsed []*pathPattern
+	for _, pattern := range patterns {
+		pp, err := parsePathPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, pp)
+	}
+	return parsed, nil
+}
+
+// newPathFilter returns nil if no pattern specified.
+func newPathFilter(includes, excludes []string) (*pathFilter, error) {
+	if len(includes) == 0 && len(excludes) == 0 {
+		return nil, nil
+	}
+	filter := &pathFilter{}
+	var err error
+	if filter.includes, err = parsePathPatterns(includes); err != nil {
+		return nil, err
+	}
+	if filter.excludes, err = parsePathPatterns(excludes); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func splitEntryName(name string) []string {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return nil
+	}
+	return strings.Split(name[1:], "/")
+}
+
+// keep returns true if the entry of name is left in layer. The directories
+// are kept if any included entries may be inside them, so that the included
+// entries keep the metadata of their parents.
+func (filter *pathFilter) keep(name string, isDir bool) bool {
+	names := splitEntryName(name)
+	if len(names) == 0 {
+		return true
+	}
+	for _, pp := range filter.excludes {
+		if pp.match(names, isDir, false) {
+			return false
+		}
+	}
+	if len(filter.includes) == 0 {
+		return true
+	}
+	for _, pp := range filter.includes {
+		if pp.match(names, isDir, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepEntry returns true if the tar entry is left in layer, the whiteouts
+// are filtered by the entries they delete, so that an included file deleted
+// by upper layer stays deleted, and the hard links are dropped along with
+// their targets.
+func (filter *pathFilter) keepEntry(hdr *tar.Header) bool {
+	dir, base := path.Split(path.Clean("/" + hdr.Name))
+	switch {
+	case base == opaqueWhiteout:
+		return filter.keep(dir, true)
+	case strings.HasPrefix(base, whiteoutPrefix):
+		name := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+		// The type of deleted entry is unknown, keep the whiteout if
+		// the entry could be kept as either.
+		return filter.keep(name, false) || filter.keep(name, true)
+	case hdr.Typeflag == tar.TypeLink:
+		if !filter.keep(hdr.Linkname, false) {
+			return false
+		}
+	}
+	return filter.keep(hdr.Name, hdr.Typeflag == tar.TypeDir)
+}
+
+// filterTar returns the function writing the tar stream written by write
+// without the entries dropped by filter.
+func filterTar(write func(w io.Writer) error, filter *pathFilter) func(w io.Writer) error {
+	return rewriteTar(write, filter.keepEntry)
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathFilter(t *testing.T) {
+	filter, err := newPathFilter(nil, nil)
+	require.NoError(t, err)
+	require.Nil(t, filter)
+	for _, pattern := range []string{"", "!foo", "/", "[a"} {
+		_, err := newPathFilter(nil, []string{pattern})
+		require.Error(t, err)
+	}
+
+	filter, err = newPathFilter(nil, []string{"dir-2/**", "*.log", "/cache/", "a/**/b"})
+	require.NoError(t, err)
+	for name, expected := range map[string]bool{
+		"dir-1":            true,
+		"dir-1/file-1":     true,
+		"dir-2":            false,
+		"./dir-2/file-2":   false,
+		"dir-2/dir-3/file": false,
+		"dir-22/file":      true,
+		"app.log":          false,
+		"var/log/app.log":  false,
+		"app.log.1":        true,
+		"cache/file":       false,
+		"var/cache/file":   true,
+		"a/b":              false,
+		"a/x/y/b/file":     false,
+		"a/x/c":            true,
+	} {
+		require.Equal(t, expected, filter.keep(name, false), name)
+	}
+	require.False(t, filter.keep("cache", true))
+	require.True(t, filter.keep("cache", false))
+
+	// The excludes take precedence over the includes.
+	filter, err = newPathFilter([]string{"usr/bin/**", "etc/*.conf"}, []string{"usr/bin/debug"})
+	require.NoError(t, err)
+	for name, expected := range map[string]bool{
+		"usr/bin/sh":     true,
+		"usr/bin/debug":  false,
+		"usr/lib/libc":   false,
+		"etc/a.conf":     true,
+		"etc/passwd":     false,
+		"etc/sub/a.conf": false,
+	} {
+		require.Equal(t, expected, filter.keep(name, false), name)
+	}
+	// The parents of included entries are kept.
+	require.True(t, filter.keep("usr", true))
+	require.True(t, filter.keep("etc", true))
+	require.False(t, filter.keep("var", true))
+	require.False(t, filter.keep("etc/sub", true))
+}
+
+func TestFilterTar(t *testing.T) {
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir},
+		{Name: "etc/a.conf", Typeflag: tar.TypeReg, Size: 6},
+		{Name: "etc/.wh.b.conf", Typeflag: tar.TypeReg},
+		{Name: "etc/.wh.passwd", Typeflag: tar.TypeReg},
+		{Name: "etc/link.conf", Typeflag: tar.TypeLink, Linkname: "etc/a.conf"},
+		{Name: "etc/shadow.conf", Typeflag: tar.TypeLink, Linkname: "etc/shadow"},
+		{Name: "etc/sub/", Typeflag: tar.TypeDir},
+		{Name: "etc/sub/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "var/", Typeflag: tar.TypeDir},
+		{Name: "var/app.log", Typeflag: tar.TypeReg, Size: 6},
+		{Name: "var/.wh.a.conf", Typeflag: tar.TypeReg},
+	} {
+		hdr.Mode = 0644
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Size > 0 {
+			_, err := tw.Write([]byte("file-1"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	layer := buf.Bytes()
+
+	filter, err := newPathFilter([]string{"*.conf"}, []string{"var/"})
+	require.NoError(t, err)
+	ra, err := newTarReaderAt(newBytesReaderAt(layer), filterTar(decompressTar(newBytesReaderAt(layer)), filter), t.TempDir())
+	require.NoError(t, err)
+	defer ra.Close()
+
+	names := []string{}
+	tr := tar.NewReader(io.NewSectionReader(ra, 0, ra.Size()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		if hdr.Name == "etc/a.conf" {
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			require.Equal(t, "file-1", string(data))
+		}
+	}
+	// The whiteout of passwd is kept since it may be a directory of included
+	// files.
+	require.Equal(t, []string{"etc/", "etc/a.conf", "etc/.wh.b.conf", "etc/.wh.passwd", "etc/link.conf", "etc/sub/", "etc/sub/.wh..wh..opq"}, names)
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+type LayerDecision string
+
+const (
+	// LayerBuilt means the layer is newly built in the conversion.
+	LayerBuilt LayerDecision = "Built"
+	// LayerReused means the layer is reused from build cache or chunk dict,
+	// so no new blob is produced.
+	LayerReused LayerDecision = "Reused"
+)
+
+// PlannedLayer is a layer of the target image and how it's produced.
+type PlannedLayer struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"media_type"`
+	Size      int64         `json:"size"`
+	Decision  LayerDecision `json:"decision"`
+}
+
+// Plan describes the work of conversion, which is useful to estimate the
+// conversion with Opt.DryRun before actually pushing the target image.
+type Plan struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	// TargetDigest is the digest of target manifest or index.
+	TargetDigest digest.Digest `json:"target_digest"`
+
+	Layers       []PlannedLayer `json:"layers"`
+	BuiltLayers  int            `json:"built_layers"`
+	BuiltBytes   int64          `json:"built_bytes"`
+	ReusedLayers int            `json:"reused_layers"`
+	ReusedBytes  int64          `json:"reused_bytes"`
+	TotalBytes   int64          `json:"total_bytes"`
+
+	// FailedPlatforms are the platforms skipped with Opt.ConvertAllPlatforms
+	// because of conversion failure.
+	FailedPlatforms []string `json:"failed_platforms,omitempty"`
+	// BuilderVersion is the version of nydus-image builder used by the
+	// conversion.
+	BuilderVersion string `json:"builder_version,omitempty"`
+	// LayerMap maps each source layer to the nydus blob layer converted from
+	// it, see Result.LayerMap.
+	LayerMap map[digest.Digest]digest.Digest `json:"layer_map,omitempty"`
+}
+
+// makePlan walks the target image in content store to collect all layers,
+// the content not found is skipped since the manifests of unmatched platforms
+// may be referenced by target index without being pulled.
+func makePlan(ctx context.Context, cs *store, source, target string, desc ocispec.Descriptor) (*Plan, error) {
+	plan := &Plan{
+		Source:       source,
+		Target:       target,
+		TargetDigest: desc.Digest,
+		Layers:       []PlannedLayer{},
+	}
+
+	seen := map[digest.Digest]bool{}
+	childrenHandler := images.ChildrenHandler(cs)
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if images.IsLayerType(desc.MediaType) {
+			if seen[desc.Digest] {
+				return nil, nil
+			}
+			seen[desc.Digest] = true
+
+			layer := PlannedLayer{
+				Digest:    desc.Digest,
+				MediaType: desc.MediaType,
+				Size:      desc.Size,
+				Decision:  LayerReused,
+			}
+			if cs.isBuilt(desc.Digest) {
+				layer.Decision = LayerBuilt
+				plan.BuiltLayers++
+				plan.BuiltBytes += desc.Size
+			} else {
+				plan.ReusedLayers++
+				plan.ReusedBytes += desc.Size
+			}
+			plan.TotalBytes += desc.Size
+			plan.Layers = append(plan.Layers, layer)
+			return nil, nil
+		}
+
+		children, err := childrenHandler.Handle(ctx, desc)
+		if errdefs.IsNotFound(err) {
+			return nil, nil
+		}
+		return children, err
+	})
+	if err := images.Walk(ctx, handler, desc); err != nil {
+		return nil, errors.Wrap(err, "walk target image")
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func writeContent(t *testing.T, cs content.Store, mediaType string, data []byte, fetched bool) ocispec.Descriptor {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	ref := "ref-" + desc.Digest.String()
+	if fetched {
+		require.NoError(t, content.WriteBlob(ctx, cs, ref, bytes.NewReader(data), desc))
+		return desc
+	}
+
+	// The content built by driver is written without expected digest.
+	writer, err := content.OpenWriter(ctx, cs, content.WithRef(ref))
+	require.NoError(t, err)
+	defer writer.Close()
+	_, err = writer.Write(data)
+	require.NoError(t, err)
+	if err := writer.Commit(ctx, desc.Size, desc.Digest); !errdefs.IsAlreadyExists(err) {
+		require.NoError(t, err)
+	}
+	return desc
+}
+
+func TestMakePlan(t *testing.T) {
+	base, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	cs := newStore(base, 1, nil)
+
+	reused := writeContent(t, cs, ocispec.MediaTypeImageLayer, []byte("reused"), true)
+	built := writeContent(t, cs, ocispec.MediaTypeImageLayer, []byte("built layer"), false)
+	config := writeContent(t, cs, ocispec.MediaTypeImageConfig, []byte("{}"), false)
+	manifestBytes, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{reused, built, reused},
+	})
+	require.NoError(t, err)
+	manifest := writeContent(t, cs, ocispec.MediaTypeImageManifest, manifestBytes, false)
+
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	plan, err := makePlan(ctx, cs, "source", "target", manifest)
+	require.NoError(t, err)
+	require.Equal(t, manifest.Digest, plan.TargetDigest)
+	require.Equal(t, []PlannedLayer{
+		{Digest: reused.Digest, MediaType: reused.MediaType, Size: reused.Size, Decision: LayerReused},
+		{Digest: built.Digest, MediaType: built.MediaType, Size: built.Size, Decision: LayerBuilt},
+	}, plan.Layers)
+	require.Equal(t, 1, plan.BuiltLayers)
+	require.Equal(t, built.Size, plan.BuiltBytes)
+	require.Equal(t, 1, plan.ReusedLayers)
+	require.Equal(t, reused.Size, plan.ReusedBytes)
+	require.Equal(t, reused.Size+built.Size, plan.TotalBytes)
+}
@@ -0,0 +1,265 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/goharbor/acceleration-service/pkg/converter"
+	accelerrdefs "github.com/goharbor/acceleration-service/pkg/errdefs"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+// platformConvertFunc converts the manifest of the platform in source index,
+// returns the converted manifest or index.
+type platformConvertFunc func(ctx context.Context, idx int, platform ocispec.Platform) (*ocispec.Descriptor, error)
+
+// platformTargetRef returns the placeholder reference of the image converted
+// for a single platform, which is staged in provider without being pushed.
+func platformTargetRef(idx int) string {
+	return fmt.Sprintf("localhost/nydusify/platform:%d", idx)
+}
+
+// parsePlatforms parses the comma separated platforms like
+// `linux/amd64,linux/arm/v7` into the matcher of source manifests, the
+// platforms are matched by os, architecture and variant after normalized,
+// so `linux/arm/v7` never selects the manifest of `linux/arm/v6`. The
+// matcher prefers the platforms in the specified order, and defaults to the
+// host platform if none is specified.
+func parsePlatforms(all bool, specifiers string) (platforms.MatchComparer, error) {
+	if all {
+		return platforms.All, nil
+	}
+
+	parsed := []ocispec.Platform{}
+	for _, specifier := range strings.Split(specifiers, ",") {
+		if specifier = strings.TrimSpace(specifier); specifier == "" {
+			continue
+		}
+		platform, err := platforms.Parse(specifier)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid platform %q", specifier)
+		}
+		parsed = append(parsed, platform)
+	}
+	if len(parsed) == 0 {
+		return platforms.DefaultStrict(), nil
+	}
+
+	return platforms.Ordered(parsed...), nil
+}
+
+// convertPlatforms converts the manifests of source index platform by
+// platform and assembles the converted manifests into a new index, the
+// failed platforms are skipped and returned with the errors.
+func convertPlatforms(ctx context.Context, cs content.Store, index ocispec.Index, docker2oci bool, convertFunc platformConvertFunc) (*ocispec.Descriptor, []string, error) {
+	manifests := []ocispec.Descriptor{}
+	failed := []string{}
+	for idx, manifest := range index.Manifests {
+		// Skip the manifests without platform like the attestation manifest
+		// of buildkit with `unknown/unknown` platform.
+		if manifest.Platform == nil || manifest.Platform.OS == "unknown" {
+			continue
+		}
+		platform := platforms.Format(*manifest.Platform)
+
+		logrus.Infof("converting platform %s", platform)
+		desc, err := convertFunc(ctx, idx, *manifest.Platform)
+		if err != nil {
+			logrus.Warnf("failed to convert platform %s: %s", platform, err)
+			failed = append(failed, fmt.Sprintf("%s: %s", platform, err))
+			continue
+		}
+
+		if !images.IsIndexType(desc.MediaType) {
+			desc.Platform = manifest.Platform
+			manifests = append(manifests, *desc)
+			continue
+		}
+		var converted ocispec.Index
+		if err := readJSON(ctx, cs, *desc, &converted); err != nil {
+			return nil, nil, errors.Wrapf(err, "read converted index of platform %s", platform)
+		}
+		manifests = append(manifests, converted.Manifests...)
+	}
+
+	if len(manifests) == 0 {
+		if len(failed) == 0 {
+			return nil, nil, fmt.Errorf("no platform found in source index")
+		}
+		return nil, nil, fmt.Errorf("all platforms failed to convert: %s", strings.Join(failed, "; "))
+	}
+
+	mediaType := index.MediaType
+	if mediaType == "" || (docker2oci && mediaType == images.MediaTypeDockerSchema2ManifestList) {
+		mediaType = ocispec.MediaTypeImageIndex
+	}
+	newIndex := ocispec.Index{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   mediaType,
+		Manifests:   manifests,
+		Annotations: index.Annotations,
+	}
+	data, err := json.Marshal(newIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(data), desc); err != nil {
+		return nil, nil, errors.Wrap(err, "write target index")
+	}
+
+	return &desc, failed, nil
+}
+
+func readJSON(ctx context.Context, cs content.Store, desc ocispec.Descriptor, v interface{}) error {
+	data, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// mergeMetric accumulates the metric of converting a single platform.
+func mergeMetric(total *converter.Metric, metric *converter.Metric) {
+	if metric == nil {
+		return
+	}
+	total.SourceImageSize += metric.SourceImageSize
+	total.TargetImageSize += metric.TargetImageSize
+	total.SourcePullElapsed += metric.SourcePullElapsed
+	total.ConversionElapsed += metric.ConversionElapsed
+	total.TargetPushElapsed += metric.TargetPushElapsed
+}
+
+// platformPrefetchPatterns returns the prefetch patterns of platform in
+// opt.PlatformPrefetchPatterns, or opt.PrefetchPatterns if it's absent.
+func platformPrefetchPatterns(opt Opt, platform ocispec.Platform) string {
+	want := platforms.Format(platforms.Normalize(platform))
+	for specifier, patterns := range opt.PlatformPrefetchPatterns {
+		parsed, err := platforms.Parse(specifier)
+		if err == nil && platforms.Format(platforms.Normalize(parsed)) == want {
+			return patterns
+		}
+	}
+	return opt.PrefetchPatterns
+}
+
+// convertAllPlatforms converts every platform of source image separately,
+// so that a failed platform doesn't abort the whole conversion, and pushes
+// the target index referencing all the converted platforms.
+func convertAllPlatforms(ctx context.Context, opt Opt, pvd *provider.Provider, source, target string) ([]string, error) {
+	var metric converter.Metric
+	defer opt.Metrics.observeBuild(&metric)
+	if opt.OutputJSON != "" {
+		defer dumpMetric(&metric, opt.OutputJSON)
+	}
+
+	sourceNamed, err := docker.ParseDockerRef(source)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse source reference")
+	}
+	start := time.Now()
+	if err := pvd.Pull(ctx, sourceNamed.String()); err != nil {
+		if !accelerrdefs.NeedsRetryWithHTTP(err) {
+			return nil, errors.Wrap(err, "pull image")
+		}
+		pvd.UsePlainHTTP()
+		if err := pvd.Pull(ctx, sourceNamed.String()); err != nil {
+			return nil, errors.Wrap(err, "try to pull image")
+		}
+	}
+	metric.SourcePullElapsed = time.Since(start)
+	sourceDesc, err := pvd.Image(ctx, sourceNamed.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "get source image")
+	}
+
+	newConverter := func(platformMC platforms.MatchComparer, prefetchPatterns string) (*converter.Converter, error) {
+		platformOpt := opt
+		platformOpt.PrefetchPatterns = prefetchPatterns
+		return converter.New(
+			converter.WithProvider(pvd),
+			converter.WithDriver("nydus", getConfig(platformOpt)),
+			converter.WithPlatform(platformMC),
+		)
+	}
+
+	// The source image of single platform is converted as usual.
+	if !images.IsIndexType(sourceDesc.MediaType) {
+		cvt, err := newConverter(platforms.All, opt.PrefetchPatterns)
+		if err != nil {
+			return nil, err
+		}
+		platformMetric, err := cvt.Convert(ctx, source, target, opt.CacheRef)
+		mergeMetric(&metric, platformMetric)
+		return nil, err
+	}
+
+	var index ocispec.Index
+	if err := readJSON(ctx, pvd.ContentStore(), *sourceDesc, &index); err != nil {
+		return nil, errors.Wrap(err, "read source index")
+	}
+	convertFunc := func(ctx context.Context, idx int, platform ocispec.Platform) (*ocispec.Descriptor, error) {
+		cvt, err := newConverter(platforms.OnlyStrict(platform), platformPrefetchPatterns(opt, platform))
+		if err != nil {
+			return nil, err
+		}
+		ref := platformTargetRef(idx)
+		pvd.Stage(ref)
+		platformMetric, err := cvt.Convert(ctx, source, ref, opt.CacheRef)
+		if err != nil {
+			return nil, err
+		}
+		mergeMetric(&metric, platformMetric)
+		return pvd.Image(ctx, ref)
+	}
+	targetDesc, failed, err := convertPlatforms(ctx, pvd.ContentStore(), index, opt.Docker2OCI, convertFunc)
+	if err != nil {
+		return nil, err
+	}
+	if len(failed) > 0 {
+		logrus.Warnf("skipped %d failed platforms:\n%s", len(failed), strings.Join(failed, "\n"))
+	}
+
+	targetNamed, err := docker.ParseDockerRef(target)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse target reference")
+	}
+	logrus.Infof("pushing image %s", targetNamed)
+	start = time.Now()
+	if err := pvd.Push(ctx, *targetDesc, targetNamed.String()); err != nil {
+		if !accelerrdefs.NeedsRetryWithHTTP(err) {
+			return nil, errors.Wrap(err, "push image")
+		}
+		pvd.UsePlainHTTP()
+		if err := pvd.Push(ctx, *targetDesc, targetNamed.String()); err != nil {
+			return nil, errors.Wrap(err, "try to push image")
+		}
+	}
+	metric.TargetPushElapsed += time.Since(start)
+	logrus.Infof("pushed image %s", targetNamed)
+
+	return failed, nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertPlatforms(t *testing.T) {
+	base, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	cs := newStore(base, 1, nil)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	platformOf := func(platform string) *ocispec.Platform {
+		p := platforms.MustParse(platform)
+		return &p
+	}
+	index := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("amd64"), Platform: platformOf("linux/amd64")},
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("arm64"), Platform: platformOf("linux/arm64")},
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("attestation"), Platform: &ocispec.Platform{OS: "unknown", Architecture: "unknown"}},
+		},
+	}
+
+	// The fake converter returns a nydus manifest for amd64, and an index
+	// containing the nydus manifest for arm64.
+	converted := map[string]ocispec.Descriptor{}
+	convertFunc := func(ctx context.Context, idx int, platform ocispec.Platform) (*ocispec.Descriptor, error) {
+		manifestBytes, err := json.Marshal(ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    ocispec.DescriptorEmptyJSON,
+		})
+		require.NoError(t, err)
+		manifest := writeContent(t, cs, ocispec.MediaTypeImageManifest, append(manifestBytes, []byte(platform.Architecture)...), false)
+		switch platform.Architecture {
+		case "amd64":
+			converted["amd64"] = manifest
+			return &manifest, nil
+		case "arm64":
+			manifest.Platform = &platform
+			converted["arm64"] = manifest
+			indexBytes, err := json.Marshal(ocispec.Index{
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				MediaType: ocispec.MediaTypeImageIndex,
+				Manifests: []ocispec.Descriptor{manifest},
+			})
+			require.NoError(t, err)
+			desc := writeContent(t, cs, ocispec.MediaTypeImageIndex, indexBytes, false)
+			return &desc, nil
+		}
+		return nil, fmt.Errorf("unexpected platform %s", platforms.Format(platform))
+	}
+
+	desc, failed, err := convertPlatforms(ctx, cs, index, false, convertFunc)
+	require.NoError(t, err)
+	require.Empty(t, failed)
+
+	var target ocispec.Index
+	require.NoError(t, readJSON(ctx, cs, *desc, &target))
+	require.Equal(t, ocispec.MediaTypeImageIndex, target.MediaType)
+	require.Len(t, target.Manifests, 2)
+	require.Equal(t, converted["amd64"].Digest, target.Manifests[0].Digest)
+	require.Equal(t, "linux/amd64", platforms.Format(*target.Manifests[0].Platform))
+	require.Equal(t, converted["arm64"].Digest, target.Manifests[1].Digest)
+	require.Equal(t, "linux/arm64", platforms.Format(*target.Manifests[1].Platform))
+
+	// The failed platform is skipped and reported.
+	index.Manifests = append(index.Manifests, ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("s390x"),
+		Platform:  platformOf("linux/s390x"),
+	})
+	desc, failed, err = convertPlatforms(ctx, cs, index, false, convertFunc)
+	require.NoError(t, err)
+	require.Len(t, failed, 1)
+	require.Contains(t, failed[0], "linux/s390x")
+	require.NoError(t, readJSON(ctx, cs, *desc, &target))
+	require.Len(t, target.Manifests, 2)
+
+	// All platforms failed.
+	index.Manifests = index.Manifests[3:]
+	_, _, err = convertPlatforms(ctx, cs, index, false, convertFunc)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "all platforms failed")
+}
+
+func TestParsePlatforms(t *testing.T) {
+	manifests := []ocispec.Descriptor{}
+	for _, platform := range []string{"linux/amd64", "linux/arm/v6", "linux/arm/v7", "linux/arm64/v8"} {
+		p := platforms.MustParse(platform)
+		manifests = append(manifests, ocispec.Descriptor{Digest: digest.FromString(platform), Platform: &p})
+	}
+	selected := func(platformMC platforms.MatchComparer) []string {
+		matched := []string{}
+		for _, manifest := range manifests {
+			if platformMC.Match(*manifest.Platform) {
+				matched = append(matched, platforms.Format(*manifest.Platform))
+			}
+		}
+		return matched
+	}
+
+	platformMC, err := parsePlatforms(false, "linux/arm/v7")
+	require.NoError(t, err)
+	require.Equal(t, []string{"linux/arm/v7"}, selected(platformMC))
+
+	platformMC, err = parsePlatforms(false, " linux/arm/v6, linux/arm64 ")
+	require.NoError(t, err)
+	require.Equal(t, []string{"linux/arm/v6", "linux/arm64/v8"}, selected(platformMC))
+
+	platformMC, err = parsePlatforms(true, "linux/arm/v7")
+	require.NoError(t, err)
+	require.Len(t, selected(platformMC), 4)
+
+	// Failure situation
+	for _, platform := range []string{"linux/arm/v7/extra", "linux//amd64", "linux/*", "unknown-arch"} {
+		_, err = parsePlatforms(false, platform)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "invalid platform")
+	}
+	err = validateOpt(Opt{Platforms: "linux/amd64,linux/arm/v7/extra"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid platform "linux/arm/v7/extra"`)
+}
+
+func TestPlatformPrefetchPatterns(t *testing.T) {
+	opt := Opt{
+		PrefetchPatterns: "/",
+		PlatformPrefetchPatterns: map[string]string{
+			"linux/amd64":    "/usr/bin/amd64",
+			"linux/arm64/v8": "/usr/bin/arm64",
+		},
+	}
+	require.Equal(t, "/usr/bin/amd64", platformPrefetchPatterns(opt, platforms.MustParse("linux/amd64")))
+	require.Equal(t, "/usr/bin/arm64", platformPrefetchPatterns(opt, ocispec.Platform{OS: "linux", Architecture: "arm64"}))
+	require.Equal(t, "/", platformPrefetchPatterns(opt, platforms.MustParse("linux/s390x")))
+
+	require.NoError(t, validateOpt(Opt{ConvertAllPlatforms: true, PlatformPrefetchPatterns: opt.PlatformPrefetchPatterns}))
+
+	// Failure situation
+	err := validateOpt(Opt{PlatformPrefetchPatterns: opt.PlatformPrefetchPatterns})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "platform prefetch patterns are only supported with converting all platforms")
+	err = validateOpt(Opt{ConvertAllPlatforms: true, PlatformPrefetchPatterns: map[string]string{"linux//amd64": "/"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid platform \"linux//amd64\" of prefetch patterns")
+}
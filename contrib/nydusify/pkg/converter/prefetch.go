@@ -0,0 +1,391 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference/docker"
+	accelerrdefs "github.com/goharbor/acceleration-service/pkg/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+const whiteoutPrefix = ".wh."
+
+// loadPrefetchTrace reads the paths line by line in access order from the
+// trace file, the duplicated paths only keep the first access, and the
+// invalid lines are warned and skipped since the trace is collected from
+// runtime rather than written by hand.
+func loadPrefetchTrace(tracePath string) ([]string, error) {
+	if tracePath == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(tracePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "open prefetch trace file")
+	}
+	defer file.Close()
+
+	paths := []string{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		path := strings.TrimSpace(scanner.Text())
+		if path == "" {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			logrus.Warnf("skip invalid prefetch trace path %s at line %d, should be an absolute path", path, line)
+			continue
+		}
+		path = filepath.Clean(path)
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read prefetch trace file")
+	}
+
+	return paths, nil
+}
+
+// mergePrefetchTrace puts the traced paths before the prefetch patterns, the
+// builder orders the prefetch table by the order of patterns, and omits the
+// pattern covered by a previous one.
+func mergePrefetchTrace(tracePaths []string, patterns string) string {
+	if len(tracePaths) == 0 {
+		return patterns
+	}
+
+	merged := append([]string{}, tracePaths...)
+	seen := map[string]bool{}
+	for _, path := range tracePaths {
+		seen[path] = true
+	}
+	for _, pattern := range strings.Split(patterns, "\n") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" && !seen[pattern] {
+			seen[pattern] = true
+			merged = append(merged, pattern)
+		}
+	}
+
+	return strings.Join(merged, "\n")
+}
+
+// walkLayer calls fn with the header of each entry in layer tarball, the
+// name of header is cleaned as an absolute path.
+func walkLayer(ctx context.Context, cs content.Store, desc ocispec.Descriptor, fn func(name string, hdr *tar.Header)) error {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+
+	reader, err := utils.DecompressLayer(content.NewReader(ra), desc.MediaType)
+	if err != nil {
+		return errors.Wrap(err, "decompress layer")
+	}
+	defer reader.Close()
+
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "read layer tarball")
+		}
+		fn(path.Clean("/"+hdr.Name), hdr)
+	}
+}
+
+// deletePaths removes the path deleted by whiteout and the paths inside it
+// from the path set.
+func deletePaths(paths map[string]bool, deleted string) {
+	for p := range paths {
+		if p == deleted || strings.HasPrefix(p, deleted+"/") {
+			delete(paths, p)
+		}
+	}
+}
+
+// layerPaths adds the paths in layer tarball into the path set, and removes
+// the paths deleted by whiteout files. The opaque whiteouts are ignored, so
+// that an existing path is never reported as missing by mistake.
+func layerPaths(ctx context.Context, cs content.Store, desc ocispec.Descriptor, paths map[string]bool) error {
+	return walkLayer(ctx, cs, desc, func(name string, _ *tar.Header) {
+		dir, base := path.Split(name)
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			deletePaths(paths, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			return
+		}
+		for p := name; p != "/"; p = path.Dir(p) {
+			paths[p] = true
+		}
+	})
+}
+
+// walkManifests calls fn with each manifest of the image pulled into content
+// store, the manifests of unmatched platforms aren't pulled and skipped.
+func walkManifests(ctx context.Context, cs content.Store, desc ocispec.Descriptor, fn func(manifest ocispec.Manifest) error) error {
+	childrenHandler := images.ChildrenHandler(cs)
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if !images.IsManifestType(desc.MediaType) {
+			children, err := childrenHandler.Handle(ctx, desc)
+			if errdefs.IsNotFound(err) {
+				return nil, nil
+			}
+			return children, err
+		}
+
+		var manifest ocispec.Manifest
+		if err := readJSON(ctx, cs, desc, &manifest); err != nil {
+			if errdefs.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, errors.Wrap(err, "read manifest")
+		}
+		return nil, fn(manifest)
+	})
+	return images.Walk(ctx, handler, desc)
+}
+
+// missingTracePaths returns the traced paths which aren't found in any
+// platform of the image pulled into content store.
+func missingTracePaths(ctx context.Context, cs content.Store, desc ocispec.Descriptor, tracePaths []string) ([]string, error) {
+	found := map[string]bool{"/": true}
+	if err := walkManifests(ctx, cs, desc, func(manifest ocispec.Manifest) error {
+		paths := map[string]bool{}
+		for _, layer := range manifest.Layers {
+			if err := layerPaths(ctx, cs, layer, paths); err != nil {
+				return errors.Wrapf(err, "read layer %s", layer.Digest)
+			}
+		}
+		for p := range paths {
+			found[p] = true
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+	for _, path := range tracePaths {
+		if !found[path] {
+			missing = append(missing, path)
+		}
+	}
+
+	return missing, nil
+}
+
+// warnMissingTracePaths warns the traced paths not found in source image,
+// which are ignored by builder without failing the conversion. The source
+// layers are read from cs directly rather than the store reporting progress.
+func warnMissingTracePaths(ctx context.Context, pvd *provider.Provider, cs content.Store, source string, tracePaths []string) {
+	sourceNamed, err := docker.ParseDockerRef(source)
+	if err != nil {
+		logrus.Warnf("failed to check prefetch trace paths: %s", err)
+		return
+	}
+	sourceDesc, err := pvd.Image(ctx, sourceNamed.String())
+	if err != nil {
+		logrus.Warnf("failed to check prefetch trace paths: %s", err)
+		return
+	}
+	missing, err := missingTracePaths(ctx, cs, *sourceDesc, tracePaths)
+	if err != nil {
+		logrus.Warnf("failed to check prefetch trace paths: %s", err)
+		return
+	}
+	for _, path := range missing {
+		logrus.Warnf("prefetch trace path %s isn't found in source image", path)
+	}
+}
+
+const (
+	// PrefetchLayerPolicyAll prefetches the files of all layers matched by
+	// prefetch patterns.
+	PrefetchLayerPolicyAll = "all"
+	// PrefetchLayerPolicyNone prefetches nothing.
+	PrefetchLayerPolicyNone = "none"
+	// prefetchLayerPolicyBottom is the prefix of policy `bottom-<n>`, which
+	// only prefetches the files of the lowest n layers.
+	prefetchLayerPolicyBottom = "bottom-"
+)
+
+// noPrefetchPattern is a path never existing in image, the builder prefetches
+// all files for empty patterns, so it's used to prefetch nothing.
+const noPrefetchPattern = "/.nydusify-no-prefetch"
+
+// resolvePrefetchPatterns returns the prefetch patterns passed to builder,
+// which are the inline patterns merged with the patterns file and prefetch
+// trace, and the paths of prefetch trace.
+func resolvePrefetchPatterns(opt Opt) (string, []string, error) {
+	patterns, err := loadPrefetchPatterns(opt)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "load prefetch patterns")
+	}
+	tracePaths, err := loadPrefetchTrace(opt.PrefetchTracePath)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "load prefetch trace")
+	}
+	patterns = mergePrefetchTrace(tracePaths, patterns)
+	if opt.PrefetchIncludeMetadataOnly {
+		// The builder prefetches all files for empty patterns.
+		patterns = noPrefetchPattern
+	}
+	return patterns, tracePaths, nil
+}
+
+// parsePrefetchLayerPolicy returns the count of the lowest layers to be
+// prefetched by policy, or -1 for all the layers.
+func parsePrefetchLayerPolicy(policy string) (int, error) {
+	switch policy {
+	case "", PrefetchLayerPolicyAll:
+		return -1, nil
+	case PrefetchLayerPolicyNone:
+		return 0, nil
+	}
+	if strings.HasPrefix(policy, prefetchLayerPolicyBottom) {
+		count, err := strconv.Atoi(strings.TrimPrefix(policy, prefetchLayerPolicyBottom))
+		if err == nil && count >= 0 {
+			return count, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid prefetch layer policy %s, should be one of %s, %s and %s<n>", policy, PrefetchLayerPolicyAll, PrefetchLayerPolicyNone, prefetchLayerPolicyBottom)
+}
+
+// bottomLayerFiles adds the files of the lowest count layers of manifest into
+// the file set, except the ones replaced or deleted by upper layers. The
+// directories are skipped since they would match the files of all layers
+// inside them as prefetch patterns.
+func bottomLayerFiles(ctx context.Context, cs content.Store, manifest ocispec.Manifest, count int, files map[string]bool) error {
+	bottom := map[string]bool{}
+	for idx, layer := range manifest.Layers {
+		if err := walkLayer(ctx, cs, layer, func(name string, hdr *tar.Header) {
+			dir, base := path.Split(name)
+			switch {
+			case strings.HasPrefix(base, whiteoutPrefix):
+				deletePaths(bottom, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			case hdr.Typeflag == tar.TypeDir:
+			case idx < count:
+				bottom[name] = true
+			default:
+				delete(bottom, name)
+			}
+		}); err != nil {
+			return errors.Wrapf(err, "read layer %s", layer.Digest)
+		}
+	}
+	for file := range bottom {
+		files[file] = true
+	}
+	return nil
+}
+
+// layerPrefetchPatterns returns the files of the lowest count layers matched
+// by the prefetch patterns in order of patterns, the lowest layers of all
+// platforms of the image pulled into content store are counted.
+func layerPrefetchPatterns(ctx context.Context, cs content.Store, desc ocispec.Descriptor, count int, patterns string) (string, error) {
+	files := map[string]bool{}
+	if count > 0 {
+		if err := walkManifests(ctx, cs, desc, func(manifest ocispec.Manifest) error {
+			return bottomLayerFiles(ctx, cs, manifest, count, files)
+		}); err != nil {
+			return "", err
+		}
+	}
+	sorted := make([]string, 0, len(files))
+	for file := range files {
+		sorted = append(sorted, file)
+	}
+	sort.Strings(sorted)
+
+	if strings.TrimSpace(patterns) == "" {
+		patterns = "/"
+	}
+	matched := []string{}
+	seen := map[string]bool{}
+	for _, pattern := range strings.Split(patterns, "\n") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		pattern = path.Clean(pattern)
+		for _, file := range sorted {
+			if seen[file] {
+				continue
+			}
+			if pattern == "/" || file == pattern || strings.HasPrefix(file, pattern+"/") {
+				seen[file] = true
+				matched = append(matched, file)
+			}
+		}
+	}
+	if len(matched) == 0 {
+		return noPrefetchPattern, nil
+	}
+
+	return strings.Join(matched, "\n"), nil
+}
+
+// sourcePrefetchPatterns pulls the source image, and returns the prefetch
+// patterns limited by the layer policy, which are passed to builder for all
+// layers. The source layers are read from cs directly rather than the store
+// reporting progress.
+func sourcePrefetchPatterns(ctx context.Context, pvd *provider.Provider, cs content.Store, source string, opt Opt) (string, error) {
+	count, err := parsePrefetchLayerPolicy(opt.PrefetchLayerPolicy)
+	if err != nil {
+		return "", err
+	}
+	if count < 0 {
+		return opt.PrefetchPatterns, nil
+	}
+	if count == 0 {
+		return noPrefetchPattern, nil
+	}
+
+	sourceNamed, err := docker.ParseDockerRef(source)
+	if err != nil {
+		return "", errors.Wrap(err, "parse source reference")
+	}
+	if err := pvd.Pull(ctx, sourceNamed.String()); err != nil {
+		if !accelerrdefs.NeedsRetryWithHTTP(err) {
+			return "", errors.Wrap(err, "pull image")
+		}
+		pvd.UsePlainHTTP()
+		if err := pvd.Pull(ctx, sourceNamed.String()); err != nil {
+			return "", errors.Wrap(err, "try to pull image")
+		}
+	}
+	sourceDesc, err := pvd.Image(ctx, sourceNamed.String())
+	if err != nil {
+		return "", errors.Wrap(err, "get source image")
+	}
+
+	return layerPrefetchPatterns(ctx, cs, *sourceDesc, count, opt.PrefetchPatterns)
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func makeLayer(t *testing.T, names ...string) []byte {
+	buf := bytes.Buffer{}
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, name := range names {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}))
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func TestLoadPrefetchTrace(t *testing.T) {
+	tracePath := filepath.Join(t.TempDir(), "trace.txt")
+	require.NoError(t, os.WriteFile(tracePath, []byte("/usr/bin/bash\n/etc/passwd\n\nusr/lib\n/usr/bin/bash\n  /lib//libc.so  \n"), 0644))
+
+	paths, err := loadPrefetchTrace(tracePath)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/usr/bin/bash", "/etc/passwd", "/lib/libc.so"}, paths)
+
+	// The traced paths are put before the prefetch patterns.
+	require.Equal(t, "/usr/bin/bash\n/etc/passwd\n/lib/libc.so\n/", mergePrefetchTrace(paths, "/"))
+	require.Equal(t, "/usr/bin/bash\n/etc/passwd\n/lib/libc.so\n/usr/lib", mergePrefetchTrace(paths, "/etc/passwd\n/usr/lib"))
+	require.Equal(t, "/", mergePrefetchTrace(nil, "/"))
+
+	paths, err = loadPrefetchTrace("")
+	require.NoError(t, err)
+	require.Empty(t, paths)
+
+	// Failure situation
+	_, err = loadPrefetchTrace(filepath.Join(t.TempDir(), "non-existent.txt"))
+	require.Error(t, err)
+}
+
+func TestMissingTracePaths(t *testing.T) {
+	base, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	lower := writeContent(t, base, ocispec.MediaTypeImageLayerGzip, makeLayer(t, "usr/bin/bash", "etc/passwd", "etc/shadow"), true)
+	upper := writeContent(t, base, ocispec.MediaTypeImageLayerGzip, makeLayer(t, "etc/.wh.shadow", "./usr/lib/libc.so"), true)
+	manifestBytes, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.DescriptorEmptyJSON,
+		Layers:    []ocispec.Descriptor{lower, upper},
+	})
+	require.NoError(t, err)
+	manifest := writeContent(t, base, ocispec.MediaTypeImageManifest, manifestBytes, true)
+
+	missing, err := missingTracePaths(ctx, base, manifest, []string{"/usr/lib/libc.so", "/etc/shadow", "/usr/bin", "/etc/passwd", "/opt/app"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"/etc/shadow", "/opt/app"}, missing)
+}
+
+func TestLayerPrefetchPatterns(t *testing.T) {
+	base, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	lower := writeContent(t, base, ocispec.MediaTypeImageLayerGzip, makeLayer(t, "usr/bin/bash", "etc/passwd", "etc/shadow"), true)
+	middle := writeContent(t, base, ocispec.MediaTypeImageLayerGzip, makeLayer(t, "lib/libc.so", "etc/hosts"), true)
+	upper := writeContent(t, base, ocispec.MediaTypeImageLayerGzip, makeLayer(t, "etc/.wh.shadow", "etc/hosts", "app/main"), true)
+	manifestBytes, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.DescriptorEmptyJSON,
+		Layers:    []ocispec.Descriptor{lower, middle, upper},
+	})
+	require.NoError(t, err)
+	manifest := writeContent(t, base, ocispec.MediaTypeImageManifest, manifestBytes, true)
+
+	// Only the files of the lowest two layers are prefetched, the files
+	// replaced or deleted by the upper layer are excluded.
+	count, err := parsePrefetchLayerPolicy("bottom-2")
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	patterns, err := layerPrefetchPatterns(ctx, base, manifest, count, "/")
+	require.NoError(t, err)
+	require.Equal(t, "/etc/passwd\n/lib/libc.so\n/usr/bin/bash", patterns)
+
+	// The files are limited by the prefetch patterns in order of patterns.
+	patterns, err = layerPrefetchPatterns(ctx, base, manifest, count, "/usr\n/etc/\n/app")
+	require.NoError(t, err)
+	require.Equal(t, "/usr/bin/bash\n/etc/passwd", patterns)
+
+	patterns, err = layerPrefetchPatterns(ctx, base, manifest, 1, "")
+	require.NoError(t, err)
+	require.Equal(t, "/etc/passwd\n/usr/bin/bash", patterns)
+
+	// Nothing is prefetched if no file is matched.
+	patterns, err = layerPrefetchPatterns(ctx, base, manifest, count, "/app")
+	require.NoError(t, err)
+	require.Equal(t, noPrefetchPattern, patterns)
+	patterns, err = layerPrefetchPatterns(ctx, base, manifest, 0, "/")
+	require.NoError(t, err)
+	require.Equal(t, noPrefetchPattern, patterns)
+
+	for policy, expected := range map[string]int{"": -1, "all": -1, "none": 0, "bottom-0": 0, "bottom-10": 10} {
+		count, err := parsePrefetchLayerPolicy(policy)
+		require.NoError(t, err)
+		require.Equal(t, expected, count)
+	}
+
+	// Failure situation
+	for _, policy := range []string{"top-1", "bottom-", "bottom--1", "bottom-x"} {
+		_, err := parsePrefetchLayerPolicy(policy)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "invalid prefetch layer policy")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// writeJSON writes v into content store as the content of media type.
+func writeJSON(ctx context.Context, cs content.Store, mediaType string, v interface{}) (*ocispec.Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(data), desc); err != nil {
+		return nil, err
+	}
+	return &desc, nil
+}
+
+// sourceManifest returns the manifest of source image for the platform, the
+// source image of single manifest is used for any platform.
+func sourceManifest(ctx context.Context, cs content.Store, sourceDesc ocispec.Descriptor, platform ocispec.Platform) (*ocispec.Descriptor, error) {
+	if !images.IsIndexType(sourceDesc.MediaType) {
+		return &sourceDesc, nil
+	}
+
+	var index ocispec.Index
+	if err := readJSON(ctx, cs, sourceDesc, &index); err != nil {
+		return nil, errors.Wrap(err, "read source index")
+	}
+	matcher := platforms.OnlyStrict(platform)
+	for _, manifest := range index.Manifests {
+		if manifest.Platform != nil && matcher.Match(*manifest.Platform) {
+			return &manifest, nil
+		}
+	}
+
+	return nil, fmt.Errorf("platform %s isn't found in source index", platforms.Format(platform))
+}
+
+// preserveManifestConfig replaces the config of target manifest by the
+// config of source manifest, only the rootfs and history are taken from the
+// target config, since they describe the nydus layers.
+func preserveManifestConfig(ctx context.Context, cs content.Store, sourceDesc, targetDesc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	// The source manifest is merged into target index with MergePlatform.
+	if sourceDesc.Digest == targetDesc.Digest {
+		return &targetDesc, nil
+	}
+
+	var sourceManifest, targetManifest ocispec.Manifest
+	if err := readJSON(ctx, cs, sourceDesc, &sourceManifest); err != nil {
+		return nil, errors.Wrap(err, "read source manifest")
+	}
+	if err := readJSON(ctx, cs, targetDesc, &targetManifest); err != nil {
+		return nil, errors.Wrap(err, "read target manifest")
+	}
+
+	// The config is decoded as raw fields, so that the fields unknown to
+	// OCI image spec like `container_config` of docker are kept verbatim.
+	var sourceConfig, targetConfig map[string]json.RawMessage
+	if err := readJSON(ctx, cs, sourceManifest.Config, &sourceConfig); err != nil {
+		return nil, errors.Wrap(err, "read source config")
+	}
+	if err := readJSON(ctx, cs, targetManifest.Config, &targetConfig); err != nil {
+		return nil, errors.Wrap(err, "read target config")
+	}
+	for _, field := range []string{"rootfs", "history"} {
+		if value, ok := targetConfig[field]; ok {
+			sourceConfig[field] = value
+		} else {
+			delete(sourceConfig, field)
+		}
+	}
+
+	configDesc, err := writeJSON(ctx, cs, targetManifest.Config.MediaType, sourceConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "write target config")
+	}
+	configDesc.Annotations = targetManifest.Config.Annotations
+	targetManifest.Config = *configDesc
+
+	manifestDesc, err := writeJSON(ctx, cs, targetDesc.MediaType, targetManifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "write target manifest")
+	}
+	manifestDesc.Platform = targetDesc.Platform
+	manifestDesc.Annotations = targetDesc.Annotations
+
+	return manifestDesc, nil
+}
+
+// preserveConfig replaces the configs of all the manifests in target image
+// by the configs of the source manifests of the same platform.
+func preserveConfig(ctx context.Context, cs content.Store, sourceDesc, targetDesc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	if !images.IsIndexType(targetDesc.MediaType) {
+		var config ocispec.Image
+		var manifest ocispec.Manifest
+		if err := readJSON(ctx, cs, targetDesc, &manifest); err != nil {
+			return nil, errors.Wrap(err, "read target manifest")
+		}
+		if err := readJSON(ctx, cs, manifest.Config, &config); err != nil {
+			return nil, errors.Wrap(err, "read target config")
+		}
+		source, err := sourceManifest(ctx, cs, sourceDesc, config.Platform)
+		if err != nil {
+			return nil, err
+		}
+		return preserveManifestConfig(ctx, cs, *source, targetDesc)
+	}
+
+	var index ocispec.Index
+	if err := readJSON(ctx, cs, targetDesc, &index); err != nil {
+		return nil, errors.Wrap(err, "read target index")
+	}
+	for idx, manifest := range index.Manifests {
+		if manifest.Platform == nil {
+			continue
+		}
+		source, err := sourceManifest(ctx, cs, sourceDesc, *manifest.Platform)
+		if err != nil {
+			return nil, err
+		}
+		desc, err := preserveManifestConfig(ctx, cs, *source, manifest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "preserve config of platform %s", platforms.Format(*manifest.Platform))
+		}
+		index.Manifests[idx] = *desc
+	}
+
+	desc, err := writeJSON(ctx, cs, targetDesc.MediaType, index)
+	if err != nil {
+		return nil, errors.Wrap(err, "write target index")
+	}
+	desc.Annotations = targetDesc.Annotations
+
+	return desc, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestPreserveConfig(t *testing.T) {
+	cs, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	marshal := func(v interface{}) []byte {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return data
+	}
+	writeManifest := func(config []byte, layer ocispec.Descriptor) ocispec.Descriptor {
+		return writeContent(t, cs, ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    writeContent(t, cs, ocispec.MediaTypeImageConfig, config, true),
+			Layers:    []ocispec.Descriptor{layer},
+		}), true)
+	}
+
+	// The source config has the docker specific fields unknown to OCI spec.
+	sourceConfig := marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config": map[string]interface{}{
+			"Env":        []string{"PATH=/usr/bin"},
+			"Entrypoint": []string{"/entrypoint.sh"},
+			"Cmd":        []string{"serve"},
+			"WorkingDir": "/app",
+			"Labels":     map[string]string{"maintainer": "nydus"},
+			"Healthcheck": map[string]interface{}{
+				"Test": []string{"CMD", "true"},
+			},
+		},
+		"container_config": map[string]interface{}{"Hostname": "builder"},
+		"docker_version":   "24.0.0",
+		"history":          []ocispec.History{{CreatedBy: "COPY app /app"}},
+		"rootfs":           ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromString("oci")}},
+	})
+	sourceLayer := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("oci layer")}
+	source := writeManifest(sourceConfig, sourceLayer)
+
+	// The target config converted by driver lost the labels.
+	targetRootFS := ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromString("nydus")}}
+	targetHistory := []ocispec.History{{CreatedBy: "COPY app /app"}, {CreatedBy: "Nydus Converter"}}
+	targetConfig := marshal(ocispec.Image{
+		Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		RootFS:   targetRootFS,
+		History:  targetHistory,
+	})
+	targetLayer := ocispec.Descriptor{MediaType: utils.MediaTypeNydusBlob, Digest: digest.FromString("nydus layer")}
+	target := writeManifest(targetConfig, targetLayer)
+
+	checkConfig := func(desc ocispec.Descriptor) {
+		var manifest ocispec.Manifest
+		require.NoError(t, readJSON(ctx, cs, desc, &manifest))
+		require.Equal(t, []ocispec.Descriptor{targetLayer}, manifest.Layers)
+
+		var config map[string]json.RawMessage
+		require.NoError(t, readJSON(ctx, cs, manifest.Config, &config))
+		require.JSONEq(t, `{"Hostname":"builder"}`, string(config["container_config"]))
+		require.JSONEq(t, `"24.0.0"`, string(config["docker_version"]))
+		require.JSONEq(t, string(marshal(targetRootFS)), string(config["rootfs"]))
+		require.JSONEq(t, string(marshal(targetHistory)), string(config["history"]))
+
+		var image ocispec.Image
+		require.NoError(t, readJSON(ctx, cs, manifest.Config, &image))
+		require.Equal(t, map[string]string{"maintainer": "nydus"}, image.Config.Labels)
+		require.Equal(t, []string{"PATH=/usr/bin"}, image.Config.Env)
+		require.Equal(t, []string{"/entrypoint.sh"}, image.Config.Entrypoint)
+		require.Equal(t, []string{"serve"}, image.Config.Cmd)
+		require.Equal(t, "/app", image.Config.WorkingDir)
+	}
+
+	desc, err := preserveConfig(ctx, cs, source, target)
+	require.NoError(t, err)
+	checkConfig(*desc)
+
+	// The source manifest merged into target index is kept as it is.
+	platform := platforms.MustParse("linux/amd64")
+	source.Platform = &platform
+	target.Platform = &platform
+	sourceIndex := writeContent(t, cs, ocispec.MediaTypeImageIndex, marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{source},
+	}), true)
+	targetIndex := writeContent(t, cs, ocispec.MediaTypeImageIndex, marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{source, target},
+	}), true)
+	desc, err = preserveConfig(ctx, cs, sourceIndex, targetIndex)
+	require.NoError(t, err)
+	var index ocispec.Index
+	require.NoError(t, readJSON(ctx, cs, *desc, &index))
+	require.Len(t, index.Manifests, 2)
+	require.Equal(t, source, index.Manifests[0])
+	require.Equal(t, &platform, index.Manifests[1].Platform)
+	checkConfig(index.Manifests[1])
+
+	// Failure situation
+	arm64 := platforms.MustParse("linux/arm64")
+	target.Platform = &arm64
+	targetIndex = writeContent(t, cs, ocispec.MediaTypeImageIndex, marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{target},
+	}), true)
+	_, err = preserveConfig(ctx, cs, sourceIndex, targetIndex)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "platform linux/arm64 isn't found in source index")
+}
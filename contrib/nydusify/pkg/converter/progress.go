@@ -0,0 +1,93 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"sync/atomic"
+
+	"github.com/containerd/containerd/reference/docker"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type Phase string
+
+const (
+	// PhasePullSource means a source layer is pulled from registry.
+	PhasePullSource Phase = "PullSource"
+	// PhaseBuildLayer means a source layer is being built into nydus blob.
+	PhaseBuildLayer Phase = "BuildLayer"
+	// PhasePushBlob means a nydus blob layer is pushed to registry.
+	PhasePushBlob Phase = "PushBlob"
+	// PhasePushBootstrap means a nydus bootstrap layer is pushed to registry.
+	PhasePushBootstrap Phase = "PushBootstrap"
+)
+
+// Progress is an event emitted to Opt.ProgressCh during conversion.
+type Progress struct {
+	Phase  Phase
+	Digest digest.Digest
+	// Done and Total are the processed and total bytes of the layer.
+	Done  int64
+	Total int64
+}
+
+// reporter sends the progress events to channel, it's safe to use
+// a reporter with nil channel.
+type reporter struct {
+	ch chan<- Progress
+	// target is the reference of target image.
+	target string
+	// pushedBytes counts the size of layers uploaded to target, excluding
+	// the ones existing in target and the ones pushed to cache image.
+	pushedBytes atomic.Int64
+}
+
+// report sends the event without blocking, the event is dropped if the
+// channel is full, since it's called with the layer limiter held and a
+// stalled receiver must not block the conversion.
+func (r *reporter) report(phase Phase, desc ocispec.Descriptor, done int64) {
+	if r == nil || r.ch == nil {
+		return
+	}
+	select {
+	case r.ch <- Progress{
+		Phase:  phase,
+		Digest: desc.Digest,
+		Done:   done,
+		Total:  desc.Size,
+	}:
+	default:
+	}
+}
+
+func (r *reporter) progressFunc(desc ocispec.Descriptor, push bool) {
+	if !push {
+		r.report(PhasePullSource, desc, desc.Size)
+		return
+	}
+	if nydusify.IsNydusBootstrap(desc) {
+		r.report(PhasePushBootstrap, desc, desc.Size)
+	} else {
+		r.report(PhasePushBlob, desc, desc.Size)
+	}
+}
+
+// uploadFunc counts the layers uploaded to target, the target may be pushed
+// by the reference either as specified or normalized.
+func (r *reporter) uploadFunc(ref string, desc ocispec.Descriptor) {
+	if ref == r.target || normalizeRef(ref) == normalizeRef(r.target) {
+		r.pushedBytes.Add(desc.Size)
+	}
+}
+
+func normalizeRef(ref string) string {
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return ref
+	}
+	return named.String()
+}
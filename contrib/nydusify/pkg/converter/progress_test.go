@@ -0,0 +1,112 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReporter(t *testing.T) {
+	// A nil channel should be tolerated.
+	(&reporter{}).progressFunc(ocispec.Descriptor{}, true)
+
+	ch := make(chan Progress, 16)
+	r := &reporter{ch: ch}
+	s := newStore(&fakeStore{}, 1, r)
+
+	layers := []ocispec.Descriptor{
+		{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer-1"), Size: 1},
+		{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer-2"), Size: 2},
+	}
+	for _, layer := range layers {
+		r.progressFunc(layer, false)
+	}
+	for _, layer := range layers {
+		ra, err := s.ReaderAt(context.Background(), layer)
+		require.NoError(t, err)
+		require.NoError(t, ra.Close())
+	}
+	r.progressFunc(ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageLayer,
+		Annotations: map[string]string{nydusify.LayerAnnotationNydusBlob: "true"},
+		Size:        4,
+	}, true)
+	r.progressFunc(ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageLayerGzip,
+		Annotations: map[string]string{nydusify.LayerAnnotationNydusBootstrap: "true"},
+		Size:        1,
+	}, true)
+	close(ch)
+	// The pushes are counted only by uploads.
+	require.Zero(t, r.pushedBytes.Load())
+
+	phases := []Phase{}
+	for event := range ch {
+		phases = append(phases, event.Phase)
+	}
+	require.Equal(t, []Phase{
+		PhasePullSource, PhasePullSource,
+		PhaseBuildLayer, PhaseBuildLayer, PhaseBuildLayer, PhaseBuildLayer,
+		PhasePushBlob, PhasePushBootstrap,
+	}, phases)
+}
+
+func TestReporterStalledReceiver(t *testing.T) {
+	ch := make(chan Progress, 1)
+	r := &reporter{ch: ch}
+	s := newStore(&fakeStore{}, 1, r)
+	readLayers := func(from, to int) <-chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for idx := from; idx < to; idx++ {
+				layer := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString(fmt.Sprintf("layer-%d", idx)), Size: 1}
+				ra, err := s.ReaderAt(context.Background(), layer)
+				require.NoError(t, err)
+				require.NoError(t, ra.Close())
+			}
+		}()
+		return done
+	}
+	wait := func(done <-chan struct{}) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "reporter is blocked by stalled receiver")
+		}
+	}
+
+	// The receiver stops reading after the first event, the layers are
+	// still read through the limiter with the events dropped once the
+	// channel is full.
+	wait(readLayers(0, 1))
+	require.Equal(t, Progress{Phase: PhaseBuildLayer, Digest: digest.FromString("layer-0"), Total: 1}, <-ch)
+	wait(readLayers(1, 8))
+	require.Equal(t, Progress{Phase: PhaseBuildLayer, Digest: digest.FromString("layer-1"), Total: 1}, <-ch)
+	require.Empty(t, ch)
+}
+
+func TestReporterUploadFunc(t *testing.T) {
+	r := &reporter{target: "localhost:5000/foo:nydus"}
+	layer := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Size: 4}
+
+	r.uploadFunc("localhost:5000/foo:nydus", layer)
+	// The uploads to cache image aren't counted.
+	r.uploadFunc("localhost:5000/foo:nydus-cache", layer)
+	require.Equal(t, int64(4), r.pushedBytes.Load())
+
+	// The target may be pushed by normalized reference.
+	r = &reporter{target: "foo:nydus"}
+	r.uploadFunc("docker.io/library/foo:nydus", layer)
+	require.Equal(t, int64(4), r.pushedBytes.Load())
+}
@@ -0,0 +1,146 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/goharbor/acceleration-service/pkg/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+// ProvenanceArtifactType is the artifact type and the media type of the
+// in-toto statement of SLSA provenance attached to target image.
+const ProvenanceArtifactType = "application/vnd.in-toto+json"
+
+const (
+	inTotoStatementType     = "https://in-toto.io/Statement/v1"
+	slsaProvenancePredicate = "https://slsa.dev/provenance/v1"
+	provenanceBuildType     = "https://github.com/dragonflyoss/nydus/contrib/nydusify/convert@v1"
+	provenanceBuilderID     = "https://github.com/dragonflyoss/nydus/contrib/nydusify"
+)
+
+// provenanceOmittedParams are the options never recorded in provenance,
+// they are either secrets like the credentials of storage backend and the
+// request headers, or not build parameters.
+var provenanceOmittedParams = map[string]bool{
+	"BackendConfig":  true,
+	"RequestHeaders": true,
+	"BlobFilter":     true,
+	"ProgressCh":     true,
+	"Metrics":        true,
+}
+
+// provenanceSubject is the resource descriptor of in-toto statement.
+type provenanceSubject struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+type provenanceStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []provenanceSubject `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     provenancePredicate `json:"predicate"`
+}
+
+type provenancePredicate struct {
+	BuildDefinition struct {
+		BuildType            string                 `json:"buildType"`
+		ExternalParameters   map[string]interface{} `json:"externalParameters"`
+		ResolvedDependencies []provenanceSubject    `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version,omitempty"`
+		} `json:"builder"`
+	} `json:"runDetails"`
+}
+
+func digestSet(dgst digest.Digest) map[string]string {
+	return map[string]string{dgst.Algorithm().String(): dgst.Hex()}
+}
+
+// makeProvenance returns the in-toto statement with SLSA provenance
+// predicate, which describes the target image built from source image by
+// the options of conversion.
+func makeProvenance(opt Opt, source string, sourceDesc ocispec.Descriptor, target string, targetDesc ocispec.Descriptor, builderVersion string) ([]byte, error) {
+	// The options are recorded by field name, the function and channel
+	// options can't be marshaled even if they are nil.
+	params := map[string]interface{}{}
+	value := reflect.ValueOf(opt)
+	for idx := 0; idx < value.NumField(); idx++ {
+		name := value.Type().Field(idx).Name
+		if !provenanceOmittedParams[name] {
+			params[name] = value.Field(idx).Interface()
+		}
+	}
+
+	statement := provenanceStatement{
+		Type:          inTotoStatementType,
+		Subject:       []provenanceSubject{{Name: target, Digest: digestSet(targetDesc.Digest)}},
+		PredicateType: slsaProvenancePredicate,
+	}
+	predicate := &statement.Predicate
+	predicate.BuildDefinition.BuildType = provenanceBuildType
+	predicate.BuildDefinition.ExternalParameters = params
+	predicate.BuildDefinition.ResolvedDependencies = []provenanceSubject{{URI: source, Digest: digestSet(sourceDesc.Digest)}}
+	predicate.RunDetails.Builder.ID = provenanceBuilderID
+	if builderVersion != "" {
+		predicate.RunDetails.Builder.Version = map[string]string{"nydus-image": builderVersion}
+	}
+
+	return json.Marshal(statement)
+}
+
+// attachProvenance pushes the provenance of target image as a referrer with
+// the target image as subject into the target repository.
+func attachProvenance(ctx context.Context, pvd *provider.Provider, opt Opt, source string, sourceDesc ocispec.Descriptor, target string, builderVersion string) error {
+	targetNamed, err := docker.ParseDockerRef(target)
+	if err != nil {
+		return errors.Wrap(err, "parse target reference")
+	}
+	targetDesc, err := pvd.Image(ctx, targetNamed.String())
+	if err != nil {
+		return errors.Wrap(err, "get target image")
+	}
+	data, err := makeProvenance(opt, source, sourceDesc, targetNamed.String(), *targetDesc, builderVersion)
+	if err != nil {
+		return errors.Wrap(err, "make provenance")
+	}
+	blob := ocispec.Descriptor{
+		MediaType: ProvenanceArtifactType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+
+	logrus.Infof("pushing provenance of target image %s", targetNamed)
+	push := func() error {
+		_, err := pvd.PushReferrerBlob(ctx, target, ProvenanceArtifactType, *targetDesc, blob, data, nil)
+		return err
+	}
+	if err := push(); err != nil {
+		if !errdefs.NeedsRetryWithHTTP(err) {
+			return err
+		}
+		pvd.UsePlainHTTP()
+		if err := push(); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("pushed provenance of target image %s", targetNamed)
+
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakeProvenance(t *testing.T) {
+	sourceDesc := ocispec.Descriptor{Digest: digest.FromString("source")}
+	targetDesc := ocispec.Descriptor{Digest: digest.FromString("target")}
+	opt := Opt{
+		Source:         "docker.io/library/nginx:latest",
+		Target:         "docker.io/library/nginx:latest-nydus",
+		FsVersion:      "6",
+		Compressor:     "zstd",
+		BackendType:    "oss",
+		BackendConfig:  `{"access_key_secret":"secret"}`,
+		RequestHeaders: map[string]string{"X-Token": "secret"},
+		BlobFilter:     func(context.Context, string) error { return nil },
+		ProgressCh:     make(chan Progress),
+		Metrics:        &Metrics{},
+	}
+
+	data, err := makeProvenance(opt, opt.Source, sourceDesc, opt.Target, targetDesc, "v2.2.0")
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "secret")
+	statement := provenanceStatement{}
+	require.NoError(t, json.Unmarshal(data, &statement))
+	require.Equal(t, "https://in-toto.io/Statement/v1", statement.Type)
+	require.Equal(t, "https://slsa.dev/provenance/v1", statement.PredicateType)
+	require.Equal(t, []provenanceSubject{{
+		Name:   opt.Target,
+		Digest: map[string]string{"sha256": targetDesc.Digest.Hex()},
+	}}, statement.Subject)
+
+	definition := statement.Predicate.BuildDefinition
+	require.Equal(t, []provenanceSubject{{
+		URI:    opt.Source,
+		Digest: map[string]string{"sha256": sourceDesc.Digest.Hex()},
+	}}, definition.ResolvedDependencies)
+	require.Equal(t, "6", definition.ExternalParameters["FsVersion"])
+	require.Equal(t, "zstd", definition.ExternalParameters["Compressor"])
+	require.Equal(t, "oss", definition.ExternalParameters["BackendType"])
+	for name := range provenanceOmittedParams {
+		require.NotContains(t, definition.ExternalParameters, name)
+	}
+	require.Equal(t, map[string]string{"nydus-image": "v2.2.0"}, statement.Predicate.RunDetails.Builder.Version)
+
+	// The builder version is omitted if unknown.
+	data, err = makeProvenance(opt, opt.Source, sourceDesc, opt.Target, targetDesc, "")
+	require.NoError(t, err)
+	statement = provenanceStatement{}
+	require.NoError(t, json.Unmarshal(data, &statement))
+	require.Empty(t, statement.Predicate.RunDetails.Builder.Version)
+
+	// Failure situation
+	_, err = Convert(context.Background(), Opt{SourcePath: t.TempDir(), TargetPath: t.TempDir(), Provenance: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "provenance is only supported for target reference")
+}
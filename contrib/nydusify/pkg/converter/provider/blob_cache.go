@@ -0,0 +1,214 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const blobCacheTempPrefix = ".tmp-"
+
+// BlobCache caches the blobs pulled from registry in local directory by
+// digest, so that the blobs can be reused across conversions. The least
+// recently used blobs are evicted once the total size exceeds the limit.
+type BlobCache struct {
+	mutex   sync.Mutex
+	dir     string
+	maxSize int64
+}
+
+// NewBlobCache creates the blob cache in dir, zero maxSize means no limit.
+func NewBlobCache(dir string, maxSize int64) (*BlobCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create blob cache directory")
+	}
+	return &BlobCache{
+		dir:     dir,
+		maxSize: maxSize,
+	}, nil
+}
+
+func (cache *BlobCache) blobPath(dgst digest.Digest) string {
+	return filepath.Join(cache.dir, dgst.Algorithm().String(), dgst.Hex())
+}
+
+// isCacheable returns true for the blob like layer and config, the manifest
+// and index are always resolved from registry.
+func isCacheable(desc ocispec.Descriptor) bool {
+	return !images.IsManifestType(desc.MediaType) && !images.IsIndexType(desc.MediaType)
+}
+
+// Load writes the cached blob into store, it returns false if the blob isn't
+// cached. The digest is verified by store, the corrupted blob is removed from
+// cache.
+func (cache *BlobCache) Load(ctx context.Context, store content.Store, desc ocispec.Descriptor) bool {
+	if err := desc.Digest.Validate(); err != nil {
+		return false
+	}
+	blobPath := cache.blobPath(desc.Digest)
+	file, err := os.Open(blobPath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	ref := "blob-cache-" + desc.Digest.String()
+	if err := content.WriteBlob(ctx, store, ref, file, desc); err != nil {
+		logrus.Warnf("remove corrupted blob %s from cache: %s", desc.Digest, err)
+		_ = store.Abort(ctx, ref)
+		os.Remove(blobPath)
+		return false
+	}
+
+	// Record the access time for LRU eviction.
+	now := time.Now()
+	_ = os.Chtimes(blobPath, now, now)
+
+	return true
+}
+
+// Save copies the blob from store into cache with the digest verified, and
+// evicts the least recently used blobs if needed.
+func (cache *BlobCache) Save(ctx context.Context, store content.Store, desc ocispec.Descriptor) error {
+	if err := desc.Digest.Validate(); err != nil {
+		return err
+	}
+	if cache.maxSize > 0 && desc.Size > cache.maxSize {
+		return nil
+	}
+	blobPath := cache.blobPath(desc.Digest)
+	if _, err := os.Stat(blobPath); err == nil {
+		return nil
+	}
+
+	ra, err := store.ReaderAt(ctx, desc)
+	if err != nil {
+		return errors.Wrap(err, "open blob in store")
+	}
+	defer ra.Close()
+
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(blobPath), blobCacheTempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	digester := desc.Digest.Algorithm().Digester()
+	size, err := io.Copy(io.MultiWriter(tmp, digester.Hash()), content.NewReader(ra))
+	if err != nil {
+		return errors.Wrap(err, "copy blob")
+	}
+	if size != desc.Size || digester.Digest() != desc.Digest {
+		return fmt.Errorf("blob %s mismatched with size %d and digest %s", desc.Digest, size, digester.Digest())
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), blobPath); err != nil {
+		return err
+	}
+
+	return cache.evict()
+}
+
+type cachedBlob struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// evict removes the least recently used blobs until the total size doesn't
+// exceed the limit.
+func (cache *BlobCache) evict() error {
+	if cache.maxSize <= 0 {
+		return nil
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	blobs := []cachedBlob{}
+	total := int64(0)
+	if err := filepath.Walk(cache.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The blob may be evicted by others concurrently.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), blobCacheTempPrefix) {
+			return nil
+		}
+		blobs = append(blobs, cachedBlob{
+			path:    path,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		total += info.Size()
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "walk blob cache")
+	}
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].modTime.Before(blobs[j].modTime)
+	})
+	for _, blob := range blobs {
+		if total <= cache.maxSize {
+			break
+		}
+		if err := os.Remove(blob.path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "evict blob")
+		}
+		total -= blob.size
+	}
+
+	return nil
+}
+
+// handlerWrapper loads the blob from cache before fetching it from registry,
+// and saves the fetched blob into cache.
+func (cache *BlobCache) handlerWrapper(store content.Store, wrapper func(images.Handler) images.Handler) func(images.Handler) images.Handler {
+	return func(h images.Handler) images.Handler {
+		if wrapper != nil {
+			h = wrapper(h)
+		}
+		return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			if !isCacheable(desc) {
+				return h.Handle(ctx, desc)
+			}
+			if cache.Load(ctx, store, desc) {
+				logrus.Debugf("loaded blob %s from cache", desc.Digest)
+			}
+			children, err := h.Handle(ctx, desc)
+			if err == nil {
+				if err := cache.Save(ctx, store, desc); err != nil {
+					logrus.Warnf("save blob %s into cache: %s", desc.Digest, err)
+				}
+			}
+			return children, err
+		})
+	}
+}
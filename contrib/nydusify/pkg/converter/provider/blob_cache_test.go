@@ -0,0 +1,123 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// addImage adds an image with a single layer into fake registry with tag.
+func (r *fakeRegistry) addImage(t *testing.T, tag string, layerData []byte) ocispec.Manifest {
+	config, err := json.Marshal(ocispec.Image{
+		Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(layerData)}},
+	})
+	require.NoError(t, err)
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageConfig,
+			Digest:    digest.FromBytes(config),
+			Size:      int64(len(config)),
+		},
+		Layers: []ocispec.Descriptor{{
+			MediaType: ocispec.MediaTypeImageLayer,
+			Digest:    digest.FromBytes(layerData),
+			Size:      int64(len(layerData)),
+		}},
+	}
+	data, err := json.Marshal(manifest)
+	require.NoError(t, err)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.blobs[manifest.Config.Digest] = config
+	r.blobs[manifest.Layers[0].Digest] = layerData
+	r.manifests[tag] = fakeManifest{mediaType: ocispec.MediaTypeImageManifest, data: data}
+	r.manifests[digest.FromBytes(data).String()] = r.manifests[tag]
+
+	return manifest
+}
+
+func TestBlobCache(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newFakeRegistry(false)
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	manifest := registry.addImage(t, "latest", []byte("layer"))
+	ref := strings.TrimPrefix(server.URL, "http://") + "/foo:latest"
+
+	cacheDir := t.TempDir()
+	pull := func() *Provider {
+		cache, err := NewBlobCache(cacheDir, 0)
+		require.NoError(t, err)
+		pvd := newTestProvider(t)
+		pvd.SetBlobCache(cache)
+		require.NoError(t, pvd.Pull(ctx, ref))
+		return pvd
+	}
+
+	// The first conversion pulls the config and layer from registry
+	pull()
+	require.Equal(t, 2, registry.blobGets)
+
+	// The second conversion reuses the cached blobs
+	registry.blobGets = 0
+	pvd := pull()
+	require.Equal(t, 0, registry.blobGets)
+	info, err := pvd.ContentStore().Info(ctx, manifest.Layers[0].Digest)
+	require.NoError(t, err)
+	require.Equal(t, int64(len("layer")), info.Size)
+
+	// The corrupted blob is fetched again from registry
+	cache, err := NewBlobCache(cacheDir, 0)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(cache.blobPath(manifest.Layers[0].Digest), []byte("xxxxx"), 0644))
+	pull()
+	require.Equal(t, 1, registry.blobGets)
+	data, err := os.ReadFile(cache.blobPath(manifest.Layers[0].Digest))
+	require.NoError(t, err)
+	require.Equal(t, "layer", string(data))
+}
+
+func TestBlobCacheEvict(t *testing.T) {
+	cache, err := NewBlobCache(t.TempDir(), 10)
+	require.NoError(t, err)
+
+	// Older blobs are evicted first
+	blobs := []string{"blob-1", "blob-2", "blob-3"}
+	now := time.Now()
+	for idx, blob := range blobs {
+		blobPath := cache.blobPath(digest.FromString(blob))
+		require.NoError(t, os.MkdirAll(filepath.Dir(blobPath), 0755))
+		require.NoError(t, os.WriteFile(blobPath, []byte(blob), 0644))
+		modTime := now.Add(time.Duration(idx) * time.Minute)
+		require.NoError(t, os.Chtimes(blobPath, modTime, modTime))
+	}
+	// Access the first blob to make it recently used
+	require.NoError(t, os.Chtimes(cache.blobPath(digest.FromString("blob-1")), now.Add(time.Hour), now.Add(time.Hour)))
+
+	require.NoError(t, cache.evict())
+	_, err = os.Stat(cache.blobPath(digest.FromString("blob-1")))
+	require.NoError(t, err)
+	_, err = os.Stat(cache.blobPath(digest.FromString("blob-2")))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(cache.blobPath(digest.FromString("blob-3")))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,198 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// UseLayout makes the image reference to be imported from (or exported to)
+// the OCI image layout directory instead of pulling from (or pushing to)
+// remote registry.
+func (pvd *Provider) UseLayout(ref, dir string) {
+	pvd.mutex.Lock()
+	defer pvd.mutex.Unlock()
+	pvd.layouts[ref] = dir
+}
+
+func (pvd *Provider) layout(ref string) (string, bool) {
+	pvd.mutex.Lock()
+	defer pvd.mutex.Unlock()
+	dir, ok := pvd.layouts[ref]
+	return dir, ok
+}
+
+func layoutBlobPath(dir string, dgst digest.Digest) string {
+	return filepath.Join(dir, ocispec.ImageBlobsDir, dgst.Algorithm().String(), dgst.Hex())
+}
+
+// importLayout imports the image in OCI image layout directory into content
+// store, only the manifests matched with the platform will be imported.
+func (pvd *Provider) importLayout(ctx context.Context, dir string) (*ocispec.Descriptor, error) {
+	layoutBytes, err := os.ReadFile(filepath.Join(dir, ocispec.ImageLayoutFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "read oci layout file")
+	}
+	var layout ocispec.ImageLayout
+	if err := json.Unmarshal(layoutBytes, &layout); err != nil {
+		return nil, errors.Wrap(err, "unmarshal oci layout file")
+	}
+	if layout.Version != ocispec.ImageLayoutVersion {
+		return nil, fmt.Errorf("unsupported oci layout version %s", layout.Version)
+	}
+
+	indexBytes, err := os.ReadFile(filepath.Join(dir, ocispec.ImageIndexFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "read oci index file")
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return nil, errors.Wrap(err, "unmarshal oci index file")
+	}
+
+	var target ocispec.Descriptor
+	switch len(index.Manifests) {
+	case 0:
+		return nil, fmt.Errorf("no manifest found in oci layout %s", dir)
+	case 1:
+		target = index.Manifests[0]
+	default:
+		// The index.json isn't a blob in layout, write it into content
+		// store so that it can be treated as an image index.
+		target = ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageIndex,
+			Digest:    digest.FromBytes(indexBytes),
+			Size:      int64(len(indexBytes)),
+		}
+		if err := content.WriteBlob(ctx, pvd.store, target.Digest.String(), bytes.NewReader(indexBytes), target); err != nil {
+			return nil, errors.Wrap(err, "write oci index")
+		}
+	}
+
+	importHandler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if _, err := pvd.store.Info(ctx, desc.Digest); err == nil {
+			return nil, nil
+		} else if !errdefs.IsNotFound(err) {
+			return nil, errors.Wrapf(err, "get info of blob %s", desc.Digest)
+		}
+		ra, err := local.OpenReader(layoutBlobPath(dir, desc.Digest))
+		if err != nil {
+			return nil, errors.Wrapf(err, "open blob %s", desc.Digest)
+		}
+		defer ra.Close()
+		if err := content.WriteBlob(ctx, pvd.store, desc.Digest.String(), content.NewReader(ra), desc); err != nil {
+			return nil, errors.Wrapf(err, "import blob %s", desc.Digest)
+		}
+		return nil, nil
+	})
+
+	var handler images.Handler = images.Handlers(
+		importHandler,
+		images.FilterPlatforms(images.ChildrenHandler(pvd.store), pvd.platformMC),
+	)
+	if wrapper := pvd.progressWrapper(false); wrapper != nil {
+		handler = wrapper(handler)
+	}
+	if err := images.Dispatch(ctx, handler, nil, target); err != nil {
+		return nil, err
+	}
+
+	return &target, nil
+}
+
+// exportLayout writes the image of ref and all its referenced blobs in
+// content store into OCI image layout directory.
+func (pvd *Provider) exportLayout(ctx context.Context, desc ocispec.Descriptor, ref, dir string) error {
+	exportHandler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		path := layoutBlobPath(dir, desc.Digest)
+		if _, err := os.Stat(path); err == nil {
+			return nil, nil
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, errors.Wrap(err, "create blob directory")
+		}
+		ra, err := pvd.store.ReaderAt(ctx, desc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get reader of blob %s", desc.Digest)
+		}
+		defer ra.Close()
+		if err := writeFile(path, content.NewReader(ra)); err != nil {
+			return nil, errors.Wrapf(err, "export blob %s", desc.Digest)
+		}
+		pvd.uploaded(ref, desc)
+		return nil, nil
+	})
+
+	var handler images.Handler = images.Handlers(
+		exportHandler,
+		images.ChildrenHandler(pvd.store),
+	)
+	if wrapper := pvd.progressWrapper(true); wrapper != nil {
+		handler = wrapper(handler)
+	}
+	if err := images.Dispatch(ctx, handler, nil, desc); err != nil {
+		return err
+	}
+
+	layoutBytes, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return errors.Wrap(err, "marshal oci layout file")
+	}
+	if err := writeFile(filepath.Join(dir, ocispec.ImageLayoutFile), bytes.NewReader(layoutBytes)); err != nil {
+		return errors.Wrap(err, "write oci layout file")
+	}
+
+	indexBytes, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{desc},
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal oci index file")
+	}
+	if err := writeFile(filepath.Join(dir, ocispec.ImageIndexFile), bytes.NewReader(indexBytes)); err != nil {
+		return errors.Wrap(err, "write oci index file")
+	}
+
+	return nil
+}
+
+// writeFile writes the file through a temp file to avoid leaving a
+// partial file in layout when failed.
+func writeFile(path string, reader io.Reader) error {
+	file, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := io.Copy(file, reader); err != nil {
+		return err
+	}
+	if err := file.Chmod(0644); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
@@ -0,0 +1,192 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func writeLayoutBlob(t *testing.T, dir, mediaType string, data []byte) ocispec.Descriptor {
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	path := layoutBlobPath(dir, desc.Digest)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	return desc
+}
+
+func writeLayoutJSON(t *testing.T, path string, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	if path != "" {
+		require.NoError(t, os.WriteFile(path, data, 0644))
+	}
+	return data
+}
+
+func makeLayout(t *testing.T, dir string) (ocispec.Descriptor, ocispec.Descriptor) {
+	layer := writeLayoutBlob(t, dir, ocispec.MediaTypeImageLayerGzip, []byte("layer"))
+	config := writeLayoutBlob(t, dir, ocispec.MediaTypeImageConfig, writeLayoutJSON(t, "", ocispec.Image{
+		Platform: platforms.DefaultSpec(),
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{layer.Digest},
+		},
+	}))
+	manifest := writeLayoutBlob(t, dir, ocispec.MediaTypeImageManifest, writeLayoutJSON(t, "", ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	}))
+	writeLayoutJSON(t, filepath.Join(dir, ocispec.ImageLayoutFile), ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	writeLayoutJSON(t, filepath.Join(dir, ocispec.ImageIndexFile), ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{manifest},
+	})
+
+	return manifest, layer
+}
+
+func TestImportLayout(t *testing.T) {
+	dir := t.TempDir()
+	manifest, layer := makeLayout(t, dir)
+
+	pvd, err := New(t.TempDir(), nil, 0, "", platforms.All, 0)
+	require.NoError(t, err)
+
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	ref := "localhost/layout:latest"
+	pvd.UseLayout(ref, dir)
+	require.NoError(t, pvd.Pull(ctx, ref))
+
+	desc, err := pvd.Image(ctx, ref)
+	require.NoError(t, err)
+	require.Equal(t, manifest.Digest, desc.Digest)
+
+	data, err := content.ReadBlob(ctx, pvd.ContentStore(), layer)
+	require.NoError(t, err)
+	require.Equal(t, []byte("layer"), data)
+
+	// Failure situation
+	require.NoError(t, os.Remove(layoutBlobPath(dir, layer.Digest)))
+	pvd, err = New(t.TempDir(), nil, 0, "", platforms.All, 0)
+	require.NoError(t, err)
+	pvd.UseLayout(ref, dir)
+	require.Error(t, pvd.Pull(ctx, ref))
+}
+
+func TestExportLayout(t *testing.T) {
+	dir := t.TempDir()
+	manifest, layer := makeLayout(t, dir)
+
+	pvd, err := New(t.TempDir(), nil, 0, "", platforms.All, 0)
+	require.NoError(t, err)
+
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	source := "localhost/layout:latest"
+	pvd.UseLayout(source, dir)
+	require.NoError(t, pvd.Pull(ctx, source))
+
+	exportDir := t.TempDir()
+	target := "localhost/layout:exported"
+	pvd.UseLayout(target, exportDir)
+	require.NoError(t, pvd.Push(ctx, manifest, target))
+
+	indexBytes, err := os.ReadFile(filepath.Join(exportDir, ocispec.ImageIndexFile))
+	require.NoError(t, err)
+	var index ocispec.Index
+	require.NoError(t, json.Unmarshal(indexBytes, &index))
+	require.Len(t, index.Manifests, 1)
+	require.Equal(t, manifest.Digest, index.Manifests[0].Digest)
+
+	manifestBytes, err := os.ReadFile(layoutBlobPath(exportDir, manifest.Digest))
+	require.NoError(t, err)
+	var exported ocispec.Manifest
+	require.NoError(t, json.Unmarshal(manifestBytes, &exported))
+	require.Equal(t, []ocispec.Descriptor{layer}, exported.Layers)
+	for _, desc := range append(exported.Layers, exported.Config) {
+		require.FileExists(t, layoutBlobPath(exportDir, desc.Digest))
+	}
+}
+
+func TestPushDryRun(t *testing.T) {
+	dir := t.TempDir()
+	manifest, _ := makeLayout(t, dir)
+
+	registry := newFakeRegistry(false)
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	pvd := newTestProvider(t)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	source := "localhost/layout:latest"
+	pvd.UseLayout(source, dir)
+	require.NoError(t, pvd.Pull(ctx, source))
+
+	pvd.SetDryRun(true)
+	target := strings.TrimPrefix(server.URL, "http://") + "/foo:latest"
+	require.NoError(t, pvd.Push(ctx, manifest, target))
+	desc, err := pvd.Image(ctx, target)
+	require.NoError(t, err)
+	require.Equal(t, manifest, *desc)
+
+	// Nothing is pushed to target registry.
+	require.Empty(t, registry.blobs)
+	require.Empty(t, registry.manifests)
+}
+
+func TestPushUploadFunc(t *testing.T) {
+	dir := t.TempDir()
+	manifest, layer := makeLayout(t, dir)
+
+	registry := newFakeRegistry(false)
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	pvd := newTestProvider(t)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	source := "localhost/layout:latest"
+	pvd.UseLayout(source, dir)
+	require.NoError(t, pvd.Pull(ctx, source))
+
+	uploaded := map[string][]digest.Digest{}
+	pvd.SetUploadFunc(func(ref string, desc ocispec.Descriptor) {
+		uploaded[ref] = append(uploaded[ref], desc.Digest)
+	})
+	host := strings.TrimPrefix(server.URL, "http://")
+	require.NoError(t, pvd.Push(ctx, manifest, host+"/foo:latest"))
+	// The layer existing in registry isn't uploaded again.
+	require.NoError(t, pvd.Push(ctx, manifest, host+"/foo:another"))
+
+	exportDir := t.TempDir()
+	target := "localhost/layout:exported"
+	pvd.UseLayout(target, exportDir)
+	require.NoError(t, pvd.Push(ctx, manifest, target))
+	require.NoError(t, pvd.Push(ctx, manifest, target))
+
+	// Only the layers are reported.
+	require.Equal(t, map[string][]digest.Digest{
+		host + "/foo:latest": {layer.Digest},
+		target:               {layer.Digest},
+	}, uploaded)
+}
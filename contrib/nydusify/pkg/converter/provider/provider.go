@@ -6,38 +6,60 @@ package provider
 
 import (
 	"context"
-	"crypto/tls"
-	"net"
+	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sync"
-	"time"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
+	originprovider "github.com/dragonflyoss/nydus/contrib/nydusify/pkg/provider"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
 	"github.com/goharbor/acceleration-service/pkg/cache"
 	accelcontent "github.com/goharbor/acceleration-service/pkg/content"
 	"github.com/goharbor/acceleration-service/pkg/remote"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 )
 
 var LayerConcurrentLimit = 5
 
+// ProgressFunc is called after a layer has been pulled or pushed.
+type ProgressFunc func(desc ocispec.Descriptor, push bool)
+
 type Provider struct {
 	mutex        sync.Mutex
 	usePlainHTTP bool
 	images       map[string]*ocispec.Descriptor
+	layouts      map[string]string
+	staged       map[string]bool
 	store        content.Store
+	localStore   content.Store
+	convertStore content.Store
+	blobCache    *BlobCache
+	dryRun       bool
+	blobFilter   BlobFilter
+	imageHook    ImageHook
+	contentDir   string
 	hosts        remote.HostFunc
 	platformMC   platforms.MatchComparer
 	cacheSize    int
 	cacheVersion string
 	chunkSize    int64
+	progressFunc ProgressFunc
+	uploadFunc   UploadFunc
+	uploadWorker int
+	pullWorker   int
+	remoteOpt    originprovider.RemoteOpt
+	clients      map[bool]*http.Client
 }
 
 func New(root string, hosts remote.HostFunc, cacheSize uint, cacheVersion string, platformMC platforms.MatchComparer, chunkSize int64) (*Provider, error) {
@@ -52,7 +74,11 @@ func New(root string, hosts remote.HostFunc, cacheSize uint, cacheVersion string
 
 	return &Provider{
 		images:       make(map[string]*ocispec.Descriptor),
+		layouts:      make(map[string]string),
+		staged:       make(map[string]bool),
 		store:        store,
+		localStore:   store,
+		contentDir:   contentDir,
 		hosts:        hosts,
 		cacheSize:    int(cacheSize),
 		platformMC:   platformMC,
@@ -61,46 +87,156 @@ func New(root string, hosts remote.HostFunc, cacheSize uint, cacheVersion string
 	}, nil
 }
 
-func newDefaultClient(skipTLSVerify bool) *http.Client {
-	return &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-				DualStack: true,
-			}).DialContext,
-			MaxIdleConns:          10,
-			IdleConnTimeout:       30 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 5 * time.Second,
-			DisableKeepAlives:     true,
-			TLSNextProto:          make(map[string]func(authority string, c *tls.Conn) http.RoundTripper),
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: skipTLSVerify,
-			},
-		},
-	}
-}
-
-func newResolver(insecure, plainHTTP bool, credFunc remote.CredentialFunc, chunkSize int64) remotes.Resolver {
-	registryHosts := docker.ConfigureDefaultRegistries(
+func newRegistryHosts(client *http.Client, plainHTTP bool, credFunc remote.CredentialFunc, chunkSize int64) docker.RegistryHosts {
+	return docker.ConfigureDefaultRegistries(
 		docker.WithAuthorizer(
 			docker.NewDockerAuthorizer(
-				docker.WithAuthClient(newDefaultClient(insecure)),
+				docker.WithAuthClient(client),
 				docker.WithAuthCreds(credFunc),
 			),
 		),
-		docker.WithClient(newDefaultClient(insecure)),
+		docker.WithClient(client),
 		docker.WithPlainHTTP(func(_ string) (bool, error) {
 			return plainHTTP, nil
 		}),
 		docker.WithChunkSize(chunkSize),
 	)
+}
 
+func newResolver(client *http.Client, plainHTTP bool, credFunc remote.CredentialFunc, chunkSize int64) remotes.Resolver {
 	return docker.NewResolver(docker.ResolverOptions{
-		Hosts: registryHosts,
+		Hosts: newRegistryHosts(client, plainHTTP, credFunc, chunkSize),
+	})
+}
+
+// SetProgressFunc sets a callback to observe the layers pulled or pushed.
+func (pvd *Provider) SetProgressFunc(fn ProgressFunc) {
+	pvd.progressFunc = fn
+}
+
+func (pvd *Provider) progressWrapper(push bool) func(images.Handler) images.Handler {
+	if pvd.progressFunc == nil {
+		return nil
+	}
+	return func(h images.Handler) images.Handler {
+		return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			children, err := h.Handle(ctx, desc)
+			if err == nil && images.IsLayerType(desc.MediaType) {
+				pvd.progressFunc(desc, push)
+			}
+			return children, err
+		})
+	}
+}
+
+// SetRemoteOpt sets the option like retry policy and upload throttle for
+// registry requests, the throttle is shared by all the pushes of provider.
+func (pvd *Provider) SetRemoteOpt(opt originprovider.RemoteOpt) error {
+	if err := opt.Prepare(); err != nil {
+		return err
+	}
+	pvd.mutex.Lock()
+	defer pvd.mutex.Unlock()
+	pvd.remoteOpt = opt
+	pvd.clients = nil
+	return nil
+}
+
+// client returns the HTTP client for registry requests, which is shared by
+// the resolvers so that the connections are reused.
+func (pvd *Provider) client(insecure bool) *http.Client {
+	pvd.mutex.Lock()
+	defer pvd.mutex.Unlock()
+	if client, ok := pvd.clients[insecure]; ok {
+		return client
+	}
+	if pvd.clients == nil {
+		pvd.clients = map[bool]*http.Client{}
+	}
+	client := originprovider.NewClient(insecure, pvd.remoteOpt)
+	pvd.clients[insecure] = client
+	return client
+}
+
+// SetUploadWorker limits the number of layers being pushed to registry
+// concurrently, defaults to LayerConcurrentLimit.
+func (pvd *Provider) SetUploadWorker(worker int) {
+	pvd.uploadWorker = worker
+}
+
+// SetPullWorker limits the number of layers being pulled from registry
+// concurrently, defaults to LayerConcurrentLimit.
+func (pvd *Provider) SetPullWorker(worker int) {
+	pvd.pullWorker = worker
+}
+
+// SetBlobCache sets the cache to reuse the blobs pulled from registry across
+// conversions.
+func (pvd *Provider) SetBlobCache(cache *BlobCache) {
+	pvd.blobCache = cache
+}
+
+// SetDryRun makes the pushes only recorded without actually pushing the
+// content to registry or OCI image layout.
+func (pvd *Provider) SetDryRun(dryRun bool) {
+	pvd.dryRun = dryRun
+}
+
+// BlobFilter is called for each nydus blob layer of the image to be pushed.
+type BlobFilter func(ctx context.Context, desc ocispec.Descriptor) error
+
+// SetBlobFilter sets the filter called for the nydus blob layers before they
+// are pushed, a non-nil error aborts the push.
+func (pvd *Provider) SetBlobFilter(filter BlobFilter) {
+	pvd.blobFilter = filter
+}
+
+// ImageHook is called with the image to be pushed to ref, and returns the
+// image replacing it, which is pushed and recorded for ref instead.
+type ImageHook func(ctx context.Context, desc ocispec.Descriptor, ref string) (*ocispec.Descriptor, error)
+
+// SetImageHook sets the hook called for the images pushed to unstaged refs,
+// it's called in dry run too so that the recorded image is the same.
+func (pvd *Provider) SetImageHook(hook ImageHook) {
+	pvd.imageHook = hook
+}
+
+// BlobPath returns the path of content in the local content store.
+func (pvd *Provider) BlobPath(dgst digest.Digest) string {
+	return filepath.Join(pvd.contentDir, "blobs", dgst.Algorithm().String(), dgst.Hex())
+}
+
+// checkBlobs walks the image to be pushed, and calls the blob filter for
+// each nydus blob layer, so that the conversion fails before any content is
+// pushed.
+func (pvd *Provider) checkBlobs(ctx context.Context, desc ocispec.Descriptor) error {
+	if pvd.blobFilter == nil {
+		return nil
+	}
+	childrenHandler := images.ChildrenHandler(pvd.store)
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if desc.MediaType == utils.MediaTypeNydusBlob {
+			if err := pvd.blobFilter(ctx, desc); err != nil {
+				return nil, errors.Wrapf(err, "filter blob %s", desc.Digest)
+			}
+		}
+		return childrenHandler.Handle(ctx, desc)
 	})
+	return images.Walk(ctx, handler, desc)
+}
+
+// Stage makes the image pushed to ref only recorded, so that it can be got
+// by Image and pushed later as a part of another image.
+func (pvd *Provider) Stage(ref string) {
+	pvd.mutex.Lock()
+	defer pvd.mutex.Unlock()
+	pvd.staged[ref] = true
+}
+
+func (pvd *Provider) isStaged(ref string) bool {
+	pvd.mutex.Lock()
+	defer pvd.mutex.Unlock()
+	return pvd.staged[ref]
 }
 
 func (pvd *Provider) UsePlainHTTP() {
@@ -112,24 +248,75 @@ func (pvd *Provider) Resolver(ref string) (remotes.Resolver, error) {
 	if err != nil {
 		return nil, err
 	}
-	return newResolver(insecure, pvd.usePlainHTTP, credFunc, pvd.chunkSize), nil
+	return newResolver(pvd.client(insecure), pvd.usePlainHTTP, credFunc, pvd.chunkSize), nil
+}
+
+// verifyPinnedDigest ensures the fetched manifest matches the digest pinned
+// in reference like `name@sha256:...`, which guards against the source being
+// replaced after the tag was resolved. The digest is computed from the
+// manifest bytes fetched into content store rather than taken from the
+// descriptor, which is resolved from the pinned digest itself.
+func verifyPinnedDigest(ctx context.Context, cs content.Provider, ref string, desc ocispec.Descriptor) error {
+	spec, err := reference.Parse(ref)
+	if err != nil {
+		return errors.Wrap(err, "parse reference")
+	}
+	pinned := spec.Digest()
+	if pinned == "" {
+		return nil
+	}
+	if err := pinned.Validate(); err != nil {
+		return errors.Wrap(err, "invalid pinned digest")
+	}
+	data, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		return errors.Wrap(err, "read fetched manifest")
+	}
+	if fetched := pinned.Algorithm().FromBytes(data); fetched != pinned {
+		return fmt.Errorf("fetched manifest digest %s mismatches pinned digest %s", fetched, pinned)
+	}
+	return nil
 }
 
 func (pvd *Provider) Pull(ctx context.Context, ref string) error {
+	if dir, ok := pvd.layout(ref); ok {
+		desc, err := pvd.importLayout(ctx, dir)
+		if err != nil {
+			return errors.Wrapf(err, "import oci layout %s", dir)
+		}
+		pvd.mutex.Lock()
+		defer pvd.mutex.Unlock()
+		pvd.images[ref] = desc
+		return nil
+	}
+
 	resolver, err := pvd.Resolver(ref)
 	if err != nil {
 		return err
 	}
+	pullWorker := LayerConcurrentLimit
+	if pvd.pullWorker > 0 {
+		pullWorker = pvd.pullWorker
+	}
 	rc := &containerd.RemoteContext{
 		Resolver:               resolver,
 		PlatformMatcher:        pvd.platformMC,
-		MaxConcurrentDownloads: LayerConcurrentLimit,
+		MaxConcurrentDownloads: pullWorker,
+		HandlerWrapper:         pvd.progressWrapper(false),
+	}
+	if pvd.blobCache != nil {
+		// Bypass the wrapped content store to avoid being observed as
+		// the reading of conversion.
+		rc.HandlerWrapper = pvd.blobCache.handlerWrapper(pvd.localStore, rc.HandlerWrapper)
 	}
 
 	img, err := fetch(ctx, pvd.store, rc, ref, 0)
 	if err != nil {
 		return err
 	}
+	if err := verifyPinnedDigest(ctx, pvd.store, ref, img.Target); err != nil {
+		return err
+	}
 
 	pvd.mutex.Lock()
 	defer pvd.mutex.Unlock()
@@ -139,14 +326,53 @@ func (pvd *Provider) Pull(ctx context.Context, ref string) error {
 }
 
 func (pvd *Provider) Push(ctx context.Context, desc ocispec.Descriptor, ref string) error {
+	if pvd.imageHook != nil && !pvd.isStaged(ref) {
+		newDesc, err := pvd.imageHook(ctx, desc, ref)
+		if err != nil {
+			return errors.Wrap(err, "image hook")
+		}
+		desc = *newDesc
+	}
+	if !pvd.dryRun && !pvd.isStaged(ref) {
+		if err := pvd.checkBlobs(ctx, desc); err != nil {
+			return err
+		}
+		if err := pvd.push(ctx, desc, ref); err != nil {
+			return err
+		}
+	}
+
+	pvd.mutex.Lock()
+	defer pvd.mutex.Unlock()
+	pvd.images[ref] = &desc
+
+	return nil
+}
+
+func (pvd *Provider) push(ctx context.Context, desc ocispec.Descriptor, ref string) error {
+	if dir, ok := pvd.layout(ref); ok {
+		return errors.Wrapf(pvd.exportLayout(ctx, desc, ref, dir), "export oci layout %s", dir)
+	}
+
 	resolver, err := pvd.Resolver(ref)
 	if err != nil {
 		return err
 	}
+	if pvd.uploadFunc != nil {
+		resolver = &uploadResolver{
+			Resolver: resolver,
+			uploaded: func(desc ocispec.Descriptor) { pvd.uploaded(ref, desc) },
+		}
+	}
+	uploadWorker := LayerConcurrentLimit
+	if pvd.uploadWorker > 0 {
+		uploadWorker = pvd.uploadWorker
+	}
 	rc := &containerd.RemoteContext{
 		Resolver:                    resolver,
 		PlatformMatcher:             pvd.platformMC,
-		MaxConcurrentUploadedLayers: LayerConcurrentLimit,
+		MaxConcurrentUploadedLayers: uploadWorker,
+		HandlerWrapper:              pvd.progressWrapper(true),
 	}
 
 	return push(ctx, pvd.store, rc, desc, ref)
@@ -161,7 +387,12 @@ func (pvd *Provider) Image(_ context.Context, ref string) (*ocispec.Descriptor,
 	return nil, errdefs.ErrNotFound
 }
 
+// ContentStore returns the content store used by conversion, which is the
+// store set by SetConvertStore if any.
 func (pvd *Provider) ContentStore() content.Store {
+	if pvd.convertStore != nil {
+		return pvd.convertStore
+	}
 	return pvd.store
 }
 
@@ -169,6 +400,12 @@ func (pvd *Provider) SetContentStore(store content.Store) {
 	pvd.store = store
 }
 
+// SetConvertStore sets the content store returned by ContentStore for the
+// conversion, the store used to pull and push images isn't changed.
+func (pvd *Provider) SetConvertStore(store content.Store) {
+	pvd.convertStore = store
+}
+
 func (pvd *Provider) NewRemoteCache(ctx context.Context, ref string) (context.Context, *cache.RemoteCache) {
 	if ref != "" {
 		return cache.New(ctx, ref, "", pvd.cacheSize, pvd)
@@ -0,0 +1,392 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	originprovider "github.com/dragonflyoss/nydus/contrib/nydusify/pkg/provider"
+)
+
+func TestPullPinnedDigest(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newFakeRegistry(false)
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	manifest := registry.addImage(t, "latest", []byte("layer"))
+	data, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	pinned := digest.FromBytes(data)
+
+	// The image pinned by digest is pulled as usual.
+	ref := host + "/foo@" + pinned.String()
+	pvd := newTestProvider(t)
+	require.NoError(t, pvd.Pull(ctx, ref))
+	desc, err := pvd.Image(ctx, ref)
+	require.NoError(t, err)
+	require.Equal(t, pinned, desc.Digest)
+
+	// The tag is moved to another image, and the registry serves the new
+	// manifest for the pinned digest.
+	registry.addImage(t, "latest", []byte("another layer"))
+	registry.mutex.Lock()
+	registry.manifests[pinned.String()] = registry.manifests["latest"]
+	registry.mutex.Unlock()
+
+	pvd = newTestProvider(t)
+	// The fetched bytes fail the digest check of content store.
+	err = pvd.Pull(ctx, ref)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), fmt.Sprintf("unexpected commit digest %s, expected %s", digest.FromBytes(registry.manifests["latest"].data), pinned))
+	_, err = pvd.Image(ctx, ref)
+	require.Error(t, err)
+}
+
+// tamperedProvider serves the bytes for any descriptor, like the registry
+// serving another manifest for the pinned digest.
+type tamperedProvider []byte
+
+type bytesReaderAt struct {
+	*bytes.Reader
+}
+
+func (bytesReaderAt) Close() error {
+	return nil
+}
+
+func (p tamperedProvider) ReaderAt(_ context.Context, _ ocispec.Descriptor) (content.ReaderAt, error) {
+	return bytesReaderAt{bytes.NewReader(p)}, nil
+}
+
+func TestVerifyPinnedDigest(t *testing.T) {
+	ctx := context.Background()
+	manifest := []byte("manifest")
+	desc := ocispec.Descriptor{Digest: digest.FromBytes(manifest), Size: int64(len(manifest))}
+	cs := tamperedProvider(manifest)
+
+	require.NoError(t, verifyPinnedDigest(ctx, cs, "docker.io/library/foo:latest", desc))
+	require.NoError(t, verifyPinnedDigest(ctx, cs, "docker.io/library/foo@"+desc.Digest.String(), desc))
+	require.NoError(t, verifyPinnedDigest(ctx, cs, "docker.io/library/foo:latest@"+desc.Digest.String(), desc))
+
+	// The descriptor is resolved from the pinned digest, so only the fetched
+	// bytes tell the mismatch.
+	another := []byte("another manifest")
+	err := verifyPinnedDigest(ctx, tamperedProvider(another), "docker.io/library/foo@"+desc.Digest.String(), desc)
+	require.Error(t, err)
+	require.Equal(t, fmt.Sprintf("fetched manifest digest %s mismatches pinned digest %s", digest.FromBytes(another), desc.Digest), err.Error())
+}
+
+func TestPushImageHook(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newTestProvider(t)
+	pvd.SetDryRun(true)
+
+	original := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("original")}
+	replaced := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("replaced")}
+	pvd.SetImageHook(func(_ context.Context, desc ocispec.Descriptor, ref string) (*ocispec.Descriptor, error) {
+		require.Equal(t, original, desc)
+		if ref == "localhost/foo:invalid" {
+			return nil, fmt.Errorf("invalid image")
+		}
+		return &replaced, nil
+	})
+
+	require.NoError(t, pvd.Push(ctx, original, "localhost/foo:latest"))
+	desc, err := pvd.Image(ctx, "localhost/foo:latest")
+	require.NoError(t, err)
+	require.Equal(t, replaced, *desc)
+
+	// The staged image isn't passed to hook.
+	pvd.Stage("localhost/foo:staged")
+	require.NoError(t, pvd.Push(ctx, original, "localhost/foo:staged"))
+	desc, err = pvd.Image(ctx, "localhost/foo:staged")
+	require.NoError(t, err)
+	require.Equal(t, original, *desc)
+
+	// Failure situation
+	err = pvd.Push(ctx, original, "localhost/foo:invalid")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "image hook: invalid image")
+}
+
+// rewriteStore serves different bytes of layers, like the store feeding the
+// builder with the unpacked layers.
+type rewriteStore struct {
+	content.Store
+}
+
+func (s *rewriteStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	if desc.MediaType == ocispec.MediaTypeImageLayerGzip {
+		return nil, fmt.Errorf("layer is read from convert store")
+	}
+	return s.Store.ReaderAt(ctx, desc)
+}
+
+func TestPushWithConvertStore(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newFakeRegistry(false)
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	pvd := newTestProvider(t)
+	convertStore := &rewriteStore{Store: pvd.ContentStore()}
+	pvd.SetConvertStore(convertStore)
+	require.Equal(t, convertStore, pvd.ContentStore())
+
+	layer := []byte("source layer")
+	layerDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromBytes(layer), Size: int64(len(layer))}
+	require.NoError(t, content.WriteBlob(ctx, pvd.ContentStore(), layerDesc.Digest.String(), bytes.NewReader(layer), layerDesc))
+	manifestBytes, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.DescriptorEmptyJSON,
+		Layers:    []ocispec.Descriptor{layerDesc},
+	})
+	require.NoError(t, err)
+	manifestDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(manifestBytes), Size: int64(len(manifestBytes))}
+	require.NoError(t, content.WriteBlob(ctx, pvd.ContentStore(), manifestDesc.Digest.String(), bytes.NewReader(manifestBytes), manifestDesc))
+	require.NoError(t, content.WriteBlob(ctx, pvd.ContentStore(), ocispec.DescriptorEmptyJSON.Digest.String(), bytes.NewReader(ocispec.DescriptorEmptyJSON.Data), ocispec.DescriptorEmptyJSON))
+
+	// The original layer is pushed from the content store of provider.
+	require.NoError(t, pvd.Push(ctx, manifestDesc, host+"/foo:latest"))
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	require.Equal(t, layer, registry.blobs[layerDesc.Digest])
+}
+
+// inflightRecorder records the maximum number of the requests matched by
+// match in flight.
+type inflightRecorder struct {
+	http.Handler
+	match       func(req *http.Request) bool
+	inflight    int32
+	maxInflight int32
+}
+
+func isBlobUpload(req *http.Request) bool {
+	return req.Method == http.MethodPut && strings.Contains(req.URL.Path, "/blobs/uploads/")
+}
+
+func isBlobDownload(req *http.Request) bool {
+	return req.Method == http.MethodGet && strings.Contains(req.URL.Path, "/blobs/sha256:")
+}
+
+func (r *inflightRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.match(req) {
+		inflight := atomic.AddInt32(&r.inflight, 1)
+		defer atomic.AddInt32(&r.inflight, -1)
+		for {
+			max := atomic.LoadInt32(&r.maxInflight)
+			if inflight <= max || atomic.CompareAndSwapInt32(&r.maxInflight, max, inflight) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	r.Handler.ServeHTTP(w, req)
+}
+
+func TestPushUploadWorker(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	for _, worker := range []int{1, 3} {
+		registry := newFakeRegistry(false)
+		recorder := &inflightRecorder{Handler: registry, match: isBlobUpload}
+		server := httptest.NewServer(recorder)
+		host := strings.TrimPrefix(server.URL, "http://")
+
+		pvd := newTestProvider(t)
+		pvd.SetUploadWorker(worker)
+		layers := []ocispec.Descriptor{}
+		for idx := 0; idx < 6; idx++ {
+			layer := []byte(fmt.Sprintf("layer %d", idx))
+			desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromBytes(layer), Size: int64(len(layer))}
+			require.NoError(t, content.WriteBlob(ctx, pvd.ContentStore(), desc.Digest.String(), bytes.NewReader(layer), desc))
+			layers = append(layers, desc)
+		}
+		manifestBytes, err := json.Marshal(ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    ocispec.DescriptorEmptyJSON,
+			Layers:    layers,
+		})
+		require.NoError(t, err)
+		manifestDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(manifestBytes), Size: int64(len(manifestBytes))}
+		require.NoError(t, content.WriteBlob(ctx, pvd.ContentStore(), manifestDesc.Digest.String(), bytes.NewReader(manifestBytes), manifestDesc))
+		require.NoError(t, content.WriteBlob(ctx, pvd.ContentStore(), ocispec.DescriptorEmptyJSON.Digest.String(), bytes.NewReader(ocispec.DescriptorEmptyJSON.Data), ocispec.DescriptorEmptyJSON))
+
+		// The uploads are bounded by worker, and run concurrently up to it.
+		require.NoError(t, pvd.Push(ctx, manifestDesc, host+"/foo:latest"))
+		server.Close()
+		require.Equal(t, int32(worker), atomic.LoadInt32(&recorder.maxInflight))
+		registry.mutex.Lock()
+		for _, layer := range layers {
+			require.Contains(t, registry.blobs, layer.Digest)
+		}
+		registry.mutex.Unlock()
+	}
+}
+
+func TestPullWorker(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	for _, worker := range []int{1, 3} {
+		registry := newFakeRegistry(false)
+		recorder := &inflightRecorder{Handler: registry, match: isBlobDownload}
+		server := httptest.NewServer(recorder)
+		host := strings.TrimPrefix(server.URL, "http://")
+
+		manifest := registry.addImage(t, "latest", []byte("layer 0"))
+		registry.mutex.Lock()
+		for idx := 1; idx < 6; idx++ {
+			layer := []byte(fmt.Sprintf("layer %d", idx))
+			desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(layer), Size: int64(len(layer))}
+			registry.blobs[desc.Digest] = layer
+			manifest.Layers = append(manifest.Layers, desc)
+		}
+		data, err := json.Marshal(manifest)
+		require.NoError(t, err)
+		registry.manifests["latest"] = fakeManifest{mediaType: ocispec.MediaTypeImageManifest, data: data}
+		registry.manifests[digest.FromBytes(data).String()] = registry.manifests["latest"]
+		registry.mutex.Unlock()
+
+		// The downloads are bounded by worker, and run concurrently up to it.
+		pvd := newTestProvider(t)
+		pvd.SetPullWorker(worker)
+		require.NoError(t, pvd.Pull(ctx, host+"/foo:latest"))
+		server.Close()
+		require.Equal(t, int32(worker), atomic.LoadInt32(&recorder.maxInflight))
+		for _, layer := range manifest.Layers {
+			_, err := pvd.ContentStore().Info(ctx, layer.Digest)
+			require.NoError(t, err)
+		}
+	}
+}
+
+// stallRegistry stalls the first HEAD request of each path until the client
+// gives up, like a registry hanging on the connection.
+type stallRegistry struct {
+	http.Handler
+	mutex sync.Mutex
+	heads map[string]int
+}
+
+func (r *stallRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodHead {
+		r.mutex.Lock()
+		r.heads[req.URL.Path]++
+		stall := r.heads[req.URL.Path] == 1
+		r.mutex.Unlock()
+		if stall {
+			select {
+			case <-req.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+			return
+		}
+	}
+	r.Handler.ServeHTTP(w, req)
+}
+
+func (r *stallRegistry) headCount(path string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.heads[path]
+}
+
+func TestRequestTimeout(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newFakeRegistry(false)
+	stall := &stallRegistry{Handler: registry, heads: map[string]int{}}
+	server := httptest.NewServer(stall)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	manifest := registry.addImage(t, "latest", []byte("layer"))
+	opt := originprovider.RemoteOpt{RetryCount: 2, RetryDelay: time.Millisecond, RequestTimeout: 100 * time.Millisecond}
+
+	// The stalled manifest HEAD of resolving times out and is retried.
+	pvd := newTestProvider(t)
+	require.NoError(t, pvd.SetRemoteOpt(opt))
+	start := time.Now()
+	require.NoError(t, pvd.Pull(ctx, host+"/foo:latest"))
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Equal(t, 2, stall.headCount("/v2/foo/manifests/latest"))
+
+	// The stalled blob HEAD of checking existence before push times out
+	// and is retried.
+	desc, err := pvd.Image(ctx, host+"/foo:latest")
+	require.NoError(t, err)
+	start = time.Now()
+	require.NoError(t, pvd.Push(ctx, *desc, host+"/foo:pushed"))
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Equal(t, 2, stall.headCount("/v2/foo/blobs/"+manifest.Layers[0].Digest.String()))
+
+	// The timed out request fails without retry.
+	pvd = newTestProvider(t)
+	require.NoError(t, pvd.SetRemoteOpt(originprovider.RemoteOpt{RequestTimeout: 100 * time.Millisecond}))
+	stall.mutex.Lock()
+	stall.heads = map[string]int{}
+	stall.mutex.Unlock()
+	err = pvd.Pull(ctx, host+"/foo:latest")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "request timeout after 100ms")
+}
+
+func TestPushMaxUploadBytesPerSec(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newFakeRegistry(false)
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	// The layers of 2KB in total are pushed concurrently under the shared
+	// limit of 1KB per second.
+	pvd := newTestProvider(t)
+	require.NoError(t, pvd.SetRemoteOpt(originprovider.RemoteOpt{MaxUploadBytesPerSec: 1024}))
+	layers := []ocispec.Descriptor{}
+	for idx := 0; idx < 2; idx++ {
+		layer := bytes.Repeat([]byte{byte(idx)}, 1024)
+		desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromBytes(layer), Size: int64(len(layer))}
+		require.NoError(t, content.WriteBlob(ctx, pvd.ContentStore(), desc.Digest.String(), bytes.NewReader(layer), desc))
+		layers = append(layers, desc)
+	}
+	manifestBytes, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.DescriptorEmptyJSON,
+		Layers:    layers,
+	})
+	require.NoError(t, err)
+	manifestDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(manifestBytes), Size: int64(len(manifestBytes))}
+	require.NoError(t, content.WriteBlob(ctx, pvd.ContentStore(), manifestDesc.Digest.String(), bytes.NewReader(manifestBytes), manifestDesc))
+	require.NoError(t, content.WriteBlob(ctx, pvd.ContentStore(), ocispec.DescriptorEmptyJSON.Digest.String(), bytes.NewReader(ocispec.DescriptorEmptyJSON.Data), ocispec.DescriptorEmptyJSON))
+
+	start := time.Now()
+	require.NoError(t, pvd.Push(ctx, manifestDesc, host+"/foo:latest"))
+	require.GreaterOrEqual(t, time.Since(start), 1500*time.Millisecond)
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for _, layer := range layers {
+		require.Contains(t, registry.blobs, layer.Digest)
+	}
+}
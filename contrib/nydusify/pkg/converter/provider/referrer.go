@@ -0,0 +1,279 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	dockerremote "github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// referrersTag returns the tag of referrers index in the fallback tag schema
+// of OCI distribution spec, like `sha256-<hex>`.
+func referrersTag(dgst digest.Digest) string {
+	return fmt.Sprintf("%s-%s", dgst.Algorithm(), dgst.Hex())
+}
+
+// PushBytes pushes the content in memory to ref by resolver, it does nothing
+// if the content already exists in registry.
+func PushBytes(ctx context.Context, resolver remotes.Resolver, ref string, desc ocispec.Descriptor, data []byte) error {
+	pusher, err := resolver.Pusher(ctx, ref)
+	if err != nil {
+		return err
+	}
+	writer, err := pusher.Push(ctx, desc)
+	if err != nil {
+		if errdefs.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	}
+	defer writer.Close()
+	return content.Copy(ctx, writer, bytes.NewReader(data), desc.Size, desc.Digest)
+}
+
+// FetchBytes resolves ref by resolver and reads the content into memory, it
+// returns the error matched by errdefs.IsNotFound if ref doesn't exist.
+func FetchBytes(ctx context.Context, resolver remotes.Resolver, ref string) (*ocispec.Descriptor, []byte, error) {
+	_, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &desc, data, nil
+}
+
+// referrersSupported checks if the registry supports the referrers API by
+// listing the referrers of subject, the registry without support responds
+// with 404 status.
+func referrersSupported(ctx context.Context, registryHosts dockerremote.RegistryHosts, named docker.Named, subject digest.Digest) (bool, error) {
+	hosts, err := registryHosts(docker.Domain(named))
+	if err != nil {
+		return false, err
+	}
+	if len(hosts) == 0 {
+		return false, fmt.Errorf("no registry host for %s", named)
+	}
+	host := hosts[0]
+
+	refspec, err := reference.Parse(named.String())
+	if err != nil {
+		return false, err
+	}
+	ctx, err = dockerremote.ContextWithRepositoryScope(ctx, refspec, false)
+	if err != nil {
+		return false, err
+	}
+
+	u := url.URL{
+		Scheme: host.Scheme,
+		Host:   host.Host,
+		Path:   path.Join(host.Path, docker.Path(named), "referrers", subject.String()),
+	}
+	do := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", ocispec.MediaTypeImageIndex)
+		if host.Authorizer != nil {
+			if err := host.Authorizer.Authorize(ctx, req); err != nil {
+				return nil, err
+			}
+		}
+		return host.Client.Do(req)
+	}
+
+	resp, err := do()
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && host.Authorizer != nil {
+		resp.Body.Close()
+		if err := host.Authorizer.AddResponses(ctx, []*http.Response{resp}); err != nil {
+			return false, err
+		}
+		if resp, err = do(); err != nil {
+			return false, err
+		}
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+// updateReferrersIndex adds the referrer into the referrers index tagged by
+// the subject digest, which is the fallback for the registry without support
+// of referrers API.
+func updateReferrersIndex(ctx context.Context, resolver remotes.Resolver, named docker.Named, subject digest.Digest, referrer ocispec.Descriptor) error {
+	ref := fmt.Sprintf("%s:%s", named.Name(), referrersTag(subject))
+
+	index := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+	}
+	_, data, err := FetchBytes(ctx, resolver, ref)
+	if err == nil {
+		if err := json.Unmarshal(data, &index); err != nil {
+			return errors.Wrap(err, "unmarshal referrers index")
+		}
+	} else if !errdefs.IsNotFound(err) {
+		return errors.Wrap(err, "fetch referrers index")
+	}
+
+	for _, manifest := range index.Manifests {
+		if manifest.Digest == referrer.Digest {
+			return nil
+		}
+	}
+	index.Manifests = append(index.Manifests, referrer)
+
+	data, err = json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	indexDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	return errors.Wrap(PushBytes(ctx, resolver, ref, indexDesc, data), "push referrers index")
+}
+
+// PushReferrer pushes an artifact manifest with subject into the repository
+// of ref, the artifact carries no content except the annotations. It falls
+// back to the referrers tag schema if the registry doesn't support referrers
+// API, so that the artifact is always discoverable from the subject.
+func (pvd *Provider) PushReferrer(ctx context.Context, ref, artifactType string, subject ocispec.Descriptor, annotations map[string]string) (*ocispec.Descriptor, error) {
+	return pvd.PushReferrerBlob(ctx, ref, artifactType, subject, ocispec.DescriptorEmptyJSON, ocispec.DescriptorEmptyJSON.Data, annotations)
+}
+
+// PushReferrerBlob is like PushReferrer, but the artifact carries the blob
+// of data as its only layer, like a SBOM document of subject.
+func (pvd *Provider) PushReferrerBlob(ctx context.Context, ref, artifactType string, subject, blob ocispec.Descriptor, data []byte, annotations map[string]string) (*ocispec.Descriptor, error) {
+	named, registryHosts, err := pvd.referrerHosts(ref)
+	if err != nil {
+		return nil, err
+	}
+	resolver := dockerremote.NewResolver(dockerremote.ResolverOptions{
+		Hosts: registryHosts,
+	})
+
+	manifest := ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       ocispec.DescriptorEmptyJSON,
+		Layers:       []ocispec.Descriptor{blob},
+		Subject: &ocispec.Descriptor{
+			MediaType: subject.MediaType,
+			Digest:    subject.Digest,
+			Size:      subject.Size,
+		},
+		Annotations: annotations,
+	}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Digest:       digest.FromBytes(manifestData),
+		Size:         int64(len(manifestData)),
+		Annotations:  annotations,
+	}
+
+	byDigest := fmt.Sprintf("%s@%s", named.Name(), desc.Digest)
+	if err := PushBytes(ctx, resolver, byDigest, ocispec.DescriptorEmptyJSON, ocispec.DescriptorEmptyJSON.Data); err != nil {
+		return nil, errors.Wrap(err, "push empty config")
+	}
+	if blob.Digest != ocispec.DescriptorEmptyJSON.Digest {
+		if err := PushBytes(ctx, resolver, byDigest, blob, data); err != nil {
+			return nil, errors.Wrap(err, "push referrer blob")
+		}
+	}
+	if err := PushBytes(ctx, resolver, byDigest, desc, manifestData); err != nil {
+		return nil, errors.Wrap(err, "push referrer manifest")
+	}
+
+	if err := linkReferrer(ctx, registryHosts, resolver, named, subject, desc); err != nil {
+		return nil, err
+	}
+
+	return &desc, nil
+}
+
+// LinkReferrer makes the manifest with subject already pushed into the
+// repository of ref discoverable from the subject, by the referrers tag
+// schema if the registry doesn't support referrers API.
+func (pvd *Provider) LinkReferrer(ctx context.Context, ref string, subject, referrer ocispec.Descriptor) error {
+	named, registryHosts, err := pvd.referrerHosts(ref)
+	if err != nil {
+		return err
+	}
+	resolver := dockerremote.NewResolver(dockerremote.ResolverOptions{
+		Hosts: registryHosts,
+	})
+	return linkReferrer(ctx, registryHosts, resolver, named, subject, referrer)
+}
+
+// referrerHosts returns the repository of ref and its registry hosts.
+func (pvd *Provider) referrerHosts(ref string) (docker.Named, dockerremote.RegistryHosts, error) {
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parse reference")
+	}
+	credFunc, insecure, err := pvd.hosts(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	return docker.TrimNamed(named), newRegistryHosts(pvd.client(insecure), pvd.usePlainHTTP, credFunc, pvd.chunkSize), nil
+}
+
+func linkReferrer(ctx context.Context, registryHosts dockerremote.RegistryHosts, resolver remotes.Resolver, named docker.Named, subject, referrer ocispec.Descriptor) error {
+	supported, err := referrersSupported(ctx, registryHosts, named, subject.Digest)
+	if err != nil {
+		return errors.Wrap(err, "check referrers API")
+	}
+	if !supported {
+		return updateReferrersIndex(ctx, resolver, named, subject.Digest, referrer)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/goharbor/acceleration-service/pkg/remote"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeManifest struct {
+	mediaType string
+	data      []byte
+}
+
+// fakeRegistry is a minimal registry serving a single repository, which
+// supports the referrers API optionally.
+type fakeRegistry struct {
+	mutex     sync.Mutex
+	referrers bool
+	blobGets  int
+	blobs     map[digest.Digest][]byte
+	manifests map[string]fakeManifest
+}
+
+func newFakeRegistry(referrers bool) *fakeRegistry {
+	return &fakeRegistry{
+		referrers: referrers,
+		blobs:     map[digest.Digest][]byte{},
+		manifests: map[string]fakeManifest{},
+	}
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	const prefix = "/v2/foo/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, prefix), "/", 2)
+	if len(parts) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	kind, object := parts[0], parts[1]
+
+	switch {
+	case kind == "blobs" && object == "uploads/" && req.Method == http.MethodPost:
+		w.Header().Set("Location", prefix+"blobs/uploads/session")
+		w.WriteHeader(http.StatusAccepted)
+	case kind == "blobs" && object == "uploads/session" && req.Method == http.MethodPut:
+		data, _ := io.ReadAll(req.Body)
+		dgst := digest.Digest(req.URL.Query().Get("digest"))
+		r.blobs[dgst] = data
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	case kind == "blobs":
+		data, ok := r.blobs[digest.Digest(object)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			r.blobGets++
+			_, _ = w.Write(data)
+		}
+	case kind == "manifests" && req.Method == http.MethodPut:
+		data, _ := io.ReadAll(req.Body)
+		manifest := fakeManifest{mediaType: req.Header.Get("Content-Type"), data: data}
+		r.manifests[object] = manifest
+		r.manifests[digest.FromBytes(data).String()] = manifest
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(data).String())
+		w.WriteHeader(http.StatusCreated)
+	case kind == "manifests":
+		manifest, ok := r.manifests[object]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", manifest.mediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(manifest.data)))
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest.data).String())
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(manifest.data)
+		}
+	case kind == "referrers" && r.referrers:
+		index := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: []ocispec.Descriptor{}}
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+		_ = json.NewEncoder(w).Encode(index)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *fakeRegistry) manifest(t *testing.T, ref string, v interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	manifest, ok := r.manifests[ref]
+	require.True(t, ok, "manifest %s not found", ref)
+	require.NoError(t, json.Unmarshal(manifest.data, v))
+}
+
+// newTestProvider creates the provider accessing fake registry anonymously
+// with plain HTTP.
+func newTestProvider(t *testing.T) *Provider {
+	hosts := func(string) (remote.CredentialFunc, bool, error) {
+		return func(string) (string, string, error) {
+			return "", "", nil
+		}, false, nil
+	}
+	pvd, err := New(t.TempDir(), hosts, 0, "", platforms.All, 0)
+	require.NoError(t, err)
+	pvd.UsePlainHTTP()
+	return pvd
+}
+
+func TestPushReferrer(t *testing.T) {
+	subject := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("source"),
+		Size:      6,
+	}
+	annotations := map[string]string{"io.nydus.image.ref": "localhost/foo@sha256:abc"}
+
+	for _, referrers := range []bool{true, false} {
+		t.Run(fmt.Sprintf("referrers=%v", referrers), func(t *testing.T) {
+			registry := newFakeRegistry(referrers)
+			server := httptest.NewServer(registry)
+			defer server.Close()
+
+			pvd := newTestProvider(t)
+
+			ref := strings.TrimPrefix(server.URL, "http://") + "/foo:latest"
+			desc, err := pvd.PushReferrer(context.Background(), ref, "application/vnd.nydus.image", subject, annotations)
+			require.NoError(t, err)
+
+			var manifest ocispec.Manifest
+			registry.manifest(t, desc.Digest.String(), &manifest)
+			require.Equal(t, "application/vnd.nydus.image", manifest.ArtifactType)
+			require.Equal(t, subject.Digest, manifest.Subject.Digest)
+			require.Equal(t, annotations, manifest.Annotations)
+			require.Contains(t, registry.blobs, ocispec.DescriptorEmptyJSON.Digest)
+
+			// The referrers index is only tagged for the registry without
+			// support of referrers API.
+			tag := referrersTag(subject.Digest)
+			if referrers {
+				require.NotContains(t, registry.manifests, tag)
+				return
+			}
+			var index ocispec.Index
+			registry.manifest(t, tag, &index)
+			require.Len(t, index.Manifests, 1)
+			require.Equal(t, desc.Digest, index.Manifests[0].Digest)
+			require.Equal(t, "application/vnd.nydus.image", index.Manifests[0].ArtifactType)
+
+			// Pushing the same referrer again won't duplicate index entries
+			_, err = pvd.PushReferrer(context.Background(), ref, "application/vnd.nydus.image", subject, annotations)
+			require.NoError(t, err)
+			registry.manifest(t, tag, &index)
+			require.Len(t, index.Manifests, 1)
+		})
+	}
+}
+
+func TestPushReferrerBlob(t *testing.T) {
+	subject := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("target"),
+		Size:      6,
+	}
+	data := []byte(`{"spdxVersion":"SPDX-2.3"}`)
+	blob := ocispec.Descriptor{
+		MediaType: "application/spdx+json",
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+
+	for _, referrers := range []bool{true, false} {
+		t.Run(fmt.Sprintf("referrers=%v", referrers), func(t *testing.T) {
+			registry := newFakeRegistry(referrers)
+			server := httptest.NewServer(registry)
+			defer server.Close()
+
+			pvd := newTestProvider(t)
+
+			ref := strings.TrimPrefix(server.URL, "http://") + "/foo:latest"
+			desc, err := pvd.PushReferrerBlob(context.Background(), ref, "application/spdx+json", subject, blob, data, nil)
+			require.NoError(t, err)
+			require.Equal(t, data, registry.blobs[blob.Digest])
+
+			var manifest ocispec.Manifest
+			registry.manifest(t, desc.Digest.String(), &manifest)
+			require.Equal(t, "application/spdx+json", manifest.ArtifactType)
+			require.Equal(t, []ocispec.Descriptor{blob}, manifest.Layers)
+			require.Equal(t, ocispec.DescriptorEmptyJSON.Digest, manifest.Config.Digest)
+			require.Equal(t, subject.Digest, manifest.Subject.Digest)
+
+			tag := referrersTag(subject.Digest)
+			if referrers {
+				require.NotContains(t, registry.manifests, tag)
+				return
+			}
+			var index ocispec.Index
+			registry.manifest(t, tag, &index)
+			require.Len(t, index.Manifests, 1)
+			require.Equal(t, desc.Digest, index.Manifests[0].Digest)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// UploadFunc is called after a layer has been uploaded to the image of ref,
+// the layers already existing in or mounted to the repository aren't
+// uploaded.
+type UploadFunc func(ref string, desc ocispec.Descriptor)
+
+// SetUploadFunc sets a callback to observe the layers uploaded by push.
+func (pvd *Provider) SetUploadFunc(fn UploadFunc) {
+	pvd.uploadFunc = fn
+}
+
+func (pvd *Provider) uploaded(ref string, desc ocispec.Descriptor) {
+	if pvd.uploadFunc != nil && images.IsLayerType(desc.MediaType) {
+		pvd.uploadFunc(ref, desc)
+	}
+}
+
+// uploadResolver reports the layers committed by the writers of its pushers,
+// the pusher returns ErrAlreadyExists without a writer for the blob existing
+// in or mounted to the repository.
+type uploadResolver struct {
+	remotes.Resolver
+	uploaded func(desc ocispec.Descriptor)
+}
+
+func (r *uploadResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	pusher, err := r.Resolver.Pusher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadPusher{Pusher: pusher, uploaded: r.uploaded}, nil
+}
+
+type uploadPusher struct {
+	remotes.Pusher
+	uploaded func(desc ocispec.Descriptor)
+}
+
+func (p *uploadPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	writer, err := p.Pusher.Push(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadWriter{Writer: writer, desc: desc, uploaded: p.uploaded}, nil
+}
+
+type uploadWriter struct {
+	content.Writer
+	desc     ocispec.Descriptor
+	uploaded func(desc ocispec.Descriptor)
+}
+
+func (w *uploadWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	if err := w.Writer.Commit(ctx, size, expected, opts...); err != nil {
+		return err
+	}
+	w.uploaded(w.desc)
+	return nil
+}
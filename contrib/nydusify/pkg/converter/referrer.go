@@ -0,0 +1,69 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/goharbor/acceleration-service/pkg/errdefs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+const (
+	// NydusArtifactType is the artifact type of the referrer linking the
+	// Nydus image to its source image.
+	NydusArtifactType = "application/vnd.nydus.image"
+	// AnnotationNydusImage records the Nydus image reference by digest in the
+	// referrer of source image.
+	AnnotationNydusImage = "io.nydus.image.ref"
+)
+
+// linkSource pushes a referrer with the source image as subject into the
+// source repository, which records the converted Nydus image.
+func linkSource(ctx context.Context, pvd *provider.Provider, source, target string) error {
+	sourceNamed, err := docker.ParseDockerRef(source)
+	if err != nil {
+		return errors.Wrap(err, "parse source reference")
+	}
+	targetNamed, err := docker.ParseDockerRef(target)
+	if err != nil {
+		return errors.Wrap(err, "parse target reference")
+	}
+
+	sourceDesc, err := pvd.Image(ctx, sourceNamed.String())
+	if err != nil {
+		return errors.Wrap(err, "get source image")
+	}
+	targetDesc, err := pvd.Image(ctx, targetNamed.String())
+	if err != nil {
+		return errors.Wrap(err, "get target image")
+	}
+	annotations := map[string]string{
+		AnnotationNydusImage: fmt.Sprintf("%s@%s", docker.TrimNamed(targetNamed), targetDesc.Digest),
+	}
+
+	logrus.Infof("pushing referrer of source image %s", sourceNamed)
+	push := func() error {
+		_, err := pvd.PushReferrer(ctx, source, NydusArtifactType, *sourceDesc, annotations)
+		return err
+	}
+	if err := push(); err != nil {
+		if !errdefs.NeedsRetryWithHTTP(err) {
+			return err
+		}
+		pvd.UsePlainHTTP()
+		if err := push(); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("pushed referrer of source image %s", sourceNamed)
+
+	return nil
+}
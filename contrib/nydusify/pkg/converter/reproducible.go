@@ -0,0 +1,191 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// reproducibleTime is the modification time of all the entries of source
+// layers converted with Opt.Reproducible.
+var reproducibleTime = time.Unix(0, 0)
+
+// decompressTar returns the function writing the decompressed tar stream of
+// source layer.
+func decompressTar(ra content.ReaderAt) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		reader, err := compression.DecompressStream(io.NewSectionReader(ra, 0, ra.Size()))
+		if err != nil {
+			return errors.Wrap(err, "decompress layer")
+		}
+		defer reader.Close()
+		_, err = io.Copy(w, reader)
+		return errors.Wrap(err, "read layer")
+	}
+}
+
+// emptyTar writes the tar stream without entries for the zero-byte source
+// layer, which isn't a valid tarball to builder. The layer contributes
+// nothing to the filesystem of image.
+func emptyTar(w io.Writer) error {
+	return errors.Wrap(tar.NewWriter(w).Close(), "close tar writer")
+}
+
+// rewriteTar returns the function writing the tar stream written by write
+// with the header of each entry rewritten by rewrite, the entry is dropped
+// if rewrite returns false.
+func rewriteTar(write func(w io.Writer) error, rewrite func(hdr *tar.Header) bool) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(write(writer))
+		}()
+		defer reader.Close()
+
+		tr := tar.NewReader(reader)
+		tw := tar.NewWriter(w)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return errors.Wrap(err, "read layer")
+			}
+			if !rewrite(hdr) {
+				continue
+			}
+			// The format is chosen by writer from the header fields.
+			hdr.Format = tar.FormatUnknown
+			if err := tw.WriteHeader(hdr); err != nil {
+				return errors.Wrap(err, "write tar header")
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return errors.Wrapf(err, "write tar entry %s", hdr.Name)
+			}
+		}
+		return errors.Wrap(tw.Close(), "close tar writer")
+	}
+}
+
+// normalizeTar returns the function writing the tar stream written by write
+// with the modification time of entries reset to reproducibleTime, and the
+// access and change time dropped, so that the layers of the same files built
+// at different time or by different tar tools are converted to the same
+// Nydus blob. The entries are
+// sorted by builder in bootstrap, so they're kept in the order of source.
+func normalizeTar(write func(w io.Writer) error) func(w io.Writer) error {
+	return rewriteTar(write, func(hdr *tar.Header) bool {
+		hdr.ModTime = reproducibleTime
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
+		for _, key := range []string{"mtime", "atime", "ctime"} {
+			delete(hdr.PAXRecords, key)
+		}
+		return true
+	})
+}
+
+// clearManifestCreated removes the created time of the config of target
+// manifest and its history entries, the other fields are kept verbatim.
+func clearManifestCreated(ctx context.Context, cs content.Store, targetDesc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	var manifest ocispec.Manifest
+	if err := readJSON(ctx, cs, targetDesc, &manifest); err != nil {
+		return nil, errors.Wrap(err, "read target manifest")
+	}
+	var config map[string]json.RawMessage
+	if err := readJSON(ctx, cs, manifest.Config, &config); err != nil {
+		return nil, errors.Wrap(err, "read target config")
+	}
+
+	delete(config, "created")
+	if data, ok := config["history"]; ok {
+		var history []map[string]json.RawMessage
+		if err := json.Unmarshal(data, &history); err != nil {
+			return nil, errors.Wrap(err, "unmarshal history of target config")
+		}
+		for _, entry := range history {
+			delete(entry, "created")
+		}
+		data, err := json.Marshal(history)
+		if err != nil {
+			return nil, errors.Wrap(err, "marshal history of target config")
+		}
+		config["history"] = data
+	}
+
+	configDesc, err := writeJSON(ctx, cs, manifest.Config.MediaType, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "write target config")
+	}
+	configDesc.Annotations = manifest.Config.Annotations
+	manifest.Config = *configDesc
+
+	manifestDesc, err := writeJSON(ctx, cs, targetDesc.MediaType, manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "write target manifest")
+	}
+	manifestDesc.Platform = targetDesc.Platform
+	manifestDesc.Annotations = targetDesc.Annotations
+
+	return manifestDesc, nil
+}
+
+// clearCreated removes the created time of the configs of all the manifests
+// in target image, the source manifests merged into target index with
+// MergePlatform are kept as they are.
+func clearCreated(ctx context.Context, cs content.Store, sourceDesc, targetDesc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	sources := map[digest.Digest]bool{sourceDesc.Digest: true}
+	if images.IsIndexType(sourceDesc.MediaType) {
+		var index ocispec.Index
+		if err := readJSON(ctx, cs, sourceDesc, &index); err != nil {
+			return nil, errors.Wrap(err, "read source index")
+		}
+		for _, manifest := range index.Manifests {
+			sources[manifest.Digest] = true
+		}
+	}
+
+	if !images.IsIndexType(targetDesc.MediaType) {
+		if sources[targetDesc.Digest] {
+			return &targetDesc, nil
+		}
+		return clearManifestCreated(ctx, cs, targetDesc)
+	}
+
+	var index ocispec.Index
+	if err := readJSON(ctx, cs, targetDesc, &index); err != nil {
+		return nil, errors.Wrap(err, "read target index")
+	}
+	for idx, manifest := range index.Manifests {
+		if sources[manifest.Digest] {
+			continue
+		}
+		desc, err := clearManifestCreated(ctx, cs, manifest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "clear created time of manifest %s", manifest.Digest)
+		}
+		index.Manifests[idx] = *desc
+	}
+
+	desc, err := writeJSON(ctx, cs, targetDesc.MediaType, index)
+	if err != nil {
+		return nil, errors.Wrap(err, "write target index")
+	}
+	desc.Annotations = targetDesc.Annotations
+
+	return desc, nil
+}
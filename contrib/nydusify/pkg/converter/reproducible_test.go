@@ -0,0 +1,180 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeTar(t *testing.T) {
+	makeLayer := func(mtime time.Time, format tar.Format) []byte {
+		buf := bytes.Buffer{}
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime, Format: format}))
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:       "etc/passwd",
+			Typeflag:   tar.TypeReg,
+			Mode:       0644,
+			Size:       4,
+			ModTime:    mtime,
+			AccessTime: mtime,
+			ChangeTime: mtime,
+			Format:     format,
+		}))
+		_, err := tw.Write([]byte("root"))
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+		require.NoError(t, gw.Close())
+		return buf.Bytes()
+	}
+	normalize := func(layer []byte) []byte {
+		ra, err := newTarReaderAt(newBytesReaderAt(layer), normalizeTar(decompressTar(newBytesReaderAt(layer))), t.TempDir())
+		require.NoError(t, err)
+		defer ra.Close()
+		data, err := io.ReadAll(io.NewSectionReader(ra, 0, ra.Size()))
+		require.NoError(t, err)
+		return data
+	}
+
+	now := time.Now()
+	normalized := normalize(makeLayer(now, tar.FormatPAX))
+	require.True(t, bytes.Equal(normalized, normalize(makeLayer(now.Add(time.Hour), tar.FormatPAX))))
+	require.True(t, bytes.Equal(normalized, normalize(makeLayer(now.Add(-time.Hour), tar.FormatGNU))))
+
+	tr := tar.NewReader(bytes.NewReader(normalized))
+	for _, name := range []string{"etc/", "etc/passwd"} {
+		hdr, err := tr.Next()
+		require.NoError(t, err)
+		require.Equal(t, name, hdr.Name)
+		require.True(t, hdr.ModTime.Equal(reproducibleTime))
+		require.True(t, hdr.AccessTime.IsZero())
+		require.True(t, hdr.ChangeTime.IsZero())
+	}
+	data, err := io.ReadAll(tr)
+	require.NoError(t, err)
+	require.Equal(t, "root", string(data))
+	_, err = tr.Next()
+	require.Equal(t, io.EOF, err)
+
+	// Failure situation
+	_, err = newTarReaderAt(newBytesReaderAt([]byte("invalid")), normalizeTar(decompressTar(newBytesReaderAt([]byte("invalid")))), t.TempDir())
+	require.Error(t, err)
+}
+
+func TestRewriteTarNames(t *testing.T) {
+	names := []string{
+		"文件-ファイル-파일",
+		"name with spaces ",
+		"name\nwith\nnewlines",
+		strings.Repeat("é", 127) + "x",
+		strings.Repeat("目", 85) + "/" + strings.Repeat("🐳", 63) + "xyz",
+	}
+	for _, format := range []tar.Format{tar.FormatPAX, tar.FormatGNU} {
+		buf := bytes.Buffer{}
+		tw := tar.NewWriter(&buf)
+		for _, name := range names {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Format: format}))
+		}
+		require.NoError(t, tw.Close())
+		layer := buf.Bytes()
+
+		// The names are kept byte by byte whatever the source format is.
+		write := rewriteTar(decompressTar(newBytesReaderAt(layer)), func(hdr *tar.Header) bool { return true })
+		rewritten := bytes.Buffer{}
+		require.NoError(t, write(&rewritten))
+		tr := tar.NewReader(&rewritten)
+		for _, name := range names {
+			hdr, err := tr.Next()
+			require.NoError(t, err)
+			require.Equal(t, name, hdr.Name)
+		}
+		_, err := tr.Next()
+		require.Equal(t, io.EOF, err)
+	}
+}
+
+func TestClearCreated(t *testing.T) {
+	cs, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	marshal := func(v interface{}) []byte {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return data
+	}
+	writeManifest := func(created time.Time) ocispec.Descriptor {
+		config := marshal(map[string]interface{}{
+			"architecture":   "amd64",
+			"os":             "linux",
+			"created":        created,
+			"docker_version": "24.0.0",
+			"history": []ocispec.History{
+				{Created: &created, CreatedBy: "COPY app /app"},
+				{Created: &created, CreatedBy: "Nydus Converter", Comment: "Nydus Bootstrap Layer"},
+			},
+		})
+		return writeContent(t, cs, ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    writeContent(t, cs, ocispec.MediaTypeImageConfig, config, true),
+		}), true)
+	}
+
+	now := time.Now()
+	source := writeManifest(now)
+	target := writeManifest(now.Add(time.Second))
+	desc, err := clearCreated(ctx, cs, source, writeManifest(now.Add(time.Minute)))
+	require.NoError(t, err)
+	other, err := clearCreated(ctx, cs, source, writeManifest(now.Add(time.Hour)))
+	require.NoError(t, err)
+	require.Equal(t, desc.Digest, other.Digest)
+
+	var manifest ocispec.Manifest
+	require.NoError(t, readJSON(ctx, cs, *desc, &manifest))
+	var config map[string]json.RawMessage
+	require.NoError(t, readJSON(ctx, cs, manifest.Config, &config))
+	require.NotContains(t, config, "created")
+	require.JSONEq(t, `"24.0.0"`, string(config["docker_version"]))
+	require.JSONEq(t, `[{"created_by":"COPY app /app"},{"created_by":"Nydus Converter","comment":"Nydus Bootstrap Layer"}]`, string(config["history"]))
+
+	// The source manifest merged into target index is kept as it is.
+	sourceIndex := writeContent(t, cs, ocispec.MediaTypeImageIndex, marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{source},
+	}), true)
+	targetIndex := writeContent(t, cs, ocispec.MediaTypeImageIndex, marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{source, target},
+	}), true)
+	desc, err = clearCreated(ctx, cs, sourceIndex, targetIndex)
+	require.NoError(t, err)
+	var index ocispec.Index
+	require.NoError(t, readJSON(ctx, cs, *desc, &index))
+	require.Equal(t, []digest.Digest{source.Digest, other.Digest}, []digest.Digest{index.Manifests[0].Digest, index.Manifests[1].Digest})
+
+	// The source manifest converted to itself is kept as it is.
+	desc, err = clearCreated(ctx, cs, source, source)
+	require.NoError(t, err)
+	require.Equal(t, source.Digest, desc.Digest)
+}
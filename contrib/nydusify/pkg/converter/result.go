@@ -0,0 +1,67 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"time"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// Result is the summary of a finished conversion, it can be marshaled to
+// JSON so that the callers don't need to parse the logs.
+type Result struct {
+	// TargetDigest is the digest of target manifest or index.
+	TargetDigest digest.Digest `json:"target_digest"`
+	// BlobDigests are the digests of nydus blob layers in target image.
+	BlobDigests []digest.Digest `json:"blob_digests"`
+	// PushedBytes is the total size of layers uploaded to target, the
+	// layers already existing in or mounted to target repository and the
+	// pushes to build cache aren't counted, it's zero with Opt.DryRun.
+	PushedBytes int64 `json:"pushed_bytes"`
+	// DedupRatio is the ratio of the layer bytes reused from build cache or
+	// chunk dict to the total layer bytes of target image.
+	DedupRatio float64 `json:"dedup_ratio"`
+	// Elapsed is the duration of whole conversion, in nanoseconds in JSON.
+	Elapsed time.Duration `json:"elapsed"`
+	// Unchanged is true if Copy pushes nothing, since the target image has
+	// been converted from the same source image and all its blobs exist.
+	Unchanged bool `json:"unchanged"`
+	// BuilderVersion is the version of nydus-image builder used by the
+	// conversion, it's empty if the conversion is skipped.
+	BuilderVersion string `json:"builder_version,omitempty"`
+	// LayerMap maps the digest of each source layer converted to the digest
+	// of nydus blob layer built from it, or reused from build cache. The
+	// blob is recorded even if all its chunks are deduplicated into other
+	// blobs, then it isn't referenced by target manifest.
+	LayerMap map[digest.Digest]digest.Digest `json:"layer_map,omitempty"`
+
+	plan *Plan
+}
+
+func newResult(plan *Plan, pushedBytes int64, elapsed time.Duration) *Result {
+	result := &Result{
+		TargetDigest: plan.TargetDigest,
+		BlobDigests:  []digest.Digest{},
+		PushedBytes:  pushedBytes,
+		Elapsed:      elapsed,
+		plan:         plan,
+
+		BuilderVersion: plan.BuilderVersion,
+		LayerMap:       plan.LayerMap,
+	}
+	for _, layer := range plan.Layers {
+		if layer.MediaType == utils.MediaTypeNydusBlob {
+			result.BlobDigests = append(result.BlobDigests, layer.Digest)
+		}
+	}
+	if plan.TotalBytes > 0 {
+		result.DedupRatio = float64(plan.ReusedBytes) / float64(plan.TotalBytes)
+	}
+
+	return result
+}
@@ -0,0 +1,54 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestNewResult(t *testing.T) {
+	blob1 := digest.FromString("blob-1")
+	blob2 := digest.FromString("blob-2")
+	plan := &Plan{
+		TargetDigest: digest.FromString("manifest"),
+		Layers: []PlannedLayer{
+			{Digest: blob1, MediaType: utils.MediaTypeNydusBlob, Size: 300, Decision: LayerReused},
+			{Digest: blob2, MediaType: utils.MediaTypeNydusBlob, Size: 500, Decision: LayerBuilt},
+			{Digest: digest.FromString("bootstrap"), MediaType: ocispec.MediaTypeImageLayerGzip, Size: 200, Decision: LayerBuilt},
+		},
+		BuiltBytes:  700,
+		ReusedBytes: 300,
+		TotalBytes:  1000,
+	}
+
+	result := newResult(plan, 700, time.Second)
+	require.Equal(t, plan.TargetDigest, result.TargetDigest)
+	require.Equal(t, []digest.Digest{blob1, blob2}, result.BlobDigests)
+	require.Equal(t, int64(700), result.PushedBytes)
+	require.Equal(t, 0.3, result.DedupRatio)
+	require.Equal(t, time.Second, result.Elapsed)
+
+	data, err := json.Marshal(result)
+	require.NoError(t, err)
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &fields))
+	require.Equal(t, plan.TargetDigest.String(), fields["target_digest"])
+	require.Len(t, fields["blob_digests"], 2)
+	require.Equal(t, float64(time.Second), fields["elapsed"])
+	require.NotContains(t, fields, "plan")
+
+	// The image without layers has no dedup ratio.
+	result = newResult(&Plan{}, 0, 0)
+	require.Empty(t, result.BlobDigests)
+	require.Zero(t, result.DedupRatio)
+}
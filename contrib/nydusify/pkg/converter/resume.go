@@ -0,0 +1,203 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/reference/docker"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+// resumeState is the content of Opt.ResumeStateFile, which records the nydus
+// blob layers built from the layers of source image so far.
+type resumeState struct {
+	Source digest.Digest                      `json:"source"`
+	Params json.RawMessage                    `json:"params"`
+	Layers map[digest.Digest]buildCacheRecord `json:"layers"`
+}
+
+// resumer records each nydus blob layer into the state file once it's built,
+// and the blob data into the directory `<state file>.blobs`, so that the
+// conversion restarted after failure skips the layers built before. The
+// state is only reused for the same source image and build parameters.
+type resumer struct {
+	path   string
+	params []byte
+	blobs  *provider.BlobCache
+	// source returns the digest of source image, which is called once the
+	// source image is pulled.
+	source func(ctx context.Context) (digest.Digest, error)
+
+	mutex  sync.Mutex
+	loaded bool
+	state  resumeState
+}
+
+func newResumer(path string, opt Opt, version *BuilderVersion, source func(ctx context.Context) (digest.Digest, error)) (*resumer, error) {
+	params, err := marshalBuildParams(opt, version)
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := provider.NewBlobCache(path+".blobs", 0)
+	if err != nil {
+		return nil, err
+	}
+	return &resumer{
+		path:   path,
+		params: params,
+		blobs:  blobs,
+		source: source,
+	}, nil
+}
+
+// init loads the state file once the source image is pulled, the state of
+// another source image or build parameters is discarded together with its
+// blobs. It must be called with mutex held.
+func (r *resumer) init(ctx context.Context) error {
+	if r.loaded {
+		return nil
+	}
+	source, err := r.source(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(r.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrap(err, "read resume state")
+	}
+	var state resumeState
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			logrus.Warnf("discard invalid resume state %s: %s", r.path, err)
+		}
+	}
+	if state.Source != source || !bytes.Equal(state.Params, r.params) {
+		if len(state.Layers) > 0 {
+			logrus.Infof("discard resume state %s of source image %s", r.path, state.Source)
+		}
+		if err := os.RemoveAll(r.path + ".blobs"); err != nil {
+			return errors.Wrap(err, "remove blobs of resume state")
+		}
+		state = resumeState{Source: source, Params: r.params}
+	}
+	if state.Layers == nil {
+		state.Layers = map[digest.Digest]buildCacheRecord{}
+	}
+	r.state = state
+	r.loaded = true
+	return nil
+}
+
+// load writes the nydus blob layer built from source layer before into
+// store, it returns false if the layer isn't built.
+func (r *resumer) load(ctx context.Context, store content.Store, source digest.Digest) (digest.Digest, bool) {
+	r.mutex.Lock()
+	// The layers are also checked before the source image is pulled.
+	if err := r.init(ctx); err != nil {
+		r.mutex.Unlock()
+		logrus.Debugf("skip resume state %s: %s", r.path, err)
+		return "", false
+	}
+	record, ok := r.state.Layers[source]
+	r.mutex.Unlock()
+	if !ok {
+		return "", false
+	}
+	desc := ocispec.Descriptor{
+		MediaType: nydusify.MediaTypeNydusBlob,
+		Digest:    record.Blob,
+		Size:      record.Size,
+	}
+	if _, err := store.Info(ctx, desc.Digest); err != nil && !r.blobs.Load(ctx, store, desc) {
+		return "", false
+	}
+	logrus.Infof("resumed blob %s built from layer %s", record.Blob, source)
+	return record.Blob, true
+}
+
+// save copies the nydus blob layer built from source layer from store, and
+// records it in state file.
+func (r *resumer) save(ctx context.Context, store content.Store, source, blob digest.Digest) error {
+	r.mutex.Lock()
+	err := r.init(ctx)
+	r.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	info, err := store.Info(ctx, blob)
+	if err != nil {
+		return errors.Wrapf(err, "get blob info %s", blob)
+	}
+	desc := ocispec.Descriptor{
+		MediaType: nydusify.MediaTypeNydusBlob,
+		Digest:    blob,
+		Size:      info.Size,
+	}
+	if err := r.blobs.Save(ctx, store, desc); err != nil {
+		return errors.Wrapf(err, "save blob %s", blob)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.state.Layers[source] = buildCacheRecord{Blob: blob, Size: info.Size}
+	data, err := json.Marshal(r.state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), buildCacheTempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+// remove removes the state file and the blobs, which are useless once the
+// conversion succeeds.
+func (r *resumer) remove() error {
+	if err := os.RemoveAll(r.path + ".blobs"); err != nil {
+		return err
+	}
+	if err := os.Remove(r.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// sourceImageDigest returns the function getting the digest of source image,
+// which is called once the source image is pulled.
+func sourceImageDigest(pvd *provider.Provider, source string) func(ctx context.Context) (digest.Digest, error) {
+	return func(ctx context.Context) (digest.Digest, error) {
+		sourceNamed, err := docker.ParseDockerRef(source)
+		if err != nil {
+			return "", errors.Wrap(err, "parse source reference")
+		}
+		sourceDesc, err := pvd.Image(ctx, sourceNamed.String())
+		if err != nil {
+			return "", errors.Wrap(err, "get source image")
+		}
+		return sourceDesc.Digest, nil
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/namespaces"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResume(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	statePath := filepath.Join(t.TempDir(), "resume.json")
+	sourceDigest := digest.FromString("source")
+	layers := []string{"layer-1", "layer-2"}
+
+	// newRun prepares the store of a conversion with the source layers
+	// pulled.
+	newRun := func(opt Opt) (*store, []digest.Digest) {
+		base, err := local.NewStore(t.TempDir())
+		require.NoError(t, err)
+		cs := newStore(base, 1, nil)
+		cs.resumer, err = newResumer(statePath, opt, nil, func(context.Context) (digest.Digest, error) {
+			return sourceDigest, nil
+		})
+		require.NoError(t, err)
+		sources := []digest.Digest{}
+		for _, layer := range layers {
+			sources = append(sources, writeContent(t, base, ocispec.MediaTypeImageLayerGzip, []byte(layer), true).Digest)
+		}
+		return cs, sources
+	}
+	// convert builds the source layers like the layer converter, the layer
+	// with target digest label is skipped, and the building fails at layer
+	// failAt.
+	convert := func(cs *store, sources []digest.Digest, failAt int) ([]int, error) {
+		built := []int{}
+		for idx, source := range sources {
+			info, err := cs.Info(ctx, source)
+			require.NoError(t, err)
+			if info.Labels[nydusify.LayerAnnotationNydusTargetDigest] != "" {
+				continue
+			}
+			if idx == failAt {
+				return built, fmt.Errorf("build layer %d", idx)
+			}
+			writer, err := content.OpenWriter(ctx, cs, content.WithRef(layerConvertRefPrefix+source.String()))
+			require.NoError(t, err)
+			_, err = writer.Write([]byte("blob of " + layers[idx]))
+			require.NoError(t, err)
+			require.NoError(t, writer.Commit(ctx, 0, ""))
+			require.NoError(t, writer.Close())
+			built = append(built, idx)
+		}
+		return built, nil
+	}
+
+	// The first conversion fails on layer 2.
+	cs, sources := newRun(Opt{})
+	built, err := convert(cs, sources, 1)
+	require.Error(t, err)
+	require.Equal(t, []int{0}, built)
+	blob1 := cs.converted[sources[0]]
+	require.NotEmpty(t, blob1)
+
+	// Layer 1 isn't rebuilt by the restarted conversion.
+	cs, sources = newRun(Opt{})
+	built, err = convert(cs, sources, -1)
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, built)
+	require.Equal(t, blob1, cs.converted[sources[0]])
+	require.False(t, cs.isBuilt(blob1))
+	data, err := content.ReadBlob(ctx, cs.Store, ocispec.Descriptor{Digest: blob1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("blob of layer-1"), data)
+
+	// The state is invalidated by the change of build parameters.
+	cs, sources = newRun(Opt{Compressor: "lz4_block"})
+	built, err = convert(cs, sources, 1)
+	require.Error(t, err)
+	require.Equal(t, []int{0}, built)
+
+	// The state is invalidated by the change of source image.
+	sourceDigest = digest.FromString("another source")
+	cs, sources = newRun(Opt{})
+	built, err = convert(cs, sources, -1)
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1}, built)
+
+	require.NoError(t, cs.resumer.remove())
+	_, err = os.Stat(statePath)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(statePath + ".blobs")
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/goharbor/acceleration-service/pkg/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+// SBOMArtifactType is the artifact type and the media type of the SPDX
+// document attached to target image.
+const SBOMArtifactType = "application/spdx+json"
+
+// sbom is the SPDX document in JSON format attached to target image.
+type sbom struct {
+	name string
+	data []byte
+}
+
+// loadSBOM reads the SBOM file, which must be a JSON document.
+func loadSBOM(path string) (*sbom, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read sbom")
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("invalid sbom %s, should be a SPDX document in JSON format", path)
+	}
+	return &sbom{name: filepath.Base(path), data: data}, nil
+}
+
+// attachSBOM pushes the SBOM as a referrer with the target image as subject
+// into the target repository.
+func attachSBOM(ctx context.Context, pvd *provider.Provider, doc *sbom, target string) error {
+	targetNamed, err := docker.ParseDockerRef(target)
+	if err != nil {
+		return errors.Wrap(err, "parse target reference")
+	}
+	targetDesc, err := pvd.Image(ctx, targetNamed.String())
+	if err != nil {
+		return errors.Wrap(err, "get target image")
+	}
+	blob := ocispec.Descriptor{
+		MediaType: SBOMArtifactType,
+		Digest:    digest.FromBytes(doc.data),
+		Size:      int64(len(doc.data)),
+		Annotations: map[string]string{
+			ocispec.AnnotationTitle: doc.name,
+		},
+	}
+
+	logrus.Infof("pushing sbom of target image %s", targetNamed)
+	push := func() error {
+		_, err := pvd.PushReferrerBlob(ctx, target, SBOMArtifactType, *targetDesc, blob, doc.data, nil)
+		return err
+	}
+	if err := push(); err != nil {
+		if !errdefs.NeedsRetryWithHTTP(err) {
+			return err
+		}
+		pvd.UsePlainHTTP()
+		if err := push(); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("pushed sbom of target image %s", targetNamed)
+
+	return nil
+}
@@ -0,0 +1,39 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSBOM(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sbom.spdx.json")
+	data := []byte(`{"spdxVersion":"SPDX-2.3","name":"nydus"}`)
+	require.NoError(t, os.WriteFile(path, data, 0644))
+
+	doc, err := loadSBOM(path)
+	require.NoError(t, err)
+	require.Equal(t, "sbom.spdx.json", doc.name)
+	require.Equal(t, data, doc.data)
+
+	// Failure situation
+	_, err = loadSBOM(filepath.Join(t.TempDir(), "non-existent.json"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "read sbom")
+
+	require.NoError(t, os.WriteFile(path, []byte("SPDXVersion: SPDX-2.3"), 0644))
+	_, err = loadSBOM(path)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "should be a SPDX document in JSON format")
+
+	_, err = Convert(context.Background(), Opt{SourcePath: t.TempDir(), TargetPath: t.TempDir(), SBOMPath: path})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "sbom is only supported for target reference")
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/content"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const sharedBlobTempPrefix = ".tmp-"
+
+// saveSharedBlobs places the nydus blobs built by the conversion in the
+// shared blob directory.
+func saveSharedBlobs(ctx context.Context, cs content.Store, dir string, layers []PlannedLayer) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "create shared blob directory")
+	}
+	for _, layer := range layers {
+		if layer.Decision != LayerBuilt || layer.MediaType != nydusify.MediaTypeNydusBlob {
+			continue
+		}
+		desc := ocispec.Descriptor{
+			MediaType: layer.MediaType,
+			Digest:    layer.Digest,
+			Size:      layer.Size,
+		}
+		if err := saveSharedBlob(ctx, cs, dir, desc); err != nil {
+			return errors.Wrapf(err, "save blob %s", layer.Digest)
+		}
+	}
+	return nil
+}
+
+// saveSharedBlob copies the blob from store to `<dir>/<hex>` like the blob
+// directory of localfs backend, the blob already in directory is skipped.
+// The blob is written to a temp file and renamed once its digest is
+// verified, so the concurrent conversions sharing the directory never see
+// a partial blob, and the same blob renamed by them has the same content.
+func saveSharedBlob(ctx context.Context, cs content.Store, dir string, desc ocispec.Descriptor) error {
+	blobPath := filepath.Join(dir, desc.Digest.Hex())
+	if _, err := os.Stat(blobPath); err == nil {
+		return nil
+	}
+
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return errors.Wrap(err, "open blob in store")
+	}
+	defer ra.Close()
+
+	tmp, err := os.CreateTemp(dir, sharedBlobTempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	digester := desc.Digest.Algorithm().Digester()
+	size, err := io.Copy(io.MultiWriter(tmp, digester.Hash()), content.NewReader(ra))
+	if err != nil {
+		return errors.Wrap(err, "copy blob")
+	}
+	if size != desc.Size || digester.Digest() != desc.Digest {
+		return fmt.Errorf("blob %s mismatched with size %d and digest %s", desc.Digest, size, digester.Digest())
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), blobPath); err != nil {
+		return err
+	}
+	logrus.Debugf("saved blob %s into shared blob directory", desc.Digest)
+
+	return nil
+}
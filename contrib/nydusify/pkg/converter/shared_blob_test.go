@@ -0,0 +1,68 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/namespaces"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveSharedBlobs(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	dir := filepath.Join(t.TempDir(), "blobs")
+
+	data := bytes.Repeat([]byte("blob"), 1<<20)
+	// Each conversion builds the same blob in its own store.
+	convert := func() (content.Store, []PlannedLayer) {
+		cs, err := local.NewStore(t.TempDir())
+		require.NoError(t, err)
+		blob := writeContent(t, cs, nydusify.MediaTypeNydusBlob, data, false)
+		bootstrap := writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, []byte("bootstrap"), false)
+		reused := digest.FromString("reused")
+		return cs, []PlannedLayer{
+			{Digest: blob.Digest, MediaType: blob.MediaType, Size: blob.Size, Decision: LayerBuilt},
+			{Digest: reused, MediaType: nydusify.MediaTypeNydusBlob, Size: 6, Decision: LayerReused},
+			{Digest: bootstrap.Digest, MediaType: bootstrap.MediaType, Size: bootstrap.Size, Decision: LayerBuilt},
+		}
+	}
+
+	// The conversions save the same blob into shared directory concurrently.
+	wg := sync.WaitGroup{}
+	errs := make([]error, 8)
+	for idx := range errs {
+		cs, layers := convert()
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			errs[idx] = saveSharedBlobs(ctx, cs, dir, layers)
+		}(idx)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	// Only the built blob is saved, without partial files.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	dgst := digest.FromBytes(data)
+	require.Equal(t, dgst.Hex(), entries[0].Name())
+	saved, err := os.ReadFile(filepath.Join(dir, dgst.Hex()))
+	require.NoError(t, err)
+	require.Equal(t, dgst, digest.FromBytes(saved))
+}
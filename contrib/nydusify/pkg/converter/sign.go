@@ -0,0 +1,287 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference/docker"
+	accelerrdefs "github.com/goharbor/acceleration-service/pkg/errdefs"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+// The formats compatible with cosign, see https://github.com/sigstore/cosign.
+const (
+	// SignPasswordEnv is the environment variable of the passphrase to
+	// decrypt the encrypted cosign private key.
+	SignPasswordEnv = "COSIGN_PASSWORD"
+
+	signatureType             = "cosign container image signature"
+	mediaTypeSimpleSigning    = "application/vnd.dev.cosign.simplesigning.v1+json"
+	annotationCosignSignature = "dev.cosignproject.cosign/signature"
+
+	pemTypeCosignEncrypted   = "ENCRYPTED COSIGN PRIVATE KEY"
+	pemTypeSigstoreEncrypted = "ENCRYPTED SIGSTORE PRIVATE KEY"
+)
+
+// encryptedKey is the private key encrypted by cosign with scrypt KDF and
+// nacl secretbox cipher.
+type encryptedKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// simpleSigning is the payload signed by cosign.
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+func decryptKey(data, password []byte) ([]byte, error) {
+	var key encryptedKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, errors.Wrap(err, "unmarshal encrypted key")
+	}
+	if key.KDF.Name != "scrypt" || key.Cipher.Name != "nacl/secretbox" {
+		return nil, fmt.Errorf("unsupported kdf %s or cipher %s", key.KDF.Name, key.Cipher.Name)
+	}
+	if len(key.Cipher.Nonce) != 24 {
+		return nil, fmt.Errorf("invalid nonce size %d", len(key.Cipher.Nonce))
+	}
+
+	secret, err := scrypt.Key(password, key.KDF.Salt, key.KDF.Params.N, key.KDF.Params.R, key.KDF.Params.P, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "derive key")
+	}
+	var nonce [24]byte
+	var secretKey [32]byte
+	copy(nonce[:], key.Cipher.Nonce)
+	copy(secretKey[:], secret)
+	decrypted, ok := secretbox.Open(nil, key.Ciphertext, &nonce, &secretKey)
+	if !ok {
+		return nil, fmt.Errorf("decryption failed, please check the password in env %s", SignPasswordEnv)
+	}
+
+	return decrypted, nil
+}
+
+// loadSignKey loads the ECDSA private key in PEM format, the key encrypted by
+// cosign is decrypted with the password from env `COSIGN_PASSWORD`.
+func loadSignKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read sign key")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("invalid sign key %s, should be in PEM format", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case pemTypeCosignEncrypted, pemTypeSigstoreEncrypted:
+		der, err := decryptKey(block.Bytes, []byte(os.Getenv(SignPasswordEnv)))
+		if err != nil {
+			return nil, errors.Wrap(err, "decrypt sign key")
+		}
+		key, err = x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse sign key")
+		}
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse sign key")
+		}
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse sign key")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported sign key type %s", block.Type)
+	}
+
+	ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported sign key %T, should be an ECDSA key", key)
+	}
+	return ecdsaKey, nil
+}
+
+// signManifest produces the simple signing payload of manifest and signs the
+// payload with key, returns the payload and base64 encoded signature.
+func signManifest(key *ecdsa.PrivateKey, repository string, manifestDigest digest.Digest) ([]byte, string, error) {
+	var signing simpleSigning
+	signing.Critical.Identity.DockerReference = repository
+	signing.Critical.Image.DockerManifestDigest = manifestDigest.String()
+	signing.Critical.Type = signatureType
+	payload, err := json.Marshal(signing)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		return nil, "", errors.Wrap(err, "sign payload")
+	}
+
+	return payload, base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// signatureTag returns the tag of signature manifest used by cosign, like
+// `sha256-<hex>.sig`.
+func signatureTag(dgst digest.Digest) string {
+	return fmt.Sprintf("%s-%s.sig", dgst.Algorithm(), dgst.Hex())
+}
+
+// pushSignature signs the target image and pushes the signature image with
+// cosign tag into the target repository, the signature is appended if the
+// signature image exists already.
+func pushSignature(ctx context.Context, pvd *provider.Provider, key *ecdsa.PrivateKey, target string) error {
+	targetNamed, err := docker.ParseDockerRef(target)
+	if err != nil {
+		return errors.Wrap(err, "parse target reference")
+	}
+	targetDesc, err := pvd.Image(ctx, targetNamed.String())
+	if err != nil {
+		return errors.Wrap(err, "get target image")
+	}
+	repository := docker.TrimNamed(targetNamed).String()
+	payload, signature, err := signManifest(key, repository, targetDesc.Digest)
+	if err != nil {
+		return err
+	}
+
+	resolver, err := pvd.Resolver(target)
+	if err != nil {
+		return err
+	}
+	ref := fmt.Sprintf("%s:%s", repository, signatureTag(targetDesc.Digest))
+
+	layer := ocispec.Descriptor{
+		MediaType: mediaTypeSimpleSigning,
+		Digest:    digest.FromBytes(payload),
+		Size:      int64(len(payload)),
+		Annotations: map[string]string{
+			annotationCosignSignature: signature,
+		},
+	}
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+	}
+	_, data, err := provider.FetchBytes(ctx, resolver, ref)
+	if err == nil {
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return errors.Wrap(err, "unmarshal signature manifest")
+		}
+	} else if !errdefs.IsNotFound(err) {
+		return errors.Wrap(err, "fetch signature manifest")
+	}
+	manifest.Layers = append(manifest.Layers, layer)
+
+	diffIDs := []digest.Digest{}
+	for _, layer := range manifest.Layers {
+		diffIDs = append(diffIDs, layer.Digest)
+	}
+	config := ocispec.Image{
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	}
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	manifest.Config = ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    digest.FromBytes(configBytes),
+		Size:      int64(len(configBytes)),
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	manifestDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifestBytes),
+		Size:      int64(len(manifestBytes)),
+	}
+
+	if err := provider.PushBytes(ctx, resolver, ref, layer, payload); err != nil {
+		return errors.Wrap(err, "push signature payload")
+	}
+	if err := provider.PushBytes(ctx, resolver, ref, manifest.Config, configBytes); err != nil {
+		return errors.Wrap(err, "push signature config")
+	}
+	if err := provider.PushBytes(ctx, resolver, ref, manifestDesc, manifestBytes); err != nil {
+		return errors.Wrap(err, "push signature manifest")
+	}
+
+	return nil
+}
+
+// signImage signs the target image, and retries with plain HTTP if needed.
+func signImage(ctx context.Context, pvd *provider.Provider, keyPath, target string) error {
+	key, err := loadSignKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("signing image %s", target)
+	if err := pushSignature(ctx, pvd, key, target); err != nil {
+		if !accelerrdefs.NeedsRetryWithHTTP(err) {
+			return err
+		}
+		pvd.UsePlainHTTP()
+		if err := pushSignature(ctx, pvd, key, target); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("signed image %s", target)
+
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// writeEncryptedKey writes the private key encrypted by password in the
+// same format as `cosign generate-key-pair`.
+func writeEncryptedKey(t *testing.T, path string, key *ecdsa.PrivateKey, password string) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	var encrypted encryptedKey
+	encrypted.KDF.Name = "scrypt"
+	encrypted.KDF.Params.N = 1 << 10
+	encrypted.KDF.Params.R = 8
+	encrypted.KDF.Params.P = 1
+	encrypted.KDF.Salt = make([]byte, 32)
+	_, err = rand.Read(encrypted.KDF.Salt)
+	require.NoError(t, err)
+	encrypted.Cipher.Name = "nacl/secretbox"
+	encrypted.Cipher.Nonce = make([]byte, 24)
+	_, err = rand.Read(encrypted.Cipher.Nonce)
+	require.NoError(t, err)
+
+	secret, err := scrypt.Key([]byte(password), encrypted.KDF.Salt, encrypted.KDF.Params.N, encrypted.KDF.Params.R, encrypted.KDF.Params.P, 32)
+	require.NoError(t, err)
+	var nonce [24]byte
+	var secretKey [32]byte
+	copy(nonce[:], encrypted.Cipher.Nonce)
+	copy(secretKey[:], secret)
+	encrypted.Ciphertext = secretbox.Seal(nil, der, &nonce, &secretKey)
+
+	data, err := json.Marshal(encrypted)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{
+		Type:  pemTypeCosignEncrypted,
+		Bytes: data,
+	}), 0600))
+}
+
+func TestLoadSignKey(t *testing.T) {
+	workDir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	// Encrypted cosign key
+	encryptedKeyPath := filepath.Join(workDir, "cosign.key")
+	writeEncryptedKey(t, encryptedKeyPath, key, "password")
+	t.Setenv(SignPasswordEnv, "password")
+	loaded, err := loadSignKey(encryptedKeyPath)
+	require.NoError(t, err)
+	require.True(t, key.Equal(loaded))
+
+	t.Setenv(SignPasswordEnv, "wrong")
+	_, err = loadSignKey(encryptedKeyPath)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "decryption failed")
+
+	// Unencrypted EC key
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	keyPath := filepath.Join(workDir, "ec.key")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: der,
+	}), 0600))
+	loaded, err = loadSignKey(keyPath)
+	require.NoError(t, err)
+	require.True(t, key.Equal(loaded))
+
+	// Invalid key
+	invalidKeyPath := filepath.Join(workDir, "invalid.key")
+	require.NoError(t, os.WriteFile(invalidKeyPath, []byte("invalid"), 0600))
+	_, err = loadSignKey(invalidKeyPath)
+	require.Error(t, err)
+}
+
+func TestSignManifest(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	manifestDigest := digest.FromString("manifest")
+	payload, signature, err := signManifest(key, "localhost:5000/foo", manifestDigest)
+	require.NoError(t, err)
+
+	var signing simpleSigning
+	require.NoError(t, json.Unmarshal(payload, &signing))
+	require.Equal(t, "localhost:5000/foo", signing.Critical.Identity.DockerReference)
+	require.Equal(t, manifestDigest.String(), signing.Critical.Image.DockerManifestDigest)
+	require.Equal(t, signatureType, signing.Critical.Type)
+
+	// Verify the signature with public key
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	require.NoError(t, err)
+	hash := sha256.Sum256(payload)
+	require.True(t, ecdsa.VerifyASN1(&key.PublicKey, hash[:], sig))
+
+	require.Equal(t, "sha256-"+manifestDigest.Hex()+".sig", signatureTag(manifestDigest))
+}
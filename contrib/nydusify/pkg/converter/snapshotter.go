@@ -0,0 +1,86 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/containerd/containerd/content"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// snapshotterManifest writes the target manifest with the layer annotations
+// consumed by nydus snapshotter: the nydus blob layers are marked with
+// LayerAnnotationNydusBlob, and the bootstrap layer is marked with
+// LayerAnnotationNydusBootstrap, and records the fs version and the IDs of
+// all the blobs referenced by bootstrap, including the blobs of chunk dict
+// and the blobs in storage backend which aren't in manifest.
+func snapshotterManifest(ctx context.Context, cs content.Store, opt Opt, targetDesc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	var manifest ocispec.Manifest
+	if err := readJSON(ctx, cs, targetDesc, &manifest); err != nil {
+		return nil, errors.Wrap(err, "read target manifest")
+	}
+	bootstrapPath, cleanup, err := unpackManifestBootstrap(ctx, cs, opt, manifest)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	info, err := readBootstrapSuperBlock(bootstrapPath)
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := bootstrapBlobs(ctx, opt, bootstrapPath)
+	if err != nil {
+		return nil, err
+	}
+	blobIDs := []string{}
+	for _, blob := range blobs {
+		blobIDs = append(blobIDs, blob.ID)
+	}
+	blobIDsJSON, err := json.Marshal(blobIDs)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal blob IDs")
+	}
+
+	for idx, layer := range manifest.Layers {
+		annotations := map[string]string{}
+		for key, value := range layer.Annotations {
+			annotations[key] = value
+		}
+		switch {
+		case nydusify.IsNydusBootstrap(layer):
+			annotations[utils.LayerAnnotationNydusBootstrap] = "true"
+			annotations[utils.LayerAnnotationNydusFsVersion] = info.FsVersion
+			annotations[utils.LayerAnnotationNydusReferenceBlobIDs] = string(blobIDsJSON)
+		case layer.MediaType == utils.MediaTypeNydusBlob || nydusify.IsNydusBlob(layer):
+			annotations[utils.LayerAnnotationNydusBlob] = "true"
+		default:
+			continue
+		}
+		manifest.Layers[idx].Annotations = annotations
+	}
+
+	manifestDesc, err := writeJSON(ctx, cs, targetDesc.MediaType, manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "write target manifest")
+	}
+	manifestDesc.Platform = targetDesc.Platform
+	manifestDesc.Annotations = targetDesc.Annotations
+
+	return manifestDesc, nil
+}
+
+// snapshotterCompat annotates the layers of all the manifests in target
+// image for nydus snapshotter, see snapshotterManifest.
+func snapshotterCompat(ctx context.Context, cs content.Store, opt Opt, sourceDesc, targetDesc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	return rewriteManifests(ctx, cs, sourceDesc, targetDesc, func(desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		return snapshotterManifest(ctx, cs, opt, desc)
+	})
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestSnapshotterCompat(t *testing.T) {
+	base, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	cs := newStore(base, 1, nil)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	marshal := func(v interface{}) []byte {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return data
+	}
+
+	config := writeContent(t, cs, ocispec.MediaTypeImageConfig, []byte("{}"), true)
+	sourceManifest := writeContent(t, cs, ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, []byte("layer"), true)},
+	}), true)
+	sourceDesc := writeContent(t, cs, ocispec.MediaTypeImageIndex, marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{sourceManifest},
+	}), true)
+
+	blob := digest.FromString("blob")
+	dictBlob := digest.FromString("dict blob")
+	bootstrapLayer := writeContent(t, cs, ocispec.MediaTypeImageLayerGzip, makeBootstrapLayer(t), true)
+	bootstrapLayer.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+	targetManifest := writeContent(t, cs, ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers: []ocispec.Descriptor{
+			{MediaType: utils.MediaTypeNydusBlob, Digest: blob, Size: 10},
+			bootstrapLayer,
+		},
+	}), true)
+	targetManifest.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	// The source manifest merged into target index is kept.
+	targetDesc := writeContent(t, cs, ocispec.MediaTypeImageIndex, marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{targetManifest, sourceManifest},
+	}), true)
+
+	opt := Opt{
+		WorkDir: t.TempDir(),
+		NydusImagePath: fakeBlobsBuilder(t, []BootstrapBlob{
+			{ID: dictBlob.Hex(), CompressedSize: 10, DecompressedSize: 30},
+			{ID: blob.Hex(), CompressedSize: 10, DecompressedSize: 20},
+		}),
+	}
+	desc, err := snapshotterCompat(ctx, cs, opt, sourceDesc, targetDesc)
+	require.NoError(t, err)
+
+	var index ocispec.Index
+	require.NoError(t, readJSON(ctx, cs, *desc, &index))
+	require.Len(t, index.Manifests, 2)
+	require.Equal(t, sourceManifest, index.Manifests[1])
+	require.Equal(t, targetManifest.Platform, index.Manifests[0].Platform)
+
+	var manifest ocispec.Manifest
+	require.NoError(t, readJSON(ctx, cs, index.Manifests[0], &manifest))
+	require.Len(t, manifest.Layers, 2)
+	require.Equal(t, map[string]string{
+		utils.LayerAnnotationNydusBlob: "true",
+	}, manifest.Layers[0].Annotations)
+	require.Equal(t, map[string]string{
+		utils.LayerAnnotationNydusBootstrap:        "true",
+		utils.LayerAnnotationNydusFsVersion:        "6",
+		utils.LayerAnnotationNydusReferenceBlobIDs: fmt.Sprintf(`["%s","%s"]`, dictBlob.Hex(), blob.Hex()),
+	}, manifest.Layers[1].Annotations)
+
+	// Failure situation
+	opt.NydusImagePath = "/bin/false"
+	_, err = snapshotterCompat(ctx, cs, opt, sourceDesc, targetDesc)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "get blobs of bootstrap")
+}
@@ -0,0 +1,230 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/semaphore"
+)
+
+// store limits the number of source layers being converted at the same time.
+// The containerd converter converts all layers of a manifest concurrently,
+// and each layer conversion holds a reader of the source layer until the
+// nydus-image builder finishes, so bounding the readers of source layers
+// bounds the concurrent builders.
+type store struct {
+	content.Store
+	limiter  *semaphore.Weighted
+	reporter *reporter
+	// estargz makes the eStargz source layers read as the tar stream without
+	// TOC, otherwise they are read as normal tarballs.
+	estargz bool
+	// reproducible makes the entries of source layers read with the
+	// timestamps reset, see normalizeTar.
+	reproducible bool
+	// owner overrides the ownership of the entries of source layers if not
+	// nil, see overrideOwner.
+	owner *Owner
+	// filter drops the entries of source layers if not nil, see filterTar.
+	filter *pathFilter
+	// tempDir keeps the temp files of the source layers rewritten for
+	// builder, the system temp directory is used if it's empty.
+	tempDir string
+	// bottomLayers returns the lowest source layers, whose whiteouts are
+	// dropped if it's not nil, see dropWhiteouts.
+	bottomLayers func(ctx context.Context) (map[digest.Digest]bool, error)
+
+	// buildCache provides the nydus blob layers built from source layers by
+	// previous conversions if it's not nil.
+	buildCache *buildCache
+	// resumer provides the nydus blob layers built by the failed conversion
+	// of the same source image, and records the layers built by this one if
+	// it's not nil.
+	resumer *resumer
+	// reused provides the nydus blob layers built by the probing conversion
+	// of SkipIncompressibleThreshold if it's not nil, see
+	// probeIncompressible.
+	reused map[digest.Digest]digest.Digest
+
+	bottomOnce sync.Once
+	bottom     map[digest.Digest]bool
+	bottomErr  error
+
+	mutex sync.Mutex
+	// built records the content produced locally during conversion.
+	built map[digest.Digest]bool
+	// converted records the nydus blob layer built from each source layer.
+	converted map[digest.Digest]digest.Digest
+}
+
+type readerAt struct {
+	content.ReaderAt
+	release func()
+}
+
+func newStore(base content.Store, worker int, reporter *reporter) *store {
+	return &store{
+		Store:    base,
+		limiter:  semaphore.NewWeighted(int64(worker)),
+		reporter: reporter,
+		built:    map[digest.Digest]bool{},
+
+		converted: map[digest.Digest]digest.Digest{},
+	}
+}
+
+type writer struct {
+	content.Writer
+	store *store
+	// source is the source layer converted to the content, if any.
+	source digest.Digest
+}
+
+// Writer records the content without expected digest as built, the content
+// fetched from registry always has a descriptor with expected digest.
+func (s *store) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	w, err := s.Store.Writer(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var wOpts content.WriterOpts
+	for _, opt := range opts {
+		if err := opt(&wOpts); err != nil {
+			return nil, err
+		}
+	}
+	if wOpts.Desc.Digest != "" {
+		return w, nil
+	}
+	return &writer{Writer: w, store: s, source: convertedLayer(wOpts.Ref)}, nil
+}
+
+func (w *writer) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	err := w.Writer.Commit(ctx, size, expected, opts...)
+	if err != nil && !errdefs.IsAlreadyExists(err) {
+		return err
+	}
+	w.store.mutex.Lock()
+	w.store.built[w.Writer.Digest()] = true
+	if w.source != "" {
+		w.store.converted[w.source] = w.Writer.Digest()
+	}
+	w.store.mutex.Unlock()
+	if w.source != "" && w.store.resumer != nil {
+		if err := w.store.resumer.save(ctx, w.store.Store, w.source, w.Writer.Digest()); err != nil {
+			logrus.Warnf("failed to record layer %s in resume state: %s", w.source, err)
+		}
+	}
+	return err
+}
+
+func (s *store) isBuilt(dgst digest.Digest) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.built[dgst]
+}
+
+// isBottom returns true if the source layer is the lowest layer.
+func (s *store) isBottom(ctx context.Context, dgst digest.Digest) (bool, error) {
+	s.bottomOnce.Do(func() {
+		s.bottom, s.bottomErr = s.bottomLayers(ctx)
+	})
+	return s.bottom[dgst], s.bottomErr
+}
+
+func (s *store) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	// The nydus layers are read all together in bootstrap merge stage,
+	// so they must not be limited.
+	if !images.IsLayerType(desc.MediaType) || nydusify.IsNydusBlob(desc) || nydusify.IsNydusBootstrap(desc) {
+		return s.Store.ReaderAt(ctx, desc)
+	}
+
+	if err := s.limiter.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	ra, err := s.Store.ReaderAt(ctx, desc)
+	if err != nil {
+		s.limiter.Release(1)
+		return nil, err
+	}
+	if !s.isBuilt(desc.Digest) {
+		var write func(w io.Writer) error
+		if desc.Size == 0 {
+			write = emptyTar
+		}
+		if s.estargz && write == nil {
+			write = estargzTar(ra)
+		}
+		if s.reproducible {
+			if write == nil {
+				write = decompressTar(ra)
+			}
+			write = normalizeTar(write)
+		}
+		if s.owner != nil {
+			if write == nil {
+				write = decompressTar(ra)
+			}
+			write = overrideOwner(write, *s.owner)
+		}
+		if s.filter != nil {
+			if write == nil {
+				write = decompressTar(ra)
+			}
+			write = filterTar(write, s.filter)
+		}
+		if s.bottomLayers != nil {
+			isBottom, err := s.isBottom(ctx, desc.Digest)
+			if err != nil {
+				ra.Close()
+				s.limiter.Release(1)
+				return nil, errors.Wrap(err, "get bottom layers of source image")
+			}
+			if isBottom {
+				if write == nil {
+					write = decompressTar(ra)
+				}
+				write = dropWhiteouts(write)
+			}
+		}
+		if write != nil {
+			unpacked, err := newTarReaderAt(ra, write, s.tempDir)
+			if err != nil {
+				ra.Close()
+				s.limiter.Release(1)
+				return nil, errors.Wrapf(err, "read layer %s", desc.Digest)
+			}
+			ra = unpacked
+		}
+	}
+	s.reporter.report(PhaseBuildLayer, desc, 0)
+
+	var once sync.Once
+	return &readerAt{
+		ReaderAt: ra,
+		release: func() {
+			once.Do(func() {
+				s.limiter.Release(1)
+				s.reporter.report(PhaseBuildLayer, desc, desc.Size)
+			})
+		},
+	}, nil
+}
+
+func (ra *readerAt) Close() error {
+	defer ra.release()
+	return ra.ReaderAt.Close()
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeReaderAt struct {
+	content.ReaderAt
+	opened *int32
+}
+
+func (ra *fakeReaderAt) Close() error {
+	atomic.AddInt32(ra.opened, -1)
+	return nil
+}
+
+type fakeStore struct {
+	content.Store
+	opened    int32
+	maxOpened int32
+}
+
+func (s *fakeStore) ReaderAt(_ context.Context, _ ocispec.Descriptor) (content.ReaderAt, error) {
+	opened := atomic.AddInt32(&s.opened, 1)
+	for {
+		max := atomic.LoadInt32(&s.maxOpened)
+		if opened <= max || atomic.CompareAndSwapInt32(&s.maxOpened, max, opened) {
+			break
+		}
+	}
+	return &fakeReaderAt{opened: &s.opened}, nil
+}
+
+func TestStoreLimitsLayerReaders(t *testing.T) {
+	base := &fakeStore{}
+	s := newStore(base, 2, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ra, err := s.ReaderAt(context.Background(), ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+			})
+			require.NoError(t, err)
+			time.Sleep(10 * time.Millisecond)
+			require.NoError(t, ra.Close())
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(2), base.maxOpened)
+
+	// Non-layer content should not be limited.
+	var readers []content.ReaderAt
+	for i := 0; i < 3; i++ {
+		ra, err := s.ReaderAt(context.Background(), ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+		})
+		require.NoError(t, err)
+		readers = append(readers, ra)
+	}
+	require.Equal(t, int32(3), base.maxOpened)
+	for _, ra := range readers {
+		require.NoError(t, ra.Close())
+	}
+}
+
+func TestStoreReadsZeroByteLayerAsEmptyTar(t *testing.T) {
+	base, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	s := newStore(base, 1, nil)
+	ctx := context.Background()
+
+	desc := writeContent(t, s, ocispec.MediaTypeImageLayerGzip, []byte{}, true)
+	require.Equal(t, int64(0), desc.Size)
+	ra, err := s.ReaderAt(ctx, desc)
+	require.NoError(t, err)
+	defer ra.Close()
+
+	data, err := io.ReadAll(content.NewReader(ra))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), ra.Size())
+	_, err = tar.NewReader(bytes.NewReader(data)).Next()
+	require.Equal(t, io.EOF, err)
+}
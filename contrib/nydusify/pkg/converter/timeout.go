@@ -0,0 +1,128 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// killInterval is the interval to kill the builder subprocesses again after
+// timeout, since a new one may be started before the conversion stops.
+const killInterval = 100 * time.Millisecond
+
+// linkBuilder links the builder into the temp directory of conversion, the
+// link is used as the builder path of conversion, so that its subprocesses
+// can be told apart from the ones of other conversions in the same process.
+func linkBuilder(builderPath, dir string) (string, error) {
+	if builderPath == "" {
+		builderPath = "nydus-image"
+	}
+	path, err := exec.LookPath(builderPath)
+	if err != nil {
+		return "", errors.Wrap(err, "find builder")
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", errors.Wrap(err, "get absolute builder path")
+	}
+	link := filepath.Join(dir, "nydus-image")
+	if err := os.Symlink(path, link); err != nil {
+		return "", errors.Wrap(err, "link builder")
+	}
+	return link, nil
+}
+
+// builderProcesses returns the pids of the child processes started from the
+// builder path, they can only be found by procfs since the builder is executed
+// by nydus-snapshotter converter without the context of conversion.
+func builderProcesses(builderPath string) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	self := os.Getpid()
+	pids := []int{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The format is `pid (comm) state ppid ...`, and the comm may
+		// contain spaces or parentheses.
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) < 2 || fields[1] != strconv.Itoa(self) {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		if argv0, _, _ := bytes.Cut(cmdline, []byte{0}); string(argv0) == builderPath {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids
+}
+
+func killBuilders(builderPath string) {
+	for _, pid := range builderProcesses(builderPath) {
+		logrus.Warnf("killing builder process %d because of timeout", pid)
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			logrus.Warnf("kill builder process %d: %s", pid, err)
+		}
+	}
+}
+
+// killBuildersOnTimeout sends SIGKILL to the running builder subprocesses
+// once the deadline of ctx is exceeded, until the returned stop function is
+// called.
+func killBuildersOnTimeout(ctx context.Context, builderPath string) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+		if ctx.Err() != context.DeadlineExceeded {
+			return
+		}
+
+		ticker := time.NewTicker(killInterval)
+		defer ticker.Stop()
+		for {
+			killBuilders(builderPath)
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
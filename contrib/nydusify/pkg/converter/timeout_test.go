@@ -0,0 +1,217 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// envFakeBuilder makes the test binary act as a builder which supports
+// tar2rafs but hangs on building.
+const envFakeBuilder = "NYDUSIFY_TEST_FAKE_BUILDER"
+
+// envFakeBuilderArgs makes the fake builder write the arguments of building
+// line by line into the file before hanging.
+const envFakeBuilderArgs = "NYDUSIFY_TEST_FAKE_BUILDER_ARGS"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(envFakeTarBuilder); mode != "" {
+		os.Exit(fakeTarBuilder(mode, os.Args[1:]))
+	}
+	if os.Getenv(envFakeBuilder) != "" {
+		switch {
+		case len(os.Args) > 1 && os.Args[1] == "--version":
+			fmt.Println("Version: v2.2.0")
+		case len(os.Args) > 2 && os.Args[1] == "create" && os.Args[2] == "-h":
+			fmt.Println("--type tar-rafs")
+		default:
+			if argsPath := os.Getenv(envFakeBuilderArgs); argsPath != "" {
+				if err := os.WriteFile(argsPath, []byte(strings.Join(os.Args[1:], "\n")), 0644); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+			}
+			time.Sleep(time.Minute)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeSlowBuilder copies the sleep binary as the builder, which hangs until
+// being killed.
+func fakeSlowBuilder(t *testing.T) string {
+	sleepPath, err := exec.LookPath("sleep")
+	require.NoError(t, err)
+	data, err := os.ReadFile(sleepPath)
+	require.NoError(t, err)
+	builderPath := filepath.Join(t.TempDir(), "nydus-image")
+	require.NoError(t, os.WriteFile(builderPath, data, 0755))
+	return builderPath
+}
+
+func TestKillBuildersOnTimeout(t *testing.T) {
+	builderPath := fakeSlowBuilder(t)
+
+	cmd := exec.Command(builderPath, "60")
+	require.NoError(t, cmd.Start())
+	require.Eventually(t, func() bool {
+		return len(builderProcesses(builderPath)) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The builder started from the link of another conversion is kept.
+	otherPath, err := linkBuilder(builderPath, t.TempDir())
+	require.NoError(t, err)
+	other := exec.Command(otherPath, "60")
+	require.NoError(t, other.Start())
+	defer func() {
+		_ = other.Process.Kill()
+		_ = other.Wait()
+	}()
+	require.Eventually(t, func() bool {
+		return len(builderProcesses(otherPath)) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	stop := killBuildersOnTimeout(ctx, builderPath)
+	defer stop()
+
+	waited := make(chan error, 1)
+	go func() {
+		waited <- cmd.Wait()
+	}()
+	select {
+	case err := <-waited:
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "signal: killed")
+	case <-time.After(10 * time.Second):
+		_ = cmd.Process.Kill()
+		t.Fatal("builder process isn't killed after timeout")
+	}
+	require.Len(t, builderProcesses(otherPath), 1)
+}
+
+func TestKillBuildersWithoutTimeout(t *testing.T) {
+	builderPath := fakeSlowBuilder(t)
+
+	cmd := exec.Command(builderPath, "60")
+	require.NoError(t, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	// The builder isn't killed if the conversion completes before timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	stop := killBuildersOnTimeout(ctx, builderPath)
+	stop()
+	cancel()
+	time.Sleep(2 * killInterval)
+	require.Len(t, builderProcesses(builderPath), 1)
+}
+
+func TestLinkBuilder(t *testing.T) {
+	builderPath := fakeSlowBuilder(t)
+
+	dir := t.TempDir()
+	link, err := linkBuilder(builderPath, dir)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "nydus-image"), link)
+	target, err := os.Readlink(link)
+	require.NoError(t, err)
+	require.Equal(t, builderPath, target)
+
+	// Failure situation
+	_, err = linkBuilder(filepath.Join(t.TempDir(), "non-existent"), t.TempDir())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "find builder")
+}
+
+// writeBlob writes the blob into OCI image layout directory.
+func writeBlob(t *testing.T, dir, mediaType string, data []byte) ocispec.Descriptor {
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	path := filepath.Join(dir, ocispec.ImageBlobsDir, desc.Digest.Algorithm().String(), desc.Digest.Hex())
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	return desc
+}
+
+// makeLayout makes the OCI image layout directory of image with one layer
+// for the platform of host.
+func makeLayout(t *testing.T, names ...string) string {
+	dir := t.TempDir()
+
+	layer := makeLayer(t, names...)
+	diffID := bytes.Buffer{}
+	tw := tar.NewWriter(&diffID)
+	for _, name := range names {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}))
+	}
+	require.NoError(t, tw.Close())
+
+	config, err := json.Marshal(ocispec.Image{
+		Platform: ocispec.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH},
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(diffID.Bytes())}},
+	})
+	require.NoError(t, err)
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    writeBlob(t, dir, ocispec.MediaTypeImageConfig, config),
+		Layers:    []ocispec.Descriptor{writeBlob(t, dir, ocispec.MediaTypeImageLayerGzip, layer)},
+	})
+	require.NoError(t, err)
+	index, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{writeBlob(t, dir, ocispec.MediaTypeImageManifest, manifest)},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ocispec.ImageIndexFile), index, 0644))
+	layout, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ocispec.ImageLayoutFile), layout, 0644))
+
+	return dir
+}
+
+func TestConvertTimeout(t *testing.T) {
+	executable, err := os.Executable()
+	require.NoError(t, err)
+	t.Setenv(envFakeBuilder, "1")
+
+	start := time.Now()
+	_, err = Convert(context.Background(), Opt{
+		WorkDir:        t.TempDir(),
+		NydusImagePath: executable,
+		SourcePath:     makeLayout(t, "foo"),
+		TargetPath:     t.TempDir(),
+		Timeout:        time.Second,
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "conversion timeout after 1s")
+	// The conversion returns once the hanging builder is killed.
+	require.Less(t, time.Since(start), 30*time.Second)
+}
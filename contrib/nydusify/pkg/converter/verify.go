@@ -0,0 +1,195 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference/docker"
+	accelerrdefs "github.com/goharbor/acceleration-service/pkg/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+// maxSignaturePayloadSize limits the simple signing payload read from
+// registry, which is a small JSON document.
+const maxSignaturePayloadSize = 1 << 20
+
+// loadVerifyKey loads the ECDSA public key in PEM format, like the
+// `cosign.pub` generated by `cosign generate-key-pair`.
+func loadVerifyKey(path string) (*ecdsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read verify key")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("invalid verify key %s, should be a public key in PEM format", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse verify key")
+	}
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported verify key %T, should be an ECDSA key", key)
+	}
+	return ecdsaKey, nil
+}
+
+// verifyPayload verifies the base64 encoded signature of the simple signing
+// payload with key, and the payload must be signed for manifestDigest.
+func verifyPayload(key *ecdsa.PublicKey, payload []byte, signature string, manifestDigest digest.Digest) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.Wrap(err, "decode signature")
+	}
+	hash := sha256.Sum256(payload)
+	if !ecdsa.VerifyASN1(key, hash[:], sig) {
+		return fmt.Errorf("signature mismatched with verify key")
+	}
+
+	var signing simpleSigning
+	if err := json.Unmarshal(payload, &signing); err != nil {
+		return errors.Wrap(err, "unmarshal signature payload")
+	}
+	if signing.Critical.Type != signatureType {
+		return fmt.Errorf("unsupported signature type %s", signing.Critical.Type)
+	}
+	if signing.Critical.Image.DockerManifestDigest != manifestDigest.String() {
+		return fmt.Errorf("signature is for %s, expected %s", signing.Critical.Image.DockerManifestDigest, manifestDigest)
+	}
+	return nil
+}
+
+// fetchVerifiedSource resolves the source image and verifies it by the
+// signatures pushed with cosign tag into the source repository, any of the
+// signatures verified with key is accepted. It returns the digest of the
+// verified source image.
+func fetchVerifiedSource(ctx context.Context, pvd *provider.Provider, key *ecdsa.PublicKey, source string) (digest.Digest, error) {
+	sourceNamed, err := docker.ParseDockerRef(source)
+	if err != nil {
+		return "", errors.Wrap(err, "parse source reference")
+	}
+	resolver, err := pvd.Resolver(source)
+	if err != nil {
+		return "", err
+	}
+	_, sourceDesc, err := resolver.Resolve(ctx, sourceNamed.String())
+	if err != nil {
+		return "", errors.Wrap(err, "resolve source image")
+	}
+
+	ref := fmt.Sprintf("%s:%s", docker.TrimNamed(sourceNamed).String(), signatureTag(sourceDesc.Digest))
+	_, data, err := provider.FetchBytes(ctx, resolver, ref)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return "", fmt.Errorf("no signature found for source image %s", sourceDesc.Digest)
+		}
+		return "", errors.Wrap(err, "fetch signature manifest")
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return "", errors.Wrap(err, "unmarshal signature manifest")
+	}
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+
+	var verifyErr error
+	for _, layer := range manifest.Layers {
+		signature, ok := layer.Annotations[annotationCosignSignature]
+		if !ok || layer.MediaType != mediaTypeSimpleSigning {
+			continue
+		}
+		reader, err := fetcher.Fetch(ctx, layer)
+		if err != nil {
+			return "", errors.Wrap(err, "fetch signature payload")
+		}
+		payload, err := io.ReadAll(io.LimitReader(reader, maxSignaturePayloadSize))
+		reader.Close()
+		if err != nil {
+			return "", errors.Wrap(err, "read signature payload")
+		}
+		if verifyErr = verifyPayload(key, payload, signature, sourceDesc.Digest); verifyErr == nil {
+			return sourceDesc.Digest, nil
+		}
+	}
+
+	if verifyErr == nil {
+		return "", fmt.Errorf("no signature found for source image %s", sourceDesc.Digest)
+	}
+	return "", errors.Wrapf(verifyErr, "verify signature of source image %s", sourceDesc.Digest)
+}
+
+// verifySource verifies the signature of source image before pulling it,
+// and retries with plain HTTP if needed. It returns the digest of the
+// verified source image, the pulled source must be of the same digest.
+func verifySource(ctx context.Context, pvd *provider.Provider, keyPath, source string) (digest.Digest, error) {
+	key, err := loadVerifyKey(keyPath)
+	if err != nil {
+		return "", err
+	}
+
+	logrus.Infof("verifying signature of image %s", source)
+	verified, err := fetchVerifiedSource(ctx, pvd, key, source)
+	if err != nil {
+		if !accelerrdefs.NeedsRetryWithHTTP(err) {
+			return "", err
+		}
+		pvd.UsePlainHTTP()
+		if verified, err = fetchVerifiedSource(ctx, pvd, key, source); err != nil {
+			return "", err
+		}
+	}
+	logrus.Infof("verified signature of image %s", source)
+
+	return verified, nil
+}
+
+// verifiedSourceHook wraps hook to check the source image pulled is the
+// verified one before pushing target, since the tag may be moved to another
+// image after verification.
+func verifiedSourceHook(pvd *provider.Provider, hook provider.ImageHook, source, target string, verified digest.Digest) (provider.ImageHook, error) {
+	sourceNamed, err := docker.ParseDockerRef(source)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse source reference")
+	}
+	targetNamed, err := docker.ParseDockerRef(target)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse target reference")
+	}
+
+	return func(ctx context.Context, desc ocispec.Descriptor, ref string) (*ocispec.Descriptor, error) {
+		if ref == targetNamed.String() {
+			sourceDesc, err := pvd.Image(ctx, sourceNamed.String())
+			if err != nil {
+				return nil, errors.Wrap(err, "get source image")
+			}
+			if sourceDesc.Digest != verified {
+				return nil, fmt.Errorf("source image %s is pulled, but %s is verified", sourceDesc.Digest, verified)
+			}
+		}
+		if hook == nil {
+			return &desc, nil
+		}
+		return hook(ctx, desc, ref)
+	}, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+// signatureRegistry serves the manifests and blobs of repository `foo` by
+// path, like `manifests/latest` and `blobs/sha256:<hex>`.
+type signatureRegistry map[string][]byte
+
+func (r signatureRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data, ok := r[strings.TrimPrefix(req.URL.Path, "/v2/foo/")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if strings.HasPrefix(req.URL.Path, "/v2/foo/manifests/") {
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(data).String())
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		_, _ = w.Write(data)
+	}
+}
+
+func (r signatureRegistry) addManifest(t *testing.T, tag string, manifest ocispec.Manifest) digest.Digest {
+	data, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	dgst := digest.FromBytes(data)
+	r["manifests/"+tag] = data
+	r["manifests/"+dgst.String()] = data
+	return dgst
+}
+
+// addSignature signs the manifest of dgst with key, like `cosign sign`.
+func (r signatureRegistry) addSignature(t *testing.T, key *ecdsa.PrivateKey, dgst digest.Digest) {
+	payload, signature, err := signManifest(key, "localhost/foo", dgst)
+	require.NoError(t, err)
+	layer := ocispec.Descriptor{
+		MediaType:   mediaTypeSimpleSigning,
+		Digest:      digest.FromBytes(payload),
+		Size:        int64(len(payload)),
+		Annotations: map[string]string{annotationCosignSignature: signature},
+	}
+	r["blobs/"+layer.Digest.String()] = payload
+	r.addManifest(t, signatureTag(dgst), ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+}
+
+func writePublicKey(t *testing.T, path string, key *ecdsa.PrivateKey) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	}), 0644))
+}
+
+func TestVerifySource(t *testing.T) {
+	ctx := context.Background()
+	registry := signatureRegistry{}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "cosign.pub")
+	writePublicKey(t, keyPath, key)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	signed := registry.addManifest(t, "signed", ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Annotations: map[string]string{
+			"name": "signed",
+		},
+	})
+	registry.addSignature(t, key, signed)
+	unsigned := registry.addManifest(t, "unsigned", ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+	})
+	foreign := registry.addManifest(t, "foreign", ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Annotations: map[string]string{
+			"name": "foreign",
+		},
+	})
+	registry.addSignature(t, otherKey, foreign)
+
+	verify := func(tag string) (digest.Digest, error) {
+		source := host + "/foo:" + tag
+		pvd, err := provider.New(t.TempDir(), hosts(Opt{Source: source, SourceInsecure: true}), 0, "", platforms.All, 0)
+		require.NoError(t, err)
+		pvd.UsePlainHTTP()
+		return verifySource(ctx, pvd, keyPath, source)
+	}
+
+	verified, err := verify("signed")
+	require.NoError(t, err)
+	require.Equal(t, signed, verified)
+
+	// Failure situation
+	_, err = verify("unsigned")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no signature found for source image "+unsigned.String())
+
+	_, err = verify("foreign")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "signature mismatched with verify key")
+
+	// The signature of another image isn't accepted.
+	registry["manifests/"+signatureTag(unsigned)] = registry["manifests/"+signatureTag(signed)]
+	_, err = verify("unsigned")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "signature is for "+signed.String())
+
+	_, err = loadVerifyKey(filepath.Join(t.TempDir(), "missing.pub"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "read verify key")
+}
@@ -0,0 +1,57 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"net/http"
+)
+
+// authHeaders are the headers never overridden by the static headers, which
+// are set by the authorizer for each request.
+var authHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+}
+
+type headerTransport struct {
+	wrappedTransport
+	userAgent string
+	headers   http.Header
+}
+
+// NewHeaderTransport wraps the round tripper to set the User-Agent and the
+// static headers of option on every request, including the token requests
+// of authorizer, it returns the base round tripper directly if neither is
+// specified. The authorization headers are never overridden.
+func NewHeaderTransport(base http.RoundTripper, opt RemoteOpt) http.RoundTripper {
+	headers := http.Header{}
+	for key, value := range opt.Headers {
+		key = http.CanonicalHeaderKey(key)
+		if !authHeaders[key] {
+			headers.Set(key, value)
+		}
+	}
+	if opt.UserAgent == "" && len(headers) == 0 {
+		return base
+	}
+	return &headerTransport{
+		wrappedTransport: wrappedTransport{base},
+		userAgent:        opt.UserAgent,
+		headers:          headers,
+	}
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The request can't be modified by round tripper, clone it before
+	// setting the headers.
+	req = req.Clone(req.Context())
+	for key, values := range t.headers {
+		req.Header[key] = values
+	}
+	if t.userAgent != "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderTransport(t *testing.T) {
+	manifest := []byte("{}")
+	blob := []byte("blob data")
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+
+	var mutex sync.Mutex
+	requests := map[string]http.Header{}
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The registry requires basic auth, so the credential must be kept.
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "password" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mutex.Lock()
+		requests[r.Method+" "+r.URL.Path] = r.Header.Clone()
+		mutex.Unlock()
+		switch r.URL.Path {
+		case "/v2/library/nginx/manifests/latest":
+			w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+			w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest).String())
+			w.Header().Set("Content-Length", fmt.Sprint(len(manifest)))
+		case fmt.Sprintf("/v2/library/nginx/blobs/%s", desc.Digest):
+			_, _ = w.Write(blob)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer registry.Close()
+
+	ref := fmt.Sprintf("%s/library/nginx:latest", registry.Listener.Addr().String())
+	remote, err := withRemote(ref, true, func(string) (string, string, error) {
+		return "user", "password", nil
+	}, RemoteOpt{
+		UserAgent: "nydusify-test/1.0",
+		Headers: map[string]string{
+			"x-tenant":      "tenant-1",
+			"Authorization": "Bearer overridden",
+		},
+	})
+	require.NoError(t, err)
+	defer remote.Close()
+	remote.MaybeWithHTTP(fmt.Errorf("http: server gave HTTP response to HTTPS client: https://%s/", registry.Listener.Addr().String()))
+
+	_, err = remote.Resolve(context.Background())
+	require.NoError(t, err)
+	reader, err := remote.Pull(context.Background(), desc, true)
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, blob, data)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, key := range []string{
+		"HEAD /v2/library/nginx/manifests/latest",
+		fmt.Sprintf("GET /v2/library/nginx/blobs/%s", desc.Digest),
+	} {
+		header, ok := requests[key]
+		require.True(t, ok, key)
+		require.Equal(t, "nydusify-test/1.0", header.Get("User-Agent"), key)
+		require.Equal(t, "tenant-1", header.Get("X-Tenant"), key)
+	}
+
+	// No transport is wrapped without any header.
+	require.Equal(t, http.DefaultTransport, NewHeaderTransport(http.DefaultTransport, RemoteOpt{}))
+	require.Equal(t, http.DefaultTransport, NewHeaderTransport(http.DefaultTransport, RemoteOpt{
+		Headers: map[string]string{"authorization": "Bearer overridden"},
+	}))
+}
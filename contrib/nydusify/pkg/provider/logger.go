@@ -6,6 +6,9 @@ package provider
 
 import (
 	"context"
+	"encoding/json"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -39,3 +42,70 @@ func (logger *defaultLogger) Log(_ context.Context, msg string, fields LoggerFie
 func DefaultLogger() (ProgressLogger, error) {
 	return &defaultLogger{}, nil
 }
+
+// The phases of the events logged by JSONLogger.
+const (
+	LogPhaseStart  = "start"
+	LogPhaseFinish = "finish"
+)
+
+// LogEvent is the JSON object of each line written by JSONLogger.
+type LogEvent struct {
+	Level     string    `json:"level"`
+	Timestamp time.Time `json:"timestamp"`
+	// Phase is LogPhaseStart when the step starts, or LogPhaseFinish when
+	// it finishes.
+	Phase   string       `json:"phase"`
+	Message string       `json:"message"`
+	Fields  LoggerFields `json:"fields,omitempty"`
+	// Duration is the time the step takes, only for LogPhaseFinish.
+	Duration string `json:"duration,omitempty"`
+	// Error is the failure of the step, only for LogPhaseFinish.
+	Error string `json:"error,omitempty"`
+}
+
+type jsonLogger struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+func (logger *jsonLogger) write(event LogEvent) {
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	if err := logger.encoder.Encode(event); err != nil {
+		logrus.Warnf("failed to write log event: %s", err)
+	}
+}
+
+func (logger *jsonLogger) Log(_ context.Context, msg string, fields LoggerFields) func(err error) error {
+	start := time.Now()
+	logger.write(LogEvent{
+		Level:     logrus.InfoLevel.String(),
+		Timestamp: start,
+		Phase:     LogPhaseStart,
+		Message:   msg,
+		Fields:    fields,
+	})
+	return func(err error) error {
+		event := LogEvent{
+			Level:     logrus.InfoLevel.String(),
+			Timestamp: time.Now(),
+			Phase:     LogPhaseFinish,
+			Message:   msg,
+			Fields:    fields,
+			Duration:  time.Since(start).String(),
+		}
+		if err != nil {
+			event.Level = logrus.ErrorLevel.String()
+			event.Error = err.Error()
+		}
+		logger.write(event)
+		return err
+	}
+}
+
+// JSONLogger provides a logger writing one LogEvent in JSON per line to w,
+// which can be used in place of DefaultLogger for log aggregators.
+func JSONLogger(w io.Writer) (ProgressLogger, error) {
+	return &jsonLogger{encoder: json.NewEncoder(w)}, nil
+}
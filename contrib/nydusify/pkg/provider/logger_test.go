@@ -0,0 +1,64 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONLogger(t *testing.T) {
+	buf := bytes.Buffer{}
+	logger, err := JSONLogger(&buf)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	before := time.Now()
+	require.NoError(t, logger.Log(ctx, "pull image", LoggerFields{"Ref": "foo:latest"})(nil))
+	require.EqualError(t, logger.Log(ctx, "push image", nil)(fmt.Errorf("unauthorized")), "unauthorized")
+
+	// Each line is a JSON object of the schema.
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	require.Len(t, lines, 4)
+	for _, line := range lines {
+		for _, key := range []string{"level", "timestamp", "phase", "message"} {
+			require.Contains(t, line, key)
+		}
+		timestamp, err := time.Parse(time.RFC3339Nano, line["timestamp"].(string))
+		require.NoError(t, err)
+		require.False(t, timestamp.Before(before.Truncate(time.Second)))
+	}
+
+	require.Equal(t, "info", lines[0]["level"])
+	require.Equal(t, LogPhaseStart, lines[0]["phase"])
+	require.Equal(t, "pull image", lines[0]["message"])
+	require.Equal(t, map[string]interface{}{"Ref": "foo:latest"}, lines[0]["fields"])
+	require.NotContains(t, lines[0], "duration")
+
+	require.Equal(t, "info", lines[1]["level"])
+	require.Equal(t, LogPhaseFinish, lines[1]["phase"])
+	require.Contains(t, lines[1], "duration")
+	require.NotContains(t, lines[1], "error")
+
+	require.Equal(t, LogPhaseStart, lines[2]["phase"])
+	require.NotContains(t, lines[2], "fields")
+	require.Equal(t, "error", lines[3]["level"])
+	require.Equal(t, LogPhaseFinish, lines[3]["phase"])
+	require.Equal(t, "push image", lines[3]["message"])
+	require.Equal(t, "unauthorized", lines[3]["error"])
+}
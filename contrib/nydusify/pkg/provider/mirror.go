@@ -0,0 +1,91 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/containerd/containerd/remotes/docker"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/remote"
+)
+
+// Mirror is a read-only mirror of the registry.
+type Mirror struct {
+	// Host is the mirror address in format `[scheme://]host[:port][/path]`,
+	// the scheme defaults to https.
+	Host string
+	// Insecure skips verifying server certs for the HTTPS mirror.
+	Insecure bool
+}
+
+func parseMirror(mirror Mirror) (*url.URL, error) {
+	host := mirror.Host
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	parsed, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %s", parsed.Scheme)
+	}
+	if parsed.Host == "" {
+		return nil, fmt.Errorf("empty host")
+	}
+	parsed.Path = strings.TrimSuffix(parsed.Path, "/")
+	if !strings.HasSuffix(parsed.Path, "/v2") {
+		parsed.Path += "/v2"
+	}
+	return parsed, nil
+}
+
+// withMirrors puts the mirror hosts before the origin hosts, the mirrors are
+// only used to pull and resolve, and the push always goes to origin. The
+// fetcher and resolver of containerd try the next host on any failed request,
+// not only on 404 but also on auth, TLS and 5xx errors, the first error is
+// returned if all the hosts fail.
+func withMirrors(origin docker.RegistryHosts, mirrors []Mirror, credFunc withCredentialFunc, clients *clientPool) docker.RegistryHosts {
+	return func(host string) ([]docker.RegistryHost, error) {
+		originHosts, err := origin(host)
+		if err != nil {
+			return nil, err
+		}
+
+		hosts := []docker.RegistryHost{}
+		for _, mirror := range mirrors {
+			parsed, err := parseMirror(mirror)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mirror %s: %w", mirror.Host, err)
+			}
+			client := clients.get(mirror.Insecure)
+			hosts = append(hosts, docker.RegistryHost{
+				Client: client,
+				Authorizer: docker.NewDockerAuthorizer(
+					docker.WithAuthClient(client),
+					docker.WithAuthCreds(credFunc),
+				),
+				Host:         parsed.Host,
+				Scheme:       parsed.Scheme,
+				Path:         parsed.Path,
+				Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve,
+			})
+		}
+
+		return append(hosts, originHosts...), nil
+	}
+}
+
+// DefaultRemoteWithMirrors creates a remote instance like DefaultRemote, the
+// pull and resolve requests are sent to the mirrors in order before falling
+// back to the origin registry. The mirrors are given as Mirror rather than
+// plain host strings, so that each mirror has its own insecure flag apart
+// from the origin.
+func DefaultRemoteWithMirrors(ref string, insecure bool, mirrors []Mirror) (*remote.Remote, error) {
+	return DefaultRemoteWithOpt(ref, insecure, RemoteOpt{Mirrors: mirrors})
+}
@@ -0,0 +1,138 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultRemoteWithMirrors(t *testing.T) {
+	blob := []byte("blob data")
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	served := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != fmt.Sprintf("/v2/library/nginx/blobs/%s", desc.Digest) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(blob)
+	}))
+	defer served.Close()
+
+	// The origin host is unreachable, so the blob can only be served by mirror.
+	remote, err := DefaultRemoteWithMirrors("127.0.0.1:1/library/nginx:latest", false, []Mirror{
+		{Host: notFound.URL},
+		{Host: served.URL},
+	})
+	require.NoError(t, err)
+
+	reader, err := remote.Pull(context.Background(), desc, true)
+	require.NoError(t, err)
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, blob, data)
+}
+
+func TestWithMirrors(t *testing.T) {
+	origin := docker.ConfigureDefaultRegistries()
+	hosts, err := withMirrors(origin, []Mirror{
+		{Host: "mirror1.example.com"},
+		{Host: "http://mirror2.example.com:5000/proxy", Insecure: true},
+	}, nil, newClientPool(RemoteOpt{}))("example.com")
+	require.NoError(t, err)
+	require.Len(t, hosts, 3)
+
+	require.Equal(t, "https", hosts[0].Scheme)
+	require.Equal(t, "mirror1.example.com", hosts[0].Host)
+	require.Equal(t, "/v2", hosts[0].Path)
+	require.Equal(t, "http", hosts[1].Scheme)
+	require.Equal(t, "mirror2.example.com:5000", hosts[1].Host)
+	require.Equal(t, "/proxy/v2", hosts[1].Path)
+	for _, host := range hosts[:2] {
+		require.False(t, host.Capabilities.Has(docker.HostCapabilityPush))
+	}
+	// Push always goes to origin
+	require.Equal(t, "example.com", hosts[2].Host)
+	require.True(t, hosts[2].Capabilities.Has(docker.HostCapabilityPush))
+
+	// Failure situation
+	_, err = withMirrors(origin, []Mirror{{Host: "ftp://mirror.example.com"}}, nil, newClientPool(RemoteOpt{}))("example.com")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid mirror")
+}
+
+func TestMirrorFallbackOnFailure(t *testing.T) {
+	blob := []byte("blob data")
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+	manifest := []byte(`{"schemaVersion":2}`)
+
+	serverError := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer serverError.Close()
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mirror"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer unauthorized.Close()
+	// The cert of TLS server isn't trusted without insecure.
+	untrusted := httptest.NewTLSServer(http.NotFoundHandler())
+	defer untrusted.Close()
+	served := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case fmt.Sprintf("/v2/library/nginx/blobs/%s", desc.Digest):
+			_, _ = w.Write(blob)
+		case "/v2/library/nginx/manifests/latest":
+			w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+			w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest).String())
+			w.Header().Set("Content-Length", fmt.Sprint(len(manifest)))
+			_, _ = w.Write(manifest)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer served.Close()
+
+	remote, err := DefaultRemoteWithMirrors("127.0.0.1:1/library/nginx:latest", false, []Mirror{
+		{Host: serverError.URL},
+		{Host: unauthorized.URL},
+		{Host: untrusted.URL},
+		{Host: served.URL},
+	})
+	require.NoError(t, err)
+
+	// The failed mirrors are skipped for both pull and resolve.
+	reader, err := remote.Pull(context.Background(), desc, true)
+	require.NoError(t, err)
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, blob, data)
+
+	resolved, err := remote.Resolve(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, digest.FromBytes(manifest), resolved.Digest)
+}
@@ -6,25 +6,127 @@ package provider
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
 	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/credentials"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/remote"
 )
 
-func newDefaultClient(skipTLSVerify bool) *http.Client {
+// RemoteOpt configures the requests sent to remote registry.
+type RemoteOpt struct {
+	// RetryCount is the max number of retries for a failed request,
+	// zero means no retry.
+	RetryCount int
+	// RetryDelay is the initial delay of exponential backoff between
+	// retries, defaults to 1s.
+	RetryDelay time.Duration
+	// RequestTimeout is the deadline of each request like manifest get,
+	// blob head and blob chunk push, a timed out request is retried per
+	// the retry policy, zero means no limit.
+	RequestTimeout time.Duration
+	// Mirrors are tried in order to pull and resolve before the origin
+	// registry.
+	Mirrors []Mirror
+	// ProxyURL is the HTTP/HTTPS proxy for the requests, the proxy
+	// specified by HTTP_PROXY/HTTPS_PROXY/NO_PROXY envs is used if empty.
+	ProxyURL string
+	// CACertPath is the PEM encoded CA certs file trusted in addition to
+	// the system cert pool, usually used for proxy or private registry.
+	CACertPath string
+	// ClientCertPath and ClientKeyPath are the PEM encoded client cert and
+	// key presented to the registry requiring mutual TLS.
+	ClientCertPath string
+	ClientKeyPath  string
+	// SkipTLSVerify skips verifying the registry cert, it's implied by the
+	// insecure argument of DefaultRemoteWithOpt.
+	SkipTLSVerify bool
+	// MaxUploadBytesPerSec limits the total throughput of blob uploads
+	// shared across the concurrent pushes, zero means no limit.
+	MaxUploadBytesPerSec int64
+	// UserAgent replaces the generic User-Agent of requests if not empty,
+	// and Headers are the static headers set on every request, for example
+	// to route or audit the requests by registry. The authorization headers
+	// in Headers are ignored.
+	UserAgent string
+	Headers   map[string]string
+
+	proxy         func(*http.Request) (*url.URL, error)
+	rootCAs       *x509.CertPool
+	certificates  []tls.Certificate
+	uploadLimiter *rate.Limiter
+}
+
+// Prepare parses the proxy and TLS options and creates the upload limiter
+// for creating HTTP clients by NewClient, the clients created from the same
+// prepared option share the upload limiter.
+func (opt *RemoteOpt) Prepare() error {
+	opt.proxy = http.ProxyFromEnvironment
+	if opt.ProxyURL != "" {
+		proxyURL, err := url.Parse(opt.ProxyURL)
+		if err != nil {
+			return errors.Wrapf(err, "parse proxy url %s", opt.ProxyURL)
+		}
+		opt.proxy = http.ProxyURL(proxyURL)
+	}
+
+	if opt.CACertPath != "" {
+		certs, err := os.ReadFile(opt.CACertPath)
+		if err != nil {
+			return errors.Wrap(err, "read CA certs file")
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(certs) {
+			return fmt.Errorf("no valid CA certs found in %s", opt.CACertPath)
+		}
+		opt.rootCAs = pool
+	}
+
+	if opt.ClientCertPath != "" || opt.ClientKeyPath != "" {
+		if opt.ClientCertPath == "" || opt.ClientKeyPath == "" {
+			return fmt.Errorf("both client cert and key are required for mutual TLS")
+		}
+		cert, err := tls.LoadX509KeyPair(opt.ClientCertPath, opt.ClientKeyPath)
+		if err != nil {
+			return errors.Wrap(err, "load client cert and key")
+		}
+		opt.certificates = []tls.Certificate{cert}
+	}
+
+	opt.uploadLimiter = newUploadLimiter(opt.MaxUploadBytesPerSec)
+
+	return nil
+}
+
+// NewClient creates the HTTP client for registry requests, the transports
+// like retry, timeout and upload throttle are configured by the option
+// prepared by Prepare.
+func NewClient(skipTLSVerify bool, opt RemoteOpt) *http.Client {
+	proxy := opt.proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
 	return &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
+		Transport: NewUploadAbortTransport(NewRetryTransport(NewTimeoutTransport(newThrottleTransport(NewHeaderTransport(&http.Transport{
+			Proxy: proxy,
 			DialContext: (&net.Dialer{
 				Timeout:   30 * time.Second,
 				KeepAlive: 30 * time.Second,
@@ -34,49 +136,131 @@ func newDefaultClient(skipTLSVerify bool) *http.Client {
 			IdleConnTimeout:       30 * time.Second,
 			TLSHandshakeTimeout:   10 * time.Second,
 			ExpectContinueTimeout: 5 * time.Second,
-			DisableKeepAlives:     true,
 			TLSNextProto:          make(map[string]func(authority string, c *tls.Conn) http.RoundTripper),
 			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: skipTLSVerify,
+				InsecureSkipVerify: skipTLSVerify || opt.SkipTLSVerify,
+				RootCAs:            opt.rootCAs,
+				Certificates:       opt.certificates,
 			},
-		},
+		}, opt), opt.uploadLimiter), opt.RequestTimeout), opt)),
+	}
+}
+
+// wrappedTransport is embedded by the round trippers wrapping a base round
+// tripper, which forwards closing idle connections to the base so that the
+// connections can be released through the whole chain.
+type wrappedTransport struct {
+	base http.RoundTripper
+}
+
+// CloseIdleConnections closes the idle connections of base round tripper.
+func (t wrappedTransport) CloseIdleConnections() {
+	if base, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		base.CloseIdleConnections()
 	}
 }
 
+// clientPool shares the HTTP clients among the resolvers created for a
+// remote, so that their connections can be released on closing the remote.
+type clientPool struct {
+	mutex   sync.Mutex
+	opt     RemoteOpt
+	clients map[bool]*http.Client
+}
+
+func newClientPool(opt RemoteOpt) *clientPool {
+	return &clientPool{
+		opt:     opt,
+		clients: map[bool]*http.Client{},
+	}
+}
+
+// get returns the client with or without TLS verification.
+func (pool *clientPool) get(skipTLSVerify bool) *http.Client {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if client, ok := pool.clients[skipTLSVerify]; ok {
+		return client
+	}
+	client := NewClient(skipTLSVerify, pool.opt)
+	pool.clients[skipTLSVerify] = client
+	return client
+}
+
+// close closes the idle connections of all clients.
+func (pool *clientPool) close() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, client := range pool.clients {
+		client.CloseIdleConnections()
+	}
+	pool.clients = map[bool]*http.Client{}
+}
+
 // withCredentialFunc accepts host url parameter and returns with
 // username, password and error.
 type withCredentialFunc = func(string) (string, string, error)
 
 // withRemote creates a remote instance, it uses the implementation of containerd
 // docker remote to access image from remote registry.
-func withRemote(ref string, insecure bool, credFunc withCredentialFunc) (*remote.Remote, error) {
+func withRemote(ref string, insecure bool, credFunc withCredentialFunc, opt RemoteOpt) (*remote.Remote, error) {
+	if err := opt.Prepare(); err != nil {
+		return nil, err
+	}
+
+	clients := newClientPool(opt)
 	resolverFunc := func(retryWithHTTP bool) remotes.Resolver {
 		registryHosts := docker.ConfigureDefaultRegistries(
 			docker.WithAuthorizer(
 				docker.NewDockerAuthorizer(
-					docker.WithAuthClient(newDefaultClient(insecure)),
+					docker.WithAuthClient(clients.get(insecure)),
 					docker.WithAuthCreds(credFunc),
 				),
 			),
-			docker.WithClient(newDefaultClient(insecure)),
+			docker.WithClient(clients.get(insecure)),
 			docker.WithPlainHTTP(func(_ string) (bool, error) {
 				return retryWithHTTP, nil
 			}),
 		)
+		if len(opt.Mirrors) > 0 {
+			registryHosts = withMirrors(registryHosts, opt.Mirrors, credFunc, clients)
+		}
 
 		return docker.NewResolver(docker.ResolverOptions{
 			Hosts: registryHosts,
 		})
 	}
 
-	return remote.New(ref, resolverFunc)
+	remoter, err := remote.New(ref, resolverFunc)
+	if err != nil {
+		return nil, err
+	}
+	// The credential helpers are executed per request without long-lived
+	// state, so only the connections need to be released.
+	remoter.SetCloseFunc(clients.close)
+
+	return remoter, nil
 }
 
 // DefaultRemote creates a remote instance, it attempts to read docker auth config
 // file `$DOCKER_CONFIG/config.json` to communicate with remote registry, `$DOCKER_CONFIG`
 // defaults to `~/.docker`.
 func DefaultRemote(ref string, insecure bool) (*remote.Remote, error) {
-	return withRemote(ref, insecure, func(host string) (string, string, error) {
+	return DefaultRemoteWithOpt(ref, insecure, RemoteOpt{})
+}
+
+// DefaultRemoteWithOpt creates a remote instance like DefaultRemote, the
+// requests to remote registry are configured by the specified option.
+func DefaultRemoteWithOpt(ref string, insecure bool, opt RemoteOpt) (*remote.Remote, error) {
+	return withRemote(ref, insecure, NewDockerConfigCredFunc(), opt)
+}
+
+// NewDockerConfigCredFunc returns a credential function which reads auth from
+// docker config file, the credential helper specified by `credHelpers` for the
+// registry takes precedence over the global `credsStore`, and it falls back to
+// the static auth in `auths` if the helper fails or has no credential.
+func NewDockerConfigCredFunc() withCredentialFunc {
+	return func(host string) (string, string, error) {
 		// The host of docker hub image will be converted to `registry-1.docker.io` in:
 		// github.com/containerd/containerd/remotes/docker/registry.go
 		// But we need use the key `https://index.docker.io/v1/` to find auth from docker config.
@@ -86,12 +270,22 @@ func DefaultRemote(ref string, insecure bool) (*remote.Remote, error) {
 
 		config := dockerconfig.LoadDefaultConfigFile(os.Stderr)
 		authConfig, err := config.GetAuthConfig(host)
-		if err != nil {
-			return "", "", err
+		if err != nil || (authConfig.Username == "" && authConfig.Password == "") {
+			staticConfig, staticErr := credentials.NewFileStore(config).Get(host)
+			if staticErr != nil {
+				if err != nil {
+					return "", "", err
+				}
+				return "", "", staticErr
+			}
+			if err != nil {
+				logrus.Warnf("Fallback to static auth for %s due to credential helper error: %s", host, err)
+			}
+			authConfig = staticConfig
 		}
 
 		return authConfig.Username, authConfig.Password, nil
-	})
+	}
 }
 
 // DefaultRemoteWithAuth creates a remote instance, it parses base64 encoded auth string
@@ -111,5 +305,5 @@ func DefaultRemoteWithAuth(ref string, insecure bool, auth string) (*remote.Remo
 			return "", "", errors.New("Invalid base64 encoded auth string")
 		}
 		return ary[0], ary[1], nil
-	})
+	}, RemoteOpt{})
 }
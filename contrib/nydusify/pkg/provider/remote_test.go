@@ -0,0 +1,405 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/remote"
+)
+
+func writeCredHelper(t *testing.T, binDir, name, script string) {
+	path := filepath.Join(binDir, "docker-credential-"+name)
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755))
+}
+
+func TestDockerConfigCredFunc(t *testing.T) {
+	binDir := t.TempDir()
+	writeCredHelper(t, binDir, "fake", `read server; echo '{"ServerURL":"'$server'","Username":"helper-user","Secret":"helper-secret"}'`)
+	writeCredHelper(t, binDir, "global", `read server; echo '{"ServerURL":"'$server'","Username":"global-user","Secret":"global-secret"}'`)
+	writeCredHelper(t, binDir, "broken", `echo "helper is broken"; exit 1`)
+	t.Setenv("PATH", fmt.Sprintf("%s:%s", binDir, os.Getenv("PATH")))
+
+	configDir := t.TempDir()
+	dir := dockerconfig.Dir()
+	dockerconfig.SetDir(configDir)
+	defer dockerconfig.SetDir(dir)
+
+	writeConfig := func(config string) {
+		require.NoError(t, os.WriteFile(filepath.Join(configDir, dockerconfig.ConfigFileName), []byte(config), 0644))
+	}
+	credFunc := NewDockerConfigCredFunc()
+
+	// Per-registry helper takes precedence over global store
+	writeConfig(`{"credsStore": "global", "credHelpers": {"helper.example.com": "fake"}}`)
+	username, secret, err := credFunc("helper.example.com")
+	require.NoError(t, err)
+	require.Equal(t, "helper-user", username)
+	require.Equal(t, "helper-secret", secret)
+
+	username, secret, err = credFunc("other.example.com")
+	require.NoError(t, err)
+	require.Equal(t, "global-user", username)
+	require.Equal(t, "global-secret", secret)
+
+	// Fallback to static auth when helper fails
+	auth := base64.StdEncoding.EncodeToString([]byte("static-user:static-secret"))
+	writeConfig(fmt.Sprintf(`{"credsStore": "broken", "auths": {"static.example.com": {"auth": "%s"}}}`, auth))
+	username, secret, err = credFunc("static.example.com")
+	require.NoError(t, err)
+	require.Equal(t, "static-user", username)
+	require.Equal(t, "static-secret", secret)
+}
+
+func TestDefaultRemoteWithProxy(t *testing.T) {
+	blob := []byte("blob data")
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+	registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != fmt.Sprintf("/v2/library/nginx/blobs/%s", desc.Digest) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(blob)
+	}))
+	defer registry.Close()
+
+	// Tunnel the HTTPS requests by CONNECT method
+	var traversed int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt32(&traversed, 1)
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			defer upstream.Close()
+			_, _ = io.Copy(upstream, conn)
+		}()
+		go func() {
+			defer conn.Close()
+			_, _ = io.Copy(conn, upstream)
+		}()
+	}))
+	defer proxy.Close()
+
+	caCertPath := filepath.Join(t.TempDir(), "ca.pem")
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: registry.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caCertPath, caCert, 0644))
+
+	ref := fmt.Sprintf("%s/library/nginx:latest", registry.Listener.Addr().String())
+	remote, err := DefaultRemoteWithOpt(ref, false, RemoteOpt{
+		ProxyURL:   proxy.URL,
+		CACertPath: caCertPath,
+	})
+	require.NoError(t, err)
+
+	reader, err := remote.Pull(context.Background(), desc, true)
+	require.NoError(t, err)
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, blob, data)
+	require.Greater(t, atomic.LoadInt32(&traversed), int32(0))
+
+	// Failure situation
+	_, err = DefaultRemoteWithOpt(ref, false, RemoteOpt{CACertPath: filepath.Join(t.TempDir(), "non-existent.pem")})
+	require.Error(t, err)
+	require.NoError(t, os.WriteFile(caCertPath, []byte("invalid"), 0644))
+	_, err = DefaultRemoteWithOpt(ref, false, RemoteOpt{CACertPath: caCertPath})
+	require.Error(t, err)
+}
+
+func TestRemoteClose(t *testing.T) {
+	blob := []byte("blob data")
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+	registry := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != fmt.Sprintf("/v2/library/nginx/blobs/%s", desc.Digest) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(blob)
+	}))
+	// Track the connections which are not closed yet.
+	var mutex sync.Mutex
+	conns := map[net.Conn]http.ConnState{}
+	registry.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if state == http.StateClosed || state == http.StateHijacked {
+			delete(conns, conn)
+			return
+		}
+		conns[conn] = state
+	}
+	registry.Start()
+	defer registry.Close()
+
+	ref := fmt.Sprintf("%s/library/nginx:latest", registry.Listener.Addr().String())
+	remote, err := DefaultRemote(ref, true)
+	require.NoError(t, err)
+	remote.MaybeWithHTTP(fmt.Errorf("http: server gave HTTP response to HTTPS client: https://%s/", registry.Listener.Addr().String()))
+	require.True(t, remote.IsWithHTTP())
+
+	reader, err := remote.Pull(context.Background(), desc, true)
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, blob, data)
+	require.NoError(t, reader.Close())
+
+	// The connection is kept alive for reuse until the remote is closed.
+	require.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, state := range conns {
+			if state == http.StateIdle {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, remote.Close())
+	require.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(conns) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The remote is unusable after closed, and closing again is safe.
+	_, err = remote.Pull(context.Background(), desc, true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "remote is closed")
+	_, err = remote.Resolve(context.Background())
+	require.Error(t, err)
+	require.NoError(t, remote.Close())
+}
+
+func TestRemoteBlobMount(t *testing.T) {
+	blob := []byte("blob data")
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+	var mounted, uploaded int32
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPost && r.URL.Query().Get("mount") != "":
+			require.Equal(t, desc.Digest.String(), r.URL.Query().Get("mount"))
+			require.Equal(t, "library/source", r.URL.Query().Get("from"))
+			atomic.AddInt32(&mounted, 1)
+			w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPost:
+			w.Header().Set("Location", r.URL.Path+"upload-id")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPut:
+			atomic.AddInt32(&uploaded, 1)
+			_, _ = io.Copy(io.Discard, r.Body)
+			w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer registry.Close()
+
+	host := registry.Listener.Addr().String()
+	push := func(tryBlobMount bool, source string) {
+		remote, err := DefaultRemote(fmt.Sprintf("%s/library/target:latest", host), true)
+		require.NoError(t, err)
+		defer remote.Close()
+		remote.MaybeWithHTTP(fmt.Errorf("http: server gave HTTP response to HTTPS client: https://%s/", host))
+		remote.TryBlobMount = tryBlobMount
+		remote.MountSource = source
+		require.NoError(t, remote.Push(context.Background(), desc, true, bytes.NewReader(blob)))
+	}
+
+	// The blob is mounted from source repo without uploading.
+	push(true, fmt.Sprintf("%s/library/source:latest", host))
+	require.Equal(t, int32(1), atomic.LoadInt32(&mounted))
+	require.Equal(t, int32(0), atomic.LoadInt32(&uploaded))
+
+	// The blob is uploaded if mount isn't enabled, or the source is in
+	// another registry.
+	push(false, fmt.Sprintf("%s/library/source:latest", host))
+	push(true, "other.example.com/library/source:latest")
+	require.Equal(t, int32(1), atomic.LoadInt32(&mounted))
+	require.Equal(t, int32(2), atomic.LoadInt32(&uploaded))
+}
+
+// writeClientCert writes a self-signed client cert and its key, returns the
+// paths and the pool trusting the cert.
+func writeClientCert(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "nydusify"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPath := filepath.Join(dir, "client.pem")
+	keyPath := filepath.Join(dir, "client-key.pem")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certPath, keyPath, pool
+}
+
+func TestRemoteOptTLS(t *testing.T) {
+	blob := []byte("blob data")
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != fmt.Sprintf("/v2/library/nginx/blobs/%s", desc.Digest) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(blob)
+	})
+	pull := func(remoter *remote.Remote) error {
+		reader, err := remoter.Pull(context.Background(), desc, true)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		require.Equal(t, blob, data)
+		return nil
+	}
+
+	dir := t.TempDir()
+	certPath, keyPath, clientCAs := writeClientCert(t, dir)
+
+	// The target registry requires the client cert signed by trusted CA.
+	target := httptest.NewUnstartedServer(handler)
+	target.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	target.StartTLS()
+	defer target.Close()
+	caCertPath := filepath.Join(dir, "ca.pem")
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: target.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caCertPath, caCert, 0644))
+
+	// The source registry is plaintext.
+	source := httptest.NewServer(handler)
+	defer source.Close()
+
+	targetRef := fmt.Sprintf("%s/library/nginx:latest", target.Listener.Addr().String())
+	sourceRef := fmt.Sprintf("%s/library/nginx:latest", source.Listener.Addr().String())
+
+	sourceRemote, err := DefaultRemoteWithOpt(sourceRef, true, RemoteOpt{})
+	require.NoError(t, err)
+	defer sourceRemote.Close()
+	sourceRemote.MaybeWithHTTP(fmt.Errorf("http: server gave HTTP response to HTTPS client: https://%s/", source.Listener.Addr().String()))
+	targetRemote, err := DefaultRemoteWithOpt(targetRef, false, RemoteOpt{
+		CACertPath:     caCertPath,
+		ClientCertPath: certPath,
+		ClientKeyPath:  keyPath,
+	})
+	require.NoError(t, err)
+	defer targetRemote.Close()
+
+	require.NoError(t, pull(sourceRemote))
+	require.NoError(t, pull(targetRemote))
+
+	// The handshake fails without client cert, or without trusting the
+	// registry cert.
+	noClientCert, err := DefaultRemoteWithOpt(targetRef, false, RemoteOpt{CACertPath: caCertPath})
+	require.NoError(t, err)
+	defer noClientCert.Close()
+	require.Error(t, pull(noClientCert))
+	noCA, err := DefaultRemoteWithOpt(targetRef, false, RemoteOpt{
+		ClientCertPath: certPath,
+		ClientKeyPath:  keyPath,
+	})
+	require.NoError(t, err)
+	defer noCA.Close()
+	require.Error(t, pull(noCA))
+
+	// The registry cert isn't verified with SkipTLSVerify.
+	skipVerify, err := DefaultRemoteWithOpt(targetRef, false, RemoteOpt{
+		ClientCertPath: certPath,
+		ClientKeyPath:  keyPath,
+		SkipTLSVerify:  true,
+	})
+	require.NoError(t, err)
+	defer skipVerify.Close()
+	require.NoError(t, pull(skipVerify))
+
+	// Failure situation
+	_, err = DefaultRemoteWithOpt(targetRef, false, RemoteOpt{ClientCertPath: certPath})
+	require.Error(t, err)
+	_, err = DefaultRemoteWithOpt(targetRef, false, RemoteOpt{ClientCertPath: certPath, ClientKeyPath: caCertPath})
+	require.Error(t, err)
+}
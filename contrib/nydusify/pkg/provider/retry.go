@@ -0,0 +1,114 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+const (
+	defaultRetryDelay = time.Second
+	maxRetryDelay     = time.Second * 30
+)
+
+type retryTransport struct {
+	wrappedTransport
+	opt RemoteOpt
+}
+
+// NewRetryTransport wraps the round tripper to retry the idempotent requests
+// on network errors and retryable status codes like 5xx with exponential
+// backoff, it returns the base round tripper directly if no retry required.
+func NewRetryTransport(base http.RoundTripper, opt RemoteOpt) http.RoundTripper {
+	if opt.RetryCount <= 0 {
+		return base
+	}
+	if opt.RetryDelay <= 0 {
+		opt.RetryDelay = defaultRetryDelay
+	}
+	return &retryTransport{
+		wrappedTransport: wrappedTransport{base},
+		opt:              opt,
+	}
+}
+
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	delay := t.opt.RetryDelay << uint(attempt)
+	if delay <= 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	// Add jitter to avoid all requests retrying at the same time.
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+
+		if attempt >= t.opt.RetryCount || !isIdempotentMethod(req.Method) || req.Context().Err() != nil {
+			return resp, err
+		}
+		if err != nil {
+			// Leave the plain HTTP fallback to the caller.
+			if utils.RetryWithHTTP(err) {
+				return resp, err
+			}
+		} else if !isRetryableStatus(resp.StatusCode) {
+			return resp, err
+		}
+
+		// The request body has been consumed, rewind it for next attempt.
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return resp, err
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return resp, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		if resp != nil {
+			logrus.Warnf("Retry %s %s due to status: %s", req.Method, req.URL.Redacted(), resp.Status)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		} else {
+			logrus.Warnf("Retry %s %s due to error: %s", req.Method, req.URL.Redacted(), err)
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(t.backoff(attempt)):
+		}
+	}
+}
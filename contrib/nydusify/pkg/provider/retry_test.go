@@ -0,0 +1,92 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newFlakyServer(failures int32, code int) (*httptest.Server, *int32) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) <= failures {
+			w.WriteHeader(code)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(append([]byte("ok"), body...))
+	}))
+	return server, &hits
+}
+
+func TestRetryTransport(t *testing.T) {
+	opt := RemoteOpt{RetryCount: 3, RetryDelay: time.Millisecond}
+
+	server, hits := newFlakyServer(2, http.StatusServiceUnavailable)
+	defer server.Close()
+	client := &http.Client{Transport: NewRetryTransport(http.DefaultTransport, opt)}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "ok", string(body))
+	require.Equal(t, int32(3), atomic.LoadInt32(hits))
+
+	// The request body should be rewound for retry
+	server, hits = newFlakyServer(1, http.StatusBadGateway)
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodPut, server.URL, strings.NewReader("-blob"))
+	require.NoError(t, err)
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "ok-blob", string(body))
+	require.Equal(t, int32(2), atomic.LoadInt32(hits))
+}
+
+func TestRetryTransportNotRetryable(t *testing.T) {
+	opt := RemoteOpt{RetryCount: 3, RetryDelay: time.Millisecond}
+	client := &http.Client{Transport: NewRetryTransport(http.DefaultTransport, opt)}
+
+	for _, code := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound} {
+		server, hits := newFlakyServer(1, code)
+		resp, err := client.Get(server.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, code, resp.StatusCode)
+		require.Equal(t, int32(1), atomic.LoadInt32(hits))
+		server.Close()
+	}
+
+	// Non-idempotent request should not be retried
+	server, hits := newFlakyServer(1, http.StatusServiceUnavailable)
+	defer server.Close()
+	resp, err := client.Post(server.URL, "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, int32(1), atomic.LoadInt32(hits))
+
+	// Retry exhausted
+	server, hits = newFlakyServer(10, http.StatusServiceUnavailable)
+	defer server.Close()
+	resp, err = client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, int32(4), atomic.LoadInt32(hits))
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// newUploadLimiter creates the token bucket limiting the upload throughput in
+// bytes per second, the bucket starts empty so that the throughput never
+// exceeds the limit even for the first second.
+func newUploadLimiter(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	limiter := rate.NewLimiter(rate.Limit(bytesPerSec), int(bytesPerSec))
+	limiter.AllowN(time.Now(), int(bytesPerSec))
+	return limiter
+}
+
+type throttleTransport struct {
+	wrappedTransport
+	limiter *rate.Limiter
+}
+
+// newThrottleTransport wraps the round tripper to throttle the body of blob
+// upload requests by the limiter shared across concurrent pushes, it returns
+// the base round tripper directly if no limiter specified.
+func newThrottleTransport(base http.RoundTripper, limiter *rate.Limiter) http.RoundTripper {
+	if limiter == nil {
+		return base
+	}
+	return &throttleTransport{
+		wrappedTransport: wrappedTransport{base},
+		limiter:          limiter,
+	}
+}
+
+func isBlobUpload(req *http.Request) bool {
+	return (req.Method == http.MethodPut || req.Method == http.MethodPatch) &&
+		strings.Contains(req.URL.Path, "/blobs/uploads/")
+}
+
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody || !isBlobUpload(req) {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Body = &throttledReader{
+		ctx:     req.Context(),
+		reader:  req.Body,
+		limiter: t.limiter,
+	}
+	return t.base.RoundTrip(req)
+}
+
+type throttledReader struct {
+	ctx     context.Context
+	reader  io.ReadCloser
+	limiter *rate.Limiter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	// Never read more than the burst, which can't be waited at once.
+	if burst := r.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (r *throttledReader) Close() error {
+	return r.reader.Close()
+}
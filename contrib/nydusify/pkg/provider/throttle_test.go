@@ -0,0 +1,77 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// newUploadServer accepts the blob uploads and records the uploaded bytes.
+func newUploadServer(uploaded *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/blobs/uploads/"):
+			w.Header().Set("Location", r.URL.Path+"upload-id")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/blobs/uploads/"):
+			n, _ := io.Copy(io.Discard, r.Body)
+			atomic.AddInt64(uploaded, n)
+			w.Header().Set("Docker-Content-Digest", r.URL.Query().Get("digest"))
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestMaxUploadBytesPerSec(t *testing.T) {
+	blob := bytes.Repeat([]byte("a"), 64*1024)
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+	var uploaded int64
+	registry := newUploadServer(&uploaded)
+	defer registry.Close()
+
+	ref := fmt.Sprintf("%s/library/nginx:latest", strings.TrimPrefix(registry.URL, "http://"))
+	push := func(opt RemoteOpt) time.Duration {
+		remote, err := DefaultRemoteWithOpt(ref, true, opt)
+		require.NoError(t, err)
+		defer remote.Close()
+		remote.MaybeWithHTTP(fmt.Errorf("http: server gave HTTP response to HTTPS client: %s/", registry.URL))
+
+		start := time.Now()
+		require.NoError(t, remote.Push(context.Background(), desc, true, bytes.NewReader(blob)))
+		return time.Since(start)
+	}
+
+	// The upload takes at least size/limit seconds with the limit.
+	limit := int64(len(blob)) * 2
+	elapsed := push(RemoteOpt{MaxUploadBytesPerSec: limit})
+	require.GreaterOrEqual(t, elapsed, time.Duration(int64(len(blob))*int64(time.Second)/limit))
+	require.Equal(t, int64(len(blob)), atomic.LoadInt64(&uploaded))
+
+	// Zero means unlimited.
+	require.Nil(t, newUploadLimiter(0))
+	push(RemoteOpt{})
+	require.Equal(t, int64(len(blob))*2, atomic.LoadInt64(&uploaded))
+}
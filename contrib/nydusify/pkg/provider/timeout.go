@@ -0,0 +1,79 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type timeoutTransport struct {
+	wrappedTransport
+	timeout time.Duration
+}
+
+// NewTimeoutTransport wraps the round tripper to give each request its own
+// deadline, so that a stuck request fails and is retried rather than hanging
+// the whole conversion. It returns the base round tripper directly if no
+// timeout specified.
+//
+// The deadline covers sending the request, including the body of blob chunk
+// push, and receiving the response header, the response body of blob pull
+// may take longer and isn't limited.
+func NewTimeoutTransport(base http.RoundTripper, timeout time.Duration) http.RoundTripper {
+	if timeout <= 0 {
+		return base
+	}
+	return &timeoutTransport{
+		wrappedTransport: wrappedTransport{base},
+		timeout:          timeout,
+	}
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The request context can't be canceled on return, otherwise the
+	// response body is aborted, so cancel it by timer instead.
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(t.timeout, cancel)
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		// The timer fired, the request must fail even if the response
+		// arrived at the same time.
+		if resp != nil {
+			resp.Body.Close()
+		}
+		cancel()
+		if req.Context().Err() != nil {
+			return nil, req.Context().Err()
+		}
+		if err == nil {
+			err = context.Canceled
+		}
+		return nil, errors.Wrapf(err, "request timeout after %s", t.timeout)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody releases the request context once the response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeoutTransport(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only the first blob head is delayed past the timeout.
+		if atomic.AddInt32(&hits, 1) == 1 {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		w.Header().Set("Content-Length", "4")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	opt := RemoteOpt{RetryCount: 2, RetryDelay: time.Millisecond, RequestTimeout: 100 * time.Millisecond}
+	transport := NewRetryTransport(NewTimeoutTransport(http.DefaultTransport, opt.RequestTimeout), opt)
+	client := &http.Client{Transport: transport}
+	resp, err := client.Head(server.URL + "/v2/foo/blobs/sha256:abc")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, int32(2), atomic.LoadInt32(&hits))
+
+	// The timed out request fails without retry.
+	atomic.StoreInt32(&hits, 0)
+	client = &http.Client{Transport: NewTimeoutTransport(http.DefaultTransport, opt.RequestTimeout)}
+	_, err = client.Head(server.URL + "/v2/foo/blobs/sha256:abc")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "request timeout after 100ms")
+	require.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
+
+func TestTimeoutTransportBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// The response body arriving after the timeout isn't aborted.
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("blob"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewTimeoutTransport(http.DefaultTransport, 100*time.Millisecond)}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "blob", string(body))
+
+	require.Equal(t, http.DefaultTransport, NewTimeoutTransport(http.DefaultTransport, 0))
+}
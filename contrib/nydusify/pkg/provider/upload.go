@@ -0,0 +1,122 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const abortUploadTimeout = time.Second * 10
+
+type uploadAbortTransport struct {
+	wrappedTransport
+
+	mutex sync.Mutex
+	// sessions are the location paths of in-flight blob upload sessions.
+	sessions map[string]struct{}
+}
+
+// NewUploadAbortTransport wraps the round tripper to track the in-flight
+// blob upload sessions, the session is aborted by a DELETE request once its
+// upload request is cancelled by context, so that the partial upload isn't
+// left to occupy the quota of registry.
+func NewUploadAbortTransport(base http.RoundTripper) http.RoundTripper {
+	return &uploadAbortTransport{
+		wrappedTransport: wrappedTransport{base},
+		sessions:         map[string]struct{}{},
+	}
+}
+
+// isUploadStart returns true for the request starting a blob upload session
+// like `POST /v2/<name>/blobs/uploads/`.
+func isUploadStart(req *http.Request) bool {
+	return req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/blobs/uploads/")
+}
+
+func (t *uploadAbortTransport) track(req *http.Request, resp *http.Response) {
+	location, err := req.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sessions[location.Path] = struct{}{}
+}
+
+func (t *uploadAbortTransport) untrack(path string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, ok := t.sessions[path]
+	delete(t.sessions, path)
+	return ok
+}
+
+// abort deletes the upload session, the error is only logged since the
+// registry may not support it, and the session expires anyway.
+func (t *uploadAbortTransport) abort(req *http.Request, location *url.URL) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), abortUploadTimeout)
+	defer cancel()
+
+	deleteReq, err := http.NewRequestWithContext(ctx, http.MethodDelete, location.String(), nil)
+	if err != nil {
+		return
+	}
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		deleteReq.Header.Set("Authorization", auth)
+	}
+	resp, err := t.base.RoundTrip(deleteReq)
+	if err != nil {
+		logrus.Warnf("failed to abort blob upload %s: %s", location.Redacted(), err)
+		return
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		logrus.Debugf("abort blob upload %s: %s", location.Redacted(), resp.Status)
+		return
+	}
+	logrus.Infof("aborted blob upload %s", location.Redacted())
+}
+
+func (t *uploadAbortTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+
+	if isUploadStart(req) {
+		if err == nil && resp.StatusCode == http.StatusAccepted {
+			t.track(req, resp)
+		}
+		return resp, err
+	}
+	if req.Method != http.MethodPatch && req.Method != http.MethodPut {
+		return resp, err
+	}
+	if !t.untrack(req.URL.Path) {
+		return resp, err
+	}
+
+	switch {
+	case req.Context().Err() != nil:
+		// The request is sent to the latest location of session, which may
+		// be moved by the previous chunk.
+		location := *req.URL
+		query := location.Query()
+		query.Del("digest")
+		location.RawQuery = query.Encode()
+		t.abort(req, &location)
+	case err == nil && req.Method == http.MethodPatch && resp.StatusCode == http.StatusAccepted:
+		// The next chunk is uploaded to the new location.
+		t.track(req, resp)
+	}
+
+	return resp, err
+}
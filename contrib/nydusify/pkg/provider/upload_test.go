@@ -0,0 +1,104 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadAbortTransport(t *testing.T) {
+	const sessionPath = "/v2/foo/blobs/uploads/session"
+
+	hanging := make(chan struct{})
+	release := make(chan struct{})
+	aborted := make(chan *url.URL, 1)
+	var patches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPost && r.URL.Path == "/v2/foo/blobs/uploads/":
+			w.Header().Set("Location", sessionPath)
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPatch && r.URL.Path == sessionPath:
+			if patches.Add(1) > 1 {
+				// Hang the second chunk until the upload is cancelled.
+				close(hanging)
+				select {
+				case <-r.Context().Done():
+				case <-release:
+				}
+				return
+			}
+			_, _ = io.ReadAll(r.Body)
+			w.Header().Set("Location", sessionPath+"?_state=1")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodDelete && r.URL.Path == sessionPath:
+			aborted <- r.URL
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	// The hanging handler must return before closing server.
+	defer close(release)
+
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: docker.ConfigureDefaultRegistries(
+			docker.WithClient(NewClient(false, RemoteOpt{})),
+			docker.WithPlainHTTP(docker.MatchAllHosts),
+			docker.WithChunkSize(4),
+		),
+	})
+	ref := fmt.Sprintf("%s/foo:latest", strings.TrimPrefix(server.URL, "http://"))
+	pusher, err := resolver.Pusher(context.Background(), ref)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	data := []byte("0123456789")
+	writer, err := pusher.Push(ctx, ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	})
+	require.NoError(t, err)
+	defer writer.Close()
+
+	// The first chunk is uploaded, then the upload is cancelled during the
+	// second chunk.
+	go func() {
+		_, _ = writer.Write(data)
+	}()
+	select {
+	case <-hanging:
+	case <-time.After(10 * time.Second):
+		t.Fatal("second chunk isn't uploaded")
+	}
+	cancel()
+
+	select {
+	case location := <-aborted:
+		require.Equal(t, "1", location.Query().Get("_state"))
+		require.Empty(t, location.Query().Get("digest"))
+	case <-time.After(10 * time.Second):
+		t.Fatal("blob upload isn't aborted after cancellation")
+	}
+}
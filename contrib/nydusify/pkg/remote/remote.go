@@ -8,16 +8,25 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/remotes"
 	"github.com/distribution/reference"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 )
 
+var errClosed = errors.New("remote is closed")
+
+// distributionSourceLabel is the prefix of the annotation key recognized by
+// containerd pusher for cross-repo blob mount, followed by registry host.
+const distributionSourceLabel = "containerd.io/distribution.source."
+
 // Remote provides the ability to access remote registry
 type Remote struct {
 	// `Ref` is pointing to a remote image in formatted string host[:port]/[namespace/]repo[:tag]
@@ -30,6 +39,15 @@ type Remote struct {
 	// new resolver instance using resolverFunc for each request.
 	resolverFunc func(insecure bool) remotes.Resolver
 	pushed       sync.Map
+	// TryBlobMount makes Push try to mount the blob from the repo of
+	// MountSource by cross-repo blob mount before uploading it, only the
+	// source in the same registry as Ref is mountable.
+	TryBlobMount bool
+	MountSource  string
+	// closeFunc releases the resources shared by the resolvers.
+	closeFunc func()
+	closeOnce sync.Once
+	closed    atomic.Bool
 
 	retryWithHTTP bool
 }
@@ -48,6 +66,33 @@ func New(ref string, resolverFunc func(bool) remotes.Resolver) (*Remote, error)
 	}, nil
 }
 
+// SetCloseFunc sets the function called on Close to release the resources
+// shared by the resolvers, like the connections of HTTP clients.
+func (remote *Remote) SetCloseFunc(closeFunc func()) {
+	remote.closeFunc = closeFunc
+}
+
+// Close closes the idle connections and drops the credential state held by
+// the remote. It's safe to call Close after the conversions or more than
+// once, but the remote is unusable afterward, all requests fail.
+func (remote *Remote) Close() error {
+	remote.closeOnce.Do(func() {
+		remote.closed.Store(true)
+		if remote.closeFunc != nil {
+			remote.closeFunc()
+		}
+	})
+	return nil
+}
+
+// resolver creates a new resolver instance for the request.
+func (remote *Remote) resolver() (remotes.Resolver, error) {
+	if remote.closed.Load() {
+		return nil, errClosed
+	}
+	return remote.resolverFunc(remote.retryWithHTTP), nil
+}
+
 func (remote *Remote) MaybeWithHTTP(err error) {
 	parsed, _ := reference.ParseNormalizedNamed(remote.Ref)
 	if parsed != nil {
@@ -64,6 +109,32 @@ func (remote *Remote) IsWithHTTP() bool {
 	return remote.retryWithHTTP
 }
 
+// withMountSource appends the distribution source of blob, so that the
+// containerd pusher tries to mount the blob from the source repo first, and
+// falls back to a full upload if the mount isn't allowed.
+func (remote *Remote) withMountSource(desc ocispec.Descriptor) ocispec.Descriptor {
+	if !remote.TryBlobMount || remote.MountSource == "" {
+		return desc
+	}
+	source, err := reference.ParseNormalizedNamed(remote.MountSource)
+	if err != nil || reference.Domain(source) != reference.Domain(remote.parsed) {
+		return desc
+	}
+	// The label key is the registry host without port, same as containerd.
+	host, err := url.Parse("dummy://" + reference.Domain(source))
+	if err != nil {
+		return desc
+	}
+
+	annotations := map[string]string{}
+	for key, value := range desc.Annotations {
+		annotations[key] = value
+	}
+	annotations[distributionSourceLabel+host.Hostname()] = reference.Path(source)
+	desc.Annotations = annotations
+	return desc
+}
+
 // Push pushes blob to registry
 func (remote *Remote) Push(ctx context.Context, desc ocispec.Descriptor, byDigest bool, reader io.Reader) error {
 	// Concurrently push blob with same digest using containerd
@@ -82,13 +153,16 @@ func (remote *Remote) Push(ctx context.Context, desc ocispec.Descriptor, byDiges
 		ref = reference.TagNameOnly(remote.parsed).String()
 	}
 
-	// Create a new resolver instance for the request
-	pusher, err := remote.resolverFunc(remote.retryWithHTTP).Pusher(ctx, ref)
+	resolver, err := remote.resolver()
+	if err != nil {
+		return err
+	}
+	pusher, err := resolver.Pusher(ctx, ref)
 	if err != nil {
 		return err
 	}
 
-	writer, err := pusher.Push(ctx, desc)
+	writer, err := pusher.Push(ctx, remote.withMountSource(desc))
 	if err != nil {
 		if errdefs.IsAlreadyExists(err) {
 			return nil
@@ -109,8 +183,11 @@ func (remote *Remote) Pull(ctx context.Context, desc ocispec.Descriptor, byDiges
 		ref = reference.TagNameOnly(remote.parsed).String()
 	}
 
-	// Create a new resolver instance for the request
-	puller, err := remote.resolverFunc(remote.retryWithHTTP).Fetcher(ctx, ref)
+	resolver, err := remote.resolver()
+	if err != nil {
+		return nil, err
+	}
+	puller, err := resolver.Fetcher(ctx, ref)
 	if err != nil {
 		return nil, err
 	}
@@ -123,12 +200,32 @@ func (remote *Remote) Pull(ctx context.Context, desc ocispec.Descriptor, byDiges
 	return reader, nil
 }
 
+// Exists checks whether the blob exists in registry by HEAD request without
+// pulling its content.
+func (remote *Remote) Exists(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
+	resolver, err := remote.resolver()
+	if err != nil {
+		return false, err
+	}
+	if _, _, err := resolver.Resolve(ctx, fmt.Sprintf("%s@%s", remote.parsed.Name(), desc.Digest)); err != nil {
+		if errdefs.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
 // Resolve parses descriptor for given image reference
 func (remote *Remote) Resolve(ctx context.Context) (*ocispec.Descriptor, error) {
 	ref := reference.TagNameOnly(remote.parsed).String()
 
-	// Create a new resolver instance for the request
-	_, desc, err := remote.resolverFunc(remote.retryWithHTTP).Resolve(ctx, ref)
+	resolver, err := remote.resolver()
+	if err != nil {
+		return nil, err
+	}
+	_, desc, err := resolver.Resolve(ctx, ref)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,212 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package server runs the image conversion as an HTTP service, so that
+// nydusify can be deployed as a conversion microservice.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter"
+)
+
+// maxRequestBytes limits the size of convert request body.
+const maxRequestBytes = 1 << 20
+
+// ConvertRequest is the subset of converter options accepted by
+// `POST /convert`, the other options like the builder path and work
+// directory are configured by the server.
+type ConvertRequest struct {
+	Source         string `json:"source"`
+	Target         string `json:"target"`
+	SourceInsecure bool   `json:"source_insecure"`
+	TargetInsecure bool   `json:"target_insecure"`
+
+	FsVersion        string `json:"fs_version"`
+	Compressor       string `json:"compressor"`
+	ChunkSize        string `json:"chunk_size"`
+	BatchSize        string `json:"batch_size"`
+	PrefetchPatterns string `json:"prefetch_patterns"`
+	OCIRef           bool   `json:"oci_ref"`
+	Docker2OCI       bool   `json:"docker2oci"`
+	MergePlatform    bool   `json:"merge_platform"`
+	AllPlatforms     bool   `json:"all_platforms"`
+	Platforms        string `json:"platforms"`
+	Reproducible     bool   `json:"reproducible"`
+
+	ChunkDictRef      string `json:"chunk_dict_ref"`
+	ChunkDictInsecure bool   `json:"chunk_dict_insecure"`
+	CacheRef          string `json:"cache_ref"`
+	CacheInsecure     bool   `json:"cache_insecure"`
+}
+
+// Opt configures the conversion service.
+type Opt struct {
+	// Base is the converter options shared by all the conversions, the
+	// options of ConvertRequest override it.
+	Base converter.Opt
+	// Concurrency limits the conversions running at the same time, the
+	// excess requests are queued until a running conversion finishes,
+	// defaults to 1.
+	Concurrency int
+	// QueueSize limits the requests waiting in queue, the request beyond it
+	// is rejected with `429 Too Many Requests`, zero means no limit.
+	QueueSize int
+}
+
+// Server serves `POST /convert` converting the image of request and
+// replying the converter.Result in JSON, and `GET /healthz` and
+// `GET /readyz` probes. The readiness probe fails once the queue is full.
+type Server struct {
+	opt     Opt
+	limiter *semaphore.Weighted
+	// queued is the number of requests waiting for a conversion slot.
+	queued atomic.Int64
+	mux    *http.ServeMux
+
+	// convert is replaced by tests.
+	convert func(ctx context.Context, opt converter.Opt) (*converter.Result, error)
+}
+
+// New creates the conversion service.
+func New(opt Opt) *Server {
+	if opt.Concurrency <= 0 {
+		opt.Concurrency = 1
+	}
+	server := &Server{
+		opt:     opt,
+		limiter: semaphore.NewWeighted(int64(opt.Concurrency)),
+		mux:     http.NewServeMux(),
+		convert: converter.Convert,
+	}
+	server.mux.HandleFunc("/convert", server.handleConvert)
+	server.mux.HandleFunc("/healthz", server.handleHealthz)
+	server.mux.HandleFunc("/readyz", server.handleReadyz)
+	return server
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mux.ServeHTTP(w, r)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Warnf("failed to write response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// makeOpt overrides the base options with the options of request.
+func (server *Server) makeOpt(req ConvertRequest) converter.Opt {
+	opt := server.opt.Base
+
+	opt.Source = req.Source
+	opt.Target = req.Target
+	opt.SourceInsecure = req.SourceInsecure
+	opt.TargetInsecure = req.TargetInsecure
+
+	opt.FsVersion = req.FsVersion
+	opt.Compressor = req.Compressor
+	opt.ChunkSize = req.ChunkSize
+	opt.BatchSize = req.BatchSize
+	opt.PrefetchPatterns = req.PrefetchPatterns
+	opt.OCIRef = req.OCIRef
+	opt.Docker2OCI = req.Docker2OCI
+	opt.MergePlatform = req.MergePlatform
+	opt.AllPlatforms = req.AllPlatforms
+	opt.Platforms = req.Platforms
+	opt.Reproducible = req.Reproducible
+
+	opt.ChunkDictRef = req.ChunkDictRef
+	opt.ChunkDictInsecure = req.ChunkDictInsecure
+	opt.CacheRef = req.CacheRef
+	opt.CacheInsecure = req.CacheInsecure
+
+	return opt
+}
+
+func (server *Server) handleConvert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s isn't allowed", r.Method))
+		return
+	}
+
+	var req ConvertRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid convert request: %s", err))
+		return
+	}
+	if req.Source == "" || req.Target == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid convert request: source and target are required"))
+		return
+	}
+
+	if !server.limiter.TryAcquire(1) {
+		queued := server.queued.Add(1)
+		if server.opt.QueueSize > 0 && queued > int64(server.opt.QueueSize) {
+			server.queued.Add(-1)
+			writeError(w, http.StatusTooManyRequests, fmt.Errorf("conversion queue is full"))
+			return
+		}
+		// The request leaves the queue once the client goes away.
+		err := server.limiter.Acquire(r.Context(), 1)
+		server.queued.Add(-1)
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, fmt.Errorf("wait for conversion: %s", err))
+			return
+		}
+	}
+	defer server.limiter.Release(1)
+
+	logrus.Infof("converting %s to %s", req.Source, req.Target)
+	result, err := server.convert(r.Context(), server.makeOpt(req))
+	if err != nil {
+		logrus.Errorf("failed to convert %s to %s: %s", req.Source, req.Target, err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (server *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s isn't allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (server *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s isn't allowed", r.Method))
+		return
+	}
+	if server.opt.QueueSize > 0 && server.queued.Load() >= int64(server.opt.QueueSize) {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("conversion queue is full"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,170 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter"
+)
+
+func postConvert(t *testing.T, url string, req interface{}) (*http.Response, []byte) {
+	data, err := json.Marshal(req)
+	require.NoError(t, err)
+	resp, err := http.Post(url+"/convert", "application/json", bytes.NewReader(data))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body := bytes.Buffer{}
+	_, err = body.ReadFrom(resp.Body)
+	require.NoError(t, err)
+	return resp, body.Bytes()
+}
+
+func TestConvert(t *testing.T) {
+	server := New(Opt{
+		Base: converter.Opt{WorkDir: "/tmp/work", NydusImagePath: "/usr/bin/nydus-image", Compressor: "lz4_block"},
+	})
+	expected := &converter.Result{
+		TargetDigest: digest.FromString("target"),
+		BlobDigests:  []digest.Digest{digest.FromString("blob")},
+		PushedBytes:  1024,
+	}
+	var got converter.Opt
+	server.convert = func(ctx context.Context, opt converter.Opt) (*converter.Result, error) {
+		got = opt
+		return expected, nil
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	resp, body := postConvert(t, ts.URL, ConvertRequest{
+		Source:         "localhost:5000/foo:latest",
+		Target:         "localhost:5000/foo:nydus",
+		SourceInsecure: true,
+		FsVersion:      "6",
+		Compressor:     "zstd",
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var result converter.Result
+	require.NoError(t, json.Unmarshal(body, &result))
+	require.Equal(t, expected.TargetDigest, result.TargetDigest)
+	require.Equal(t, expected.BlobDigests, result.BlobDigests)
+	require.Equal(t, expected.PushedBytes, result.PushedBytes)
+
+	// The options of request override the base options.
+	require.Equal(t, "localhost:5000/foo:latest", got.Source)
+	require.Equal(t, "localhost:5000/foo:nydus", got.Target)
+	require.True(t, got.SourceInsecure)
+	require.Equal(t, "6", got.FsVersion)
+	require.Equal(t, "zstd", got.Compressor)
+	require.Equal(t, "/tmp/work", got.WorkDir)
+	require.Equal(t, "/usr/bin/nydus-image", got.NydusImagePath)
+
+	// Failure situation
+	resp, body = postConvert(t, ts.URL, ConvertRequest{Source: "localhost:5000/foo:latest"})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Contains(t, string(body), "source and target are required")
+	resp, body = postConvert(t, ts.URL, map[string]string{"source": "a", "target": "b", "unknown": "c"})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Contains(t, string(body), "unknown field")
+	resp, err := http.Get(ts.URL + "/convert")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestConvertFailure(t *testing.T) {
+	// The conversion fails since nothing listens on the source registry.
+	ts := httptest.NewServer(New(Opt{
+		Base: converter.Opt{
+			WorkDir:        t.TempDir(),
+			NydusImagePath: filepath.Join(t.TempDir(), "nydus-image"),
+			BuilderVersion: "v2.2.0",
+		},
+	}))
+	defer ts.Close()
+
+	resp, body := postConvert(t, ts.URL, ConvertRequest{
+		Source:         "127.0.0.1:1/foo:latest",
+		Target:         "127.0.0.1:1/foo:nydus",
+		SourceInsecure: true,
+		TargetInsecure: true,
+	})
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	var errResp errorResponse
+	require.NoError(t, json.Unmarshal(body, &errResp))
+	require.NotEmpty(t, errResp.Error)
+}
+
+func TestConvertQueue(t *testing.T) {
+	server := New(Opt{Concurrency: 1, QueueSize: 1})
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	server.convert = func(ctx context.Context, opt converter.Opt) (*converter.Result, error) {
+		started <- struct{}{}
+		<-release
+		return &converter.Result{}, nil
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	req := ConvertRequest{Source: "localhost/foo:latest", Target: "localhost/foo:nydus"}
+	statuses := make(chan int, 2)
+	convert := func() {
+		resp, _ := postConvert(t, ts.URL, req)
+		statuses <- resp.StatusCode
+	}
+	ready := func() int {
+		resp, err := http.Get(ts.URL + "/readyz")
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, ready())
+
+	// The second request waits in queue for the running conversion.
+	go convert()
+	<-started
+	go convert()
+	require.Eventually(t, func() bool {
+		return server.queued.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, http.StatusServiceUnavailable, ready())
+
+	// The request beyond queue size is rejected.
+	resp, body := postConvert(t, ts.URL, req)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Contains(t, string(body), "conversion queue is full")
+
+	// The queued request is converted once the running one finishes.
+	release <- struct{}{}
+	<-started
+	release <- struct{}{}
+	require.Equal(t, http.StatusOK, <-statuses)
+	require.Equal(t, http.StatusOK, <-statuses)
+	require.Zero(t, server.queued.Load())
+	require.Equal(t, http.StatusOK, ready())
+}
+
+func TestHealthz(t *testing.T) {
+	ts := httptest.NewServer(New(Opt{}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/healthz")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+}
@@ -8,14 +8,17 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 
+	"github.com/klauspost/compress/zstd"
 	"golang.org/x/sys/unix"
 
 	"github.com/containerd/containerd/archive"
 	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/images"
 	"github.com/opencontainers/go-digest"
 )
 
@@ -130,6 +133,34 @@ func PackTargzInfo(src, name string, compress bool) (digest.Digest, int64, error
 	return hash, <-chanSize, <-chanErr
 }
 
+// DecompressLayer decompresses the layer stream by the compression indicated
+// in media type of descriptor, like `application/vnd.oci.image.layer.v1.tar+zstd`,
+// and falls back to detecting the compression from stream for the unknown
+// media types.
+func DecompressLayer(r io.Reader, mediaType string) (io.ReadCloser, error) {
+	algorithm, err := images.DiffCompression(context.Background(), mediaType)
+	// The docker layer `application/vnd.docker.image.rootfs.diff.tar` may
+	// be compressed without a correct media type.
+	if err != nil || algorithm == "unknown" {
+		return compression.DecompressStream(r)
+	}
+
+	switch algorithm {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case "":
+		return io.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported layer compression %s of media type %s", algorithm, mediaType)
+	}
+}
+
 // UnpackTargz unpacks .tar(.gz) stream, and write to dst path
 func UnpackTargz(ctx context.Context, dst string, r io.Reader, overlay bool) error {
 	ds, err := compression.DecompressStream(r)
@@ -138,6 +169,22 @@ func UnpackTargz(ctx context.Context, dst string, r io.Reader, overlay bool) err
 	}
 	defer ds.Close()
 
+	return unpack(ctx, dst, ds, overlay)
+}
+
+// UnpackLayer unpacks the layer stream decompressed by its media type, and
+// write to dst path.
+func UnpackLayer(ctx context.Context, dst string, r io.Reader, mediaType string, overlay bool) error {
+	ds, err := DecompressLayer(r, mediaType)
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+
+	return unpack(ctx, dst, ds, overlay)
+}
+
+func unpack(ctx context.Context, dst string, ds io.Reader, overlay bool) error {
 	// Guarantee that umask won't affect file/directory creation
 	mask := unix.Umask(0)
 	defer unix.Umask(mask)
@@ -146,6 +193,7 @@ func UnpackTargz(ctx context.Context, dst string, r io.Reader, overlay bool) err
 		return err
 	}
 
+	var err error
 	if overlay {
 		_, err = archive.Apply(
 			ctx,
@@ -6,9 +6,14 @@
 package utils
 
 import (
+	"bytes"
+	"compress/gzip"
+	"io"
 	"os"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -26,3 +31,46 @@ func TestPackTargzInfo(t *testing.T) {
 	assert.Equal(t, "sha256:6cdd1b26d54d5852fbea95a81cbb25383975b70b4ffad9f9b6d25c7a434a51eb", digest.String())
 	assert.Equal(t, size, int64(315))
 }
+
+func TestDecompressLayer(t *testing.T) {
+	data := []byte("layer data")
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, err := gw.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, gw.Close())
+
+	var zstded bytes.Buffer
+	zw, err := zstd.NewWriter(&zstded)
+	assert.Nil(t, err)
+	_, err = zw.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, zw.Close())
+
+	for _, tc := range []struct {
+		mediaType string
+		layer     []byte
+	}{
+		{ocispec.MediaTypeImageLayerGzip, gzipped.Bytes()},
+		{ocispec.MediaTypeImageLayerZstd, zstded.Bytes()},
+		{ocispec.MediaTypeImageLayer, data},
+		{"application/vnd.docker.image.rootfs.diff.tar.gzip", gzipped.Bytes()},
+		// The compression is detected from stream for docker tar layer.
+		{"application/vnd.docker.image.rootfs.diff.tar", zstded.Bytes()},
+	} {
+		reader, err := DecompressLayer(bytes.NewReader(tc.layer), tc.mediaType)
+		assert.Nil(t, err, tc.mediaType)
+		decompressed, err := io.ReadAll(reader)
+		assert.Nil(t, err, tc.mediaType)
+		assert.Equal(t, data, decompressed, tc.mediaType)
+		assert.Nil(t, reader.Close())
+	}
+
+	// The media type takes precedence over the stream content.
+	reader, err := DecompressLayer(bytes.NewReader(zstded.Bytes()), ocispec.MediaTypeImageLayerGzip)
+	if err == nil {
+		_, err = io.ReadAll(reader)
+	}
+	assert.NotNil(t, err)
+}
@@ -145,6 +145,7 @@ func UnpackFile(reader io.Reader, source, target string) error {
 			if err == io.EOF {
 				break
 			}
+			return err
 		}
 		if hdr.Name == source {
 			file, err := os.Create(target)
@@ -5,14 +5,37 @@
 package tests
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/dragonflyoss/nydus/smoke/tests/texture"
 	"github.com/dragonflyoss/nydus/smoke/tests/tool"
 	"github.com/dragonflyoss/nydus/smoke/tests/tool/test"
 	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -222,6 +245,2021 @@ func (i *ImageTestSuite) TestChundict(t *testing.T, ctx tool.Context, images []s
 	ctx.Destroy(t)
 }
 
+func (i *ImageTestSuite) TestConvertOCILayout(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	// Prepare OCI image layout without registry
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	lowerLayer := texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source"))
+	lowerLayer.ToOCILayout(t, layoutDir)
+
+	target := fmt.Sprintf("localhost:%s/oci-layout:nydus-%s", os.Getenv("REGISTRY_PORT"), uuid.NewString())
+	logLevel := "--log-level warn"
+
+	// Convert image
+	convertCmd := fmt.Sprintf(
+		"%s %s convert --source-path %s --target %s --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, logLevel, layoutDir, target, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	// Check image
+	checkCmd := fmt.Sprintf(
+		"%s %s check --target %s --nydus-image %s --nydusd %s --work-dir %s",
+		ctx.Binary.Nydusify, logLevel, target, ctx.Binary.Builder, ctx.Binary.Nydusd, filepath.Join(ctx.Env.WorkDir, "check"),
+	)
+	tool.RunWithoutOutput(t, checkCmd)
+}
+
+func (i *ImageTestSuite) TestConvertWorkers(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	// Prepare an image of 10 layers
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	layers := []*tool.Layer{}
+	for idx := 0; idx < 10; idx++ {
+		id := strconv.Itoa(idx)
+		layers = append(layers, texture.MakeMatrixLayer(t, filepath.Join(ctx.Env.WorkDir, "source-"+id), id))
+	}
+	tool.LayersToOCILayout(t, layoutDir, ocispec.MediaTypeImageLayerGzip, layers...)
+
+	convert := func(worker int) string {
+		tag := fmt.Sprintf("nydus-worker-%d-%s", worker, uuid.NewString())
+		target := fmt.Sprintf("localhost:%s/workers:%s", os.Getenv("REGISTRY_PORT"), tag)
+		convertCmd := fmt.Sprintf(
+			"%s --log-level warn convert --source-path %s --target %s --worker %d --fs-version %s --nydus-image %s --work-dir %s",
+			ctx.Binary.Nydusify, layoutDir, target, worker, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+		)
+		tool.RunWithoutOutput(t, convertCmd)
+
+		// The bootstrap merged from all the layers is correct
+		checkCmd := fmt.Sprintf(
+			"%s --log-level warn check --target %s --nydus-image %s --nydusd %s --work-dir %s",
+			ctx.Binary.Nydusify, target, ctx.Binary.Builder, ctx.Binary.Nydusd, filepath.Join(ctx.Env.WorkDir, "check"),
+		)
+		tool.RunWithoutOutput(t, checkCmd)
+
+		manifestBytes, header := getFromRegistry(t, "workers/manifests/"+tag, ocispec.MediaTypeImageManifest)
+		var manifest ocispec.Manifest
+		require.NoError(t, json.Unmarshal(manifestBytes, &manifest))
+		// One nydus blob for each layer and one bootstrap layer
+		require.Len(t, manifest.Layers, 11)
+		return header.Get("Docker-Content-Digest")
+	}
+
+	// The output is the same whatever the order layers are converted in.
+	require.Equal(t, convert(1), convert(8))
+}
+
+func (i *ImageTestSuite) TestConvertReproducible(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	// The same files are packed at different time, so the source layers
+	// differ in the modification time of files.
+	layoutDirs := []string{}
+	for idx := 0; idx < 2; idx++ {
+		if idx > 0 {
+			time.Sleep(time.Second)
+		}
+		id := strconv.Itoa(idx)
+		layoutDir := filepath.Join(ctx.Env.WorkDir, "layout-"+id)
+		texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source-"+id)).ToOCILayout(t, layoutDir)
+		layoutDirs = append(layoutDirs, layoutDir)
+	}
+	require.NotEqual(t, readLayoutManifest(t, layoutDirs[0]).Layers[0].Digest, readLayoutManifest(t, layoutDirs[1]).Layers[0].Digest)
+
+	convert := func(layoutDir string) string {
+		tag := fmt.Sprintf("nydus-%s", uuid.NewString())
+		target := fmt.Sprintf("localhost:%s/reproducible:%s", os.Getenv("REGISTRY_PORT"), tag)
+		convertCmd := fmt.Sprintf(
+			"%s --log-level warn convert --source-path %s --target %s --reproducible --fs-version %s --nydus-image %s --work-dir %s",
+			ctx.Binary.Nydusify, layoutDir, target, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+		)
+		tool.RunWithoutOutput(t, convertCmd)
+
+		checkCmd := fmt.Sprintf(
+			"%s --log-level warn check --target %s --nydus-image %s --nydusd %s --work-dir %s",
+			ctx.Binary.Nydusify, target, ctx.Binary.Builder, ctx.Binary.Nydusd, filepath.Join(ctx.Env.WorkDir, "check"),
+		)
+		tool.RunWithoutOutput(t, checkCmd)
+
+		_, header := getFromRegistry(t, "reproducible/manifests/"+tag, ocispec.MediaTypeImageManifest)
+		return header.Get("Docker-Content-Digest")
+	}
+
+	digest := convert(layoutDirs[0])
+	require.Equal(t, digest, convert(layoutDirs[0]))
+	require.Equal(t, digest, convert(layoutDirs[1]))
+}
+
+func (i *ImageTestSuite) TestConvertOwnerOverride(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayout(t, layoutDir)
+
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --owner-override 1234:5678 --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, targetDir, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	// The blobs of target layout are read by nydusd from localfs backend.
+	bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap"))
+	ctx.Env.BlobDir = filepath.Join(targetDir, "blobs", "sha256")
+	mountPath := filepath.Join(ctx.Env.WorkDir, "mnt")
+	nydusd := tool.MountNydusd(t, *ctx, bootstrapPath, mountPath)
+	defer nydusd.Umount()
+
+	// All the entries are owned by the forced uid and gid, including the
+	// directories and symlinks.
+	entries := 0
+	require.NoError(t, filepath.Walk(mountPath, func(path string, info os.FileInfo, err error) error {
+		require.NoError(t, err)
+		if path == mountPath {
+			return nil
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		require.True(t, ok)
+		require.Equal(t, uint32(1234), stat.Uid, path)
+		require.Equal(t, uint32(5678), stat.Gid, path)
+		entries++
+		return nil
+	}))
+	require.Greater(t, entries, 0)
+}
+
+func (i *ImageTestSuite) TestConvertDeepDirTree(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layer, paths := texture.MakeDeepTreeLayer(t, filepath.Join(ctx.Env.WorkDir, "source"), 256)
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	layer.ToOCILayout(t, layoutDir)
+
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, targetDir, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap"))
+	ctx.Env.BlobDir = filepath.Join(targetDir, "blobs", "sha256")
+	mountPath := filepath.Join(ctx.Env.WorkDir, "mnt")
+	nydusd := tool.MountNydusd(t, *ctx, bootstrapPath, mountPath)
+	defer nydusd.Umount()
+
+	// The deeply nested paths round-trip with the names of all components,
+	// the content of each file is its path.
+	for _, path := range paths {
+		require.Equal(t, []byte(path), tool.ReadDeepFile(t, mountPath, path), path)
+	}
+}
+
+func (i *ImageTestSuite) TestConvertUnicodeNames(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	sourceDir := filepath.Join(ctx.Env.WorkDir, "source")
+	layer := texture.MakeUnicodeLayer(t, sourceDir)
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	layer.ToOCILayout(t, layoutDir)
+
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, targetDir, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap"))
+	ctx.Env.BlobDir = filepath.Join(targetDir, "blobs", "sha256")
+	mountPath := filepath.Join(ctx.Env.WorkDir, "mnt")
+	nydusd := tool.MountNydusd(t, *ctx, bootstrapPath, mountPath)
+	defer nydusd.Umount()
+
+	// The directory listings are byte-identical, and the files have the same
+	// content and metadata.
+	require.Equal(t, tool.ListDir(t, sourceDir), tool.ListDir(t, mountPath))
+	layer.Verify(t, mountPath)
+}
+
+func (i *ImageTestSuite) TestConvertSymlinkEdges(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layer, targets := texture.MakeSymlinkEdgeLayer(t, filepath.Join(ctx.Env.WorkDir, "source"))
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	layer.ToOCILayout(t, layoutDir)
+
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, targetDir, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap"))
+	ctx.Env.BlobDir = filepath.Join(targetDir, "blobs", "sha256")
+	mountPath := filepath.Join(ctx.Env.WorkDir, "mnt")
+	nydusd := tool.MountNydusd(t, *ctx, bootstrapPath, mountPath)
+	defer nydusd.Umount()
+
+	// The symlink targets are kept verbatim without being resolved.
+	layer.Verify(t, mountPath)
+	for name, target := range targets {
+		link, err := os.Readlink(filepath.Join(mountPath, name))
+		require.NoError(t, err)
+		require.Equal(t, target, link, name)
+	}
+}
+
+func (i *ImageTestSuite) TestConvertSpecialFiles(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	sourceDir := filepath.Join(ctx.Env.WorkDir, "source")
+	texture.MakeSpecialFilesLayer(t, sourceDir).ToOCILayout(t, filepath.Join(ctx.Env.WorkDir, "layout"))
+
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, filepath.Join(ctx.Env.WorkDir, "layout"), targetDir, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap"))
+	ctx.Env.BlobDir = filepath.Join(targetDir, "blobs", "sha256")
+	mountPath := filepath.Join(ctx.Env.WorkDir, "mnt")
+	nydusd := tool.MountNydusd(t, *ctx, bootstrapPath, mountPath)
+	defer nydusd.Umount()
+
+	// The file type, permission bits and device number are kept.
+	for _, name := range []string{"dev/null", "dev/char-large", "dev/sda1", "dev/block-large", "fifo"} {
+		expected := tool.NewFile(t, filepath.Join(sourceDir, name), name)
+		tool.NewFile(t, filepath.Join(mountPath, name), name).Compare(t, expected)
+	}
+	stat, err := os.Lstat(filepath.Join(mountPath, "dev", "char-large"))
+	require.NoError(t, err)
+	rdev := uint64(stat.Sys().(*syscall.Stat_t).Rdev)
+	require.Equal(t, uint32(511), unix.Major(rdev))
+	require.Equal(t, uint32(70000), unix.Minor(rdev))
+
+	// The socket is skipped by the tar writer of OCI layer, like docker.
+	_, err = os.Lstat(filepath.Join(mountPath, "socket"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func (i *ImageTestSuite) TestConvertModeBits(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	sourceDir := filepath.Join(ctx.Env.WorkDir, "source")
+	layer := texture.MakeModeLayer(t, sourceDir)
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	layer.ToOCILayout(t, layoutDir)
+
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, targetDir, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap"))
+	ctx.Env.BlobDir = filepath.Join(targetDir, "blobs", "sha256")
+	mountPath := filepath.Join(ctx.Env.WorkDir, "mnt")
+	nydusd := tool.MountNydusd(t, *ctx, bootstrapPath, mountPath)
+	defer nydusd.Umount()
+
+	// The setuid, setgid and sticky bits are kept along with the permission
+	// bits of all the entries.
+	names := tool.ListDir(t, sourceDir)
+	require.Equal(t, names, tool.ListDir(t, mountPath))
+	for _, name := range names {
+		expected, err := os.Lstat(filepath.Join(sourceDir, name))
+		require.NoError(t, err)
+		actual, err := os.Lstat(filepath.Join(mountPath, name))
+		require.NoError(t, err)
+		require.Equal(t, expected.Mode(), actual.Mode(), name)
+	}
+	stat, err := os.Lstat(filepath.Join(mountPath, "bin", "setuid"))
+	require.NoError(t, err)
+	require.NotZero(t, stat.Mode()&os.ModeSetuid)
+	layer.Verify(t, mountPath)
+}
+
+func (i *ImageTestSuite) TestConvertFlattenWhiteouts(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	// The whiteout in the lowest layer has no file to delete.
+	lowerLayer := texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "lower"))
+	lowerLayer.CreateWhiteout(t, "non-existent")
+	upperLayer := texture.MakeUpperLayer(t, filepath.Join(ctx.Env.WorkDir, "upper"))
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	tool.LayersToOCILayout(t, layoutDir, ocispec.MediaTypeImageLayerGzip, lowerLayer, upperLayer)
+
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --flatten-whiteouts --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, targetDir, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap"))
+	ctx.Env.BlobDir = filepath.Join(targetDir, "blobs", "sha256")
+	mountPath := filepath.Join(ctx.Env.WorkDir, "mnt")
+	nydusd := tool.MountNydusd(t, *ctx, bootstrapPath, mountPath)
+	defer nydusd.Umount()
+
+	// The whiteouts are collapsed into deletions without any marker left.
+	require.NoError(t, filepath.Walk(mountPath, func(path string, info os.FileInfo, err error) error {
+		require.NoError(t, err)
+		require.False(t, strings.HasPrefix(info.Name(), ".wh."), path)
+		return nil
+	}))
+	_, err := os.Lstat(filepath.Join(mountPath, "dir-1", "file-2"))
+	require.True(t, os.IsNotExist(err))
+	data, err := os.ReadFile(filepath.Join(mountPath, "dir-1", "file-1"))
+	require.NoError(t, err)
+	require.Equal(t, "dir-1/upper-file-1", string(data))
+	entries, err := os.ReadDir(filepath.Join(mountPath, "dir-2"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "file-1", entries[0].Name())
+	data, err = os.ReadFile(filepath.Join(mountPath, "dir-2", "file-1"))
+	require.NoError(t, err)
+	require.Equal(t, "dir-2/upper-file-1", string(data))
+}
+
+func (i *ImageTestSuite) TestConvertExcludePatterns(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	sourceDir := filepath.Join(ctx.Env.WorkDir, "source")
+	texture.MakeLowerLayer(t, sourceDir).ToOCILayout(t, filepath.Join(ctx.Env.WorkDir, "layout"))
+
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --exclude 'dir-2/**' --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, filepath.Join(ctx.Env.WorkDir, "layout"), targetDir, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap"))
+	ctx.Env.BlobDir = filepath.Join(targetDir, "blobs", "sha256")
+	mountPath := filepath.Join(ctx.Env.WorkDir, "mnt")
+	nydusd := tool.MountNydusd(t, *ctx, bootstrapPath, mountPath)
+	defer nydusd.Umount()
+
+	// The excluded directory is dropped along with its entries, the others
+	// are left untouched.
+	_, err := os.Lstat(filepath.Join(mountPath, "dir-2"))
+	require.True(t, os.IsNotExist(err))
+	expected := []string{}
+	for _, name := range tool.ListDir(t, sourceDir) {
+		if name != "dir-2" && !strings.HasPrefix(name, "dir-2/") {
+			expected = append(expected, name)
+		}
+	}
+	require.Equal(t, expected, tool.ListDir(t, mountPath))
+	data, err := os.ReadFile(filepath.Join(mountPath, "dir-1", "file-1"))
+	require.NoError(t, err)
+	require.Equal(t, "dir-1/file-1", string(data))
+}
+
+func (i *ImageTestSuite) TestBuildFromDir(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	sourceDir := filepath.Join(ctx.Env.WorkDir, "source")
+	texture.MakeLowerLayer(t, sourceDir)
+
+	target := fmt.Sprintf("localhost:%s/build-dir:nydus-%s", os.Getenv("REGISTRY_PORT"), uuid.NewString())
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-dir %s --target %s --exclude 'dir-2/**' --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, sourceDir, target, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	// The excluded directory isn't counted, each hard link is an inode of
+	// RAFS v6, RAFS v5 counts it once.
+	inodes := map[uint64]bool{}
+	entries := 1
+	require.NoError(t, filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+		require.NoError(t, err)
+		if path == filepath.Join(sourceDir, "dir-2") {
+			return filepath.SkipDir
+		}
+		inodes[info.Sys().(*syscall.Stat_t).Ino] = true
+		if path != sourceDir {
+			entries++
+		}
+		return nil
+	}))
+	expectedInodes := uint64(entries)
+	if ctx.Build.FSVersion == "5" {
+		expectedInodes = uint64(len(inodes))
+	}
+
+	inspectCmd := fmt.Sprintf(
+		"%s --log-level warn inspect --target %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, target, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "inspect"),
+	)
+	var info struct {
+		FsVersion  string            `json:"fs_version"`
+		InodeCount uint64            `json:"inode_count"`
+		Blobs      []json.RawMessage `json:"blobs"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(tool.RunWithOutput(inspectCmd)), &info))
+	require.Equal(t, ctx.Build.FSVersion, info.FsVersion)
+	require.Equal(t, expectedInodes, info.InodeCount)
+	require.Len(t, info.Blobs, 1)
+}
+
+func (i *ImageTestSuite) TestBuildFromDockerArchive(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	lowerLayer := texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "lower"))
+	upperLayer := texture.MakeUpperLayer(t, filepath.Join(ctx.Env.WorkDir, "upper"))
+	archivePath := filepath.Join(ctx.Env.WorkDir, "image.tar")
+	tool.LayersToDockerArchive(t, archivePath, "foo:latest", lowerLayer, upperLayer)
+
+	target := fmt.Sprintf("localhost:%s/build-archive:nydus-%s", os.Getenv("REGISTRY_PORT"), uuid.NewString())
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-archive %s --source-archive-tag foo --target %s --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, archivePath, target, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	inspectCmd := fmt.Sprintf(
+		"%s --log-level warn inspect --target %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, target, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "inspect"),
+	)
+	var info struct {
+		FsVersion string            `json:"fs_version"`
+		Blobs     []json.RawMessage `json:"blobs"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(tool.RunWithOutput(inspectCmd)), &info))
+	require.Equal(t, ctx.Build.FSVersion, info.FsVersion)
+	require.Len(t, info.Blobs, 2)
+
+	checkCmd := fmt.Sprintf(
+		"%s --log-level warn check --target %s --nydus-image %s --nydusd %s --work-dir %s",
+		ctx.Binary.Nydusify, target, ctx.Binary.Builder, ctx.Binary.Nydusd, filepath.Join(ctx.Env.WorkDir, "check"),
+	)
+	tool.RunWithoutOutput(t, checkCmd)
+}
+
+func (i *ImageTestSuite) TestConvertZstdLayer(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	// The source layer is compressed by zstd
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayoutWithMediaType(t, layoutDir, ocispec.MediaTypeImageLayerZstd)
+	require.Equal(t, ocispec.MediaTypeImageLayerZstd, readLayoutManifest(t, layoutDir).Layers[0].MediaType)
+
+	target := fmt.Sprintf("localhost:%s/zstd-layer:nydus-%s", os.Getenv("REGISTRY_PORT"), uuid.NewString())
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target %s --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, target, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	checkCmd := fmt.Sprintf(
+		"%s --log-level warn check --target %s --nydus-image %s --nydusd %s --work-dir %s",
+		ctx.Binary.Nydusify, target, ctx.Binary.Builder, ctx.Binary.Nydusd, filepath.Join(ctx.Env.WorkDir, "check"),
+	)
+	tool.RunWithoutOutput(t, checkCmd)
+}
+
+func (i *ImageTestSuite) TestConvertToOCILayout(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	sourceDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	lowerLayer := texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source"))
+	lowerLayer.ToOCILayout(t, sourceDir)
+
+	// Convert image into OCI image layout
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, sourceDir, targetDir, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	// Verify the manifest references all expected blobs
+	manifest := readLayoutManifest(t, targetDir)
+	// One nydus blob layer and one bootstrap layer
+	require.Len(t, manifest.Layers, 2)
+	require.Equal(t, "true", manifest.Layers[1].Annotations["containerd.io/snapshot/nydus-bootstrap"])
+}
+
+func (i *ImageTestSuite) TestConvertWithChunkDict(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	convert := func(source, target string, extraArgs ...string) (string, error) {
+		return tool.RunWithCombinedOutput(fmt.Sprintf(
+			"%s --log-level warn convert --source-path %s %s --fs-version %s --nydus-image %s --work-dir %s %s",
+			ctx.Binary.Nydusify, source, target, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"), strings.Join(extraArgs, " "),
+		))
+	}
+
+	// Push chunk dict image to registry
+	dictLayoutDir := filepath.Join(ctx.Env.WorkDir, "layout-dict")
+	texture.MakeChunkDictLayer(t, filepath.Join(ctx.Env.WorkDir, "source-dict")).ToOCILayout(t, dictLayoutDir)
+	dictRef := fmt.Sprintf("localhost:%s/chunk-dict:nydus-%s", os.Getenv("REGISTRY_PORT"), uuid.NewString())
+	output, err := convert(dictLayoutDir, "--target "+dictRef)
+	require.NoError(t, err, output)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayout(t, layoutDir)
+
+	// Convert without and with chunk dict
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	output, err = convert(layoutDir, "--target-path "+targetDir)
+	require.NoError(t, err, output)
+	dictTargetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus-dict")
+	output, err = convert(layoutDir, "--target-path "+dictTargetDir, "--chunk-dict bootstrap:registry:"+dictRef)
+	require.NoError(t, err, output)
+
+	// The chunks in dict image are referenced rather than stored in new blob
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%s/v2/chunk-dict/manifests/%s", os.Getenv("REGISTRY_PORT"), strings.SplitN(dictRef, ":", 3)[2]), nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", ocispec.MediaTypeImageManifest)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var dictImageManifest ocispec.Manifest
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&dictImageManifest))
+	dictBlobs := map[digest.Digest]bool{}
+	for _, layer := range dictImageManifest.Layers {
+		dictBlobs[layer.Digest] = true
+	}
+
+	blobSize := readLayoutManifest(t, targetDir).Layers[0].Size
+	dictManifest := readLayoutManifest(t, dictTargetDir)
+	newBlobSize := int64(0)
+	for _, layer := range dictManifest.Layers[:len(dictManifest.Layers)-1] {
+		if !dictBlobs[layer.Digest] {
+			newBlobSize += layer.Size
+		}
+	}
+	require.Less(t, newBlobSize, blobSize)
+
+	// Chunk dict with different compressor can't be used
+	output, err = convert(layoutDir, "--target-path "+dictTargetDir, "--chunk-dict bootstrap:registry:"+dictRef, "--compressor lz4_block")
+	require.Error(t, err)
+	require.Contains(t, output, "please specify the same compressor")
+}
+
+func (i *ImageTestSuite) TestConvertWithBaseBootstrap(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	// Push base image to registry
+	baseLayoutDir := filepath.Join(ctx.Env.WorkDir, "layout-base")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source-base")).ToOCILayout(t, baseLayoutDir)
+	baseRef := fmt.Sprintf("localhost:%s/base:nydus-%s", os.Getenv("REGISTRY_PORT"), uuid.NewString())
+	output := tool.RunWithOutput(fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target %s --print-result --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, baseLayoutDir, baseRef, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert-base"),
+	))
+	var baseResult struct {
+		BlobDigests []digest.Digest `json:"blob_digests"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(output), &baseResult))
+	require.Len(t, baseResult.BlobDigests, 1)
+
+	// The app image is the base layer plus the delta layer
+	appLayoutDir := filepath.Join(ctx.Env.WorkDir, "layout-app")
+	tool.LayersToOCILayout(t, appLayoutDir, ocispec.MediaTypeImageLayerGzip,
+		texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source-app-lower")),
+		texture.MakeUpperLayer(t, filepath.Join(ctx.Env.WorkDir, "source-app-upper")),
+	)
+	// The app image is a new tag in the repository of base image
+	appTag := "nydus-app-" + uuid.NewString()
+	appRef := fmt.Sprintf("localhost:%s/base:%s", os.Getenv("REGISTRY_PORT"), appTag)
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target %s --base-bootstrap %s --print-result --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, appLayoutDir, appRef, baseRef, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert-app"),
+	)
+	output = tool.RunWithOutput(convertCmd)
+	var appResult struct {
+		BlobDigests []digest.Digest `json:"blob_digests"`
+		PushedBytes int64           `json:"pushed_bytes"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(output), &appResult))
+	// The base blob is referenced by target image
+	require.Contains(t, appResult.BlobDigests, baseResult.BlobDigests[0])
+
+	checkCmd := fmt.Sprintf(
+		"%s --log-level warn check --target %s --nydus-image %s --nydusd %s --work-dir %s",
+		ctx.Binary.Nydusify, appRef, ctx.Binary.Builder, ctx.Binary.Nydusd, filepath.Join(ctx.Env.WorkDir, "check"),
+	)
+	tool.RunWithoutOutput(t, checkCmd)
+
+	// Only the delta blob and bootstrap are pushed, the base blob isn't
+	// pushed again.
+	manifestBytes, _ := getFromRegistry(t, "base/manifests/"+appTag, ocispec.MediaTypeImageManifest)
+	var appManifest ocispec.Manifest
+	require.NoError(t, json.Unmarshal(manifestBytes, &appManifest))
+	deltaSize := int64(0)
+	for _, layer := range appManifest.Layers {
+		if layer.Digest != baseResult.BlobDigests[0] {
+			deltaSize += layer.Size
+		}
+	}
+	require.Equal(t, deltaSize, appResult.PushedBytes)
+
+	// The base image should be a nydus image
+	output, err := tool.RunWithCombinedOutput(fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target %s --base-bootstrap %s --dry-run --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, appLayoutDir, appRef, i.prepareImage(t, "busybox:latest"), ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert-app"),
+	))
+	require.Error(t, err)
+	require.Contains(t, output, "not a nydus image")
+}
+
+func (i *ImageTestSuite) TestMergeBootstraps(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	packOption := converter.PackOption{
+		BuilderPath: ctx.Binary.Builder,
+		Compressor:  ctx.Build.Compressor,
+		FsVersion:   ctx.Build.FSVersion,
+		ChunkSize:   ctx.Build.ChunkSize,
+	}
+	mergeOption := converter.MergeOption{
+		BuilderPath: ctx.Binary.Builder,
+	}
+
+	// Build lower and upper layers independently
+	lowerLayer := texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source-lower"))
+	lowerBlobDigest := lowerLayer.Pack(t, packOption, ctx.Env.BlobDir)
+	_, lowerBootstrap := tool.MergeLayers(t, *ctx, mergeOption, []converter.Layer{
+		{Digest: lowerBlobDigest},
+	})
+	upperLayer := texture.MakeUpperLayer(t, filepath.Join(ctx.Env.WorkDir, "source-upper"))
+	upperBlobDigest := upperLayer.Pack(t, packOption, ctx.Env.BlobDir)
+	_, upperBootstrap := tool.MergeLayers(t, *ctx, mergeOption, []converter.Layer{
+		{Digest: upperBlobDigest},
+	})
+
+	// Merge the bootstraps into a single image and push it to registry
+	tag := "merge-" + uuid.NewString()
+	target := fmt.Sprintf("localhost:%s/merge:%s", os.Getenv("REGISTRY_PORT"), tag)
+	mergedBootstrap := filepath.Join(ctx.Env.WorkDir, "bootstrap-merged")
+	output, err := tool.RunWithCombinedOutput(fmt.Sprintf(
+		"%s --log-level warn merge --bootstrap %s --bootstrap %s --blob-dir %s --target %s --output-bootstrap %s --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, lowerBootstrap, upperBootstrap, ctx.Env.BlobDir, target, mergedBootstrap,
+		ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "merge"),
+	))
+	require.NoError(t, err, output)
+
+	// The upper layer overrides the lower layer in merged image
+	ctx.Env.BootstrapPath = mergedBootstrap
+	tool.Verify(t, *ctx, texture.ExpectedOverlay(lowerLayer, upperLayer))
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%s/v2/merge/manifests/%s", os.Getenv("REGISTRY_PORT"), tag), nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", ocispec.MediaTypeImageManifest)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var manifest ocispec.Manifest
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&manifest))
+	require.Len(t, manifest.Layers, 3)
+	require.Equal(t, lowerBlobDigest, manifest.Layers[0].Digest)
+	require.Equal(t, upperBlobDigest, manifest.Layers[1].Digest)
+	require.Equal(t, "true", manifest.Layers[2].Annotations["containerd.io/snapshot/nydus-bootstrap"])
+}
+
+func (i *ImageTestSuite) TestConvertAndSign(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayout(t, layoutDir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	keyPath := filepath.Join(ctx.Env.WorkDir, "sign.key")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+
+	tag := "nydus-" + uuid.NewString()
+	target := fmt.Sprintf("localhost:%s/sign:%s", os.Getenv("REGISTRY_PORT"), tag)
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target %s --sign-key %s --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, target, keyPath, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	// Verify the cosign signature of target manifest with public key
+	_, header := getFromRegistry(t, "sign/manifests/"+tag, ocispec.MediaTypeImageManifest)
+	manifestDigest := digest.Digest(header.Get("Docker-Content-Digest"))
+	require.NoError(t, manifestDigest.Validate())
+
+	data, _ := getFromRegistry(t, fmt.Sprintf("sign/manifests/%s-%s.sig", manifestDigest.Algorithm(), manifestDigest.Hex()), ocispec.MediaTypeImageManifest)
+	var sigManifest ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &sigManifest))
+	require.Len(t, sigManifest.Layers, 1)
+	layer := sigManifest.Layers[0]
+	require.Equal(t, "application/vnd.dev.cosign.simplesigning.v1+json", layer.MediaType)
+
+	payload, _ := getFromRegistry(t, "sign/blobs/"+layer.Digest.String(), "*/*")
+	require.Contains(t, string(payload), manifestDigest.String())
+	signature, err := base64.StdEncoding.DecodeString(layer.Annotations["dev.cosignproject.cosign/signature"])
+	require.NoError(t, err)
+	hash := sha256.Sum256(payload)
+	require.True(t, ecdsa.VerifyASN1(&key.PublicKey, hash[:], signature))
+}
+
+func (i *ImageTestSuite) TestConvertWithSBOM(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayout(t, layoutDir)
+
+	sbom := []byte(`{"spdxVersion":"SPDX-2.3","dataLicense":"CC0-1.0","SPDXID":"SPDXRef-DOCUMENT","name":"lower"}`)
+	sbomPath := filepath.Join(ctx.Env.WorkDir, "sbom.spdx.json")
+	require.NoError(t, os.WriteFile(sbomPath, sbom, 0644))
+
+	tag := "nydus-" + uuid.NewString()
+	target := fmt.Sprintf("localhost:%s/sbom:%s", os.Getenv("REGISTRY_PORT"), tag)
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target %s --sbom %s --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, target, sbomPath, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	_, header := getFromRegistry(t, "sbom/manifests/"+tag, ocispec.MediaTypeImageManifest)
+	manifestDigest := digest.Digest(header.Get("Docker-Content-Digest"))
+	require.NoError(t, manifestDigest.Validate())
+
+	// The referrers are listed by the tag fallback if the registry doesn't
+	// support referrers API.
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%s/v2/sbom/referrers/%s", os.Getenv("REGISTRY_PORT"), manifestDigest))
+	require.NoError(t, err)
+	resp.Body.Close()
+	var data []byte
+	if resp.StatusCode == http.StatusOK {
+		data, _ = getFromRegistry(t, "sbom/referrers/"+manifestDigest.String(), ocispec.MediaTypeImageIndex)
+	} else {
+		data, _ = getFromRegistry(t, fmt.Sprintf("sbom/manifests/%s-%s", manifestDigest.Algorithm(), manifestDigest.Hex()), ocispec.MediaTypeImageIndex)
+	}
+	var index ocispec.Index
+	require.NoError(t, json.Unmarshal(data, &index))
+	require.Len(t, index.Manifests, 1)
+	require.Equal(t, "application/spdx+json", index.Manifests[0].ArtifactType)
+
+	data, _ = getFromRegistry(t, "sbom/manifests/"+index.Manifests[0].Digest.String(), ocispec.MediaTypeImageManifest)
+	var referrer ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &referrer))
+	require.Equal(t, manifestDigest, referrer.Subject.Digest)
+	require.Len(t, referrer.Layers, 1)
+	require.Equal(t, "application/spdx+json", referrer.Layers[0].MediaType)
+	data, _ = getFromRegistry(t, "sbom/blobs/"+referrer.Layers[0].Digest.String(), "*/*")
+	require.Equal(t, sbom, data)
+}
+
+func (i *ImageTestSuite) TestConvertAttachProvenance(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayout(t, layoutDir)
+	indexData, err := os.ReadFile(filepath.Join(layoutDir, ocispec.ImageIndexFile))
+	require.NoError(t, err)
+	var sourceIndex ocispec.Index
+	require.NoError(t, json.Unmarshal(indexData, &sourceIndex))
+	require.Len(t, sourceIndex.Manifests, 1)
+
+	tag := "nydus-" + uuid.NewString()
+	target := fmt.Sprintf("localhost:%s/provenance:%s", os.Getenv("REGISTRY_PORT"), tag)
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target %s --provenance --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, target, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	_, header := getFromRegistry(t, "provenance/manifests/"+tag, ocispec.MediaTypeImageManifest)
+	manifestDigest := digest.Digest(header.Get("Docker-Content-Digest"))
+	require.NoError(t, manifestDigest.Validate())
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%s/v2/provenance/referrers/%s", os.Getenv("REGISTRY_PORT"), manifestDigest))
+	require.NoError(t, err)
+	resp.Body.Close()
+	var data []byte
+	if resp.StatusCode == http.StatusOK {
+		data, _ = getFromRegistry(t, "provenance/referrers/"+manifestDigest.String(), ocispec.MediaTypeImageIndex)
+	} else {
+		data, _ = getFromRegistry(t, fmt.Sprintf("provenance/manifests/%s-%s", manifestDigest.Algorithm(), manifestDigest.Hex()), ocispec.MediaTypeImageIndex)
+	}
+	var index ocispec.Index
+	require.NoError(t, json.Unmarshal(data, &index))
+	require.Len(t, index.Manifests, 1)
+	require.Equal(t, "application/vnd.in-toto+json", index.Manifests[0].ArtifactType)
+
+	data, _ = getFromRegistry(t, "provenance/manifests/"+index.Manifests[0].Digest.String(), ocispec.MediaTypeImageManifest)
+	var referrer ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &referrer))
+	require.Equal(t, manifestDigest, referrer.Subject.Digest)
+	require.Len(t, referrer.Layers, 1)
+	data, _ = getFromRegistry(t, "provenance/blobs/"+referrer.Layers[0].Digest.String(), "*/*")
+
+	// The statement references the digests of both source and target images.
+	var statement struct {
+		Subject []struct {
+			Digest map[string]string `json:"digest"`
+		} `json:"subject"`
+		PredicateType string `json:"predicateType"`
+		Predicate     struct {
+			BuildDefinition struct {
+				ExternalParameters   map[string]interface{} `json:"externalParameters"`
+				ResolvedDependencies []struct {
+					URI    string            `json:"uri"`
+					Digest map[string]string `json:"digest"`
+				} `json:"resolvedDependencies"`
+			} `json:"buildDefinition"`
+		} `json:"predicate"`
+	}
+	require.NoError(t, json.Unmarshal(data, &statement))
+	require.Equal(t, "https://slsa.dev/provenance/v1", statement.PredicateType)
+	require.Len(t, statement.Subject, 1)
+	require.Equal(t, manifestDigest.Hex(), statement.Subject[0].Digest["sha256"])
+	dependencies := statement.Predicate.BuildDefinition.ResolvedDependencies
+	require.Len(t, dependencies, 1)
+	require.Equal(t, layoutDir, dependencies[0].URI)
+	require.Equal(t, sourceIndex.Manifests[0].Digest.Hex(), dependencies[0].Digest["sha256"])
+	require.Equal(t, ctx.Build.FSVersion, statement.Predicate.BuildDefinition.ExternalParameters["FsVersion"])
+}
+
+func (i *ImageTestSuite) TestConvertHybridOutput(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayout(t, layoutDir)
+	indexBytes, err := os.ReadFile(filepath.Join(layoutDir, "index.json"))
+	require.NoError(t, err)
+	var layoutIndex ocispec.Index
+	require.NoError(t, json.Unmarshal(indexBytes, &layoutIndex))
+	sourceDigest := layoutIndex.Manifests[0].Digest
+
+	tag := "hybrid-" + uuid.NewString()
+	target := fmt.Sprintf("localhost:%s/hybrid:%s", os.Getenv("REGISTRY_PORT"), tag)
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target %s --oci --hybrid-output --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, target, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	// The target is the source image with the original OCI layers.
+	data, header := getFromRegistry(t, "hybrid/manifests/"+tag, ocispec.MediaTypeImageManifest)
+	require.Equal(t, sourceDigest.String(), header.Get("Docker-Content-Digest"))
+	var manifest ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	require.Len(t, manifest.Layers, 1)
+	require.Equal(t, ocispec.MediaTypeImageLayerGzip, manifest.Layers[0].MediaType)
+
+	// The Nydus image is listed as a referrer of target image.
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%s/v2/hybrid/referrers/%s", os.Getenv("REGISTRY_PORT"), sourceDigest))
+	require.NoError(t, err)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		data, _ = getFromRegistry(t, "hybrid/referrers/"+sourceDigest.String(), ocispec.MediaTypeImageIndex)
+	} else {
+		data, _ = getFromRegistry(t, fmt.Sprintf("hybrid/manifests/%s-%s", sourceDigest.Algorithm(), sourceDigest.Hex()), ocispec.MediaTypeImageIndex)
+	}
+	var referrers ocispec.Index
+	require.NoError(t, json.Unmarshal(data, &referrers))
+	require.Len(t, referrers.Manifests, 1)
+	require.Equal(t, "application/vnd.nydus.image", referrers.Manifests[0].ArtifactType)
+
+	data, _ = getFromRegistry(t, "hybrid/manifests/"+referrers.Manifests[0].Digest.String(), ocispec.MediaTypeImageManifest)
+	var nydusManifest ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &nydusManifest))
+	require.Equal(t, sourceDigest, nydusManifest.Subject.Digest)
+	bootstrapLayer := nydusManifest.Layers[len(nydusManifest.Layers)-1]
+	require.Equal(t, "true", bootstrapLayer.Annotations["containerd.io/snapshot/nydus-bootstrap"])
+	for _, layer := range nydusManifest.Layers {
+		getFromRegistry(t, "hybrid/blobs/"+layer.Digest.String(), "*/*")
+	}
+}
+
+func (i *ImageTestSuite) TestConvertDryRun(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayout(t, layoutDir)
+
+	tag := "nydus-" + uuid.NewString()
+	target := fmt.Sprintf("localhost:%s/dry-run:%s", os.Getenv("REGISTRY_PORT"), tag)
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target %s --dry-run --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, target, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	output := tool.RunWithOutput(convertCmd)
+
+	var plan struct {
+		Target      string            `json:"target"`
+		Layers      []json.RawMessage `json:"layers"`
+		BuiltBytes  int64             `json:"built_bytes"`
+		ReusedBytes int64             `json:"reused_bytes"`
+		TotalBytes  int64             `json:"total_bytes"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(output), &plan))
+	require.Equal(t, target, plan.Target)
+	require.NotEmpty(t, plan.Layers)
+	require.Equal(t, plan.BuiltBytes+plan.ReusedBytes, plan.TotalBytes)
+
+	// The target image isn't pushed to registry.
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%s/v2/dry-run/manifests/%s", os.Getenv("REGISTRY_PORT"), tag))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func (i *ImageTestSuite) TestConvertWithResult(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayout(t, layoutDir)
+
+	tag := "nydus-" + uuid.NewString()
+	target := fmt.Sprintf("localhost:%s/result:%s", os.Getenv("REGISTRY_PORT"), tag)
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target %s --print-result --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, target, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	output := tool.RunWithOutput(convertCmd)
+
+	var result struct {
+		TargetDigest digest.Digest   `json:"target_digest"`
+		BlobDigests  []digest.Digest `json:"blob_digests"`
+		PushedBytes  int64           `json:"pushed_bytes"`
+		DedupRatio   float64         `json:"dedup_ratio"`
+		Elapsed      int64           `json:"elapsed"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(output), &result))
+	require.NotEmpty(t, result.TargetDigest)
+	require.Len(t, result.BlobDigests, 1)
+	require.Positive(t, result.PushedBytes)
+	require.Zero(t, result.DedupRatio)
+	require.Positive(t, result.Elapsed)
+
+	// The target manifest in registry matches the result.
+	req, err := http.NewRequest(http.MethodHead, fmt.Sprintf("http://localhost:%s/v2/result/manifests/%s", os.Getenv("REGISTRY_PORT"), tag), nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", ocispec.MediaTypeImageManifest)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, result.TargetDigest.String(), resp.Header.Get("Docker-Content-Digest"))
+}
+
+func (i *ImageTestSuite) TestInspectImage(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	sourceDir := filepath.Join(ctx.Env.WorkDir, "source")
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, sourceDir).ToOCILayout(t, layoutDir)
+
+	target := fmt.Sprintf("localhost:%s/inspect:nydus-%s", os.Getenv("REGISTRY_PORT"), uuid.NewString())
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	for _, arg := range []string{"--target " + target, "--target-path " + targetDir} {
+		convertCmd := fmt.Sprintf(
+			"%s --log-level warn convert --source-path %s %s --compressor lz4_block --fs-version %s --nydus-image %s --work-dir %s",
+			ctx.Binary.Nydusify, layoutDir, arg, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+		)
+		tool.RunWithoutOutput(t, convertCmd)
+	}
+
+	// Each hard link is an inode of RAFS v6, RAFS v5 counts it once.
+	inodes := map[uint64]bool{}
+	entries := 1
+	require.NoError(t, filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+		require.NoError(t, err)
+		inodes[info.Sys().(*syscall.Stat_t).Ino] = true
+		if path != sourceDir {
+			entries++
+		}
+		return nil
+	}))
+	expectedInodes := uint64(entries)
+	if ctx.Build.FSVersion == "5" {
+		expectedInodes = uint64(len(inodes))
+	}
+
+	// The registry image and the local bootstrap are inspected the same.
+	bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap"))
+	for _, ref := range []string{target, bootstrapPath} {
+		inspectCmd := fmt.Sprintf(
+			"%s --log-level warn inspect --target %s --nydus-image %s --work-dir %s",
+			ctx.Binary.Nydusify, ref, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "inspect"),
+		)
+		var info struct {
+			FsVersion  string `json:"fs_version"`
+			Compressor string `json:"compressor"`
+			ChunkSize  uint32 `json:"chunk_size"`
+			InodeCount uint64 `json:"inode_count"`
+			Blobs      []struct {
+				ID             string `json:"blob_id"`
+				CompressedSize uint64 `json:"compressed_size"`
+			} `json:"blobs"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(tool.RunWithOutput(inspectCmd)), &info))
+		require.Equal(t, ctx.Build.FSVersion, info.FsVersion, ref)
+		require.Equal(t, "lz4_block", info.Compressor, ref)
+		require.Equal(t, uint32(0x100000), info.ChunkSize, ref)
+		require.Equal(t, expectedInodes, info.InodeCount, ref)
+		require.Len(t, info.Blobs, 1, ref)
+		require.Positive(t, info.Blobs[0].CompressedSize, ref)
+	}
+}
+
+func (i *ImageTestSuite) TestConvertChunkSize(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	// The pseudo-random file has no duplicated chunks to be deduplicated.
+	const fileSize = 8 << 20
+	sourceDir := filepath.Join(ctx.Env.WorkDir, "source")
+	layer := tool.NewLayer(t, sourceDir)
+	layer.CreateLargeFile(t, "large", fileSize, 1)
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	layer.ToOCILayout(t, layoutDir)
+
+	// The chunk size is accepted in both hex and human readable formats,
+	// and the file is split into chunks of the size.
+	for chunkSize, expected := range map[string]uint32{"0x100000": 0x100000, "256KiB": 0x40000} {
+		targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus-"+chunkSize)
+		convertCmd := fmt.Sprintf(
+			"%s --log-level warn convert --source-path %s --target-path %s --chunk-size %s --fs-version %s --nydus-image %s --work-dir %s",
+			ctx.Binary.Nydusify, layoutDir, targetDir, chunkSize, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+		)
+		tool.RunWithoutOutput(t, convertCmd)
+
+		bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap-"+chunkSize))
+		inspectCmd := fmt.Sprintf(
+			"%s --log-level warn inspect --target %s --nydus-image %s --work-dir %s",
+			ctx.Binary.Nydusify, bootstrapPath, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "inspect"),
+		)
+		var info struct {
+			ChunkSize uint32 `json:"chunk_size"`
+			Blobs     []struct {
+				ChunkCount uint32 `json:"chunk_count"`
+			} `json:"blobs"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(tool.RunWithOutput(inspectCmd)), &info))
+		require.Equal(t, expected, info.ChunkSize, chunkSize)
+		require.Len(t, info.Blobs, 1, chunkSize)
+		require.Equal(t, uint32(fileSize/expected), info.Blobs[0].ChunkCount, chunkSize)
+	}
+}
+
+func (i *ImageTestSuite) TestConvertBlobAnnotations(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	lowerLayer := texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "lower"))
+	upperLayer := texture.MakeUpperLayer(t, filepath.Join(ctx.Env.WorkDir, "upper"))
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	tool.LayersToOCILayout(t, layoutDir, ocispec.MediaTypeImageLayerGzip, lowerLayer, upperLayer)
+	sourceLayers := map[string]bool{}
+	for _, layer := range readLayoutManifest(t, layoutDir).Layers {
+		sourceLayers[layer.Digest.String()] = true
+	}
+
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --blob-annotations --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, targetDir, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap"))
+	inspectCmd := fmt.Sprintf(
+		"%s --log-level warn inspect --target %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, bootstrapPath, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "inspect"),
+	)
+	var info struct {
+		Blobs []struct {
+			ID               string `json:"blob_id"`
+			DecompressedSize uint64 `json:"decompressed_size"`
+			ChunkCount       uint32 `json:"chunk_count"`
+		} `json:"blobs"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(tool.RunWithOutput(inspectCmd)), &info))
+
+	// Each blob layer is annotated with its distinct source layer, and the
+	// same chunk count and uncompressed size as reported by inspect.
+	blobLayers := map[string]ocispec.Descriptor{}
+	for _, layer := range readLayoutManifest(t, targetDir).Layers {
+		if layer.Annotations["containerd.io/snapshot/nydus-blob"] == "true" {
+			blobLayers[layer.Digest.Hex()] = layer
+		}
+	}
+	require.Len(t, blobLayers, 2)
+	require.Len(t, info.Blobs, 2)
+	for _, blob := range info.Blobs {
+		layer, ok := blobLayers[blob.ID]
+		require.True(t, ok, blob.ID)
+		require.Positive(t, blob.ChunkCount, blob.ID)
+		require.Equal(t, fmt.Sprint(blob.ChunkCount), layer.Annotations["io.nydus.blob.chunk.count"], blob.ID)
+		require.Equal(t, fmt.Sprint(blob.DecompressedSize), layer.Annotations["io.nydus.blob.uncompressed.size"], blob.ID)
+		source := layer.Annotations["io.nydus.blob.source.digest"]
+		require.True(t, sourceLayers[source], blob.ID)
+		delete(sourceLayers, source)
+	}
+}
+
+func (i *ImageTestSuite) TestConvertBootstrapCompressed(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layer, _ := texture.MakeDeepTreeLayer(t, filepath.Join(ctx.Env.WorkDir, "source"), 256)
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	layer.ToOCILayout(t, layoutDir)
+
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, targetDir, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	// The bootstrap layer is always pushed as gzip compressed tar, which is
+	// smaller than the bootstrap of many directories.
+	manifest := readLayoutManifest(t, targetDir)
+	bootstrapLayer := manifest.Layers[len(manifest.Layers)-1]
+	require.True(t, strings.HasSuffix(bootstrapLayer.MediaType, "gzip"), bootstrapLayer.MediaType)
+	bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap"))
+	stat, err := os.Stat(bootstrapPath)
+	require.NoError(t, err)
+	require.Less(t, bootstrapLayer.Size, stat.Size())
+
+	// The compressed bootstrap layer is decompressed by inspect.
+	inspectCmd := fmt.Sprintf(
+		"%s --log-level warn inspect --target %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, filepath.Join(targetDir, "blobs", "sha256", bootstrapLayer.Digest.Hex()), ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "inspect"),
+	)
+	var info struct {
+		InodeCount uint64 `json:"inode_count"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(tool.RunWithOutput(inspectCmd)), &info))
+	require.Greater(t, info.InodeCount, uint64(256))
+}
+
+func (i *ImageTestSuite) TestConvertLayerMap(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	lowerLayer := texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "lower"))
+	upperLayer := texture.MakeUpperLayer(t, filepath.Join(ctx.Env.WorkDir, "upper"))
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	tool.LayersToOCILayout(t, layoutDir, ocispec.MediaTypeImageLayerGzip, lowerLayer, upperLayer)
+
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --print-result --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, targetDir, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	output := tool.RunWithOutput(convertCmd)
+
+	var result struct {
+		BlobDigests []digest.Digest                 `json:"blob_digests"`
+		LayerMap    map[digest.Digest]digest.Digest `json:"layer_map"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(output), &result))
+
+	// Each source layer is mapped to the blob in target image.
+	sourceManifest := readLayoutManifest(t, layoutDir)
+	require.Len(t, sourceManifest.Layers, 2)
+	require.Len(t, result.LayerMap, 2)
+	for _, layer := range sourceManifest.Layers {
+		require.Contains(t, result.LayerMap, layer.Digest)
+		require.Contains(t, result.BlobDigests, result.LayerMap[layer.Digest])
+	}
+	require.NotEqual(t, result.LayerMap[sourceManifest.Layers[0].Digest], result.LayerMap[sourceManifest.Layers[1].Digest])
+}
+
+func (i *ImageTestSuite) TestConvertBuildCacheDir(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayout(t, layoutDir)
+
+	// The wrapper records each subcommand the builder runs.
+	logPath := filepath.Join(ctx.Env.WorkDir, "builder.log")
+	builderPath := filepath.Join(ctx.Env.WorkDir, "nydus-image")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$1\" >> %s\nexec %s \"$@\"\n", logPath, ctx.Binary.Builder)
+	require.NoError(t, os.WriteFile(builderPath, []byte(script), 0755))
+	builds := func() int {
+		data, err := os.ReadFile(logPath)
+		require.NoError(t, err)
+		return strings.Count(string(data), "create\n")
+	}
+
+	cacheDir := filepath.Join(ctx.Env.WorkDir, "build-cache")
+	convert := func() map[digest.Digest]digest.Digest {
+		target := fmt.Sprintf("localhost:%s/build-cache-dir:nydus-%s", os.Getenv("REGISTRY_PORT"), uuid.NewString())
+		convertCmd := fmt.Sprintf(
+			"%s --log-level warn convert --source-path %s --target %s --build-cache-dir %s --print-result --fs-version %s --nydus-image %s --work-dir %s",
+			ctx.Binary.Nydusify, layoutDir, target, cacheDir, ctx.Build.FSVersion, builderPath, filepath.Join(ctx.Env.WorkDir, "convert"),
+		)
+		var result struct {
+			LayerMap map[digest.Digest]digest.Digest `json:"layer_map"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(tool.RunWithOutput(convertCmd)), &result))
+		require.Len(t, result.LayerMap, 1)
+		return result.LayerMap
+	}
+
+	// The layer is only built by the first conversion.
+	layerMap := convert()
+	require.Equal(t, 1, builds())
+	require.Equal(t, layerMap, convert())
+	require.Equal(t, 1, builds())
+}
+
+func (i *ImageTestSuite) TestConvertSharedBlobDir(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	lowerLayer := texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "lower"))
+	upperLayer := texture.MakeUpperLayer(t, filepath.Join(ctx.Env.WorkDir, "upper"))
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	tool.LayersToOCILayout(t, layoutDir, ocispec.MediaTypeImageLayerGzip, lowerLayer, upperLayer)
+
+	// The conversions of the same layers share the blob directory
+	// concurrently.
+	blobDir := filepath.Join(ctx.Env.WorkDir, "shared-blobs")
+	wg := sync.WaitGroup{}
+	errs := make([]error, 4)
+	for idx := range errs {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			convertCmd := fmt.Sprintf(
+				"%s --log-level warn convert --source-path %s --target-path %s --shared-blob-dir %s --fs-version %s --nydus-image %s --work-dir %s",
+				ctx.Binary.Nydusify, layoutDir, filepath.Join(ctx.Env.WorkDir, fmt.Sprintf("layout-nydus-%d", idx)), blobDir,
+				ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, fmt.Sprintf("convert-%d", idx)),
+			)
+			_, errs[idx] = tool.RunWithCombinedOutput(convertCmd)
+		}(idx)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	// Each blob is stored once by digest without partial files.
+	entries, err := os.ReadDir(blobDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(blobDir, entry.Name()))
+		require.NoError(t, err)
+		require.Equal(t, entry.Name(), digest.FromBytes(data).Hex())
+	}
+
+	// The image is mounted with the blobs in shared directory.
+	bootstrapPath := extractLayoutBootstrap(t, filepath.Join(ctx.Env.WorkDir, "layout-nydus-0"), filepath.Join(ctx.Env.WorkDir, "bootstrap"))
+	ctx.Env.BlobDir = blobDir
+	mountPath := filepath.Join(ctx.Env.WorkDir, "mnt")
+	nydusd := tool.MountNydusd(t, *ctx, bootstrapPath, mountPath)
+	defer nydusd.Umount()
+	tool.VerifyDir(t, mountPath, texture.ExpectedOverlay(lowerLayer, upperLayer))
+}
+
+func (i *ImageTestSuite) TestConvertEmptyLayer(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	lowerLayer := texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "lower"))
+	emptyLayer := texture.MakeEmptyLayer(t, filepath.Join(ctx.Env.WorkDir, "empty"))
+	upperLayer := texture.MakeUpperLayer(t, filepath.Join(ctx.Env.WorkDir, "upper"))
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	tool.LayersToOCILayout(t, layoutDir, ocispec.MediaTypeImageLayerGzip, lowerLayer, emptyLayer, upperLayer)
+	require.Empty(t, emptyLayer.FileTree)
+
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, targetDir, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	// The empty layer contributes nothing to the merged tree.
+	bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap"))
+	ctx.Env.BlobDir = filepath.Join(targetDir, "blobs", "sha256")
+	mountPath := filepath.Join(ctx.Env.WorkDir, "mnt")
+	nydusd := tool.MountNydusd(t, *ctx, bootstrapPath, mountPath)
+	defer nydusd.Umount()
+	tool.VerifyDir(t, mountPath, texture.ExpectedOverlay(lowerLayer, upperLayer))
+}
+
+func (i *ImageTestSuite) TestConvertMediaTypeScheme(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayout(t, layoutDir)
+
+	for _, c := range []struct {
+		scheme    string
+		manifest  string
+		config    string
+		bootstrap string
+	}{
+		// The media types of OCI source image are kept.
+		{"containerd", ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageConfig, ocispec.MediaTypeImageLayerGzip},
+		{"oci", ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageConfig, ocispec.MediaTypeImageLayerGzip},
+		{"docker", images.MediaTypeDockerSchema2Manifest, images.MediaTypeDockerSchema2Config, images.MediaTypeDockerSchema2LayerGzip},
+	} {
+		targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus-"+c.scheme)
+		convertCmd := fmt.Sprintf(
+			"%s --log-level warn convert --source-path %s --target-path %s --media-type-scheme %s --fs-version %s --nydus-image %s --work-dir %s",
+			ctx.Binary.Nydusify, layoutDir, targetDir, c.scheme, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+		)
+		tool.RunWithoutOutput(t, convertCmd)
+
+		manifest := readLayoutManifest(t, targetDir)
+		require.Equal(t, c.manifest, manifest.MediaType, c.scheme)
+		require.Equal(t, c.config, manifest.Config.MediaType, c.scheme)
+		require.Len(t, manifest.Layers, 2)
+		// The nydus blob layer always has the vendor type.
+		require.Equal(t, converter.MediaTypeNydusBlob, manifest.Layers[0].MediaType, c.scheme)
+		require.Equal(t, c.bootstrap, manifest.Layers[1].MediaType, c.scheme)
+	}
+}
+
+func (i *ImageTestSuite) TestConvertVerifyAfterBuild(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayout(t, layoutDir)
+
+	for _, compressor := range []string{"zstd", "none"} {
+		target := fmt.Sprintf("localhost:%s/verify-after-build:nydus-%s", os.Getenv("REGISTRY_PORT"), uuid.NewString())
+		convertCmd := fmt.Sprintf(
+			"%s --log-level warn convert --source-path %s --target %s --verify-after-build --compressor %s --fs-version %s --nydus-image %s --work-dir %s",
+			ctx.Binary.Nydusify, layoutDir, target, compressor, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+		)
+		tool.RunWithoutOutput(t, convertCmd)
+
+		checkCmd := fmt.Sprintf(
+			"%s --log-level warn check --target %s --nydus-image %s --nydusd %s --work-dir %s",
+			ctx.Binary.Nydusify, target, ctx.Binary.Builder, ctx.Binary.Nydusd, filepath.Join(ctx.Env.WorkDir, "check"),
+		)
+		tool.RunWithoutOutput(t, checkCmd)
+	}
+}
+
+func (i *ImageTestSuite) TestConvertSkipIncompressible(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	// The pseudo-random content can't be compressed, while the text can.
+	mediaLayer := tool.NewLayer(t, filepath.Join(ctx.Env.WorkDir, "media"))
+	mediaLayer.CreateLargeFile(t, "media.bin", 4<<20, 1)
+	textLayer := tool.NewLayer(t, filepath.Join(ctx.Env.WorkDir, "text"))
+	textLayer.CreateFile(t, "text.log", []byte(strings.Repeat("nydus text layer\n", 256<<10)))
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	tool.LayersToOCILayout(t, layoutDir, ocispec.MediaTypeImageLayerGzip, mediaLayer, textLayer)
+
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --skip-incompressible-threshold 0.9 --compressor zstd --fs-version 6 --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, targetDir, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	// The media blob is stored uncompressed, the text blob is still compressed.
+	manifest := readLayoutManifest(t, targetDir)
+	require.Len(t, manifest.Layers, 3)
+	require.GreaterOrEqual(t, manifest.Layers[0].Size, int64(4<<20))
+	require.Less(t, manifest.Layers[1].Size, int64(1<<20))
+
+	bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap"))
+	ctx.Env.BlobDir = filepath.Join(targetDir, "blobs", "sha256")
+	mountPath := filepath.Join(ctx.Env.WorkDir, "mnt")
+	nydusd := tool.MountNydusd(t, *ctx, bootstrapPath, mountPath)
+	defer nydusd.Umount()
+	mediaLayer.Overlay(t, textLayer).Verify(t, mountPath)
+
+	// Failure situation
+	output, err := tool.RunWithCombinedOutput(fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --skip-incompressible-threshold 0.9 --fs-version 5 --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, filepath.Join(ctx.Env.WorkDir, "layout-v5"), ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert-v5"),
+	))
+	require.Error(t, err)
+	require.Contains(t, output, "skipping incompressible blobs isn't supported with fs version 5")
+}
+
+func (i *ImageTestSuite) TestConvertWithSourceDiffIDs(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayout(t, layoutDir)
+	manifest := readLayoutManifest(t, layoutDir)
+	configBytes, err := os.ReadFile(filepath.Join(layoutDir, "blobs", manifest.Config.Digest.Algorithm().String(), manifest.Config.Digest.Hex()))
+	require.NoError(t, err)
+	var config ocispec.Image
+	require.NoError(t, json.Unmarshal(configBytes, &config))
+	require.Len(t, config.RootFS.DiffIDs, 1)
+	layer := manifest.Layers[0].Digest
+
+	convert := func(diffID digest.Digest, name string) (string, error) {
+		return tool.RunWithCombinedOutput(fmt.Sprintf(
+			"%s --log-level warn convert --source-path %s --target-path %s --source-diff-id %s=%s --fs-version %s --nydus-image %s --work-dir %s",
+			ctx.Binary.Nydusify, layoutDir, filepath.Join(ctx.Env.WorkDir, "layout-"+name), layer, diffID, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert-"+name),
+		))
+	}
+	_, err = convert(config.RootFS.DiffIDs[0], "nydus")
+	require.NoError(t, err)
+	readLayoutManifest(t, filepath.Join(ctx.Env.WorkDir, "layout-nydus"))
+
+	// Failure situation
+	wrong := digest.FromString("wrong diff id")
+	output, err := convert(wrong, "wrong")
+	require.Error(t, err)
+	require.Contains(t, output, fmt.Sprintf("diff id %s of layer %s doesn't match %s in image config", wrong, layer, config.RootFS.DiffIDs[0]))
+}
+
+func (i *ImageTestSuite) TestConvertEncrypt(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	// The uncompressed chunk data is plaintext-recoverable from blob unless
+	// it's encrypted.
+	marker := "nydus-plaintext-" + uuid.NewString()
+	layer := tool.NewLayer(t, filepath.Join(ctx.Env.WorkDir, "source"))
+	layer.CreateFile(t, "secret", []byte(strings.Repeat(marker, 1024)))
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	layer.ToOCILayout(t, layoutDir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	keyPath := filepath.Join(ctx.Env.WorkDir, "encrypt.pem")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+
+	blobs := func(encrypt string) []string {
+		tag := "nydus-" + uuid.NewString()
+		target := fmt.Sprintf("localhost:%s/encrypt:%s", os.Getenv("REGISTRY_PORT"), tag)
+		convertCmd := fmt.Sprintf(
+			"%s --log-level warn convert --source-path %s --target %s %s --compressor none --fs-version 6 --nydus-image %s --work-dir %s",
+			ctx.Binary.Nydusify, layoutDir, target, encrypt, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+		)
+		tool.RunWithoutOutput(t, convertCmd)
+
+		data, _ := getFromRegistry(t, "encrypt/manifests/"+tag, ocispec.MediaTypeImageManifest)
+		var manifest ocispec.Manifest
+		require.NoError(t, json.Unmarshal(data, &manifest))
+		blobs := []string{}
+		for _, layer := range manifest.Layers {
+			data, _ := getFromRegistry(t, "encrypt/blobs/"+layer.Digest.String(), "*/*")
+			blobs = append(blobs, string(data))
+		}
+		return blobs
+	}
+
+	// The plaintext is found in the blob of unencrypted image.
+	plainBlobs := blobs("")
+	require.Contains(t, strings.Join(plainBlobs, ""), marker)
+
+	encryptedBlobs := blobs("--encrypt --encrypt-key " + keyPath)
+	require.Len(t, encryptedBlobs, len(plainBlobs))
+	for _, blob := range encryptedBlobs {
+		require.NotContains(t, blob, marker)
+	}
+}
+
+func (i *ImageTestSuite) TestConvertSkipConverted(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	source := i.prepareImage(t, "busybox:latest")
+	target := fmt.Sprintf("localhost:%s/skip-converted:nydus-%s", os.Getenv("REGISTRY_PORT"), uuid.NewString())
+	convert := func(workDir string) map[string]interface{} {
+		convertCmd := fmt.Sprintf(
+			"%s --log-level warn convert --source %s --target %s --skip-converted --print-result --fs-version %s --nydus-image %s --work-dir %s",
+			ctx.Binary.Nydusify, source, target, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, workDir),
+		)
+		var result map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(tool.RunWithOutput(convertCmd)), &result))
+		return result
+	}
+
+	// The target image doesn't exist, so it's converted.
+	first := convert("convert-1")
+	require.Equal(t, false, first["unchanged"])
+	require.Positive(t, first["pushed_bytes"])
+
+	// The target image has been converted from the same source image.
+	second := convert("convert-2")
+	require.Equal(t, true, second["unchanged"])
+	require.Equal(t, first["target_digest"], second["target_digest"])
+	require.Equal(t, first["blob_digests"], second["blob_digests"])
+	require.EqualValues(t, 0, second["pushed_bytes"])
+}
+
+func (i *ImageTestSuite) TestConvertAllPlatforms(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayout(t, layoutDir)
+	manifest := readLayoutManifest(t, layoutDir)
+
+	// Make a multi-platform layout from the single platform layout, the
+	// s390x platform has an invalid layer to fail the conversion.
+	writeBlob := func(mediaType string, v interface{}) ocispec.Descriptor {
+		data, ok := v.([]byte)
+		if !ok {
+			var err error
+			data, err = json.Marshal(v)
+			require.NoError(t, err)
+		}
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+		require.NoError(t, os.WriteFile(filepath.Join(layoutDir, "blobs", "sha256", desc.Digest.Hex()), data, 0644))
+		return desc
+	}
+	index := ocispec.Index{Manifests: []ocispec.Descriptor{}}
+	index.SchemaVersion = 2
+	for _, arch := range []string{"amd64", "arm64", "s390x"} {
+		platform := ocispec.Platform{OS: "linux", Architecture: arch}
+		platformManifest := manifest
+		if arch == "s390x" {
+			platformManifest.Layers = []ocispec.Descriptor{writeBlob(ocispec.MediaTypeImageLayerGzip, []byte("invalid layer"))}
+		}
+		platformManifest.Config = writeBlob(ocispec.MediaTypeImageConfig, ocispec.Image{
+			Platform: platform,
+			RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromString(arch)}},
+		})
+		desc := writeBlob(ocispec.MediaTypeImageManifest, platformManifest)
+		desc.Platform = &platform
+		index.Manifests = append(index.Manifests, desc)
+	}
+	indexBytes, err := json.Marshal(index)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(layoutDir, "index.json"), indexBytes, 0644))
+
+	tag := "nydus-" + uuid.NewString()
+	target := fmt.Sprintf("localhost:%s/all-platforms:%s", os.Getenv("REGISTRY_PORT"), tag)
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target %s --convert-all-platforms --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, target, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	// Only the successfully converted platforms are in target index.
+	data, _ := getFromRegistry(t, "all-platforms/manifests/"+tag, ocispec.MediaTypeImageIndex)
+	var targetIndex ocispec.Index
+	require.NoError(t, json.Unmarshal(data, &targetIndex))
+	archs := []string{}
+	for _, desc := range targetIndex.Manifests {
+		require.NotNil(t, desc.Platform)
+		archs = append(archs, desc.Platform.Architecture)
+		getFromRegistry(t, "all-platforms/manifests/"+desc.Digest.String(), desc.MediaType)
+	}
+	require.Equal(t, []string{"amd64", "arm64"}, archs)
+}
+
+func (i *ImageTestSuite) TestExportImage(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	lowerLayer := texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source"))
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	lowerLayer.ToOCILayout(t, layoutDir)
+
+	target := fmt.Sprintf("localhost:%s/export:nydus-%s", os.Getenv("REGISTRY_PORT"), uuid.NewString())
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target %s --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, target, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	exportPath := filepath.Join(ctx.Env.WorkDir, "export.tar.gz")
+	exportCmd := fmt.Sprintf(
+		"%s --log-level warn export --source %s --output %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, target, exportPath, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "export"),
+	)
+	tool.RunWithoutOutput(t, exportCmd)
+
+	// The exported tarball reconstructs the same file tree as source layer.
+	exportDir := filepath.Join(ctx.Env.WorkDir, "exported")
+	require.NoError(t, os.MkdirAll(exportDir, 0755))
+	tool.RunWithoutOutput(t, fmt.Sprintf("tar --xattrs --xattrs-include='*' -xzf %s -C %s", exportPath, exportDir))
+	tool.VerifyDir(t, exportDir, lowerLayer.FileTree)
+}
+
+func (i *ImageTestSuite) TestConvertAllPlatformsWithPrefetch(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayout(t, layoutDir)
+	manifest := readLayoutManifest(t, layoutDir)
+
+	// Make a two-platform layout from the single platform layout.
+	writeBlob := func(mediaType string, v interface{}) ocispec.Descriptor {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+		require.NoError(t, os.WriteFile(filepath.Join(layoutDir, "blobs", "sha256", desc.Digest.Hex()), data, 0644))
+		return desc
+	}
+	index := ocispec.Index{Manifests: []ocispec.Descriptor{}}
+	index.SchemaVersion = 2
+	for _, arch := range []string{"amd64", "arm64"} {
+		platform := ocispec.Platform{OS: "linux", Architecture: arch}
+		platformManifest := manifest
+		platformManifest.Config = writeBlob(ocispec.MediaTypeImageConfig, ocispec.Image{
+			Platform: platform,
+			RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromString(arch)}},
+		})
+		desc := writeBlob(ocispec.MediaTypeImageManifest, platformManifest)
+		desc.Platform = &platform
+		index.Manifests = append(index.Manifests, desc)
+	}
+	indexBytes, err := json.Marshal(index)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(layoutDir, "index.json"), indexBytes, 0644))
+
+	prefetchFiles := map[string]string{
+		"amd64": "/file-1",
+		"arm64": "/dir-1/file-1",
+	}
+	args := ""
+	for arch, path := range prefetchFiles {
+		prefetchPath := filepath.Join(ctx.Env.WorkDir, "prefetch-"+arch)
+		require.NoError(t, os.WriteFile(prefetchPath, []byte(path+"\n"), 0644))
+		args += fmt.Sprintf(" --platform-prefetch-file linux/%s=%s", arch, prefetchPath)
+	}
+	tag := "nydus-" + uuid.NewString()
+	target := fmt.Sprintf("localhost:%s/all-platforms-prefetch:%s", os.Getenv("REGISTRY_PORT"), tag)
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target %s --convert-all-platforms%s --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, target, args, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	// The bootstrap of each platform prefetches its own file.
+	data, _ := getFromRegistry(t, "all-platforms-prefetch/manifests/"+tag, ocispec.MediaTypeImageIndex)
+	var targetIndex ocispec.Index
+	require.NoError(t, json.Unmarshal(data, &targetIndex))
+	require.Len(t, targetIndex.Manifests, 2)
+	for _, desc := range targetIndex.Manifests {
+		arch := desc.Platform.Architecture
+		data, _ := getFromRegistry(t, "all-platforms-prefetch/manifests/"+desc.Digest.String(), desc.MediaType)
+		var platformManifest ocispec.Manifest
+		require.NoError(t, json.Unmarshal(data, &platformManifest))
+		bootstrapLayer := platformManifest.Layers[len(platformManifest.Layers)-1]
+		data, _ = getFromRegistry(t, "all-platforms-prefetch/blobs/"+bootstrapLayer.Digest.String(), bootstrapLayer.MediaType)
+		dir := filepath.Join(ctx.Env.WorkDir, "bootstrap-"+arch)
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		layerPath := filepath.Join(dir, "bootstrap.tar.gz")
+		require.NoError(t, os.WriteFile(layerPath, data, 0644))
+		tool.RunWithoutOutput(t, fmt.Sprintf("tar -xzf %s -C %s image/image.boot", layerPath, dir))
+
+		output := tool.RunWithOutput(fmt.Sprintf("%s inspect -B %s -R prefetch", ctx.Binary.Builder, filepath.Join(dir, "image", "image.boot")))
+		var entries []struct {
+			Path string `json:"path"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(output), &entries))
+		paths := []string{}
+		for _, entry := range entries {
+			paths = append(paths, entry.Path)
+		}
+		require.Equal(t, []string{prefetchFiles[arch]}, paths, arch)
+	}
+}
+
+func (i *ImageTestSuite) TestDiffImages(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	lower := texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "lower"))
+	upper := texture.MakeUpperLayer(t, filepath.Join(ctx.Env.WorkDir, "upper"))
+	bootstraps := []string{}
+	for name, layers := range map[string][]*tool.Layer{"old": {lower}, "new": {lower, upper}} {
+		layoutDir := filepath.Join(ctx.Env.WorkDir, "layout-"+name)
+		tool.LayersToOCILayout(t, layoutDir, ocispec.MediaTypeImageLayerGzip, layers...)
+		targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus-"+name)
+		convertCmd := fmt.Sprintf(
+			"%s --log-level warn convert --source-path %s --target-path %s --fs-version %s --nydus-image %s --work-dir %s",
+			ctx.Binary.Nydusify, layoutDir, targetDir, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+		)
+		tool.RunWithoutOutput(t, convertCmd)
+		bootstraps = append(bootstraps, extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap-"+name)))
+	}
+	if strings.Contains(bootstraps[0], "bootstrap-new") {
+		bootstraps[0], bootstraps[1] = bootstraps[1], bootstraps[0]
+	}
+
+	diffCmd := fmt.Sprintf(
+		"%s --log-level warn diff --source %s --target %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, bootstraps[0], bootstraps[1], ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "diff"),
+	)
+	var report struct {
+		Added      []string `json:"added"`
+		Removed    []string `json:"removed"`
+		Modified   []string `json:"modified"`
+		AddedBlobs []struct {
+			CompressedSize int64 `json:"compressed_size"`
+		} `json:"added_blobs"`
+		RemovedBlobs        []json.RawMessage `json:"removed_blobs"`
+		CompressedSizeDelta int64             `json:"compressed_size_delta"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(tool.RunWithOutput(diffCmd)), &report))
+
+	// The whiteout removes the file, and the opaque directory hides the
+	// directory of lower layer.
+	require.Empty(t, report.Added)
+	require.Equal(t, []string{"/dir-1/file-2", "/dir-2/dir-1"}, report.Removed)
+	require.Equal(t, []string{"/dir-1/file-1", "/dir-2/file-1"}, report.Modified)
+	require.Len(t, report.AddedBlobs, 1)
+	require.Empty(t, report.RemovedBlobs)
+	require.Equal(t, report.AddedBlobs[0].CompressedSize, report.CompressedSizeDelta)
+}
+
+func (i *ImageTestSuite) TestConvertWithPrefetchTrace(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayout(t, layoutDir)
+
+	// convert converts the source layout into target layout, and returns the
+	// paths in prefetch table of bootstrap.
+	convert := func(name, extraArgs string) []string {
+		targetDir := filepath.Join(ctx.Env.WorkDir, name)
+		convertCmd := fmt.Sprintf(
+			"%s --log-level warn convert --source-path %s --target-path %s %s --fs-version %s --nydus-image %s --work-dir %s",
+			ctx.Binary.Nydusify, layoutDir, targetDir, extraArgs, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert-"+name),
+		)
+		tool.RunWithoutOutput(t, convertCmd)
+
+		bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap-"+name))
+		output := tool.RunWithOutput(fmt.Sprintf("%s inspect -B %s -R prefetch", ctx.Binary.Builder, bootstrapPath))
+		var entries []struct {
+			Path string `json:"path"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(output), &entries))
+		paths := []string{}
+		for _, entry := range entries {
+			paths = append(paths, entry.Path)
+		}
+		return paths
+	}
+
+	// All files are prefetched in directory order without trace.
+	require.Equal(t, []string{"/"}, convert("without-trace", ""))
+
+	// The prefetch table follows the access order in trace, and the path
+	// not found in image doesn't fail the conversion.
+	tracePath := filepath.Join(ctx.Env.WorkDir, "trace.txt")
+	require.NoError(t, os.WriteFile(tracePath, []byte("/dir-1/file-2\n/non-existent\n/file-2\n/dir-2/file-1\n/file-1\n"), 0644))
+	require.Equal(t, []string{"/dir-1/file-2", "/file-2", "/dir-2/file-1", "/file-1"}, convert("with-trace", "--prefetch-trace "+tracePath))
+}
+
+func (i *ImageTestSuite) TestConvertWithPrefetchLayerPolicy(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layers := []*tool.Layer{}
+	for idx := 1; idx <= 3; idx++ {
+		layer := tool.NewLayer(t, filepath.Join(ctx.Env.WorkDir, fmt.Sprintf("layer-%d", idx)))
+		layer.CreateDir(t, fmt.Sprintf("dir-%d", idx))
+		layer.CreateFile(t, fmt.Sprintf("dir-%d/file", idx), []byte(fmt.Sprintf("layer-%d", idx)))
+		layers = append(layers, layer)
+	}
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	tool.LayersToOCILayout(t, layoutDir, ocispec.MediaTypeImageLayerGzip, layers...)
+
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --prefetch-layer-policy bottom-2 --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, targetDir, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	// Only the files of the lowest two layers are in prefetch table.
+	bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap"))
+	output := tool.RunWithOutput(fmt.Sprintf("%s inspect -B %s -R prefetch", ctx.Binary.Builder, bootstrapPath))
+	var entries []struct {
+		Path string `json:"path"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(output), &entries))
+	paths := []string{}
+	for _, entry := range entries {
+		paths = append(paths, entry.Path)
+	}
+	require.Equal(t, []string{"/dir-1/file", "/dir-2/file"}, paths)
+}
+
+func (i *ImageTestSuite) TestConvertWithPrefetchMetadataOnly(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	lowerLayer := texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source"))
+	lowerLayer.ToOCILayout(t, layoutDir)
+
+	targetDir := filepath.Join(ctx.Env.WorkDir, "layout-nydus")
+	convertCmd := fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --prefetch-metadata-only --fs-version %s --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, targetDir, ctx.Build.FSVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert"),
+	)
+	tool.RunWithoutOutput(t, convertCmd)
+
+	// The bootstrap keeps all the inodes, while no file data is prefetched.
+	bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap"))
+	output := tool.RunWithOutput(fmt.Sprintf("%s inspect -B %s -R prefetch", ctx.Binary.Builder, bootstrapPath))
+	var entries []struct {
+		Path string `json:"path"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(output), &entries))
+	require.Empty(t, entries)
+
+	ctx.Env.BlobDir = filepath.Join(targetDir, "blobs", "sha256")
+	mountPath := filepath.Join(ctx.Env.WorkDir, "mnt")
+	nydusd := tool.MountNydusd(t, *ctx, bootstrapPath, mountPath)
+	defer nydusd.Umount()
+	require.Equal(t, tool.ListDir(t, filepath.Join(ctx.Env.WorkDir, "source")), tool.ListDir(t, mountPath))
+}
+
+func (i *ImageTestSuite) TestConvertFsVersion(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	layoutDir := filepath.Join(ctx.Env.WorkDir, "layout")
+	texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source")).ToOCILayout(t, layoutDir)
+
+	for _, fsVersion := range []string{"5", "6"} {
+		targetDir := filepath.Join(ctx.Env.WorkDir, "layout-v"+fsVersion)
+		convertCmd := fmt.Sprintf(
+			"%s --log-level warn convert --source-path %s --target-path %s --fs-version %s --nydus-image %s --work-dir %s",
+			ctx.Binary.Nydusify, layoutDir, targetDir, fsVersion, ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert-v"+fsVersion),
+		)
+		tool.RunWithoutOutput(t, convertCmd)
+
+		manifest := readLayoutManifest(t, targetDir)
+		require.Equal(t, fsVersion, manifest.Layers[len(manifest.Layers)-1].Annotations["containerd.io/snapshot/nydus-fs-version"])
+
+		bootstrapPath := extractLayoutBootstrap(t, targetDir, filepath.Join(ctx.Env.WorkDir, "bootstrap-v"+fsVersion))
+		bootstrap, err := os.ReadFile(bootstrapPath)
+		require.NoError(t, err)
+		if fsVersion == "5" {
+			// The RAFS v5 superblock starts with magic `RAFS` and version.
+			require.Greater(t, len(bootstrap), 8)
+			require.Equal(t, uint32(0x52414653), binary.LittleEndian.Uint32(bootstrap[0:4]))
+			require.Equal(t, uint32(0x500), binary.LittleEndian.Uint32(bootstrap[4:8]))
+		} else {
+			// The RAFS v6 superblock is the EROFS superblock at offset 1024.
+			require.Greater(t, len(bootstrap), 1028)
+			require.Equal(t, uint32(0xE0F5E1E2), binary.LittleEndian.Uint32(bootstrap[1024:1028]))
+		}
+	}
+
+	// Failure situation
+	output, err := tool.RunWithCombinedOutput(fmt.Sprintf(
+		"%s --log-level warn convert --source-path %s --target-path %s --fs-version 7 --nydus-image %s --work-dir %s",
+		ctx.Binary.Nydusify, layoutDir, filepath.Join(ctx.Env.WorkDir, "layout-v7"), ctx.Binary.Builder, filepath.Join(ctx.Env.WorkDir, "convert-v7"),
+	))
+	require.Error(t, err)
+	require.Contains(t, output, "fs-version")
+}
+
+// getFromRegistry gets the content from path under `/v2/` of local registry.
+func getFromRegistry(t *testing.T, path, accept string) ([]byte, http.Header) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%s/v2/%s", os.Getenv("REGISTRY_PORT"), path), nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", accept)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode, path)
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return data, resp.Header
+}
+
+// readLayoutManifest reads the manifest in OCI image layout and verifies
+// all the blobs referenced by manifest exist.
+func readLayoutManifest(t *testing.T, layoutDir string) ocispec.Manifest {
+	readBlob := func(dgst digest.Digest) []byte {
+		data, err := os.ReadFile(filepath.Join(layoutDir, "blobs", dgst.Algorithm().String(), dgst.Hex()))
+		require.NoError(t, err)
+		require.Equal(t, dgst, digest.FromBytes(data))
+		return data
+	}
+	indexBytes, err := os.ReadFile(filepath.Join(layoutDir, "index.json"))
+	require.NoError(t, err)
+	var index ocispec.Index
+	require.NoError(t, json.Unmarshal(indexBytes, &index))
+	require.Len(t, index.Manifests, 1)
+
+	var manifest ocispec.Manifest
+	require.NoError(t, json.Unmarshal(readBlob(index.Manifests[0].Digest), &manifest))
+	readBlob(manifest.Config.Digest)
+	for _, layer := range manifest.Layers {
+		readBlob(layer.Digest)
+	}
+
+	return manifest
+}
+
+// extractLayoutBootstrap extracts the bootstrap of Nydus image in OCI image
+// layout into dir, and returns the bootstrap path.
+func extractLayoutBootstrap(t *testing.T, layoutDir, dir string) string {
+	manifest := readLayoutManifest(t, layoutDir)
+	bootstrapLayer := manifest.Layers[len(manifest.Layers)-1]
+	require.Equal(t, "true", bootstrapLayer.Annotations["containerd.io/snapshot/nydus-bootstrap"])
+
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	tool.RunWithoutOutput(t, fmt.Sprintf(
+		"tar -xzf %s -C %s image/image.boot",
+		filepath.Join(layoutDir, "blobs", bootstrapLayer.Digest.Algorithm().String(), bootstrapLayer.Digest.Hex()), dir,
+	))
+	return filepath.Join(dir, "image", "image.boot")
+}
+
 func (i *ImageTestSuite) prepareImage(t *testing.T, image string) string {
 	if i.preparedImages == nil {
 		i.preparedImages = make(map[string]string)
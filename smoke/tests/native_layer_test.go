@@ -5,6 +5,7 @@
 package tests
 
 import (
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -215,9 +216,8 @@ func (n *NativeLayerTestSuite) testMakeLayers(ctx tool.Context, t *testing.T) {
 	require.Equal(t, actualDigests, []digest.Digest{chunkDictBlobDigest, upperBlobDigest})
 
 	// Verify overlay (lower+upper) layer mounted by nydusd
-	lowerLayer.Overlay(t, upperLayer)
 	ctx.Env.BootstrapPath = overlayBootstrap
-	tool.Verify(t, ctx, lowerLayer.FileTree)
+	tool.Verify(t, ctx, texture.ExpectedOverlay(lowerLayer, upperLayer))
 
 	// Make base layers (use as a parent bootstrap)
 	packOption.ChunkDictPath = ""
@@ -274,6 +274,172 @@ func (n *NativeLayerTestSuite) testMakeLayers(ctx tool.Context, t *testing.T) {
 	tool.Verify(t, ctx, baseLayer1.FileTree)
 }
 
+func (n *NativeLayerTestSuite) TestMtime(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	// Only RAFS v5 keeps the mtime of every inode, the compact inode of
+	// RAFS v6 uses the build time of image.
+	ctx.Build.FSVersion = "5"
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	packOption := converter.PackOption{
+		BuilderPath: ctx.Binary.Builder,
+		Compressor:  ctx.Build.Compressor,
+		FsVersion:   ctx.Build.FSVersion,
+		ChunkSize:   ctx.Build.ChunkSize,
+	}
+	lowerLayer := texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source-lower"))
+	lowerBlobDigest := lowerLayer.Pack(t, packOption, ctx.Env.BlobDir)
+	_, lowerBootstrap := tool.MergeLayers(t, *ctx, converter.MergeOption{
+		BuilderPath: ctx.Binary.Builder,
+	}, []converter.Layer{
+		{Digest: lowerBlobDigest},
+	})
+
+	ctx.Env.BootstrapPath = lowerBootstrap
+	nydusd, err := tool.NewNydusdWithContext(*ctx)
+	require.NoError(t, err)
+	require.NoError(t, nydusd.Mount())
+	defer nydusd.Umount()
+	lowerLayer.Verify(t, nydusd.MountPath)
+
+	stat, err := os.Lstat(filepath.Join(nydusd.MountPath, "file-1"))
+	require.NoError(t, err)
+	require.Equal(t, texture.LowerFile1Mtime.UnixNano(), stat.ModTime().UnixNano())
+}
+
+func (n *NativeLayerTestSuite) TestXattr(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	packOption := converter.PackOption{
+		BuilderPath: ctx.Binary.Builder,
+		Compressor:  ctx.Build.Compressor,
+		FsVersion:   ctx.Build.FSVersion,
+		ChunkSize:   ctx.Build.ChunkSize,
+	}
+	xattrLayer := texture.MakeXattrLayer(t, filepath.Join(ctx.Env.WorkDir, "source-xattr"))
+	expectedXattrs := map[string]string{
+		"user.comment": "This is a comment",
+	}
+	if os.Geteuid() == 0 {
+		expectedXattrs["trusted.foo"] = "bar"
+	}
+	require.Equal(t, expectedXattrs, xattrLayer.ListXattrs(t, "xattr-file"))
+	xattrBlobDigest := xattrLayer.Pack(t, packOption, ctx.Env.BlobDir)
+	_, xattrBootstrap := tool.MergeLayers(t, *ctx, converter.MergeOption{
+		BuilderPath: ctx.Binary.Builder,
+	}, []converter.Layer{
+		{Digest: xattrBlobDigest},
+	})
+
+	// The xattrs survive the conversion and are verified in file tree.
+	ctx.Env.BootstrapPath = xattrBootstrap
+	tool.Verify(t, *ctx, xattrLayer.FileTree)
+}
+
+func (n *NativeLayerTestSuite) TestHardlinkAcrossDirs(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	packOption := converter.PackOption{
+		BuilderPath: ctx.Binary.Builder,
+		Compressor:  ctx.Build.Compressor,
+		FsVersion:   ctx.Build.FSVersion,
+		ChunkSize:   ctx.Build.ChunkSize,
+	}
+	hardlinkLayer := texture.MakeHardlinkLayer(t, filepath.Join(ctx.Env.WorkDir, "source-hardlink"))
+	hardlinkBlobDigest := hardlinkLayer.Pack(t, packOption, ctx.Env.BlobDir)
+	_, hardlinkBootstrap := tool.MergeLayers(t, *ctx, converter.MergeOption{
+		BuilderPath: ctx.Binary.Builder,
+	}, []converter.Layer{
+		{Digest: hardlinkBlobDigest},
+	})
+
+	// All the hardlinks share the same inode and report the link count of
+	// the inode rather than the links in their own directory.
+	ctx.Env.BootstrapPath = hardlinkBootstrap
+	nydusd, err := tool.NewNydusdWithContext(*ctx)
+	require.NoError(t, err)
+	require.NoError(t, nydusd.Mount())
+	defer nydusd.Umount()
+	hardlinkLayer.Verify(t, nydusd.MountPath)
+	hardlinkLayer.VerifyNlink(t, nydusd.MountPath)
+}
+
+func (n *NativeLayerTestSuite) TestMountConvertedLayer(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	packOption := converter.PackOption{
+		BuilderPath: ctx.Binary.Builder,
+		Compressor:  ctx.Build.Compressor,
+		FsVersion:   ctx.Build.FSVersion,
+		ChunkSize:   ctx.Build.ChunkSize,
+	}
+	lowerLayer := texture.MakeLowerLayer(t, filepath.Join(ctx.Env.WorkDir, "source"))
+	lowerBlobDigest := lowerLayer.Pack(t, packOption, ctx.Env.BlobDir)
+	_, lowerBootstrap := tool.MergeLayers(t, *ctx, converter.MergeOption{
+		BuilderPath: ctx.Binary.Builder,
+	}, []converter.Layer{
+		{Digest: lowerBlobDigest},
+	})
+
+	// The files are read back from the mounted image.
+	mountPath := filepath.Join(ctx.Env.WorkDir, "mnt-lower")
+	nydusd := tool.MountNydusd(t, *ctx, lowerBootstrap, mountPath)
+	defer nydusd.Umount()
+	data, err := os.ReadFile(filepath.Join(mountPath, "file-1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("file-1"), data)
+	lowerLayer.Verify(t, mountPath)
+}
+
+func (n *NativeLayerTestSuite) TestDedupIdenticalFiles(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	packOption := converter.PackOption{
+		BuilderPath: ctx.Binary.Builder,
+		Compressor:  ctx.Build.Compressor,
+		FsVersion:   ctx.Build.FSVersion,
+		ChunkSize:   ctx.Build.ChunkSize,
+	}
+	blobSize := func(dgst digest.Digest) int64 {
+		info, err := os.Stat(filepath.Join(ctx.Env.BlobDir, dgst.Hex()))
+		require.NoError(t, err)
+		return info.Size()
+	}
+
+	// The builder deduplicates the chunks of identical files by digest, the
+	// data of 100 identical files and the hardlinks is stored only once.
+	const fileSize = 1 << 20
+	singleLayer := texture.MakeIdenticalFilesLayer(t, filepath.Join(ctx.Env.WorkDir, "source-single"), 1, fileSize)
+	singleBlobDigest := singleLayer.Pack(t, packOption, ctx.Env.BlobDir)
+	identicalLayer := texture.MakeIdenticalFilesLayer(t, filepath.Join(ctx.Env.WorkDir, "source-identical"), 100, fileSize)
+	identicalBlobDigest := identicalLayer.Pack(t, packOption, ctx.Env.BlobDir)
+	// Only the metadata of the other files is added.
+	require.Less(t, blobSize(identicalBlobDigest), blobSize(singleBlobDigest)+fileSize/4)
+
+	_, identicalBootstrap := tool.MergeLayers(t, *ctx, converter.MergeOption{
+		BuilderPath: ctx.Binary.Builder,
+	}, []converter.Layer{
+		{Digest: identicalBlobDigest},
+	})
+	ctx.Env.BootstrapPath = identicalBootstrap
+	nydusd, err := tool.NewNydusdWithContext(*ctx)
+	require.NoError(t, err)
+	require.NoError(t, nydusd.Mount())
+	defer nydusd.Umount()
+	identicalLayer.Verify(t, nydusd.MountPath)
+	// The hardlinks still share the inode of the first file.
+	identicalLayer.VerifyNlink(t, nydusd.MountPath)
+}
+
 func TestNativeLayer(t *testing.T) {
 	test.Run(t, &NativeLayerTestSuite{t: t})
 }
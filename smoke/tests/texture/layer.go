@@ -6,18 +6,24 @@ package texture
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/dragonflyoss/nydus/smoke/tests/tool"
 )
 
 type LayerMaker func(t *testing.T, layer *tool.Layer)
 
+// LowerFile1Mtime is the mtime of `file-1` in lower layer with nanoseconds.
+var LowerFile1Mtime = time.Unix(1700000000, 123456789)
+
 func LargerFileMaker(path string, sizeGB int) LayerMaker {
 	return func(t *testing.T, layer *tool.Layer) {
-		layer.CreateLargeFile(t, path, sizeGB)
+		layer.CreateLargeFile(t, path, int64(sizeGB)<<30, int64(sizeGB))
 	}
 }
 
@@ -49,6 +55,7 @@ func MakeLowerLayer(t *testing.T, workDir string, makers ...LayerMaker) *tool.La
 	// Create regular file
 	layer.CreateFile(t, "file-1", []byte("file-1"))
 	layer.CreateFile(t, "file-2", []byte("file-2"))
+	layer.SetMtime(t, "file-1", LowerFile1Mtime)
 
 	// Create directory
 	layer.CreateDir(t, "dir-1")
@@ -108,6 +115,179 @@ func MakeLowerLayer(t *testing.T, workDir string, makers ...LayerMaker) *tool.La
 	return layer
 }
 
+// MakeSparseLayer makes a layer with sparse files, the hole regions should
+// round-trip as zeros after conversion.
+func MakeSparseLayer(t *testing.T, workDir string) *tool.Layer {
+	layer := tool.NewLayer(t, workDir)
+
+	// Data across chunk boundary and in the middle of holes
+	layer.CreateSparseFile(t, "sparse-file-1", 4<<20, []int64{0, 1<<20 - 4, 3<<20 + 100})
+	// Hole only
+	layer.CreateSparseFile(t, "sparse-file-2", 1<<20, nil)
+	// Data at the end of file
+	layer.CreateSparseFile(t, "sparse-file-3", 2<<20, []int64{2<<20 - 32})
+
+	return layer
+}
+
+// MakeHardlinkLayer makes a layer with a file in `dir-1` hardlinked from
+// another directory, a nested directory and the root, so that the links of
+// an inode are spread across directories.
+func MakeHardlinkLayer(t *testing.T, workDir string) *tool.Layer {
+	layer := tool.NewLayer(t, workDir)
+
+	layer.CreateDir(t, "dir-1")
+	layer.CreateDir(t, "dir-2/dir-3")
+	layer.CreateFile(t, "dir-1/file-1", []byte("dir-1/file-1"))
+	layer.CreateHardlink(t, "dir-1/file-1-hardlink", "dir-1/file-1")
+	layer.CreateHardlink(t, "dir-2/file-1-hardlink", "dir-1/file-1")
+	layer.CreateHardlink(t, "dir-2/dir-3/file-1-hardlink", "dir-1/file-1")
+	layer.CreateHardlink(t, "file-1-hardlink", "dir-1/file-1")
+
+	return layer
+}
+
+// MakeIdenticalFilesLayer makes a layer with count files of the same
+// pseudo-random content of size, and some hardlinks to the first file.
+func MakeIdenticalFilesLayer(t *testing.T, workDir string, count int, size int64) *tool.Layer {
+	layer := tool.NewLayer(t, workDir)
+
+	layer.CreateDir(t, "identical")
+	for idx := 0; idx < count; idx++ {
+		layer.CreateLargeFile(t, fmt.Sprintf("identical/file-%d", idx), size, 1)
+	}
+	for idx := 0; idx < 10; idx++ {
+		layer.CreateHardlink(t, fmt.Sprintf("identical/file-0-hardlink-%d", idx), "identical/file-0")
+	}
+
+	return layer
+}
+
+// MakeXattrLayer makes a layer with `user.` and `trusted.` xattrs, the
+// `trusted.` xattr is only set if running as root since it requires
+// CAP_SYS_ADMIN.
+func MakeXattrLayer(t *testing.T, workDir string) *tool.Layer {
+	layer := tool.NewLayer(t, workDir)
+
+	layer.CreateFile(t, "xattr-file", []byte("xattr-file"))
+	layer.SetXattr(t, "xattr-file", "user.comment", []byte("This is a comment"))
+	if os.Geteuid() == 0 {
+		layer.SetXattr(t, "xattr-file", "trusted.foo", []byte("bar"))
+	} else {
+		t.Log("skip trusted.* xattr which requires CAP_SYS_ADMIN")
+	}
+	layer.CreateDir(t, "xattr-dir")
+	layer.SetXattr(t, "xattr-dir", "user.comment", []byte("This is a directory"))
+
+	return layer
+}
+
+// MakeSpecialFilesLayer makes a layer with the char and block devices of
+// various device numbers, including the ones which don't fit the legacy
+// 8-bit encoding, a FIFO and a unix socket.
+func MakeSpecialFilesLayer(t *testing.T, workDir string) *tool.Layer {
+	layer := tool.NewLayer(t, workDir)
+
+	layer.CreateDir(t, "dev")
+	layer.CreateSpecialFileWithDev(t, "dev/null", syscall.S_IFCHR, 1, 3)
+	layer.CreateSpecialFileWithDev(t, "dev/char-large", syscall.S_IFCHR, 511, 70000)
+	layer.CreateSpecialFileWithDev(t, "dev/sda1", syscall.S_IFBLK, 8, 1)
+	layer.CreateSpecialFileWithDev(t, "dev/block-large", syscall.S_IFBLK, 259, 300)
+	layer.CreateSpecialFile(t, "fifo", syscall.S_IFIFO)
+	layer.CreateSpecialFile(t, "socket", syscall.S_IFSOCK)
+
+	return layer
+}
+
+// MakeModeLayer makes a layer with a setuid binary, a setgid directory, a
+// sticky directory and the files of unusual permission bits.
+func MakeModeLayer(t *testing.T, workDir string) *tool.Layer {
+	layer := tool.NewLayer(t, workDir)
+
+	layer.CreateDir(t, "bin")
+	layer.CreateFileWithMode(t, "bin/setuid", []byte("setuid"), 0755|os.ModeSetuid)
+	layer.CreateFileWithMode(t, "bin/setgid", []byte("setgid"), 0750|os.ModeSetgid)
+	layer.CreateFileWithMode(t, "bin/setuid-setgid", []byte("setuid-setgid"), 0711|os.ModeSetuid|os.ModeSetgid)
+	layer.CreateDirWithMode(t, "setgid-dir", 0775|os.ModeSetgid)
+	layer.CreateFileWithMode(t, "setgid-dir/file", []byte("file"), 0664)
+	layer.CreateDirWithMode(t, "sticky-dir", 0777|os.ModeSticky)
+	layer.CreateFileWithMode(t, "sticky-dir/file", []byte("file"), 0600)
+	layer.CreateFileWithMode(t, "no-perm", []byte("no-perm"), 0)
+	layer.CreateFileWithMode(t, "all-bits", []byte("all-bits"), 0777|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+
+	return layer
+}
+
+// MakeDeepTreeLayer makes a layer with a file nested in depth directories,
+// and the file nested in the deepest directories whose path is near the
+// PATH_MAX boundary. It returns the paths of both files in layer.
+func MakeDeepTreeLayer(t *testing.T, workDir string, depth int) (*tool.Layer, []string) {
+	layer := tool.NewLayer(t, workDir)
+
+	paths := []string{
+		layer.CreateDeepDirTree(t, depth, "deep-file"),
+		layer.CreateDeepDirTree(t, layer.DeepDirTreeMaxDepth("deepest-file"), "deepest-file"),
+	}
+
+	return layer, paths
+}
+
+// MakeUnicodeLayer makes a layer with the files and directories named in
+// multibyte UTF-8, at the 255-byte NAME_MAX limit, and with spaces and
+// newlines, which should round-trip byte by byte after conversion.
+func MakeUnicodeLayer(t *testing.T, workDir string) *tool.Layer {
+	layer := tool.NewLayer(t, workDir)
+
+	layer.CreateFile(t, "文件-ファイル-파일", []byte("cjk"))
+	layer.CreateFile(t, "emoji-🐳📦", []byte("emoji"))
+	layer.CreateFile(t, "name with spaces ", []byte("spaces"))
+	layer.CreateFile(t, "name\nwith\nnewlines", []byte("newlines"))
+	// The names of 255 bytes in 1, 2, 3 and 4-byte characters.
+	layer.CreateFile(t, strings.Repeat("x", 255), []byte("ascii"))
+	layer.CreateFile(t, strings.Repeat("é", 127)+"x", []byte("latin"))
+	layer.CreateFile(t, strings.Repeat("中", 85), []byte("cjk-255"))
+	layer.CreateFile(t, strings.Repeat("🐳", 63)+"xyz", []byte("emoji-255"))
+
+	dir := strings.Repeat("目", 85)
+	layer.CreateDir(t, dir)
+	layer.CreateFile(t, filepath.Join(dir, strings.Repeat("ü", 127)+"x"), []byte("nested"))
+	layer.CreateSymlink(t, "链接 🔗", filepath.Join(dir, strings.Repeat("ü", 127)+"x"))
+
+	return layer
+}
+
+// MakeSymlinkEdgeLayer makes a layer with the dangling symlinks of relative
+// and absolute targets, a self-referential symlink and a pair of mutually
+// referential symlinks, which should be stored without resolving. It
+// returns the targets of all the symlinks by path in layer.
+func MakeSymlinkEdgeLayer(t *testing.T, workDir string) (*tool.Layer, map[string]string) {
+	layer := tool.NewLayer(t, workDir)
+
+	targets := map[string]string{
+		"dangling-relative": "missing/file",
+		"dangling-absolute": "/nonexistent/file",
+		"dir/dangling-up":   "../../outside",
+	}
+	layer.CreateDir(t, "dir")
+	for name, target := range targets {
+		layer.CreateBrokenSymlink(t, name, target)
+	}
+	layer.CreateDir(t, "loop")
+	for _, links := range [][2]string{{"self", "self"}, {"loop/a", "loop/b"}} {
+		for name, target := range layer.CreateCircularSymlink(t, links[0], links[1]) {
+			targets[name] = target
+		}
+	}
+
+	return layer, targets
+}
+
+// MakeEmptyLayer makes a layer without any file, which is packed as an
+// empty tarball.
+func MakeEmptyLayer(t *testing.T, workDir string) *tool.Layer {
+	return tool.NewLayer(t, workDir)
+}
+
 func MakeUpperLayer(t *testing.T, workDir string) *tool.Layer {
 	layer := tool.NewLayer(t, workDir)
 
@@ -124,6 +304,51 @@ func MakeUpperLayer(t *testing.T, workDir string) *tool.Layer {
 	return layer
 }
 
+// Entry is the expected file in the merged view of layers.
+type Entry = *tool.File
+
+// ExpectedOverlay computes the expected merged view of upper layer on lower
+// layer in overlay semantics: the whiteout `.wh.<name>` removes the file or
+// directory in lower layer, the opaque `.wh..wh..opq` hides all the contents
+// of the directory in lower layer, and the other files in upper layer add or
+// replace the ones in lower layer. The file trees of both layers should have
+// been recorded by packing, and they are left unchanged.
+func ExpectedOverlay(lower, upper *tool.Layer) map[string]Entry {
+	merged := map[string]Entry{}
+	for name, file := range lower.FileTree {
+		merged[name] = file
+	}
+
+	removeUnder := func(dir string) {
+		for name := range merged {
+			if strings.HasPrefix(name, dir+"/") {
+				delete(merged, name)
+			}
+		}
+	}
+	for name := range upper.FileTree {
+		dir, base := filepath.Split(name)
+		dir = filepath.Clean(dir)
+		switch {
+		case base == ".wh..wh..opq":
+			removeUnder(dir)
+		case strings.HasPrefix(base, ".wh."):
+			target := filepath.Join(dir, strings.TrimPrefix(base, ".wh."))
+			delete(merged, target)
+			removeUnder(target)
+		}
+	}
+
+	for name, file := range upper.FileTree {
+		if strings.HasPrefix(filepath.Base(name), ".wh.") {
+			continue
+		}
+		merged[name] = file
+	}
+
+	return merged
+}
+
 func MakeMatrixLayer(t *testing.T, workDir, id string) *tool.Layer {
 	layer := tool.NewLayer(t, workDir)
 
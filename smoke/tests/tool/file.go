@@ -7,13 +7,18 @@ package tool
 import (
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
 	"testing"
 
 	"github.com/opencontainers/go-digest"
 	"github.com/pkg/xattr"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 type File struct {
@@ -63,10 +68,16 @@ func NewFile(t *testing.T, path, target string) *File {
 		hash = digester.Digest()
 	}
 
+	rdev := uint64(0)
+	if stat.Mode()&os.ModeDevice == os.ModeDevice {
+		rdev = uint64(_stat.Rdev)
+	}
+
 	file := File{
 		Path:    target,
 		Size:    stat.Size(),
 		Mode:    stat.Mode(),
+		Rdev:    rdev,
 		Symlink: symlink,
 		UID:     _stat.Uid,
 		GID:     _stat.Gid,
@@ -84,3 +95,79 @@ func (file *File) Compare(t *testing.T, target *File) {
 	}
 	require.Equal(t, file, target, fmt.Sprintf("unmatched file %s", target.Path))
 }
+
+// VerifyDir compares the file tree in directory with the expected file tree.
+func VerifyDir(t *testing.T, dir string, expectedFileTree map[string]*File) {
+	actualFiles := map[string]*File{}
+	err := filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+		require.Nil(t, err)
+
+		targetPath, err := filepath.Rel(dir, path)
+		require.NoError(t, err)
+
+		if targetPath == "." || targetPath == ".." {
+			return nil
+		}
+
+		file := NewFile(t, path, targetPath)
+		actualFiles[targetPath] = file
+		if expectedFileTree[targetPath] != nil {
+			expectedFileTree[targetPath].Compare(t, file)
+		} else {
+			t.Fatalf("not found file %s in expected file tree", targetPath)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	for targetPath, file := range expectedFileTree {
+		if actualFiles[targetPath] != nil {
+			actualFiles[targetPath].Compare(t, file)
+		} else {
+			t.Fatalf("not found file %s in %s", targetPath, dir)
+		}
+	}
+}
+
+// ListDir returns the sorted paths of all the entries in directory, the
+// names are kept byte by byte.
+func ListDir(t *testing.T, dir string) []string {
+	paths := []string{}
+	err := filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+		require.NoError(t, err)
+		if path != dir {
+			paths = append(paths, strings.TrimPrefix(path, dir+"/"))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	sort.Strings(paths)
+	return paths
+}
+
+// ReadDeepFile reads the file of name in root directory by opening each
+// component of name relative to its parent, so that the path longer than
+// PATH_MAX at mount point can be read. The components are opened without
+// following symlink.
+func ReadDeepFile(t *testing.T, root, name string) []byte {
+	fd, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	require.NoError(t, err)
+	components := strings.Split(filepath.Clean(name), "/")
+	for idx, component := range components {
+		flags := unix.O_RDONLY | unix.O_NOFOLLOW
+		if idx < len(components)-1 {
+			flags |= unix.O_DIRECTORY
+		}
+		next, err := unix.Openat(fd, component, flags, 0)
+		unix.Close(fd)
+		require.NoError(t, err, fmt.Sprintf("open %s at depth %d", component, idx))
+		fd = next
+	}
+
+	file := os.NewFile(uintptr(fd), name)
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	require.NoError(t, err)
+	return data
+}
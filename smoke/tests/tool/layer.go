@@ -5,21 +5,29 @@
 package tool
 
 import (
+	"archive/tar"
 	"bytes"
 	"compress/gzip"
 	"context"
-	"crypto/rand"
+	"encoding/json"
+	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/containerd/containerd/archive"
+	"github.com/containerd/containerd/archive/compression"
 	"github.com/containerd/containerd/content/local"
 	"github.com/containerd/nydus-snapshotter/pkg/converter"
 	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/xattr"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -29,14 +37,17 @@ import (
 type Layer struct {
 	workDir  string
 	FileTree map[string]*File
+	// hardlinks maps the hardlink to its target created in layer.
+	hardlinks map[string]string
 }
 
 func NewLayer(t *testing.T, workDir string) *Layer {
 	err := os.MkdirAll(workDir, 0755)
 	require.NoError(t, err)
 	return &Layer{
-		workDir:  workDir,
-		FileTree: make(map[string]*File),
+		workDir:   workDir,
+		FileTree:  make(map[string]*File),
+		hardlinks: make(map[string]string),
 	}
 }
 
@@ -45,14 +56,32 @@ func (l *Layer) CreateFile(t *testing.T, name string, data []byte) {
 	require.NoError(t, err)
 }
 
-func (l *Layer) CreateLargeFile(t *testing.T, name string, sizeGB int) {
-	f, err := os.Create(filepath.Join(l.workDir, name))
+// CreateFileWithMode creates the file with mode, which is set by chmod after
+// writing, so that the umask doesn't apply and the setuid, setgid and sticky
+// bits of mode are kept.
+func (l *Layer) CreateFileWithMode(t *testing.T, path string, data []byte, mode os.FileMode) {
+	l.CreateFile(t, path, data)
+	err := os.Chmod(filepath.Join(l.workDir, path), mode)
+	require.NoError(t, err)
+}
+
+// NewLargeFileReader returns the reader of pseudo-random content of size,
+// which is reproducible by the same seed.
+func NewLargeFileReader(size int64, seed int64) io.Reader {
+	return io.LimitReader(rand.New(rand.NewSource(seed)), size)
+}
+
+// CreateLargeFile streams the pseudo-random content derived from seed into
+// file without holding it in memory, the content can be derived again by
+// NewLargeFileReader to be compared after mount.
+func (l *Layer) CreateLargeFile(t *testing.T, path string, size int64, seed int64) {
+	f, err := os.Create(filepath.Join(l.workDir, path))
 	require.NoError(t, err)
 	defer func() {
 		f.Close()
 	}()
 
-	_, err = io.CopyN(f, rand.Reader, int64(sizeGB)<<30)
+	_, err = io.Copy(f, NewLargeFileReader(size, seed))
 	assert.Nil(t, err)
 }
 
@@ -70,31 +99,127 @@ func (l *Layer) CreateHoledFile(t *testing.T, name string, data []byte, offset,
 	require.NoError(t, err)
 }
 
+// CreateSparseFile creates a file of logical size with the data written only
+// at the offsets by ftruncate and pwrite, the other regions are left as holes.
+func (l *Layer) CreateSparseFile(t *testing.T, path string, size int64, dataOffsets []int64) {
+	f, err := os.Create(filepath.Join(l.workDir, path))
+	require.NoError(t, err)
+	defer f.Close()
+
+	err = unix.Ftruncate(int(f.Fd()), size)
+	require.NoError(t, err)
+
+	for _, offset := range dataOffsets {
+		data := []byte(fmt.Sprintf("sparse-data-%d", offset))
+		require.LessOrEqual(t, offset+int64(len(data)), size, "data exceeds file size")
+		_, err = unix.Pwrite(int(f.Fd()), data, offset)
+		require.NoError(t, err)
+	}
+}
+
+// SetMtime sets the mtime of file with nanosecond precision by utimensat,
+// the symlink itself rather than its target is changed, and atime is kept.
+func (l *Layer) SetMtime(t *testing.T, path string, mtime time.Time) {
+	times := []unix.Timespec{
+		{Nsec: unix.UTIME_OMIT},
+		unix.NsecToTimespec(mtime.UnixNano()),
+	}
+	err := unix.UtimesNanoAt(unix.AT_FDCWD, filepath.Join(l.workDir, path), times, unix.AT_SYMLINK_NOFOLLOW)
+	require.NoError(t, err)
+}
+
 func (l *Layer) CreateDir(t *testing.T, name string) {
 	err := os.MkdirAll(filepath.Join(l.workDir, name), 0755)
 	require.NoError(t, err)
 }
 
+// CreateDirWithMode creates the directory with mode like CreateFileWithMode.
+func (l *Layer) CreateDirWithMode(t *testing.T, name string, mode os.FileMode) {
+	l.CreateDir(t, name)
+	err := os.Chmod(filepath.Join(l.workDir, name), mode)
+	require.NoError(t, err)
+}
+
+// CreateDeepDirTree creates the leaf file nested in depth directories named
+// `a` like `a/a/.../a/leafFile`, whose content is its path in layer, and
+// returns the path. The absolute path of leaf file in work directory must be
+// shorter than PATH_MAX, see DeepDirTreeMaxDepth.
+func (l *Layer) CreateDeepDirTree(t *testing.T, depth int, leafFile string) string {
+	name := strings.Repeat("a/", depth) + leafFile
+	require.Less(t, len(filepath.Join(l.workDir, name)), unix.PathMax, "path of leaf file exceeds PATH_MAX")
+	l.CreateDir(t, filepath.Dir(name))
+	l.CreateFile(t, name, []byte(name))
+	return name
+}
+
+// DeepDirTreeMaxDepth returns the depth of the deepest tree which can be
+// created by CreateDeepDirTree in layer, the path of its leaf file is near
+// the PATH_MAX boundary.
+func (l *Layer) DeepDirTreeMaxDepth(leafFile string) int {
+	// The path is joined as `<workDir>/a/.../a/<leafFile>` with terminating
+	// NUL.
+	return (unix.PathMax - len(filepath.Clean(l.workDir)) - len(leafFile) - 2) / 2
+}
+
 func (l *Layer) CreateSymlink(t *testing.T, name string, target string) {
 	err := os.Symlink(filepath.Join(l.workDir, target), filepath.Join(l.workDir, name))
 	require.NoError(t, err)
 }
 
+// CreateBrokenSymlink creates a symlink with the target stored verbatim
+// rather than joined with the layer directory, the target may not exist.
+func (l *Layer) CreateBrokenSymlink(t *testing.T, name string, target string) {
+	err := os.Symlink(target, filepath.Join(l.workDir, name))
+	require.NoError(t, err)
+}
+
+// CreateCircularSymlink creates the symlinks name and peer referring to
+// each other by relative target, or a symlink referring to itself if peer
+// is name. It returns the targets of the symlinks by name.
+func (l *Layer) CreateCircularSymlink(t *testing.T, name string, peer string) map[string]string {
+	targets := map[string]string{}
+	for _, link := range [][2]string{{name, peer}, {peer, name}} {
+		target, err := filepath.Rel(filepath.Dir(link[0]), link[1])
+		require.NoError(t, err)
+		targets[link[0]] = target
+	}
+	for link, target := range targets {
+		l.CreateBrokenSymlink(t, link, target)
+	}
+	return targets
+}
+
 func (l *Layer) CreateHardlink(t *testing.T, name string, target string) {
 	err := os.Link(filepath.Join(l.workDir, target), filepath.Join(l.workDir, name))
 	require.NoError(t, err)
+	l.hardlinks[name] = target
 }
 
+// CreateSpecialFile creates the special file of devType like S_IFCHR,
+// S_IFBLK, S_IFIFO or S_IFSOCK with device number 255:0 by mknod. The FIFO
+// and socket created aren't opened by anyone, since the data written into
+// them is never stored on filesystem.
 func (l *Layer) CreateSpecialFile(t *testing.T, name string, devType uint32) {
-	err := syscall.Mknod(filepath.Join(l.workDir, name), devType|0666, int(unix.Mkdev(255, 0)))
+	l.CreateSpecialFileWithDev(t, name, devType, 255, 0)
+}
+
+// CreateSpecialFileWithDev is like CreateSpecialFile, but the device number
+// of char or block device is major:minor.
+func (l *Layer) CreateSpecialFileWithDev(t *testing.T, name string, devType uint32, major, minor uint32) {
+	err := syscall.Mknod(filepath.Join(l.workDir, name), devType|0666, int(unix.Mkdev(major, minor)))
 	require.NoError(t, err)
 }
 
-func (l *Layer) SetXattr(t *testing.T, name string, key string, data []byte) {
-	err := xattr.Set(filepath.Join(l.workDir, name), key, data)
+func (l *Layer) SetXattr(t *testing.T, path, name string, value []byte) {
+	err := syscall.Setxattr(filepath.Join(l.workDir, path), name, value, 0)
 	require.NoError(t, err)
 }
 
+// ListXattrs lists the xattrs of file in layer without following symlink.
+func (l *Layer) ListXattrs(t *testing.T, path string) map[string]string {
+	return GetXattrs(t, filepath.Join(l.workDir, path))
+}
+
 func (l *Layer) CreateWhiteout(t *testing.T, target string) {
 	name := filepath.Base(target)
 	dir := filepath.Dir(target)
@@ -207,6 +332,12 @@ func (l *Layer) Overlay(_ *testing.T, upper *Layer) *Layer {
 			delete(l.FileTree, target)
 		}
 	}
+	// The hardlinks are broken if any of them is removed or updated.
+	for name, target := range l.hardlinks {
+		if l.FileTree[name] == nil || l.FileTree[target] == nil || upper.FileTree[name] != nil || upper.FileTree[target] != nil {
+			delete(l.hardlinks, name)
+		}
+	}
 	// Handle added/updated files
 	for lowerName := range l.FileTree {
 		for upperName, upperFile := range upper.FileTree {
@@ -228,6 +359,44 @@ func (l *Layer) Overlay(_ *testing.T, upper *Layer) *Layer {
 	return l
 }
 
+// Verify asserts the file tree at mount point matches all the entries
+// created in layer, including the content, mode, symlink target, device
+// number and xattrs, and the hardlinks still share the same inode.
+func (l *Layer) Verify(t *testing.T, mountPoint string) {
+	if len(l.FileTree) == 0 {
+		l.recordFileTree(t)
+	}
+	VerifyDir(t, mountPoint, l.FileTree)
+
+	for name, target := range l.hardlinks {
+		stat, err := os.Lstat(filepath.Join(mountPoint, name))
+		require.NoError(t, err)
+		targetStat, err := os.Lstat(filepath.Join(mountPoint, target))
+		require.NoError(t, err)
+		require.True(t, os.SameFile(stat, targetStat), fmt.Sprintf("hardlink %s isn't linked to %s", name, target))
+	}
+}
+
+// VerifyNlink asserts the link count of every hardlinked inode at mount
+// point equals the number of its hardlinks created in layer plus the
+// target itself.
+func (l *Layer) VerifyNlink(t *testing.T, mountPoint string) {
+	nlinks := map[string]uint64{}
+	for _, target := range l.hardlinks {
+		if nlinks[target] == 0 {
+			nlinks[target] = 1
+		}
+		nlinks[target]++
+	}
+	for name, target := range l.hardlinks {
+		for _, path := range []string{name, target} {
+			stat, err := os.Lstat(filepath.Join(mountPoint, path))
+			require.NoError(t, err)
+			require.Equal(t, nlinks[target], uint64(stat.Sys().(*syscall.Stat_t).Nlink), fmt.Sprintf("unexpected link count of %s", path))
+		}
+	}
+}
+
 func (l *Layer) recordFileTree(t *testing.T) {
 	l.FileTree = map[string]*File{}
 	filepath.Walk(l.workDir, func(path string, _ os.FileInfo, _ error) error {
@@ -240,8 +409,219 @@ func (l *Layer) recordFileTree(t *testing.T) {
 	})
 }
 
+// ToOCITar creates the OCI layer tarball of layer. The tarball created by
+// containerd only keeps the `security.capability` xattr and truncates mtime
+// to seconds, so the `user.` and `trusted.` xattrs and the nanosecond mtime
+// in layer are added back as PAX records.
 func (l *Layer) ToOCITar(_ *testing.T) io.ReadCloser {
-	return archive.Diff(context.Background(), "", l.workDir)
+	diff := archive.Diff(context.Background(), "", l.workDir)
+	reader, writer := io.Pipe()
+	go func() {
+		defer diff.Close()
+		writer.CloseWithError(l.addXattrs(diff, writer))
+	}()
+	return reader
+}
+
+func (l *Layer) addXattrs(src io.Reader, dst io.Writer) error {
+	tr := tar.NewReader(src)
+	tw := tar.NewWriter(dst)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		info, err := os.Lstat(filepath.Join(l.workDir, hdr.Name))
+		if err != nil {
+			return err
+		}
+		if mtime := info.ModTime(); mtime.Truncate(time.Second).Equal(hdr.ModTime) {
+			// The PAX mtime record is written for the sub-second mtime.
+			hdr.ModTime = mtime
+			hdr.Format = tar.FormatPAX
+		}
+
+		names, err := xattr.LList(filepath.Join(l.workDir, hdr.Name))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if !strings.HasPrefix(name, "user.") && !strings.HasPrefix(name, "trusted.") {
+				continue
+			}
+			value, err := xattr.LGet(filepath.Join(l.workDir, hdr.Name), name)
+			if err != nil {
+				return err
+			}
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords["SCHILY.xattr."+name] = string(value)
+			hdr.Format = tar.FormatPAX
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// ToOCILayout writes the layer as a single layer image into OCI image
+// layout directory.
+func (l *Layer) ToOCILayout(t *testing.T, layoutDir string) {
+	l.ToOCILayoutWithMediaType(t, layoutDir, ocispec.MediaTypeImageLayerGzip)
+}
+
+// ToOCILayoutWithMediaType writes the layer like ToOCILayout, the layer is
+// compressed by the compression of media type, which can be uncompressed,
+// gzip or zstd.
+func (l *Layer) ToOCILayoutWithMediaType(t *testing.T, layoutDir, mediaType string) {
+	LayersToOCILayout(t, layoutDir, mediaType, l)
+}
+
+// LayersToOCILayout writes the layers as an image into OCI image layout
+// directory, the layers are stacked in order from the lowest one and
+// compressed by the compression of media type.
+func LayersToOCILayout(t *testing.T, layoutDir, mediaType string, layers ...*Layer) {
+	writeBlob := func(mediaType string, data []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{
+			MediaType: mediaType,
+			Digest:    digest.FromBytes(data),
+			Size:      int64(len(data)),
+		}
+		blobDir := filepath.Join(layoutDir, "blobs", desc.Digest.Algorithm().String())
+		require.NoError(t, os.MkdirAll(blobDir, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(blobDir, desc.Digest.Hex()), data, 0644))
+		return desc
+	}
+	marshal := func(v interface{}) []byte {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return data
+	}
+
+	algorithm := compression.Uncompressed
+	switch mediaType {
+	case ocispec.MediaTypeImageLayerGzip:
+		algorithm = compression.Gzip
+	case ocispec.MediaTypeImageLayerZstd:
+		algorithm = compression.Zstd
+	default:
+		require.Equal(t, ocispec.MediaTypeImageLayer, mediaType)
+	}
+
+	var layerDescs []ocispec.Descriptor
+	var diffIDs []digest.Digest
+	for _, l := range layers {
+		l.recordFileTree(t)
+
+		ociTar := l.ToOCITar(t)
+		tarBytes, err := io.ReadAll(ociTar)
+		ociTar.Close()
+		require.NoError(t, err)
+		var layerBytes bytes.Buffer
+		cw, err := compression.CompressStream(&layerBytes, algorithm)
+		require.NoError(t, err)
+		_, err = cw.Write(tarBytes)
+		require.NoError(t, err)
+		require.NoError(t, cw.Close())
+
+		layerDescs = append(layerDescs, writeBlob(mediaType, layerBytes.Bytes()))
+		diffIDs = append(diffIDs, digest.FromBytes(tarBytes))
+	}
+
+	config := writeBlob(ocispec.MediaTypeImageConfig, marshal(ocispec.Image{
+		Platform: ocispec.Platform{
+			OS:           "linux",
+			Architecture: runtime.GOARCH,
+		},
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	}))
+	manifest := writeBlob(ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    layerDescs,
+	}))
+
+	require.NoError(t, os.WriteFile(filepath.Join(layoutDir, "oci-layout"), marshal(ocispec.ImageLayout{
+		Version: ocispec.ImageLayoutVersion,
+	}), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(layoutDir, "index.json"), marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{manifest},
+	}), 0644))
+}
+
+// LayersToDockerArchive writes the layers as an image of repo tag into the
+// tarball like `docker save`, which has the uncompressed layers, the config
+// and manifest.json.
+func LayersToDockerArchive(t *testing.T, tarPath, repoTag string, layers ...*Layer) {
+	file, err := os.Create(tarPath)
+	require.NoError(t, err)
+	defer file.Close()
+	tw := tar.NewWriter(file)
+	writeFile := func(name string, data []byte) {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(data)),
+		}))
+		_, err := tw.Write(data)
+		require.NoError(t, err)
+	}
+	marshal := func(v interface{}) []byte {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return data
+	}
+
+	var layerNames []string
+	var diffIDs []digest.Digest
+	for _, l := range layers {
+		l.recordFileTree(t)
+
+		ociTar := l.ToOCITar(t)
+		tarBytes, err := io.ReadAll(ociTar)
+		ociTar.Close()
+		require.NoError(t, err)
+		diffID := digest.FromBytes(tarBytes)
+		name := filepath.Join(diffID.Hex(), "layer.tar")
+		writeFile(name, tarBytes)
+		layerNames = append(layerNames, name)
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	config := marshal(ocispec.Image{
+		Platform: ocispec.Platform{
+			OS:           "linux",
+			Architecture: runtime.GOARCH,
+		},
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	configName := digest.FromBytes(config).Hex() + ".json"
+	writeFile(configName, config)
+	writeFile("manifest.json", marshal([]map[string]interface{}{{
+		"Config":   configName,
+		"RepoTags": []string{repoTag},
+		"Layers":   layerNames,
+	}}))
+	require.NoError(t, tw.Close())
 }
 
 func MergeLayers(t *testing.T, ctx Context, mergeOption converter.MergeOption, layers []converter.Layer) ([]digest.Digest, string) {
@@ -10,7 +10,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/fs"
 	"net"
 	"net/http"
 	"os"
@@ -260,8 +259,8 @@ func NewNydusdWithOverlay(conf NydusdConfig) (*Nydusd, error) {
 	return nydusd, nil
 }
 
-func NewNydusdWithContext(ctx Context) (*Nydusd, error) {
-	conf := NydusdConfig{
+func contextConfig(ctx Context) NydusdConfig {
+	return NydusdConfig{
 		EnablePrefetch:  ctx.Runtime.EnablePrefetch,
 		NydusdPath:      ctx.Binary.Nydusd,
 		BootstrapPath:   ctx.Env.BootstrapPath,
@@ -277,7 +276,10 @@ func NewNydusdWithContext(ctx Context) (*Nydusd, error) {
 		DigestValidate:  false,
 		AmplifyIO:       ctx.Runtime.AmplifyIO,
 	}
+}
 
+func NewNydusdWithContext(ctx Context) (*Nydusd, error) {
+	conf := contextConfig(ctx)
 	if err := makeConfig(NydusdConfigTpl, conf); err != nil {
 		return nil, errors.Wrap(err, "create config file for Nydusd")
 	}
@@ -314,6 +316,42 @@ func (nydusd *Nydusd) Mount() error {
 	return nydusd.WaitStatus("RUNNING")
 }
 
+// MountNydusd mounts the bootstrap at mountPath by the nydusd of ctx, the
+// blobs are read from ctx.Env.BlobDir and cached in a new blob cache
+// directory. It skips the test if nydusd isn't installed. The nydusd is
+// umounted and stopped once the test finishes even if it fails, callers
+// should still defer Umount if ctx.Env.WorkDir is destroyed by defer.
+func MountNydusd(t *testing.T, ctx Context, bootstrap, mountPath string) *Nydusd {
+	if _, err := exec.LookPath(ctx.Binary.Nydusd); err != nil {
+		t.Skipf("skip mounting by nydusd %s which isn't installed: %s", ctx.Binary.Nydusd, err)
+	}
+
+	id := uuid.NewString()
+	conf := contextConfig(ctx)
+	conf.BootstrapPath = bootstrap
+	conf.MountPath = mountPath
+	conf.BlobCacheDir = filepath.Join(ctx.Env.WorkDir, "cache-"+id)
+	conf.ConfigPath = filepath.Join(ctx.Env.WorkDir, "nydusd-config-"+id+".json")
+	conf.APISockPath = filepath.Join(ctx.Env.WorkDir, "nydusd-api-"+id+".sock")
+	require.NoError(t, os.MkdirAll(conf.BlobCacheDir, 0755))
+	require.NoError(t, os.MkdirAll(conf.MountPath, 0755))
+
+	nydusd, err := NewNydusd(conf)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := nydusd.Umount(); err != nil {
+			t.Logf("umount %s: %s", mountPath, err)
+		}
+		if nydusd.cmd.Process != nil {
+			// The nydusd may have exited after umount.
+			_ = nydusd.cmd.Process.Kill()
+		}
+	})
+	require.NoError(t, nydusd.Mount(), "mount %s by nydusd", bootstrap)
+
+	return nydusd
+}
+
 func (nydusd *Nydusd) MountByAPI(config NydusdConfig) error {
 	err := makeConfig(NydusdConfigTpl, config)
 	if err != nil {
@@ -622,36 +660,7 @@ func (nydusd *Nydusd) GetInflightMetrics() (*InflightMetrics, error) {
 }
 
 func (nydusd *Nydusd) Verify(t *testing.T, expectedFileTree map[string]*File) {
-	actualFiles := map[string]*File{}
-	err := filepath.WalkDir(nydusd.MountPath, func(path string, _ fs.DirEntry, err error) error {
-		require.Nil(t, err)
-
-		targetPath, err := filepath.Rel(nydusd.MountPath, path)
-		require.NoError(t, err)
-
-		if targetPath == "." || targetPath == ".." {
-			return nil
-		}
-
-		file := NewFile(t, path, targetPath)
-		actualFiles[targetPath] = file
-		if expectedFileTree[targetPath] != nil {
-			expectedFileTree[targetPath].Compare(t, file)
-		} else {
-			t.Fatalf("not found file %s in OCI layer", targetPath)
-		}
-
-		return nil
-	})
-	require.NoError(t, err)
-
-	for targetPath, file := range expectedFileTree {
-		if actualFiles[targetPath] != nil {
-			actualFiles[targetPath].Compare(t, file)
-		} else {
-			t.Fatalf("not found file %s in nydus layer: %s %s", targetPath, nydusd.MountPath, nydusd.BootstrapPath)
-		}
-	}
+	VerifyDir(t, nydusd.MountPath, expectedFileTree)
 }
 
 func Verify(t *testing.T, ctx Context, expectedFileTree map[string]*File) {
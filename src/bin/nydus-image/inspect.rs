@@ -288,7 +288,8 @@ impl RafsInspector {
                                     "readahead_offset": blob_info.prefetch_offset(),
                                     "readahead_size": blob_info.prefetch_size(),
                                     "decompressed_size": blob_info.uncompressed_size(),
-                                    "compressed_size": blob_info.compressed_size(),});
+                                    "compressed_size": blob_info.compressed_size(),
+                                    "chunk_count": blob_info.chunk_count(),});
                 value.as_array_mut().unwrap().push(v);
             } else {
                 let mapped_blkaddr = extra_infos